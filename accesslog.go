@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// accessLogger writes the access log, a line at a time.
+var accessLogger = log.New(os.Stdout, "", 0)
+
+// accessLine is a line of the access log. Its fields are kept stable, so
+// queries can be built on them; the query string and headers of the request
+// are left out, as they may hold credentials.
+type accessLine struct {
+	Time       string  `json:"time"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Status     int     `json:"status"`
+	DurationMs float64 `json:"durationMs"`
+	Bytes      int64   `json:"bytes"`
+	ClientIP   string  `json:"clientIp"`
+	RequestID  string  `json:"requestId"`
+	APIKey     string  `json:"apiKey,omitempty"`
+	TraceID    string  `json:"traceId,omitempty"`
+	Target     string  `json:"target,omitempty"`
+	Targets    int     `json:"targets,omitempty"`
+	URLs       *int    `json:"urls,omitempty"`
+}
+
+// accessNote is what the handler of a parse request tells the access log
+// about it: the domain or sitemap it was for and the URLs it collected. It is
+// safe for concurrent use, as a batch notes each of its entries.
+type accessNote struct {
+	mu      sync.Mutex
+	apiKey  string
+	target  string
+	targets int
+	urls    *int
+}
+
+// accessNoteKey is the context key of the accessNote of a request.
+type accessNoteKey struct{}
+
+// noteAccessTarget records that the request is for target, a domain or
+// sitemap URL, in the access log line of the request of ctx, if any. The
+// credentials of a URL aren't recorded.
+func noteAccessTarget(ctx context.Context, target string) {
+	note, ok := ctx.Value(accessNoteKey{}).(*accessNote)
+	if !ok {
+		return
+	}
+	if u, err := url.Parse(target); err == nil && u.User != nil {
+		u.User = nil
+		target = u.String()
+	}
+	note.mu.Lock()
+	if note.targets == 0 {
+		note.target = target
+	}
+	note.targets++
+	note.mu.Unlock()
+}
+
+// noteAccessKey records the name of the API key the request of ctx was made
+// with in its access log line, if any.
+func noteAccessKey(ctx context.Context, name string) {
+	note, ok := ctx.Value(accessNoteKey{}).(*accessNote)
+	if !ok {
+		return
+	}
+	note.mu.Lock()
+	note.apiKey = name
+	note.mu.Unlock()
+}
+
+// noteAccessURLs adds n URLs collected to the access log line of the request
+// of ctx, if any.
+func noteAccessURLs(ctx context.Context, n int) {
+	note, ok := ctx.Value(accessNoteKey{}).(*accessNote)
+	if !ok {
+		return
+	}
+	note.mu.Lock()
+	if note.urls == nil {
+		note.urls = new(int)
+	}
+	*note.urls += n
+	note.mu.Unlock()
+}
+
+// logAccess is the middleware giving each request its ID and a logger telling
+// it and the trace of the request, and logging a JSON line per request to stdout, once its reply is done,
+// even when the handler aborts it. A request for several targets, such as a
+// batch, logs how many there were rather than the first.
+func logAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		id := requestID(w, r)
+		requestLogger := logger.With("requestId", id)
+		traceID := spanFrom(r.Context()).traceIDString()
+		if traceID != "" {
+			requestLogger = requestLogger.With("traceId", traceID)
+		}
+		ctx := withLogger(r.Context(), requestLogger)
+		if !configFrom(ctx).accessLog {
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+		note := &accessNote{}
+		aw := &accessWriter{ResponseWriter: w}
+		defer func() {
+			line := accessLine{
+				Time:       started.UTC().Format(time.RFC3339Nano),
+				Method:     r.Method,
+				Path:       r.URL.Path,
+				Status:     aw.status,
+				DurationMs: float64(time.Since(started).Microseconds()) / 1000,
+				Bytes:      aw.bytes,
+				ClientIP:   clientIP(r),
+				RequestID:  id,
+				TraceID:    traceID,
+			}
+			if line.Status == 0 {
+				line.Status = http.StatusOK
+			}
+			note.mu.Lock()
+			line.APIKey = note.apiKey
+			if note.targets == 1 {
+				line.Target = note.target
+			} else {
+				line.Targets = note.targets
+			}
+			line.URLs = note.urls
+			note.mu.Unlock()
+			encoded, err := json.Marshal(line)
+			if err != nil {
+				logger.Error("encoding access log line failed", "err", err)
+				return
+			}
+			accessLogger.Println(string(encoded))
+		}()
+		next.ServeHTTP(aw, r.WithContext(context.WithValue(ctx, accessNoteKey{}, note)))
+	})
+}
+
+// accessWriter records the status and size of a reply.
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush sends what was written so far to the client.
+func (w *accessWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack hands the connection over to the handler, for a WebSocket session,
+// whose upgrade is logged as a 101.
+func (w *accessWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can't be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Codes of the errors reported by the admin endpoints.
+const (
+	errCodeUnauthorized  = "UNAUTHORIZED"
+	errCodeAdminDisabled = "ADMIN_DISABLED"
+)
+
+// requireAdmin wraps the handler of an admin endpoint, replying with a 403 while
+// no admin token is configured and with a 401 to requests that don't carry it
+// as an Authorization bearer token.
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		adminToken := configFrom(r.Context()).adminToken
+		if adminToken == "" {
+			writeAPIError(w, http.StatusForbidden, errCodeAdminDisabled, "Admin endpoints are disabled; set ADMIN_TOKEN to enable them", nil)
+			return
+		}
+		token, bearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !bearer || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeAPIError(w, http.StatusUnauthorized, errCodeUnauthorized, "Missing or invalid admin token", nil)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// adminBreakersResponse is the response of the breakers admin endpoint: the
+// breakers left, and how many a DELETE reset.
+type adminBreakersResponse struct {
+	Reset    int            `json:"reset"`
+	Breakers breakerMetrics `json:"breakers"`
+}
+
+// handleAdminBreakersEndpoint reports the circuit breakers of the hosts with
+// failures. A DELETE resets the breakers of the host query parameter, with or
+// without its port, or of every host without one.
+func handleAdminBreakersEndpoint(w http.ResponseWriter, r *http.Request) {
+	var response adminBreakersResponse
+	if r.Method == http.MethodDelete {
+		host := r.URL.Query().Get("host")
+		response.Reset = breakers.reset(host)
+		if host == "" {
+			host = "every host"
+		}
+		loggerFrom(r.Context()).Info("admin reset circuit breakers", "clientIp", clientIP(r), "host", host, "reset", response.Reset)
+	}
+	response.Breakers = breakers.metrics(time.Now())
+	writeJSON(w, response)
+}
+
+// adminCacheTopEntries is the number of entries the cache admin endpoint lists
+// by size, and by age.
+const adminCacheTopEntries = 10
+
+// adminCacheEntry describes an entry of the result cache: what it holds, the
+// sitemap URL or domain it is for, its key, its approximate size, and its age
+// and time left.
+type adminCacheEntry struct {
+	Kind             string `json:"kind"`
+	Target           string `json:"target"`
+	Key              string `json:"key"`
+	Bytes            int64  `json:"bytes"`
+	AgeSeconds       int    `json:"ageSeconds"`
+	ExpiresInSeconds int    `json:"expiresInSeconds"`
+}
+
+// adminCacheResponse is the response of the cache admin endpoint: the usage
+// of the result cache with its largest and oldest entries, and what a DELETE
+// removed, by cache. Only the memory backend lists its entries.
+type adminCacheResponse struct {
+	Removed map[string]int    `json:"removed,omitempty"`
+	Cache   cacheMetrics      `json:"cache"`
+	Largest []adminCacheEntry `json:"largest"`
+	Oldest  []adminCacheEntry `json:"oldest"`
+}
+
+// cacheKeyMatches reports whether the cache entry stored under key is about
+// the sitemap at sitemapURL, normalized, or the discovery of the sitemap of its
+// host, or its robots.txt file.
+func cacheKeyMatches(key, sitemapURL, host string) bool {
+	kind, rest, _ := strings.Cut(key, " ")
+	target, _, _ := strings.Cut(rest, " ")
+	switch kind {
+	case "sitemap", "document":
+		return target == sitemapURL
+	case "domain", "robots":
+		return limitedHost("http://"+extractDomain(target)) == host
+	}
+	return false
+}
+
+// handleAdminCacheEndpoint reports the usage of the result cache and its
+// largest and oldest entries. A DELETE flushes everything: the result cache,
+// the robots.txt files it holds, counted apart, the DNS cache, with its negative
+// entries for the hosts found not to exist, and the Crawl-delays learned from
+// robots.txt files. With the url query parameter, only the entries of that
+// URL, normalized like cache keys, are evicted across these caches: its walk
+// results and document, the discovery of the sitemap of its host, the
+// robots.txt file of the host, and its DNS entry, negative or not, and
+// Crawl-delay. Flushes are logged with the address of the caller.
+func handleAdminCacheEndpoint(w http.ResponseWriter, r *http.Request) {
+	var response adminCacheResponse
+	if r.Method == http.MethodDelete {
+		target := r.URL.Query().Get("url")
+		match := func(string) bool { return true }
+		host := ""
+		if target != "" {
+			sitemapURL := normalizeURL(target)
+			if host = limitedHost(sitemapURL); host == "" {
+				writeAPIError(w, http.StatusBadRequest, errCodeInvalidURL, "Invalid URL", nil)
+				return
+			}
+			match = func(key string) bool { return cacheKeyMatches(key, sitemapURL, host) }
+		}
+		robots := cache.purge(func(key string) bool { return strings.HasPrefix(key, "robots ") && match(key) })
+		response.Removed = map[string]int{
+			"cache":       cache.purge(match),
+			"robots":      robots,
+			"dns":         resolver.forget(host),
+			"crawlDelays": politeness.forgetCrawlDelays(host),
+		}
+		if target == "" {
+			target = "every sitemap"
+		}
+		loggerFrom(r.Context()).Info("admin flushed caches", "clientIp", clientIP(r), "target", target, "entries", response.Removed["cache"], "robots", robots, "hosts", response.Removed["dns"], "crawlDelays", response.Removed["crawlDelays"])
+	}
+
+	response.Cache = currentCacheMetrics(configFrom(r.Context()))
+	response.Largest, response.Oldest = []adminCacheEntry{}, []adminCacheEntry{}
+	if memory, ok := cache.(*resultCache); ok {
+		now := time.Now()
+		entries := memory.snapshot(now)
+		describe := func(entries []*cacheEntry) []adminCacheEntry {
+			if len(entries) > adminCacheTopEntries {
+				entries = entries[:adminCacheTopEntries]
+			}
+			described := make([]adminCacheEntry, len(entries))
+			for i, entry := range entries {
+				kind, rest, _ := strings.Cut(entry.key, " ")
+				target, _, _ := strings.Cut(rest, " ")
+				described[i] = adminCacheEntry{
+					Kind:             kind,
+					Target:           target,
+					Key:              entry.key,
+					Bytes:            entry.size,
+					AgeSeconds:       int(now.Sub(entry.stored) / time.Second),
+					ExpiresInSeconds: int(entry.expires.Sub(now) / time.Second),
+				}
+			}
+			return described
+		}
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].size > entries[j].size })
+		response.Largest = describe(entries)
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].stored.Before(entries[j].stored) })
+		response.Oldest = describe(entries)
+	}
+	writeJSON(w, response)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	tests := []struct {
+		name          string
+		token         string
+		authorization string
+		status        int
+	}{
+		{"disabled", "", "Bearer secret", http.StatusForbidden},
+		{"bearer token", "secret", "Bearer secret", http.StatusOK},
+		{"no header", "secret", "", http.StatusUnauthorized},
+		{"token without scheme", "secret", "secret", http.StatusUnauthorized},
+		{"other scheme", "secret", "Basic secret", http.StatusUnauthorized},
+		{"lowercase scheme", "secret", "bearer secret", http.StatusUnauthorized},
+		{"wrong token", "secret", "Bearer secrets", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, map[string]string{"ADMIN_TOKEN": tt.token})
+			handler := requireAdmin(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/admin/cache", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestAdminCacheEvictsURL(t *testing.T) {
+	useConfig(t, map[string]string{"ADMIN_TOKEN": "secret"})
+	logs := captureLogs(t)
+
+	for _, key := range []string{
+		"sitemap https://example.com/sitemap.xml {}",
+		"document https://example.com/sitemap.xml",
+		"domain example.com ",
+		"robots example.com",
+		"robots other.example.com",
+		"sitemap https://example.com/news.xml {}",
+	} {
+		cache.set(key, &cacheEntry{}, time.Minute)
+	}
+	// example.com was found not to exist
+	gone := &dnsEntry{ready: make(chan struct{}), err: errors.New("no such host"), expires: time.Now().Add(time.Minute)}
+	close(gone.ready)
+	resolver.entries["example.com"] = gone
+	resolver.entries["other.example.com"] = &dnsEntry{ready: gone.ready, expires: gone.expires}
+
+	r := httptest.NewRequest(http.MethodDelete, "/v1/admin/cache?url=HTTPS://Example.com:443/sitemap.xml", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	requireAdmin(handleAdminCacheEndpoint)(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var response adminCacheResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if removed := response.Removed; removed["cache"] != 3 || removed["robots"] != 1 || removed["dns"] != 1 {
+		t.Errorf("removed = %v, want 3 results, 1 robots.txt and 1 DNS entry", removed)
+	}
+
+	for key, kept := range map[string]bool{
+		"robots example.com":                       false,
+		"document https://example.com/sitemap.xml": false,
+		"robots other.example.com":                 true,
+		"sitemap https://example.com/news.xml {}":  true,
+	} {
+		if (cache.get(key) != nil) != kept {
+			t.Errorf("entry %q kept = %v, want %v", key, !kept, kept)
+		}
+	}
+	if _, ok := resolver.entries["example.com"]; ok {
+		t.Error("the negative DNS entry of the host wasn't evicted")
+	}
+	if _, ok := resolver.entries["other.example.com"]; !ok {
+		t.Error("the DNS entry of another host was evicted")
+	}
+	if output := logs.String(); !strings.Contains(output, "admin flushed caches") || !strings.Contains(output, "clientIp=192.0.2.1") {
+		t.Errorf("the flush wasn't logged with the caller:\n%s", output)
+	}
+}
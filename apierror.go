@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Codes of the errors reported to clients. The vocabulary is part of the API,
+// so clients can tell failures apart without matching messages.
+const (
+	errCodeInvalidRequest       = "INVALID_REQUEST"
+	errCodeInvalidDomain        = "INVALID_DOMAIN"
+	errCodeInvalidURL           = "INVALID_URL"
+	errCodeNotFound             = "NOT_FOUND"
+	errCodeMethodNotAllowed     = "METHOD_NOT_ALLOWED"
+	errCodePayloadTooLarge      = "PAYLOAD_TOO_LARGE"
+	errCodeUnsupportedMediaType = "UNSUPPORTED_MEDIA_TYPE"
+	errCodeLimitExceeded        = "LIMIT_EXCEEDED"
+	errCodeRateLimited          = "RATE_LIMITED"
+	errCodeSitemapNotFound      = "SITEMAP_NOT_FOUND"
+	errCodeFetchFailed          = "FETCH_FAILED"
+	errCodeUpstreamTimeout      = "UPSTREAM_TIMEOUT"
+	errCodeUpstreamRateLimited  = "UPSTREAM_RATE_LIMITED"
+	errCodeUpstreamCircuitOpen  = "UPSTREAM_CIRCUIT_OPEN"
+	errCodeParseFailed          = "PARSE_FAILED"
+	errCodeInternal             = "INTERNAL_ERROR"
+)
+
+// requestError is an error reported to the client with a specific HTTP status
+// and error code, and any structured details.
+type requestError struct {
+	Status  int
+	Code    string
+	Message string
+	Details map[string]interface{}
+}
+
+func (e *requestError) Error() string {
+	return e.Message
+}
+
+// asRequestError returns err as a *requestError, reporting any other error as
+// an internal one.
+func asRequestError(err error) *requestError {
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		return reqErr
+	}
+	return &requestError{http.StatusInternalServerError, errCodeInternal, err.Error(), nil}
+}
+
+// errorBody is the JSON envelope of an error reply.
+type errorBody struct {
+	Error errorDetail `json:"error"`
+}
+
+// errorDetail describes an error: its code, a human-readable message, and any
+// structured details.
+type errorDetail struct {
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// writeAPIError replies with the JSON error envelope and the HTTP status, and
+// with a Retry-After header when the details tell when to retry.
+func writeAPIError(w http.ResponseWriter, status int, code, message string, details map[string]interface{}) {
+	body, err := json.Marshal(errorBody{Error: errorDetail{Code: code, Message: message, Details: details}})
+	if err != nil {
+		body = []byte(`{"error":{"code":"` + errCodeInternal + `","message":"Failed to create JSON response"}}`)
+		status = http.StatusInternalServerError
+	}
+	clearCacheHeaders(w)
+	if seconds, ok := details["retryAfterSeconds"].(int); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// writeRequestError replies with the JSON error envelope of err.
+func writeRequestError(w http.ResponseWriter, err error) {
+	reqErr := asRequestError(err)
+	writeAPIError(w, reqErr.Status, reqErr.Code, reqErr.Message, reqErr.Details)
+}
+
+// writeMethodNotAllowed replies that the request method isn't one of allowed.
+func writeMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Method not allowed", map[string]interface{}{"allowed": allowed})
+}
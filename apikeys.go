@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// apiKeyHeader is the header a client may send its API key in, rather than as
+// an Authorization bearer token.
+const apiKeyHeader = "X-API-Key"
+
+// apiKey is a key accepted by the API, known by its name in the logs so the key
+// itself is never written anywhere. Only its digest is kept, which is what is
+// compared.
+type apiKey struct {
+	name   string
+	digest [sha256.Size]byte
+}
+
+// parseAPIKeys parses the API_KEYS setting of s: comma separated keys, each
+// named as name=key, or key alone to be named by its position, such as key1.
+// Empty keys and names given twice are problems of the configuration.
+func parseAPIKeys(s *configSource) []apiKey {
+	var keys []apiKey
+	names := map[string]bool{}
+	for i, entry := range strings.Split(s.string("API_KEYS", ""), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, key, named := strings.Cut(entry, "=")
+		if !named {
+			name, key = "key"+strconv.Itoa(i+1), entry
+		}
+		name, key = strings.TrimSpace(name), strings.TrimSpace(key)
+		if name == "" || key == "" {
+			s.problem("API_KEYS", "entry %d: expected name=key or a key", i+1)
+			continue
+		}
+		if names[name] {
+			s.problem("API_KEYS", "the name %q is given to several keys", name)
+			continue
+		}
+		names[name] = true
+		keys = append(keys, apiKey{name: name, digest: sha256.Sum256([]byte(key))})
+	}
+	return keys
+}
+
+// openPaths are the paths served without an API key, in the versioned API or
+// outside of it: the probes, the build information, the documentation, and
+// the admin endpoints, which take the ADMIN_TOKEN instead.
+var openPaths = map[string]bool{
+	"/":               true,
+	"/openapi.json":   true,
+	"/ping":           true,
+	"/admin/breakers": true,
+	"/admin/cache":    true,
+	"/admin/keys":     true,
+	healthzPath:       true,
+	readyzPath:        true,
+	versionPath:       true,
+}
+
+// isOpenPath reports whether path is served without an API key.
+func isOpenPath(path string) bool {
+	path = strings.TrimSuffix(path, "/")
+	if path == "" {
+		path = "/"
+	}
+	if versioned := strings.TrimPrefix(path, "/"+apiVersion); versioned != path {
+		if versioned == "" {
+			return true
+		}
+		path = versioned
+	}
+	return openPaths[path]
+}
+
+// presentedAPIKey returns the API key of a request, from its Authorization
+// bearer token or its X-API-Key header.
+func presentedAPIKey(r *http.Request) string {
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		return key
+	}
+	if auth := r.Header.Get("Authorization"); len(auth) > len("Bearer ") && strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):])
+	}
+	return ""
+}
+
+// matchAPIKey returns the name of the key among keys that presented is, or ""
+// when it is none. Every key is compared in constant time, so the time taken
+// tells nothing of the keys.
+func matchAPIKey(keys []apiKey, presented string) string {
+	digest := sha256.Sum256([]byte(presented))
+	name := ""
+	for _, key := range keys {
+		if subtle.ConstantTimeCompare(digest[:], key.digest[:]) == 1 {
+			name = key.name
+		}
+	}
+	return name
+}
+
+// apiKeyNameKey is the context key of the name of the API key of a request.
+type apiKeyNameKey struct{}
+
+// apiKeyFrom returns the name of the API key the request of ctx was made with,
+// or "" when keys aren't required.
+func apiKeyFrom(ctx context.Context) string {
+	name, _ := ctx.Value(apiKeyNameKey{}).(string)
+	return name
+}
+
+// requireAPIKey is the middleware requiring an API key, as an Authorization
+// bearer token or an X-API-Key header, on every endpoint but the open ones,
+// once API_KEYS are configured. Requests without a key, or with an unknown
+// one, get a 401. The name of the key is logged with the request.
+func requireAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys := configFrom(r.Context()).apiKeys
+		if len(keys) == 0 || isOpenPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		presented := presentedAPIKey(r)
+		name := ""
+		if presented != "" {
+			name = matchAPIKey(keys, presented)
+		}
+		if name == "" {
+			message := "Missing API key; send it as an Authorization bearer token or an X-API-Key header"
+			if presented != "" {
+				message = "Invalid API key"
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			writeAPIError(w, http.StatusUnauthorized, errCodeUnauthorized, message, nil)
+			return
+		}
+		noteAccessKey(r.Context(), name)
+		ctx := context.WithValue(r.Context(), apiKeyNameKey{}, name)
+		ctx = withLogger(ctx, loggerFrom(ctx).With("apiKey", name))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
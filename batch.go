@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// batchPayload represents the JSON payload accepted by the batch endpoint.
+//
+// Besides the list of domains it accepts every option of the domain endpoint,
+// which applies to each domain of the batch.
+type batchPayload struct {
+	Domains []string `json:"domains"`
+	requestPayload
+}
+
+// batchResponse is the response of the batch endpoint.
+type batchResponse struct {
+	Type    string        `json:"type"`
+	Results []batchResult `json:"results"`
+	Meta    batchMeta     `json:"meta"`
+}
+
+// batchMeta describes the batch as a whole.
+type batchMeta struct {
+	Domains    int   `json:"domains"`
+	Duplicates int   `json:"duplicates"`
+	DurationMs int64 `json:"durationMs"`
+}
+
+// batchResult holds the outcome of a single domain of a batch request.
+type batchResult struct {
+	Domain     string           `json:"domain"`
+	Status     int              `json:"status"`
+	DurationMs int64            `json:"durationMs"`
+	Error      string           `json:"error,omitempty"`
+	Code       string           `json:"code,omitempty"`
+	Result     *sitemapResponse `json:"result,omitempty"`
+}
+
+// uniqueDomains returns the domains with duplicates collapsed, keeping the
+// first occurrence of each, and the number of duplicates removed.
+func uniqueDomains(domains []string) ([]string, int) {
+	seen := make(map[string]bool, len(domains))
+	unique := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		key := strings.ToLower(extractDomain(strings.TrimSpace(domain)))
+		if key == "" {
+			key = domain
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, domain)
+	}
+	return unique, len(domains) - len(unique)
+}
+
+// handleBatchEndpoint handles the HTTP request for the batch endpoint.
+//
+// It discovers and parses the sitemap of every domain in the payload with bounded
+// concurrency, and returns one result per domain so a failing domain doesn't fail
+// the whole batch.
+func handleBatchEndpoint(w http.ResponseWriter, r *http.Request) {
+	// Decompress a gzip request body and check it is JSON before decoding it
+	if err := prepareJSONBody(w, r); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	// Decode the JSON payload
+	var payload batchPayload
+	if err := decodeJSONBody(r, &payload); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+	if len(payload.Domains) == 0 {
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, "Missing 'domains' field in JSON payload", nil)
+		return
+	}
+	applyCacheControl(r, &payload.requestPayload)
+
+	id := requestID(w, r)
+
+	// Reject a malformed callback URL before any fetching starts
+	if payload.CallbackURL != "" {
+		if reqErr := validateCallbackURL(configFrom(r.Context()), payload.CallbackURL); reqErr != nil {
+			writeRequestError(w, reqErr)
+			return
+		}
+	}
+
+	domains, duplicates := uniqueDomains(payload.Domains)
+	if maxBatchDomains := configFrom(r.Context()).maxBatchDomains; len(domains) > maxBatchDomains {
+		writeAPIError(w, http.StatusBadRequest, errCodeLimitExceeded, fmt.Sprintf("Too many domains: %d (maximum is %d)", len(domains), maxBatchDomains), map[string]interface{}{"limit": maxBatchDomains})
+		return
+	}
+
+	start := time.Now()
+	results := make([]batchResult, len(domains))
+
+	// Process the domains with a bounded number of workers
+	var wg sync.WaitGroup
+	jobs := make(chan int)
+	workers := configFrom(r.Context()).batchConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = processBatchDomain(r, domains[i], payload.requestPayload)
+			}
+		}()
+	}
+	for i := range domains {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	response := batchResponse{
+		Type:    "batch",
+		Results: results,
+		Meta:    batchMeta{Domains: len(domains), Duplicates: duplicates, DurationMs: time.Since(start).Milliseconds()},
+	}
+
+	// Push the whole batch to the callback URL, if any
+	if payload.CallbackURL != "" {
+		sendCallback(r.Context(), payload.CallbackURL, callbackBody{RequestID: id, Status: http.StatusOK, Result: response})
+	}
+
+	writeCacheableJSON(w, r, response)
+}
+
+// processBatchDomain runs the domain request of a single batch entry.
+func processBatchDomain(r *http.Request, domain string, payload requestPayload) batchResult {
+	start := time.Now()
+	payload.Domain = domain
+	payload.CallbackURL = ""
+
+	result := batchResult{Domain: domain, Status: http.StatusOK}
+	response, err := processRequest(r.Context(), "domain", payload)
+	if err != nil {
+		reqErr := asRequestError(err)
+		result.Status = reqErr.Status
+		result.Error = reqErr.Message
+		result.Code = reqErr.Code
+	}
+	result.Result = response
+	result.DurationMs = time.Since(start).Milliseconds()
+	return result
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Media types of the request bodies the endpoints accept.
+const (
+	mediaTypeJSON      = "application/json"
+	mediaTypeText      = "text/plain"
+	mediaTypeForm      = "application/x-www-form-urlencoded"
+	mediaTypeMultipart = "multipart/form-data"
+)
+
+// missingContentTypeWarning is the Warning header set on requests whose JSON
+// body came without a Content-Type, which are still accepted for backward
+// compatibility.
+const missingContentTypeWarning = `299 - "Missing Content-Type, the body was read as application/json"`
+
+// limitedBody is a request body cut at a size limit. Reading past the limit
+// fails with the 413 *requestError of the limit.
+type limitedBody struct {
+	io.ReadCloser
+	limit    int64
+	read     int64
+	tooLarge *requestError
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err != nil && err != io.EOF && b.read >= b.limit {
+		err = b.tooLarge
+	}
+	return n, err
+}
+
+// requestBodyLimit returns the largest body of r accepted, as sent and once
+// decompressed: the maxMultipartBodyBytes of the configuration for uploads and
+// its maxRequestBodyBytes otherwise.
+func requestBodyLimit(r *http.Request) int {
+	config := configFrom(r.Context())
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == mediaTypeMultipart {
+		return config.maxMultipartBodyBytes
+	}
+	return config.maxRequestBodyBytes
+}
+
+// limitRequestBody is the middleware capping the size of request bodies at
+// their requestBodyLimit. A body announced as too large is refused before the
+// handler runs; one that turns out to be too large fails the handler's read.
+func limitRequestBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := requestBodyLimit(r)
+		tooLarge := &requestError{http.StatusRequestEntityTooLarge, errCodePayloadTooLarge, fmt.Sprintf("Request body exceeds %d bytes", limit), nil}
+		if r.ContentLength > int64(limit) {
+			writeRequestError(w, tooLarge)
+			return
+		}
+		if r.Body != nil {
+			r.Body = &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, int64(limit)), limit: int64(limit), tooLarge: tooLarge}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bodyReadError returns the error to report for a failed read of the request
+// body: the 413 of its size limit when the body is too large, or else a 400
+// with message.
+func bodyReadError(err error, message string) error {
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		return reqErr
+	}
+	return &requestError{http.StatusBadRequest, errCodeInvalidRequest, message, nil}
+}
+
+// decodeJSONBody decodes the JSON request body into v. Failures are returned
+// as a *requestError.
+func decodeJSONBody(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return bodyReadError(err, "Invalid JSON payload")
+	}
+	return nil
+}
+
+// inflateBody replaces a gzip request body with its decompressed contents, so
+// the handlers decode it as if it had been sent uncompressed. The contents are
+// held to the requestBodyLimit of the request, which guards against zip bombs.
+// Requests without a Content-Encoding are left untouched. Failures are
+// returned as a *requestError.
+func inflateBody(r *http.Request) error {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+		return nil
+	case "gzip", "x-gzip":
+	default:
+		return &requestError{http.StatusUnsupportedMediaType, errCodeUnsupportedMediaType, fmt.Sprintf("Unsupported Content-Encoding %q: only gzip is supported", encoding), nil}
+	}
+
+	gz, err := gzip.NewReader(r.Body)
+	if err != nil {
+		return bodyReadError(err, "Invalid gzip data in the request body")
+	}
+	defer gz.Close()
+
+	// Read one byte past the limit to tell whether the body inflates beyond it
+	limit := requestBodyLimit(r)
+	body, err := ioutil.ReadAll(io.LimitReader(gz, int64(limit)+1))
+	if err != nil {
+		return bodyReadError(err, "Invalid gzip data in the request body")
+	}
+	if len(body) > limit {
+		return &requestError{http.StatusRequestEntityTooLarge, errCodePayloadTooLarge, fmt.Sprintf("Request body exceeds %d bytes once decompressed", limit), nil}
+	}
+
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Del("Content-Encoding")
+	return nil
+}
+
+// requestMediaType returns the media type of the request body, without its
+// parameters, or "" when the request has no Content-Type. A type that isn't one
+// of supported is returned as a 415 *requestError naming the supported ones.
+func requestMediaType(r *http.Request, supported ...string) (string, error) {
+	header := r.Header.Get("Content-Type")
+	if header == "" {
+		return "", nil
+	}
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err == nil {
+		for _, s := range supported {
+			if mediaType == s {
+				return mediaType, nil
+			}
+		}
+	} else {
+		mediaType = header
+	}
+	return "", &requestError{http.StatusUnsupportedMediaType, errCodeUnsupportedMediaType, fmt.Sprintf("Unsupported Content-Type %q: expected one of %s", mediaType, strings.Join(supported, ", ")), nil}
+}
+
+// prepareJSONBody decompresses a gzip request body and checks that it is JSON,
+// for the endpoints taking only a JSON payload. Failures are returned as a
+// *requestError.
+func prepareJSONBody(w http.ResponseWriter, r *http.Request) error {
+	if err := inflateBody(r); err != nil {
+		return err
+	}
+	mediaType, err := requestMediaType(r, mediaTypeJSON)
+	if err != nil {
+		return err
+	}
+	if mediaType == "" {
+		w.Header().Set("Warning", missingContentTypeWarning)
+	}
+	return nil
+}
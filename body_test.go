@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serve sends r through the routes of the API, middleware included, and
+// returns the response.
+func serve(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	newRoutes().handler().ServeHTTP(w, r)
+	return w
+}
+
+// assertErrorCode fails the test unless the response is an error of status
+// and code.
+func assertErrorCode(t *testing.T, w *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+	var body errorBody
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != status || body.Error.Code != code {
+		t.Errorf("response = %d %s, want %d %s: %s", w.Code, body.Error.Code, status, code, w.Body)
+	}
+}
+
+// unsizedBody hides the length of its reader, like a chunked request body.
+type unsizedBody struct {
+	io.Reader
+}
+
+func TestOversizedRequestBodies(t *testing.T) {
+	useLocalConfig(t, map[string]string{"REQUEST_MAX_BYTES": "96", "ACCESS_LOG": "0"})
+	captureLogs(t)
+	oversized := `{"url":"https://example.com/` + strings.Repeat("a", 100) + `.xml"}`
+
+	for _, path := range []string{"/v1/sitemap", "/v1/domain", "/v1/batch", "/v1/stats", "/v1/diff", "/v1/generate", "/v1/submit", "/v1/robots"} {
+		t.Run(path, func(t *testing.T) {
+			// Announced by its Content-Length, the body is refused before being read
+			r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(oversized))
+			r.Header.Set("Content-Type", "application/json")
+			assertErrorCode(t, serve(r), http.StatusRequestEntityTooLarge, errCodePayloadTooLarge)
+
+			// Without one, reading past the limit fails
+			r = httptest.NewRequest(http.MethodPost, path, unsizedBody{strings.NewReader(oversized)})
+			r.Header.Set("Content-Type", "application/json")
+			assertErrorCode(t, serve(r), http.StatusRequestEntityTooLarge, errCodePayloadTooLarge)
+		})
+	}
+
+	t.Run("gzip", func(t *testing.T) {
+		var compressed bytes.Buffer
+		gz := gzip.NewWriter(&compressed)
+		gz.Write([]byte(`{"url":"https://example.com/sitemap.xml","filter":"` + strings.Repeat("a", 200) + `"}`))
+		gz.Close()
+		if compressed.Len() > 96 {
+			t.Fatalf("compressed body of %d bytes, want it within REQUEST_MAX_BYTES", compressed.Len())
+		}
+		r := httptest.NewRequest(http.MethodPost, "/v1/sitemap", &compressed)
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Content-Encoding", "gzip")
+		assertErrorCode(t, serve(r), http.StatusRequestEntityTooLarge, errCodePayloadTooLarge)
+	})
+}
+
+// gzipped returns body compressed with gzip.
+func gzipped(body []byte) *bytes.Buffer {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(body)
+	gz.Close()
+	return &compressed
+}
+
+func TestGzipBodyHeldToRequestLimit(t *testing.T) {
+	useLocalConfig(t, map[string]string{"REQUEST_MAX_BYTES": "4096", "ACCESS_LOG": "0"})
+	captureLogs(t)
+	send := func(body []byte) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/v1/stats", gzipped(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Content-Encoding", "gzip")
+		return serve(r)
+	}
+
+	// A megabyte of padding compresses to far less than the limit
+	bomb := []byte(`{"url":"https://example.com/sitemap.xml","filter":"` + strings.Repeat("a", 1<<20) + `"}`)
+	if size := gzipped(bomb).Len(); size > 4096 {
+		t.Fatalf("compressed bomb of %d bytes, want it within REQUEST_MAX_BYTES", size)
+	}
+	w := send(bomb)
+	assertErrorCode(t, w, http.StatusRequestEntityTooLarge, errCodePayloadTooLarge)
+	if !strings.Contains(w.Body.String(), "exceeds 4096 bytes once decompressed") {
+		t.Errorf("body = %s, want the limit of the endpoint", w.Body)
+	}
+
+	// Within the limit once decompressed, the body is decoded
+	if w := send([]byte(`{"url":"not a url"}`)); w.Code == http.StatusRequestEntityTooLarge || w.Code == http.StatusUnsupportedMediaType {
+		t.Errorf("status = %d: %s, want the payload decoded", w.Code, w.Body)
+	}
+}
+
+func TestOversizedUploads(t *testing.T) {
+	useLocalConfig(t, map[string]string{"REQUEST_MAX_BYTES": "64", "ACCESS_LOG": "0", "UPLOAD_MAX_BYTES": "1024", "REQUEST_MAX_MULTIPART_BYTES": "2048"})
+	captureLogs(t)
+	upload := func(size int) *http.Request {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile(uploadFilePart, "sitemap.xml")
+		io.WriteString(part, urlSet("https://example.com/"+strings.Repeat("a", size)))
+		form.Close()
+		r := httptest.NewRequest(http.MethodPost, "/v1/sitemap", &body)
+		r.Header.Set("Content-Type", form.FormDataContentType())
+		return r
+	}
+
+	// Uploads have their own limit, above the one of JSON payloads
+	if w := serve(upload(200)); w.Code != http.StatusOK {
+		t.Errorf("upload within the multipart limit = %d: %s", w.Code, w.Body)
+	}
+	assertErrorCode(t, serve(upload(1500)), http.StatusRequestEntityTooLarge, errCodePayloadTooLarge)
+	assertErrorCode(t, serve(upload(4096)), http.StatusRequestEntityTooLarge, errCodePayloadTooLarge)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The states of a circuit breaker.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// circuitOpenError is returned for the fetches of a host whose breaker is
+// open, without any request being sent.
+type circuitOpenError struct {
+	Host       string
+	RetryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("Circuit open for %s after repeated failures, retry in %ds", e.Host, e.retryAfterSeconds())
+}
+
+// retryAfterSeconds returns the time left before a probe is let through, in
+// whole seconds rounded up, and at least one.
+func (e *circuitOpenError) retryAfterSeconds() int {
+	if seconds := int((e.RetryAfter + time.Second - 1) / time.Second); seconds > 0 {
+		return seconds
+	}
+	return 1
+}
+
+// hostBreaker is the circuit breaker of a host. It counts the consecutive
+// failures of the host while closed, fails every fetch while open, and lets a
+// single probe through once the cooldown is over, whose outcome closes or
+// opens it again.
+type hostBreaker struct {
+	state       string
+	failures    int
+	lastFailure time.Time
+	openUntil   time.Time
+	probing     bool
+}
+
+// breakerSet holds the circuit breakers of the hosts fetched, by host and
+// port. Hosts are only held while they have failures. It is safe for
+// concurrent use.
+type breakerSet struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*hostBreaker
+}
+
+// breakers are the circuit breakers of outbound fetches, set up by
+// setupServices.
+var breakers *breakerSet
+
+func newBreakerSet(threshold int, cooldown time.Duration) *breakerSet {
+	return &breakerSet{threshold: threshold, cooldown: cooldown, hosts: make(map[string]*hostBreaker)}
+}
+
+// breakerHost returns the host and port a URL is fetched from, which keys its
+// breaker, so a host failing over https doesn't cut it off over http.
+func breakerHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// allow reports whether a fetch of host may be sent at now, returning a
+// circuitOpenError when it may not. probe is true for the fetch let through a
+// half-open breaker.
+func (s *breakerSet) allow(host string, now time.Time) (probe bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.hosts[host]
+	if !ok || b.state == breakerClosed {
+		return false, nil
+	}
+	if b.state == breakerOpen && now.Before(b.openUntil) {
+		return false, &circuitOpenError{Host: host, RetryAfter: b.openUntil.Sub(now)}
+	}
+	if b.probing {
+		// Another fetch is probing the host
+		return false, &circuitOpenError{Host: host}
+	}
+	b.state, b.probing = breakerHalfOpen, true
+	return true, nil
+}
+
+// record accounts for the outcome of a fetch of host at now. A failure opens
+// the breaker once threshold failures follow each other, or right away for a
+// probe; a success closes it. When the outcome says nothing of the host, as
+// for a cancelled fetch, a probe is given back for the next fetch to make.
+func (s *breakerSet) record(host string, probe bool, outcome error, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.hosts[host]
+	switch {
+	case outcome == errBreakerUnknown:
+		if probe && b != nil {
+			b.probing = false
+		}
+	case outcome == nil:
+		delete(s.hosts, host)
+	default:
+		if b == nil {
+			b = &hostBreaker{state: breakerClosed}
+			s.hosts[host] = b
+		}
+		b.failures++
+		b.lastFailure = now
+		if probe || b.failures >= s.threshold {
+			b.state, b.openUntil, b.probing = breakerOpen, now.Add(s.cooldown), false
+		}
+	}
+}
+
+// errBreakerUnknown is the outcome of fetches telling nothing of their host.
+var errBreakerUnknown = errors.New("outcome unknown")
+
+// breakerOutcome returns what a fetch bound to ctx tells of its host: nil for
+// a host answering, an error for a host failing with a transient error or a
+// 5xx status, and errBreakerUnknown when the fetch was cancelled, its request
+// deadline ran out, or the host asked to wait with Retry-After.
+func breakerOutcome(ctx context.Context, resp *http.Response, err error) error {
+	switch {
+	case ctx.Err() != nil:
+		return errBreakerUnknown
+	case err != nil && isTransient(err):
+		return err
+	case err != nil:
+		return errBreakerUnknown
+	}
+	if _, asked := retryAfter(resp); asked {
+		return errBreakerUnknown
+	}
+	if resp.StatusCode >= 500 {
+		return &upstreamStatusError{URL: resp.Request.URL.String(), Status: resp.StatusCode}
+	}
+	return nil
+}
+
+// fetch makes a single attempt of a fetch of rawURL through the breaker of its
+// host, failing it with a circuitOpenError while the breaker is open.
+func (s *breakerSet) fetch(ctx context.Context, rawURL string, attempt func() (*http.Response, error)) (*http.Response, error) {
+	host := breakerHost(rawURL)
+	if s.threshold <= 0 || host == "" {
+		return attempt()
+	}
+	probe, err := s.allow(host, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := attempt()
+	s.record(host, probe, breakerOutcome(ctx, resp, err), time.Now())
+	return resp, err
+}
+
+// reset closes the breakers of host, given with or without a port, or of
+// every host when host is empty, returning how many were reset.
+func (s *breakerSet) reset(host string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	host = strings.ToLower(host)
+	reset := 0
+	for key := range s.hosts {
+		if name, _, _ := net.SplitHostPort(key); host == "" || key == host || name == host {
+			delete(s.hosts, key)
+			reset++
+		}
+	}
+	return reset
+}
+
+// sweep drops the breakers whose last failure is older than twice the
+// cooldown at now, unless they are probing, returning how many were dropped, so
+// hosts failing once in a while or no longer fetched aren't held forever.
+func (s *breakerSet) sweep(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	for host, b := range s.hosts {
+		if !b.probing && now.Sub(b.lastFailure) > 2*s.cooldown {
+			delete(s.hosts, host)
+			removed++
+		}
+	}
+	return removed
+}
+
+// breakerState reports the breaker of a host.
+type breakerState struct {
+	Host      string     `json:"host"`
+	State     string     `json:"state"`
+	Failures  int        `json:"failures"`
+	OpenUntil *time.Time `json:"openUntil,omitempty"`
+}
+
+// breakerMetrics reports the circuit breakers of the hosts with failures,
+// against the threshold and cooldown they are configured with.
+type breakerMetrics struct {
+	Enabled          bool           `json:"enabled"`
+	FailureThreshold int            `json:"failureThreshold"`
+	CooldownSeconds  int            `json:"cooldownSeconds"`
+	Open             int            `json:"open"`
+	Hosts            []breakerState `json:"hosts"`
+}
+
+// metrics reports the breakers at now, by host.
+func (s *breakerSet) metrics(now time.Time) breakerMetrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	metrics := breakerMetrics{
+		Enabled:          s.threshold > 0,
+		FailureThreshold: s.threshold,
+		CooldownSeconds:  int(s.cooldown / time.Second),
+		Hosts:            make([]breakerState, 0, len(s.hosts)),
+	}
+	for host, b := range s.hosts {
+		state := breakerState{Host: host, State: b.state, Failures: b.failures}
+		if b.state == breakerOpen {
+			openUntil := b.openUntil.UTC()
+			state.OpenUntil = &openUntil
+			if now.Before(b.openUntil) {
+				metrics.Open++
+			}
+		}
+		metrics.Hosts = append(metrics.Hosts, state)
+	}
+	sort.Slice(metrics.Hosts, func(i, j int) bool { return metrics.Hosts[i].Host < metrics.Hosts[j].Host })
+	return metrics
+}
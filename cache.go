@@ -0,0 +1,465 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheBackend holds cache entries by key for a TTL. Implementations are safe
+// for concurrent use, and treat their failures as misses, so a failing backend
+// only costs the requests their cache hits.
+type cacheBackend interface {
+	// get returns the entry stored under key, or nil.
+	get(key string) *cacheEntry
+	// set stores an entry under key for ttl, replacing any entry already there.
+	set(key string, entry *cacheEntry, ttl time.Duration)
+	// delete drops the entry stored under key, if any.
+	delete(key string)
+	// purge drops the entries whose key match accepts, returning how many
+	// were dropped.
+	purge(match func(key string) bool) int
+}
+
+// cache is the cache of the service, set up by setupServices.
+var cache cacheBackend
+
+// newCacheBackend returns the cache backend selected by the cacheBackend of c.
+func newCacheBackend(c *Config) cacheBackend {
+	switch c.cacheBackend {
+	case "redis":
+		return newRedisCache(c)
+	case "memory":
+	default:
+		logger.Warn("unknown cache backend, caching in memory", "backend", c.cacheBackend)
+	}
+	return newResultCache(c.cacheMaxEntries, c.cacheMaxBytes)
+}
+
+// cacheEntry is a walk result, the sitemap discovered for a domain, a sitemap
+// document or a robots.txt file, held in the cache. Entries aren't modified once stored, so they can be read after
+// being evicted.
+type cacheEntry struct {
+	result    *sitemapResult
+	redirects redirectTrace
+	discovery *sitemapDiscovery
+	document  *cachedDocument
+	robots    *robotsFile
+	stored    time.Time
+	expires   time.Time
+
+	key  string
+	size int64
+}
+
+// approximateSize estimates the memory held by the entry stored under key from
+// the size of its JSON encoding.
+func (e *cacheEntry) approximateSize(key string) int64 {
+	size := int64(len(key))
+	values := []interface{}{e.result, e.redirects, e.discovery, e.robots}
+	if e.document != nil {
+		values = append(values, e.document.sitemap)
+		size += int64(len(e.document.etag) + len(e.document.lastModified))
+	}
+	for _, v := range values {
+		encoded, _ := json.Marshal(v)
+		size += int64(len(encoded))
+	}
+	return size
+}
+
+// resultCache is the in-memory cache backend. It holds cache entries by key
+// until they expire or are evicted, the least recently used first, to keep
+// within maxEntries and maxBytes, where zero means no bound.
+type resultCache struct {
+	maxEntries int
+	maxBytes   int64
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// recent orders the entries from the most to the least recently used.
+	recent *list.List
+	bytes  int64
+}
+
+func newResultCache(maxEntries int, maxBytes int64) *resultCache {
+	return &resultCache{maxEntries: maxEntries, maxBytes: maxBytes, entries: make(map[string]*list.Element), recent: list.New()}
+}
+
+// set stores an entry under key for ttl, replacing any entry already there.
+// Expired entries are dropped on the way, and the least recently used ones
+// evicted until the cache is within its bounds. An entry larger than
+// maxBytes on its own isn't stored.
+func (c *resultCache) set(key string, entry *cacheEntry, ttl time.Duration) {
+	entry.key = key
+	entry.size = entry.approximateSize(key)
+	if c.maxBytes > 0 && entry.size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	for element := c.recent.Back(); element != nil; {
+		previous := element.Prev()
+		if now.After(element.Value.(*cacheEntry).expires) {
+			c.remove(element)
+		}
+		element = previous
+	}
+
+	entry.stored = now
+	entry.expires = now.Add(ttl)
+	c.entries[key] = c.recent.PushFront(entry)
+	c.bytes += entry.size
+
+	for (c.maxEntries > 0 && c.recent.Len() > c.maxEntries) || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		evicted := c.recent.Back()
+		logger.Debug("cache entry evicted", "key", evicted.Value.(*cacheEntry).key, "bytes", evicted.Value.(*cacheEntry).size)
+		c.remove(evicted)
+	}
+}
+
+// get returns the entry stored under key, marking it as recently used, or nil
+// when it is unknown or expired.
+func (c *resultCache) get(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(element)
+		return nil
+	}
+	c.recent.MoveToFront(element)
+	return entry
+}
+
+// sweep drops the entries expired at now, returning how many were dropped.
+// Readers holding one of them keep a valid entry, as entries aren't modified.
+func (c *resultCache) sweep(now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	for element := c.recent.Back(); element != nil; {
+		previous := element.Prev()
+		if now.After(element.Value.(*cacheEntry).expires) {
+			c.remove(element)
+			removed++
+		}
+		element = previous
+	}
+	return removed
+}
+
+// delete drops the entry stored under key, if any.
+func (c *resultCache) delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+}
+
+// purge drops the entries whose key match accepts, returning how many were
+// dropped.
+func (c *resultCache) purge(match func(key string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	for key, element := range c.entries {
+		if match(key) {
+			c.remove(element)
+			removed++
+		}
+	}
+	return removed
+}
+
+// snapshot returns the entries of the cache unexpired at now.
+func (c *resultCache) snapshot(now time.Time) []*cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make([]*cacheEntry, 0, c.recent.Len())
+	for element := c.recent.Front(); element != nil; element = element.Next() {
+		if entry := element.Value.(*cacheEntry); !now.After(entry.expires) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// remove drops an entry from the cache. The caller holds c.mu.
+func (c *resultCache) remove(element *list.Element) {
+	entry := c.recent.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size
+}
+
+// usage returns the number of entries in the cache and their approximate size
+// in bytes.
+func (c *resultCache) usage() (entries int, bytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.recent.Len(), c.bytes
+}
+
+// refreshLimiter remembers when each sitemap was last refreshed, to refresh it at
+// most once per interval. It is safe for concurrent use.
+type refreshLimiter struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+// refreshes limits the forced refreshes of the service, set up by
+// setupServices.
+var refreshes *refreshLimiter
+
+func newRefreshLimiter(interval time.Duration) *refreshLimiter {
+	return &refreshLimiter{interval: interval, last: make(map[string]time.Time)}
+}
+
+// allow reports whether key may be refreshed now, and records the refresh when
+// it may.
+func (l *refreshLimiter) allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for k, last := range l.last {
+		if now.Sub(last) >= l.interval {
+			delete(l.last, k)
+		}
+	}
+	if _, recent := l.last[key]; recent {
+		return false
+	}
+	l.last[key] = now
+	return true
+}
+
+// usesCache reports whether the request may be answered from the cache, which
+// callers turn off with "cache": false, under c.
+func (p requestPayload) usesCache(c *Config) bool {
+	return c.cacheTTL > 0 && (p.Cache == nil || *p.Cache)
+}
+
+// cachesResult reports whether the walk of the request may be answered from
+// the cache. Streamed and uploaded walks, and samples drawn without a seed,
+// are always run.
+func (p requestPayload) cachesResult(c *Config) bool {
+	return p.usesCache(c) && p.onURLs == nil && p.upload == nil && (p.Sample == nil || p.Seed != nil)
+}
+
+// resultCacheKey returns the cache key of the walk of sitemapURL for the
+// request: the normalized URL, so /domain and /sitemap share entries, and the
+// options shaping the result. Options applied after the walk are left out.
+func resultCacheKey(sitemapURL string, p requestPayload) string {
+	p.Domain, p.Sitemap, p.DiscoverOnly, p.CandidatePaths = "", "", false, nil
+	p.TimeoutSeconds, p.CallbackURL, p.Cache, p.Refresh = nil, "", nil, false
+	p.Sort, p.DiffAgainstPrevious, p.PageSize, p.Cursor = "", false, nil, ""
+	p.Debug = false
+	if p.Format != formatTree {
+		p.Format = ""
+	}
+	options, _ := json.Marshal(p)
+	return "sitemap " + normalizeURL(sitemapURL) + " " + string(options)
+}
+
+// applyCacheControl applies the Cache-Control header of the request to its
+// payload: no-store turns the cache off like "cache": false, and no-cache
+// forces a refresh like "refresh": true.
+func applyCacheControl(r *http.Request, payload *requestPayload) {
+	for _, directive := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "no-store":
+			off := false
+			payload.Cache = &off
+		case "no-cache":
+			payload.Refresh = true
+		}
+	}
+}
+
+// clone returns a copy of the result whose URL lists can be sorted without
+// affecting the original.
+func (r *sitemapResult) clone() *sitemapResult {
+	c := *r
+	c.URLs = append([]string(nil), r.URLs...)
+	if r.Sources != nil {
+		c.Sources = make([]sitemapSource, len(r.Sources))
+		for i, source := range r.Sources {
+			source.URLs = append([]string(nil), source.URLs...)
+			c.Sources[i] = source
+		}
+	}
+	return &c
+}
+
+// parseSitemapCached parses the sitemap like parseSitemap, answering from the
+// cache without any fetch when the request allows it. Results are stored for
+// cacheTTL, unless they are partial. A forced refresh skips the cached result
+// and replaces it, unless the sitemap was refreshed less than
+// cacheRefreshInterval ago, in which case the cached result is answered with a
+// warning.
+func parseSitemapCached(ctx context.Context, sitemapURL string, trace *redirectTrace, opts walkOptions, payload requestPayload) (result *sitemapResult, err error) {
+	ctx, span := startSpan(ctx, "parse sitemap", spanKindInternal)
+	span.set("url.full", sitemapURL)
+	defer func() {
+		span.fail(err)
+		if result != nil {
+			span.set("cache.hit", result.Cached, "sitemap.urls", len(result.URLs), "sitemap.partial", result.Partial)
+		}
+		span.finish()
+	}()
+
+	config := configFrom(ctx)
+	opts.Revalidate = payload.usesCache(config)
+	if !payload.cachesResult(config) {
+		return parseSitemap(ctx, sitemapURL, trace, opts)
+	}
+
+	key := resultCacheKey(sitemapURL, payload)
+	refresh := payload.Refresh && refreshes.allow("sitemap "+normalizeURL(sitemapURL), time.Now())
+	if !refresh {
+		if entry := cache.get(key); entry != nil {
+			*trace = entry.redirects
+			result := entry.result.clone()
+			result.Cached = true
+			result.CacheAge = time.Since(entry.stored)
+			// Nothing was fetched to answer this request
+			result.Fetched, result.FetchErrors, result.Bytes, result.NotModified, result.Retries = 0, 0, 0, 0, 0
+			result.CrawlDelay = 0
+			if payload.Refresh {
+				result.Warnings = append(result.Warnings, fmt.Sprintf("Refresh ignored, %s was refreshed less than %s ago", sitemapURL, config.cacheRefreshInterval))
+			}
+			return result, nil
+		}
+	}
+
+	result, err = parseSitemap(ctx, sitemapURL, trace, opts)
+	if err == nil && (!result.Partial || config.cachePartialResults) {
+		redirects := *trace
+		redirects.Chain = append([]redirectHop{}, trace.Chain...)
+		cache.set(key, &cacheEntry{result: result.clone(), redirects: redirects}, config.cacheTTL)
+	}
+	if err == nil {
+		result.Refreshed = refresh
+	}
+	return result, err
+}
+
+// discoverSitemapCached discovers the sitemap of a domain like
+// getSitemapURLFromDomain, answering from the cache when the request allows it.
+// Forced refreshes discover the sitemap again, as often as walks are refreshed.
+func discoverSitemapCached(ctx context.Context, domain string, candidatePaths []string, payload requestPayload) (discovery *sitemapDiscovery, err error) {
+	ctx, span := startSpan(ctx, "discover sitemap", spanKindInternal)
+	span.set("server.address", domain)
+	cached := false
+	defer func() {
+		span.fail(err)
+		span.set("cache.hit", cached)
+		if discovery != nil {
+			span.set("sitemap.url", discovery.SitemapURL, "sitemap.discovery.source", discovery.Source)
+		}
+		span.finish()
+	}()
+
+	config := configFrom(ctx)
+	if !payload.usesCache(config) {
+		return getSitemapURLFromDomain(ctx, domain, candidatePaths)
+	}
+
+	key := "domain " + strings.ToLower(domain) + " " + strings.Join(candidatePaths, " ")
+	if !payload.Refresh || !refreshes.allow(key, time.Now()) {
+		if entry := cache.get(key); entry != nil {
+			cached = true
+			return entry.discovery, nil
+		}
+	}
+
+	discovery, err = getSitemapURLFromDomain(ctx, domain, candidatePaths)
+	if err == nil {
+		cache.set(key, &cacheEntry{discovery: discovery}, config.cacheTTL)
+	}
+	return discovery, err
+}
+
+// cachedDocument is a decoded sitemap document kept with the validators it was
+// served with.
+type cachedDocument struct {
+	sitemap      *Sitemap
+	etag         string
+	lastModified string
+}
+
+// documentCacheKey returns the cache key of the document of the sitemap at
+// sitemapURL.
+func documentCacheKey(sitemapURL string) string {
+	return "document " + normalizeURL(sitemapURL)
+}
+
+// cachedSitemapDocument returns the document kept for the sitemap at
+// sitemapURL, or nil when there is none.
+func cachedSitemapDocument(sitemapURL string) *cachedDocument {
+	entry := cache.get(documentCacheKey(sitemapURL))
+	if entry == nil {
+		return nil
+	}
+	return entry.document
+}
+
+// storeSitemapDocument keeps the document of the sitemap at sitemapURL for
+// ttl, with the validators of header. Documents served without any validator
+// can't be fetched conditionally, so they aren't kept.
+func storeSitemapDocument(sitemapURL string, sitemap *Sitemap, header http.Header, ttl time.Duration) {
+	document := &cachedDocument{sitemap: sitemap, etag: header.Get("ETag"), lastModified: header.Get("Last-Modified")}
+	if document.etag == "" && document.lastModified == "" {
+		return
+	}
+	cache.set(documentCacheKey(sitemapURL), &cacheEntry{document: document}, ttl)
+}
+
+// revalidated keeps the document for another ttl after a 304, with the
+// validators the 304 updated.
+func (d *cachedDocument) revalidated(sitemapURL string, header http.Header, ttl time.Duration) {
+	document := *d
+	if etag := header.Get("ETag"); etag != "" {
+		document.etag = etag
+	}
+	if lastModified := header.Get("Last-Modified"); lastModified != "" {
+		document.lastModified = lastModified
+	}
+	cache.set(documentCacheKey(sitemapURL), &cacheEntry{document: &document}, ttl)
+}
+
+// conditionalHeader returns the header fields fetching the document again
+// only when it changed.
+func (d *cachedDocument) conditionalHeader() http.Header {
+	header := http.Header{}
+	if d.etag != "" {
+		header.Set("If-None-Match", d.etag)
+	}
+	if d.lastModified != "" {
+		header.Set("If-Modified-Since", d.lastModified)
+	}
+	return header
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// callbackClient delivers the callbacks, with the callbackTimeout of the
+// configuration. It is set up by setupServices.
+var callbackClient *http.Client
+
+// newCallbackClient returns the client delivering callbacks under c. It dials
+// like outbound fetches, through dns and guardDial, and follows redirects like
+// them, so a callback can't reach an internal address either.
+func newCallbackClient(c *Config, dns *dnsCache) *http.Client {
+	return &http.Client{
+		Transport:     newFetchTransport(c, dns),
+		CheckRedirect: checkRedirect,
+		Timeout:       c.callbackTimeout,
+	}
+}
+
+// callbackMetrics reports the callbacks delivered and failed since the start,
+// their retries, and the last failure.
+type callbackMetrics struct {
+	Delivered   int64            `json:"delivered"`
+	Failed      int64            `json:"failed"`
+	Retries     int64            `json:"retries"`
+	LastFailure *callbackFailure `json:"lastFailure"`
+}
+
+// callbackFailure describes a callback that couldn't be delivered.
+type callbackFailure struct {
+	RequestID   string    `json:"requestId"`
+	CallbackURL string    `json:"callbackUrl"`
+	Error       string    `json:"error"`
+	Attempts    int       `json:"attempts"`
+	At          time.Time `json:"at"`
+}
+
+// callbackStats counts the deliveries of callbacks since the start.
+var callbackStats struct {
+	delivered, failed, retries int64
+
+	mu          sync.Mutex
+	lastFailure *callbackFailure
+}
+
+// currentCallbackMetrics reports the deliveries of callbacks.
+func currentCallbackMetrics() callbackMetrics {
+	callbackStats.mu.Lock()
+	defer callbackStats.mu.Unlock()
+	return callbackMetrics{
+		Delivered:   atomic.LoadInt64(&callbackStats.delivered),
+		Failed:      atomic.LoadInt64(&callbackStats.failed),
+		Retries:     atomic.LoadInt64(&callbackStats.retries),
+		LastFailure: callbackStats.lastFailure,
+	}
+}
+
+// signatureHeader is the header carrying the HMAC-SHA256 signature of a callback body.
+const signatureHeader = "X-Signature"
+
+// callbackBody is the JSON body posted to a callback URL.
+type callbackBody struct {
+	RequestID string      `json:"requestId"`
+	Status    int         `json:"status"`
+	Result    interface{} `json:"result,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Code      string      `json:"code,omitempty"`
+}
+
+// validateCallbackURL checks a callback URL given by a client like the sitemap
+// URLs: an absolute http or https URL with a host, without userinfo,
+// whitespace or control characters, is a 400 otherwise. An address of an
+// internal network, other than the ones of FETCH_ALLOWED_NETWORKS under c, is
+// a 403, as it isn't fetched either. It returns the error to reply with, or
+// nil. Hosts resolving to an internal address are stopped on delivery.
+func validateCallbackURL(c *Config, callbackURL string) *requestError {
+	if reqErr := validateTargetURL(callbackURL); reqErr != nil {
+		return &requestError{http.StatusBadRequest, errCodeInvalidRequest, "Invalid 'callbackUrl': " + reqErr.Message, nil}
+	}
+	u, _ := url.ParseRequestURI(callbackURL)
+	var targetErr *forbiddenTargetError
+	if err := guardDial(c.fetchAllowedNetworks)("tcp", u.Hostname(), nil); errors.As(err, &targetErr) {
+		return &requestError{http.StatusForbidden, errCodeTargetForbidden, "Invalid 'callbackUrl': " + targetErr.Error(), map[string]interface{}{"address": targetErr.Addr}}
+	}
+	return nil
+}
+
+// signCallback returns the signature of a callback body, "sha256=" followed by
+// the hex-encoded HMAC-SHA256 of the body keyed with the shared secret.
+func signCallback(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sendCallback posts the outcome of a request to its callback URL in the background.
+//
+// Deliveries failing at the transport level or with a 5xx status are retried with
+// a growing delay. Failures are logged and reported by the callbacks of the
+// metrics, and never affect the request itself, whose ctx the delivery outlives.
+func sendCallback(ctx context.Context, callbackURL string, body callbackBody) {
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				logger.Error("callback panicked", "callback", callbackURL, "requestId", body.RequestID, "panic", p)
+			}
+		}()
+
+		attempts, err := deliverCallback(ctx, callbackURL, body)
+		if err == nil {
+			atomic.AddInt64(&callbackStats.delivered, 1)
+			return
+		}
+		logger.Warn("callback failed", "callback", callbackURL, "requestId", body.RequestID, "attempts", attempts, "err", err)
+		atomic.AddInt64(&callbackStats.failed, 1)
+		callbackStats.mu.Lock()
+		callbackStats.lastFailure = &callbackFailure{RequestID: body.RequestID, CallbackURL: callbackURL, Error: err.Error(), Attempts: attempts, At: time.Now().UTC()}
+		callbackStats.mu.Unlock()
+	}()
+}
+
+// deliverCallback posts the callback body, retrying transient failures, and
+// returns the number of attempts made with the error of the last one.
+func deliverCallback(ctx context.Context, callbackURL string, body callbackBody) (int, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return 0, err
+	}
+
+	config := configFrom(ctx)
+	delay := config.callbackRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err = postCallback(ctx, callbackURL, payload)
+		if err == nil || attempt >= config.callbackAttempts {
+			return attempt, err
+		}
+		var statusErr *callbackStatusError
+		var targetErr *forbiddenTargetError
+		if errors.As(err, &statusErr) || errors.As(err, &targetErr) {
+			return attempt, err
+		}
+		atomic.AddInt64(&callbackStats.retries, 1)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// callbackStatusError reports a callback rejected with a non-retryable status.
+type callbackStatusError struct {
+	Status int
+}
+
+func (e *callbackStatusError) Error() string {
+	return fmt.Sprintf("callback rejected with status %d", e.Status)
+}
+
+// postCallback sends a single callback attempt.
+func postCallback(ctx context.Context, callbackURL string, payload []byte) error {
+	if err := checkFetchURL(callbackURL); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret := configFrom(ctx).callbackSecret; secret != "" {
+		req.Header.Set(signatureHeader, signCallback(secret, payload))
+	}
+
+	resp, err := callbackClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 500:
+		return fmt.Errorf("callback failed with status %d", resp.StatusCode)
+	case resp.StatusCode >= 300:
+		return &callbackStatusError{Status: resp.StatusCode}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// isTrustedProxy reports whether addr is the address of one of the
+// trustedProxies.
+func isTrustedProxy(trustedProxies []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client of a request: the peer of the
+// connection, or, when that is a trusted proxy, the last address of the
+// X-Forwarded-For header that isn't one, so a client can't pass for another by
+// sending the header itself.
+func clientIP(r *http.Request) string {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		addr = r.RemoteAddr
+	}
+	trustedProxies := configFrom(r.Context()).trustedProxies
+	if !isTrustedProxy(trustedProxies, addr) {
+		return addr
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		addr = hop
+		if !isTrustedProxy(trustedProxies, hop) {
+			break
+		}
+	}
+	return addr
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// clientRateLimiter bounds the requests of each client address with a token
+// bucket, so a single client can't monopolize the service. It is safe for
+// concurrent use.
+type clientRateLimiter struct {
+	mu       sync.Mutex
+	buckets  map[string]*tokenBucket
+	rejected int64
+}
+
+var clientRates = &clientRateLimiter{buckets: make(map[string]*tokenBucket)}
+
+// readClientRate reads the rate of the requests of a client of s, off while
+// CLIENT_RATE_LIMIT_PER_MINUTE is zero. The burst defaults to the requests of
+// a minute.
+func readClientRate(s *configSource) hostRate {
+	perMinute := s.int("CLIENT_RATE_LIMIT_PER_MINUTE", 0)
+	rate := hostRate{perSecond: float64(perMinute) / 60, burst: s.int("CLIENT_RATE_LIMIT_BURST", perMinute)}
+	if perMinute > 0 && rate.burst == 0 {
+		s.problem("CLIENT_RATE_LIMIT_BURST", "must be at least 1 while CLIENT_RATE_LIMIT_PER_MINUTE is set")
+	}
+	return rate
+}
+
+// allow takes a token at now from the bucket of the client at addr, paced at
+// rate, and returns 0, or how long to wait for a token when there is none.
+func (l *clientRateLimiter) allow(addr string, rate hostRate, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket := l.buckets[addr]
+	if bucket == nil {
+		bucket = &tokenBucket{rate: rate, tokens: float64(rate.burst), last: now}
+		l.buckets[addr] = bucket
+	}
+	bucket.pace(rate, now)
+	bucket.refill(now)
+	if bucket.tokens < 1 {
+		l.rejected++
+		return time.Duration((1 - bucket.tokens) / rate.perSecond * float64(time.Second))
+	}
+	bucket.tokens--
+	return 0
+}
+
+// sweep drops the buckets of the clients idle for long enough for them to be
+// full again at now, returning how many were dropped.
+func (l *clientRateLimiter) sweep(now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	removed := 0
+	for addr, bucket := range l.buckets {
+		bucket.refill(now)
+		if bucket.tokens >= float64(bucket.rate.burst) {
+			delete(l.buckets, addr)
+			removed++
+		}
+	}
+	return removed
+}
+
+// clientRateMetrics reports the rate of the requests of a client, the clients
+// having made requests recently, and the requests turned away since the start.
+type clientRateMetrics struct {
+	Enabled           bool  `json:"enabled"`
+	RequestsPerMinute int   `json:"requestsPerMinute"`
+	Burst             int   `json:"burst"`
+	Clients           int   `json:"clients"`
+	Rejected          int64 `json:"rejected"`
+}
+
+// metrics reports the limiter under rate.
+func (l *clientRateLimiter) metrics(rate hostRate) clientRateMetrics {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return clientRateMetrics{
+		Enabled:           rate.perSecond > 0,
+		RequestsPerMinute: int(rate.perSecond*60 + 0.5),
+		Burst:             rate.burst,
+		Clients:           len(l.buckets),
+		Rejected:          l.rejected,
+	}
+}
+
+// limitClientRate is the middleware bounding the requests of each client
+// address, as told by clientIP, to CLIENT_RATE_LIMIT_PER_MINUTE, once set.
+// Requests past it get a 429 with a Retry-After header. The paths served
+// without an API key, such as the probes, aren't limited.
+func limitClientRate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rate := configFrom(r.Context()).clientRate
+		if rate.perSecond <= 0 || isOpenPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if wait := clientRates.allow(clientIP(r), rate, time.Now()); wait > 0 {
+			perMinute := int(rate.perSecond*60 + 0.5)
+			writeAPIError(w, http.StatusTooManyRequests, errCodeRateLimited, fmt.Sprintf("Clients may make %d requests a minute; try again later", perMinute), map[string]interface{}{"limit": perMinute, "retryAfterSeconds": ceilSeconds(wait)})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,851 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config is the configuration of the service, read once by loadConfig from
+// the environment variables, over the settings of the file named by the
+// CONFIG_FILE environment variable, if any. It isn't modified once read: a
+// reload replaces the runtimeSettings of the configuration in use with the
+// ones of a new Config, and the settings of the other fields only apply after
+// a restart.
+type Config struct {
+	// source is where the settings were read from.
+	source *configSource
+
+	runtimeSettings
+
+	// accessLog tells whether a line is logged to stdout for every request.
+	// It can be configured through the ACCESS_LOG environment variable, 0
+	// turning the access log off.
+	accessLog bool
+
+	// adminToken is the bearer token of the admin endpoints, which are
+	// disabled while it is empty. It is separate from whatever gives access to
+	// the rest of the API. It can be configured through the ADMIN_TOKEN
+	// environment variable.
+	adminToken string
+
+	// batchConcurrency is the number of domains of a batch processed in
+	// parallel. It can be configured through the BATCH_CONCURRENCY environment
+	// variable.
+	batchConcurrency int
+
+	// maxRequestBodyBytes is the largest request body accepted, as sent, which
+	// keeps a client from tying up memory with a huge payload. It can be
+	// configured through the REQUEST_MAX_BYTES environment variable.
+	maxRequestBodyBytes int
+
+	// maxMultipartBodyBytes is the largest multipart/form-data request body
+	// accepted, as sent, which has room for an upload of maxUploadBytes. It
+	// can be configured through the REQUEST_MAX_MULTIPART_BYTES environment
+	// variable.
+	maxMultipartBodyBytes int
+
+	// maxUploadBytes is the largest sitemap accepted as a file upload, both as
+	// sent and once decompressed. It can be configured through the
+	// UPLOAD_MAX_BYTES environment variable.
+	maxUploadBytes int
+
+	// breakerThreshold is the number of consecutive failed fetches of a host
+	// after which its circuit breaker opens. Zero turns the breakers off. It
+	// can be configured through the BREAKER_FAILURE_THRESHOLD environment
+	// variable.
+	breakerThreshold int
+
+	// breakerCooldown is how long an open breaker fails the fetches of its
+	// host before letting a probe through. It can be configured through the
+	// BREAKER_COOLDOWN_SECONDS environment variable.
+	breakerCooldown time.Duration
+
+	// cacheTTL is how long the result of a walk, and the sitemap discovered for
+	// a domain, are served from the cache. Zero turns the cache off. It can be
+	// configured through the CACHE_TTL_SECONDS environment variable.
+	cacheTTL time.Duration
+
+	// cachePartialResults allows caching the results of walks that had failing
+	// child sitemaps, which are otherwise walked again on the next request. It
+	// can be set through the CACHE_PARTIAL_RESULTS environment variable.
+	cachePartialResults bool
+
+	// cacheMaxEntries and cacheMaxBytes bound the number of entries in the
+	// cache and their approximate size. The least recently used entries are
+	// evicted when either is exceeded, and zero means no bound. They can be
+	// configured through the CACHE_MAX_ENTRIES and CACHE_MAX_BYTES environment
+	// variables.
+	cacheMaxEntries int
+	cacheMaxBytes   int64
+
+	// cacheRefreshInterval is the least time between two forced refreshes of
+	// the same sitemap, so clients refreshing every request still get cached
+	// results. It can be configured through the CACHE_REFRESH_INTERVAL_SECONDS
+	// environment variable.
+	cacheRefreshInterval time.Duration
+
+	// cacheValidatorTTL is how long a sitemap document served with an ETag or
+	// a Last-Modified date is kept, to fetch it again conditionally once the
+	// walk results holding it expire. Each 304 keeps it that much longer. It
+	// can be configured through the CACHE_VALIDATOR_TTL_SECONDS environment
+	// variable.
+	cacheValidatorTTL time.Duration
+
+	// cacheBackend selects where the cache is held: "memory", in the process,
+	// or "redis", shared by every replica of the service. It can be configured
+	// through the CACHE_BACKEND environment variable.
+	cacheBackend string
+
+	// redisAddr is the address of the Redis server of the redis cache backend.
+	// It can be configured through the REDIS_ADDR environment variable.
+	redisAddr string
+
+	// redisKeyPrefix prefixes the keys of the cache in Redis, so several
+	// services can share a server. It can be configured through the
+	// REDIS_KEY_PREFIX environment variable.
+	redisKeyPrefix string
+
+	// redisPassword authenticates the connections to Redis, with AUTH, when
+	// set, and redisDB is the database they SELECT. They are read from the
+	// REDIS_PASSWORD and REDIS_DB environment variables.
+	redisPassword string
+	redisDB       int
+
+	// redisTimeout bounds each command sent to Redis. It can be configured
+	// through the REDIS_TIMEOUT_MS environment variable.
+	redisTimeout time.Duration
+
+	// callbackSecret is the shared secret signing the callback bodies. It is
+	// read from the CALLBACK_SECRET environment variable.
+	callbackSecret string
+
+	// callbackAttempts is the number of times a callback is attempted. It can
+	// be configured through the CALLBACK_ATTEMPTS environment variable.
+	callbackAttempts int
+
+	// callbackRetryBackoff is the wait before the first retry of a callback,
+	// doubled for every retry after it. It can be configured through the
+	// CALLBACK_RETRY_BACKOFF_MS environment variable.
+	callbackRetryBackoff time.Duration
+
+	// callbackTimeout bounds each delivery of a callback. It can be configured
+	// through the CALLBACK_TIMEOUT_SECONDS environment variable.
+	callbackTimeout time.Duration
+
+	// trustedProxies are the networks of the proxies in front of the service,
+	// whose X-Forwarded-For header tells the address of the client. Without
+	// any, the header is ignored, since clients could set it to anything. It
+	// can be configured through the TRUSTED_PROXIES environment variable, as
+	// comma separated addresses or CIDR ranges.
+	trustedProxies []*net.IPNet
+
+	// corsOrigins are the origins of the browser clients allowed to call the
+	// API, none while CORS is off. It can be configured through the
+	// CORS_ALLOWED_ORIGINS environment variable, as comma separated origins
+	// such as https://dashboard.example.com, https://*.example.com for the
+	// subdomains of example.com, or * for any origin.
+	corsOrigins []corsOrigin
+
+	// corsAllowCredentials tells browsers they may send cookies and
+	// authorization headers along with cross-origin requests. It can be
+	// configured through the CORS_ALLOW_CREDENTIALS environment variable.
+	corsAllowCredentials bool
+
+	// corsMaxAge is how long browsers may cache the answer to a preflight, in
+	// seconds. It can be configured through the CORS_MAX_AGE_SECONDS
+	// environment variable.
+	corsMaxAge int
+
+	// maxDiffListSize is the largest number of URLs returned in each list of a
+	// /diff response. It can be configured through the DIFF_MAX_LIST_SIZE
+	// environment variable, and lowered per request with the limit payload
+	// field.
+	maxDiffListSize int
+
+	// dnsCacheTTL is how long the addresses of a host are reused by outbound
+	// fetches, whatever the TTL of the DNS answer. Zero resolves every dial,
+	// for hosts whose DNS answers are load-balanced on purpose. It can be
+	// configured through the DNS_CACHE_TTL_SECONDS environment variable.
+	dnsCacheTTL time.Duration
+
+	// dnsNegativeTTL is how long a host found not to exist stays so. It can be
+	// configured through the DNS_NEGATIVE_TTL_SECONDS environment variable.
+	dnsNegativeTTL time.Duration
+
+	// responseMaxAge is the max-age, in seconds, of the Cache-Control header
+	// of successful responses. Zero asks clients to revalidate every time, with
+	// the ETag of the response. It can be configured through the
+	// RESPONSE_MAX_AGE_SECONDS environment variable.
+	responseMaxAge int
+
+	// maxRedirects is the maximum number of redirects followed per fetch. It
+	// can be configured through the MAX_REDIRECTS environment variable.
+	maxRedirects int
+
+	// fetchMaxIdleConns bounds the idle connections of outbound fetches kept
+	// across hosts, and fetchMaxIdleConnsPerHost those kept per host. They can
+	// be configured through the FETCH_MAX_IDLE_CONNS and
+	// FETCH_MAX_IDLE_CONNS_PER_HOST environment variables.
+	fetchMaxIdleConns        int
+	fetchMaxIdleConnsPerHost int
+
+	// fetchMaxConnsPerHost bounds the connections open to a host at once, zero
+	// meaning no bound. It can be configured through the
+	// FETCH_MAX_CONNS_PER_HOST environment variable.
+	fetchMaxConnsPerHost int
+
+	// fetchIdleConnTimeout is how long an idle connection is kept. It can be
+	// configured through the FETCH_IDLE_CONN_TIMEOUT_SECONDS environment
+	// variable.
+	fetchIdleConnTimeout time.Duration
+
+	// fetchConnectTimeout bounds the resolution of the host and the dial of a
+	// new connection, so a host not accepting connections fails fast while a
+	// large document can take the whole fetchTimeout to download. It can be
+	// configured through the FETCH_CONNECT_TIMEOUT_SECONDS environment
+	// variable.
+	fetchConnectTimeout time.Duration
+
+	// fetchTLSHandshakeTimeout bounds the TLS handshake of a new connection.
+	// It can be configured through the FETCH_TLS_HANDSHAKE_TIMEOUT_SECONDS
+	// environment variable.
+	fetchTLSHandshakeTimeout time.Duration
+
+	// fetchResponseHeaderTimeout bounds the wait for the header of the
+	// response once the request was sent, zero meaning no bound but
+	// fetchTimeout. It can be configured through the
+	// FETCH_RESPONSE_HEADER_TIMEOUT_SECONDS environment variable.
+	fetchResponseHeaderTimeout time.Duration
+
+	// fetchMaxConcurrent bounds the outbound fetches open at once across every
+	// request, whatever the bounds per request and per host allow, so the
+	// service can't flood the sites it fetches. Zero means no bound. It can be
+	// configured through the FETCH_MAX_CONCURRENT environment variable.
+	fetchMaxConcurrent int
+
+	// fetchSlotWarnAfter is how long the fetches of a request may wait for a
+	// slot in total before the response warns about it. It can be configured
+	// through the FETCH_SLOT_WARN_MS environment variable.
+	fetchSlotWarnAfter time.Duration
+
+	// fetchMaxAttempts is the number of times a fetch is attempted when it
+	// fails transiently. It can be configured through the FETCH_MAX_ATTEMPTS
+	// environment variable, and 1 turns retries off.
+	fetchMaxAttempts int
+
+	// fetchRetryBackoff is the wait before the first retry of a fetch, doubled
+	// for every retry after it. It can be configured through the
+	// FETCH_RETRY_BACKOFF_MS environment variable.
+	fetchRetryBackoff time.Duration
+
+	// fetchMaxBodyBytes is the largest response body read by a fetch, once
+	// decompressed, 50 MiB by default like the sitemap protocol allows. It can
+	// be configured through the FETCH_MAX_BODY_BYTES environment variable.
+	fetchMaxBodyBytes int
+
+	// fetchAllowedNetworks are the networks fetched despite being internal,
+	// for deployments that need to parse the sitemaps of internal hosts. It can
+	// be configured through the FETCH_ALLOWED_NETWORKS environment variable, as
+	// comma separated addresses or CIDR ranges.
+	fetchAllowedNetworks []*net.IPNet
+
+	// hostRate is the rate at which the fetches of a host are sent, across
+	// every request, and how many may be sent at once after a quiet period. A
+	// rate of zero turns the limit off. It can be configured through the
+	// HOST_RATE_LIMIT_RPS and HOST_RATE_LIMIT_BURST environment variables.
+	hostRate hostRate
+
+	// hostRateOverrides are the rates of the hosts not fetched at the default
+	// one. They can be configured through the HOST_RATE_LIMITS environment
+	// variable, as a comma separated list of host=rate or host=rate:burst
+	// pairs, where a rate of 0 turns the limit off for the host.
+	hostRateOverrides map[string]hostRate
+
+	// maxCrawlDelay is the longest Crawl-delay of a robots.txt honored. The
+	// fetches of a host asking for more fail instead of stalling. It can be
+	// configured through the MAX_CRAWL_DELAY_SECONDS environment variable.
+	maxCrawlDelay time.Duration
+
+	// childFetchConcurrency is the number of child sitemaps fetched in
+	// parallel per request. It can be configured through the
+	// SITEMAP_FETCH_CONCURRENCY environment variable.
+	childFetchConcurrency int
+
+	// maxGenerateURLs is the largest number of entries accepted by /generate.
+	// It can be configured through the GENERATE_MAX_URLS environment variable.
+	maxGenerateURLs int
+
+	// maxHistoryEntries is the number of sitemaps whose last URL list is kept
+	// for diffAgainstPrevious requests. It can be configured through the
+	// HISTORY_MAX_ENTRIES environment variable.
+	maxHistoryEntries int
+
+	// idempotencyTTL is how long the response of a request carrying an
+	// Idempotency-Key is replayed to the requests repeating it. Zero turns
+	// idempotency keys off. It can be configured through the
+	// IDEMPOTENCY_TTL_SECONDS environment variable.
+	idempotencyTTL time.Duration
+
+	// idempotencyMaxBytes is the size past which a response isn't kept for
+	// replay, so a request repeating its key runs again. It can be configured
+	// through the IDEMPOTENCY_MAX_BYTES environment variable.
+	idempotencyMaxBytes int
+
+	// janitorInterval is how often the janitor removes what expired from the
+	// cache, the paginated results and the store. Zero leaves expired entries
+	// until they are next looked up. It can be configured through the
+	// JANITOR_INTERVAL_SECONDS environment variable.
+	janitorInterval time.Duration
+
+	// resultTTL is how long a paginated result is held for its cursors. It can
+	// be configured through the RESULT_TTL_SECONDS environment variable.
+	resultTTL time.Duration
+
+	// maxRawBytes is the largest body passed through by /raw. It can be
+	// configured through the RAW_MAX_BYTES environment variable.
+	maxRawBytes int
+
+	// statsOtherThreshold is the default size under which the buckets of a
+	// /stats response are collapsed into "other". It can be configured through
+	// the STATS_OTHER_THRESHOLD environment variable, and per request with the
+	// otherThreshold payload field.
+	statsOtherThreshold int
+
+	// submitEngines are the ping endpoints called by /submit. They can be
+	// configured through the SUBMIT_ENGINES environment variable, as a comma
+	// separated list of name=URL pairs where {sitemap} stands for the escaped
+	// sitemap URL.
+	submitEngines []submitEngine
+
+	// submitInterval is the minimum time between two submissions of the same
+	// sitemap. It can be configured through the SUBMIT_INTERVAL_SECONDS
+	// environment variable.
+	submitInterval time.Duration
+
+	// storeBackend selects where completed parses are persisted: "none" keeps
+	// nothing across restarts, and "bolt" keeps them in the bbolt database
+	// file at storePath. They can be configured through the STORE_BACKEND and
+	// STORE_PATH environment variables.
+	storeBackend string
+	storePath    string
+
+	// storeRetention is how long persisted parses are kept. It can be
+	// configured through the STORE_RETENTION_HOURS environment variable.
+	storeRetention time.Duration
+
+	// storeQueueSize is the number of parses waiting to be written past which
+	// new ones are dropped, so writing never holds up a request. It can be
+	// configured through the STORE_QUEUE_SIZE environment variable.
+	storeQueueSize int
+
+	// workerPoolSize is the number of parses run at once, across every
+	// request. It can be configured through the WORKER_POOL_SIZE environment
+	// variable.
+	workerPoolSize int
+
+	// workerQueueSize is the number of parses waiting for a worker past which
+	// no more are queued. It can be configured through the WORKER_QUEUE_SIZE
+	// environment variable.
+	workerQueueSize int
+
+	// workerQueueWait is how long a synchronous request waits for room in a
+	// full queue before being turned away. It can be configured through the
+	// WORKER_QUEUE_WAIT_MS environment variable.
+	workerQueueWait time.Duration
+
+	// listenAddr is the address the API is served on, as host:port, or as
+	// unix:///path/to.sock for a Unix domain socket. An empty host listens on
+	// every interface, and port 0 on a port picked by the system, which is
+	// logged once listening. It can be configured through the LISTEN_ADDR
+	// environment variable.
+	listenAddr string
+
+	// listenSocketMode is the file mode of the Unix domain socket, in octal,
+	// which decides who may connect to it. It can be configured through the
+	// LISTEN_SOCKET_MODE environment variable.
+	listenSocketMode os.FileMode
+
+	// readHeaderTimeout is how long a client is given to send the headers of
+	// a request, past which its connection is closed, so clients trickling
+	// headers in can't hold connections open. It can be configured through
+	// the READ_HEADER_TIMEOUT_SECONDS environment variable.
+	readHeaderTimeout time.Duration
+
+	// tlsCertFile and tlsKeyFile are the PEM files of the certificate chain
+	// and private key the API is served with over HTTPS, on listenAddr.
+	// Without both, the API is served over plain HTTP. They can be configured
+	// through the TLS_CERT_FILE and TLS_KEY_FILE environment variables.
+	tlsCertFile string
+	tlsKeyFile  string
+
+	// tlsReloadInterval is how often the certificate files are checked for a
+	// renewal, which is loaded without a restart. SIGHUP loads them at once.
+	// It can be configured through the TLS_RELOAD_INTERVAL_SECONDS environment
+	// variable, 0 leaving reloads to SIGHUP.
+	tlsReloadInterval time.Duration
+
+	// httpListenAddr is the address of a plain HTTP listener served alongside
+	// the HTTPS one, none when empty. It can be configured through the
+	// HTTP_LISTEN_ADDR environment variable.
+	httpListenAddr string
+
+	// tlsRedirectHTTP tells whether the plain HTTP listener redirects every
+	// request to HTTPS rather than serving the API. It can be configured
+	// through the TLS_REDIRECT_HTTP environment variable, 1 redirecting.
+	tlsRedirectHTTP bool
+
+	// pprofAddr is the address of the listener serving the profiles of the
+	// service under /debug/pprof/, which isn't started while it is empty. It
+	// is separate from the API so profiling can't be reached from where the
+	// API is; bind it to a loopback or private address. It can be configured
+	// through the PPROF_ADDR environment variable.
+	pprofAddr string
+
+	// shutdownGrace is how long the in-flight requests, the queued parses and
+	// the pending writes are given to finish once the service is told to stop.
+	// It can be configured through the SHUTDOWN_GRACE_SECONDS environment
+	// variable.
+	shutdownGrace time.Duration
+
+	// shutdownDelay is how long /readyz fails before the service stops taking
+	// requests on shutdown, serving them as usual meanwhile, so load balancers
+	// polling it stop sending requests before connections are cut. It can be
+	// configured through the SHUTDOWN_DELAY_SECONDS environment variable.
+	shutdownDelay time.Duration
+
+	// logFormat is the format of the events logged to stderr: text, or json
+	// for a line of JSON per event. It can be configured through the
+	// LOG_FORMAT environment variable.
+	logFormat string
+
+	// tracing is where the spans are exported, from the standard OTEL_*
+	// environment variables.
+	tracing tracingConfig
+}
+
+// loadConfig reads the configuration of the environment looked up by
+// lookupEnv and the file at path, if not empty, and checks it. The
+// configuration is returned even when invalid, with an error listing every
+// invalid setting by name, so a reload can tell what changed.
+func loadConfig(path string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	s := newConfigSource(path, lookupEnv)
+	c := &Config{source: s, runtimeSettings: *readRuntimeSettings(s)}
+
+	c.accessLog = s.int("ACCESS_LOG", 1) != 0
+	c.adminToken = s.string("ADMIN_TOKEN", "")
+	c.batchConcurrency = s.int("BATCH_CONCURRENCY", 4)
+
+	c.maxRequestBodyBytes = s.int("REQUEST_MAX_BYTES", 1<<20)
+	c.maxUploadBytes = s.int("UPLOAD_MAX_BYTES", 10<<20)
+	c.maxMultipartBodyBytes = s.int("REQUEST_MAX_MULTIPART_BYTES", c.maxUploadBytes+1<<20)
+
+	c.breakerThreshold = s.int("BREAKER_FAILURE_THRESHOLD", 5)
+	c.breakerCooldown = s.seconds("BREAKER_COOLDOWN_SECONDS", 30)
+
+	c.cacheTTL = s.seconds("CACHE_TTL_SECONDS", 300)
+	c.cachePartialResults = s.int("CACHE_PARTIAL_RESULTS", 0) != 0
+	c.cacheMaxEntries = s.int("CACHE_MAX_ENTRIES", 1000)
+	c.cacheMaxBytes = int64(s.int("CACHE_MAX_BYTES", 64<<20))
+	c.cacheRefreshInterval = s.seconds("CACHE_REFRESH_INTERVAL_SECONDS", 60)
+	c.cacheValidatorTTL = s.seconds("CACHE_VALIDATOR_TTL_SECONDS", 86400)
+	c.cacheBackend = s.choice("CACHE_BACKEND", "memory", "memory", "redis")
+	c.redisAddr = s.string("REDIS_ADDR", "localhost:6379")
+	c.redisKeyPrefix = s.string("REDIS_KEY_PREFIX", "sitemap-parser:")
+	c.redisPassword = s.string("REDIS_PASSWORD", "")
+	c.redisDB = s.int("REDIS_DB", 0)
+	c.redisTimeout = s.milliseconds("REDIS_TIMEOUT_MS", 500)
+
+	c.callbackSecret = s.string("CALLBACK_SECRET", "")
+	c.callbackAttempts = s.int("CALLBACK_ATTEMPTS", 3)
+	c.callbackRetryBackoff = s.milliseconds("CALLBACK_RETRY_BACKOFF_MS", 500)
+	c.callbackTimeout = s.seconds("CALLBACK_TIMEOUT_SECONDS", 5)
+
+	c.trustedProxies = s.networks("TRUSTED_PROXIES")
+	c.corsOrigins = parseCORSOrigins(s, s.string("CORS_ALLOWED_ORIGINS", ""))
+	c.corsAllowCredentials = s.int("CORS_ALLOW_CREDENTIALS", 0) == 1
+	for _, origin := range c.corsOrigins {
+		// Any site could otherwise make requests on behalf of the user
+		if origin.any && c.corsAllowCredentials {
+			s.problem("CORS_ALLOW_CREDENTIALS", "credentials can't be allowed to any origin; list the origins in CORS_ALLOWED_ORIGINS")
+			c.corsAllowCredentials = false
+		}
+	}
+	c.corsMaxAge = s.int("CORS_MAX_AGE_SECONDS", 600)
+
+	c.maxDiffListSize = s.int("DIFF_MAX_LIST_SIZE", 1000)
+	c.responseMaxAge = s.int("RESPONSE_MAX_AGE_SECONDS", 60)
+
+	c.dnsCacheTTL = s.seconds("DNS_CACHE_TTL_SECONDS", 30)
+	c.dnsNegativeTTL = s.seconds("DNS_NEGATIVE_TTL_SECONDS", 5)
+	c.maxRedirects = s.int("MAX_REDIRECTS", 5)
+	c.fetchMaxIdleConns = s.int("FETCH_MAX_IDLE_CONNS", 100)
+	c.fetchMaxIdleConnsPerHost = s.int("FETCH_MAX_IDLE_CONNS_PER_HOST", 16)
+	c.fetchMaxConnsPerHost = s.int("FETCH_MAX_CONNS_PER_HOST", 0)
+	c.fetchIdleConnTimeout = s.seconds("FETCH_IDLE_CONN_TIMEOUT_SECONDS", 90)
+	c.fetchConnectTimeout = s.seconds("FETCH_CONNECT_TIMEOUT_SECONDS", 10)
+	c.fetchTLSHandshakeTimeout = s.seconds("FETCH_TLS_HANDSHAKE_TIMEOUT_SECONDS", 10)
+	c.fetchResponseHeaderTimeout = s.seconds("FETCH_RESPONSE_HEADER_TIMEOUT_SECONDS", 10)
+	c.fetchMaxConcurrent = s.int("FETCH_MAX_CONCURRENT", 128)
+	c.fetchSlotWarnAfter = s.milliseconds("FETCH_SLOT_WARN_MS", 1000)
+	c.fetchMaxAttempts = s.int("FETCH_MAX_ATTEMPTS", 3)
+	c.fetchRetryBackoff = s.milliseconds("FETCH_RETRY_BACKOFF_MS", 200)
+	c.fetchMaxBodyBytes = s.int("FETCH_MAX_BODY_BYTES", maxSitemapBytes)
+	c.fetchAllowedNetworks = s.networks("FETCH_ALLOWED_NETWORKS")
+	c.hostRate = hostRate{perSecond: s.float("HOST_RATE_LIMIT_RPS", 4), burst: s.int("HOST_RATE_LIMIT_BURST", 8)}
+	c.hostRateOverrides = parseHostRates(s.string("HOST_RATE_LIMITS", ""), c.hostRate.burst)
+	c.maxCrawlDelay = s.seconds("MAX_CRAWL_DELAY_SECONDS", 10)
+	c.childFetchConcurrency = s.int("SITEMAP_FETCH_CONCURRENCY", 8)
+
+	c.maxGenerateURLs = s.int("GENERATE_MAX_URLS", 500000)
+	c.maxHistoryEntries = s.int("HISTORY_MAX_ENTRIES", 1000)
+	c.idempotencyTTL = s.seconds("IDEMPOTENCY_TTL_SECONDS", 3600)
+	c.idempotencyMaxBytes = s.int("IDEMPOTENCY_MAX_BYTES", 4<<20)
+	c.janitorInterval = s.seconds("JANITOR_INTERVAL_SECONDS", 60)
+	c.resultTTL = s.seconds("RESULT_TTL_SECONDS", 600)
+	c.maxRawBytes = s.int("RAW_MAX_BYTES", 10<<20)
+	c.statsOtherThreshold = s.int("STATS_OTHER_THRESHOLD", 1)
+	c.submitEngines = parseSubmitEngines(s.string("SUBMIT_ENGINES", defaultSubmitEngines))
+	c.submitInterval = s.seconds("SUBMIT_INTERVAL_SECONDS", 3600)
+
+	c.storeBackend = s.choice("STORE_BACKEND", "none", "none", "bolt")
+	c.storePath = s.string("STORE_PATH", "sitemap-parser.db")
+	c.storeRetention = time.Duration(s.int("STORE_RETENTION_HOURS", 720)) * time.Hour
+	c.storeQueueSize = s.int("STORE_QUEUE_SIZE", 256)
+	c.workerPoolSize = s.int("WORKER_POOL_SIZE", 32)
+	c.workerQueueSize = s.int("WORKER_QUEUE_SIZE", 128)
+	c.workerQueueWait = s.milliseconds("WORKER_QUEUE_WAIT_MS", 1000)
+
+	c.listenAddr = s.string("LISTEN_ADDR", ":8080")
+	if err := validateListenAddr(c.listenAddr); err != nil {
+		s.problem("LISTEN_ADDR", "%v", err)
+	}
+	mode, err := parseSocketMode(s.string("LISTEN_SOCKET_MODE", "0660"))
+	if err != nil {
+		s.problem("LISTEN_SOCKET_MODE", "%v", err)
+	}
+	c.listenSocketMode = mode
+	c.readHeaderTimeout = s.seconds("READ_HEADER_TIMEOUT_SECONDS", 10)
+	c.tlsCertFile = s.string("TLS_CERT_FILE", "")
+	c.tlsKeyFile = s.string("TLS_KEY_FILE", "")
+	c.tlsReloadInterval = s.seconds("TLS_RELOAD_INTERVAL_SECONDS", 60)
+	c.httpListenAddr = s.string("HTTP_LISTEN_ADDR", "")
+	if c.httpListenAddr != "" {
+		if err := validateListenAddr(c.httpListenAddr); err != nil {
+			s.problem("HTTP_LISTEN_ADDR", "%v", err)
+		}
+	}
+	c.tlsRedirectHTTP = s.int("TLS_REDIRECT_HTTP", 0) != 0
+	c.pprofAddr = s.string("PPROF_ADDR", "")
+	c.shutdownGrace = s.seconds("SHUTDOWN_GRACE_SECONDS", 30)
+	c.shutdownDelay = s.seconds("SHUTDOWN_DELAY_SECONDS", 0)
+	c.logFormat = s.choice("LOG_FORMAT", "text", "text", "json")
+	c.tracing = readTracingConfig(s)
+
+	return c, s.err()
+}
+
+// configSource holds the settings of the service by name, the names of the
+// environment variables, from the environment and a configuration file, and
+// records the problems met reading them. It is safe for concurrent use.
+type configSource struct {
+	// path is the configuration file, "" for none.
+	path string
+	// file holds the settings of the file.
+	file map[string]string
+	// lookupEnv looks up an environment variable, os.LookupEnv but in tests.
+	lookupEnv func(string) (string, bool)
+
+	mu   sync.Mutex
+	read map[string]bool
+	// problems are the invalid settings met, one line each starting with the
+	// name of the setting.
+	problems []string
+}
+
+// newConfigSource returns the settings of the environment looked up by
+// lookupEnv and the file at path, if not empty. A file that can't be read or
+// is invalid is a problem of the configuration.
+func newConfigSource(path string, lookupEnv func(string) (string, bool)) *configSource {
+	s := &configSource{path: path, file: map[string]string{}, lookupEnv: lookupEnv, read: map[string]bool{}}
+	if path == "" {
+		return s
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		s.problems = append(s.problems, fmt.Sprintf("CONFIG_FILE: %v", err))
+		return s
+	}
+	if s.file, err = parseConfigFile(data, filepath.Ext(path)); err != nil {
+		s.file = map[string]string{}
+		s.problems = append(s.problems, fmt.Sprintf("CONFIG_FILE: %s: %v", path, err))
+	}
+	return s
+}
+
+// parseConfigFile parses the settings of a configuration file: a JSON object,
+// or for the .yaml and .yml extensions a flat YAML mapping, from the names of
+// the settings to their values. Booleans are turned into 1 and 0, like the
+// environment variables take them.
+func parseConfigFile(data []byte, ext string) (map[string]string, error) {
+	switch strings.ToLower(ext) {
+	case ".json":
+		return parseJSONConfig(data)
+	case ".yaml", ".yml":
+		return parseYAMLConfig(data)
+	default:
+		return nil, fmt.Errorf("unknown format %q, expected .json, .yaml or .yml", ext)
+	}
+}
+
+// parseJSONConfig parses a JSON object of settings, whose values are strings,
+// numbers or booleans.
+func parseJSONConfig(data []byte) (map[string]string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var raw map[string]interface{}
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, err
+	}
+	settings := make(map[string]string, len(raw))
+	for name, value := range raw {
+		switch value := value.(type) {
+		case string:
+			settings[strings.ToUpper(name)] = value
+		case json.Number:
+			settings[strings.ToUpper(name)] = value.String()
+		case bool:
+			settings[strings.ToUpper(name)] = configBool(value)
+		default:
+			return nil, fmt.Errorf("%s: expected a string, number or boolean", name)
+		}
+	}
+	return settings, nil
+}
+
+// parseYAMLConfig parses the flat YAML mapping of settings, one name: value
+// pair per line, with comments, quoted strings and booleans. Nested mappings
+// and lists aren't settings, so they are rejected.
+func parseYAMLConfig(data []byte) (map[string]string, error) {
+	settings := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		trimmed := strings.TrimSpace(text)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		if text != strings.TrimLeft(text, " \t") || strings.HasPrefix(trimmed, "- ") {
+			return nil, fmt.Errorf("line %d: nested values aren't supported", line)
+		}
+		name, value, found := strings.Cut(trimmed, ":")
+		if !found || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("line %d: expected name: value", line)
+		}
+		value = strings.TrimSpace(value)
+		switch {
+		case len(value) >= 2 && (value[0] == '"' || value[0] == '\''):
+			end := strings.LastIndexByte(value, value[0])
+			if end == 0 {
+				return nil, fmt.Errorf("line %d: unterminated string", line)
+			}
+			if value[0] == '"' {
+				unquoted, err := strconv.Unquote(value[:end+1])
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %v", line, err)
+				}
+				value = unquoted
+			} else {
+				value = strings.ReplaceAll(value[1:end], "''", "'")
+			}
+		default:
+			if i := strings.Index(value, " #"); i >= 0 {
+				value = strings.TrimSpace(value[:i])
+			}
+			switch strings.ToLower(value) {
+			case "true", "yes", "on":
+				value = configBool(true)
+			case "false", "no", "off":
+				value = configBool(false)
+			case "~", "null":
+				value = ""
+			}
+		}
+		settings[strings.ToUpper(strings.TrimSpace(name))] = value
+	}
+	return settings, scanner.Err()
+}
+
+// configBool returns the value of a boolean setting.
+func configBool(value bool) string {
+	if value {
+		return "1"
+	}
+	return "0"
+}
+
+// lookup returns the value of the named setting: its environment variable
+// when set, or else its value in the file.
+func (s *configSource) lookup(name string) (string, bool) {
+	s.mu.Lock()
+	s.read[name] = true
+	s.mu.Unlock()
+	if value, ok := s.lookupEnv(name); ok {
+		return value, true
+	}
+	value, ok := s.file[name]
+	return value, ok
+}
+
+// problem records an invalid setting.
+func (s *configSource) problem(name, format string, args ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.problems = append(s.problems, name+": "+fmt.Sprintf(format, args...))
+}
+
+// int returns the integer value of the named setting, or fallback when it is
+// unset. An invalid or negative value is a problem, and reads as fallback.
+func (s *configSource) int(name string, fallback int) int {
+	value, ok := s.lookup(name)
+	if !ok {
+		return fallback
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		s.problem(name, "%q isn't an integer", value)
+		return fallback
+	}
+	if n < 0 {
+		s.problem(name, "must not be negative, got %d", n)
+		return fallback
+	}
+	return n
+}
+
+// seconds returns the named setting as a duration in whole seconds, fallback
+// seconds when it is unset, like int.
+func (s *configSource) seconds(name string, fallback int) time.Duration {
+	return time.Duration(s.int(name, fallback)) * time.Second
+}
+
+// milliseconds returns the named setting as a duration in milliseconds,
+// fallback milliseconds when it is unset, like int.
+func (s *configSource) milliseconds(name string, fallback int) time.Duration {
+	return time.Duration(s.int(name, fallback)) * time.Millisecond
+}
+
+// string returns the value of the named setting, or fallback when it is unset.
+func (s *configSource) string(name, fallback string) string {
+	if value, ok := s.lookup(name); ok {
+		return value
+	}
+	return fallback
+}
+
+// float returns the floating-point value of the named setting, or fallback
+// when it is unset. An invalid or negative value is a problem, and reads as
+// fallback.
+func (s *configSource) float(name string, fallback float64) float64 {
+	value, ok := s.lookup(name)
+	if !ok {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		s.problem(name, "%q isn't a number", value)
+		return fallback
+	}
+	if f < 0 {
+		s.problem(name, "must not be negative, got %v", f)
+		return fallback
+	}
+	return f
+}
+
+// choice returns the value of the named setting, one of values, or fallback
+// when it is unset. Any other value is a problem, and reads as fallback.
+func (s *configSource) choice(name, fallback string, values ...string) string {
+	value, ok := s.lookup(name)
+	if !ok {
+		return fallback
+	}
+	for _, allowed := range values {
+		if value == allowed {
+			return value
+		}
+	}
+	s.problem(name, "%q isn't one of %s", value, strings.Join(values, ", "))
+	return fallback
+}
+
+// networks returns the comma separated addresses and CIDR ranges of the named
+// setting, none when it is unset. An address stands for itself alone. Entries
+// that are neither are problems, and are left out.
+func (s *configSource) networks(name string) []*net.IPNet {
+	value, _ := s.lookup(name)
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			s.problem(name, "%q isn't an address or CIDR range", entry)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// err returns an error listing every invalid setting met by name, or nil.
+func (s *configSource) err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.problems) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(s.problems, "; "))
+}
+
+// unread returns the settings of the file that nothing read, sorted, which are
+// likely misspelled.
+func (s *configSource) unread() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var unread []string
+	for name := range s.file {
+		if !s.read[name] {
+			unread = append(unread, name)
+		}
+	}
+	sort.Strings(unread)
+	return unread
+}
+
+// warnUnread logs the settings of the file of c that the service doesn't
+// know.
+func (c *Config) warnUnread() {
+	if unread := c.source.unread(); len(unread) > 0 {
+		logger.Warn("ignoring unknown settings of the configuration file", "file", c.source.path, "settings", strings.Join(unread, ", "))
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// envOf returns a lookupEnv looking the environment variables up in env.
+func envOf(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
+
+// useConfig makes the configuration of env, checked, the one in use for the
+// rest of the test, with the services built from it.
+func useConfig(t *testing.T, env map[string]string) *Config {
+	t.Helper()
+	c, err := loadConfig("", envOf(env))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	previous := currentConfig()
+	liveConfig.Store(c)
+	setupServices(c)
+	t.Cleanup(func() { liveConfig.Store(previous) })
+	return c
+}
+
+// localEnv are the settings letting the fetches of a test reach its servers on
+// the loopback, at once and without retries.
+var localEnv = map[string]string{
+	"FETCH_ALLOWED_NETWORKS": "127.0.0.0/8,::1",
+	"HOST_RATE_LIMIT_RPS":    "0",
+	"FETCH_MAX_ATTEMPTS":     "1",
+}
+
+// useLocalConfig is useConfig with localEnv under the settings of env.
+func useLocalConfig(t *testing.T, env map[string]string) *Config {
+	t.Helper()
+	merged := make(map[string]string, len(localEnv)+len(env))
+	for name, value := range localEnv {
+		merged[name] = value
+	}
+	for name, value := range env {
+		merged[name] = value
+	}
+	return useConfig(t, merged)
+}
+
+// trustServers makes the fetches of the test trust the certificates of the
+// TLS servers given.
+func trustServers(t *testing.T, servers ...*httptest.Server) {
+	t.Helper()
+	pool := x509.NewCertPool()
+	for _, server := range servers {
+		pool.AddCert(server.Certificate())
+	}
+	httpClient.Transport.(*http.Transport).TLSClientConfig = &tls.Config{RootCAs: pool}
+}
+
+// writeConfigFile writes a configuration file named name in a directory of
+// the test, returning its path.
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{"json", "config.json", `{
+			"REQUEST_TIMEOUT_SECONDS": 20,
+			"LOG_LEVEL": "debug",
+			"LOG_FORMAT": "json",
+			"API_KEYS": "ci=secret",
+			"API_KEY_LIMITS": "ci=60/minute",
+			"ACCESS_LOG": false,
+			"CACHE_TTL_SECONDS": 30,
+			"FETCH_RETRY_BACKOFF_MS": 50,
+			"LISTEN_ADDR": "127.0.0.1:9090",
+			"LISTEN_SOCKET_MODE": "0600",
+			"CORS_ALLOWED_ORIGINS": "https://app.example.com",
+			"HOST_RATE_LIMITS": "slow.example.com=0.5",
+			"FETCH_ALLOWED_NETWORKS": "10.1.0.0/16",
+			"STORE_BACKEND": "bolt",
+			"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318/"
+		}`},
+		{"yaml", "config.yaml", `# The settings of a deployment
+REQUEST_TIMEOUT_SECONDS: 20
+LOG_LEVEL: debug
+LOG_FORMAT: "json"
+API_KEYS: ci=secret
+API_KEY_LIMITS: ci=60/minute
+ACCESS_LOG: off
+CACHE_TTL_SECONDS: 30 # seconds
+FETCH_RETRY_BACKOFF_MS: 50
+LISTEN_ADDR: 127.0.0.1:9090
+LISTEN_SOCKET_MODE: '0600'
+CORS_ALLOWED_ORIGINS: https://app.example.com
+HOST_RATE_LIMITS: slow.example.com=0.5
+FETCH_ALLOWED_NETWORKS: 10.1.0.0/16
+STORE_BACKEND: bolt
+OTEL_EXPORTER_OTLP_ENDPOINT: http://collector:4318/
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfigFile(t, tt.file, tt.content)
+			c, err := loadConfig(path, envOf(nil))
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+			if unread := c.source.unread(); len(unread) > 0 {
+				t.Errorf("unread settings %v", unread)
+			}
+
+			if c.requestTimeout != 20*time.Second || c.fetchTimeout != 10*time.Second {
+				t.Errorf("timeouts = %s, %s, want 20s and the default 10s", c.requestTimeout, c.fetchTimeout)
+			}
+			if c.logLevel != slog.LevelDebug || c.logFormat != "json" {
+				t.Errorf("logging = %s, %s, want DEBUG, json", c.logLevel, c.logFormat)
+			}
+			if len(c.apiKeys) != 1 || c.apiKeys[0].name != "ci" || c.limitsOf("ci").perMinute != 60 {
+				t.Errorf("API keys = %+v, limits %+v", c.apiKeys, c.keyLimits)
+			}
+			if c.accessLog {
+				t.Error("accessLog = true, want false")
+			}
+			if c.cacheTTL != 30*time.Second || c.fetchRetryBackoff != 50*time.Millisecond {
+				t.Errorf("cacheTTL = %s, fetchRetryBackoff = %s", c.cacheTTL, c.fetchRetryBackoff)
+			}
+			if c.listenAddr != "127.0.0.1:9090" || c.listenSocketMode != 0600 {
+				t.Errorf("listen = %s, %o", c.listenAddr, c.listenSocketMode)
+			}
+			if !corsAllowed(c.corsOrigins, "https://app.example.com") || corsAllowed(c.corsOrigins, "https://other.example.com") {
+				t.Errorf("corsOrigins = %+v", c.corsOrigins)
+			}
+			if rate := c.hostRateOverrides["slow.example.com"]; rate.perSecond != 0.5 || rate.burst != c.hostRate.burst {
+				t.Errorf("override = %+v, want 0.5 with the default burst %d", rate, c.hostRate.burst)
+			}
+			if len(c.fetchAllowedNetworks) != 1 || c.fetchAllowedNetworks[0].String() != "10.1.0.0/16" {
+				t.Errorf("fetchAllowedNetworks = %v", c.fetchAllowedNetworks)
+			}
+			if c.storeBackend != "bolt" || c.storePath != "sitemap-parser.db" {
+				t.Errorf("store = %s at %s", c.storeBackend, c.storePath)
+			}
+			if c.tracing.endpoint != "http://collector:4318/v1/traces" || c.tracing.serviceName != "sitemap-parser" {
+				t.Errorf("tracing = %+v", c.tracing)
+			}
+		})
+	}
+}
+
+func TestLoadConfigEnvOverridesFile(t *testing.T) {
+	path := writeConfigFile(t, "config.json", `{"REQUEST_TIMEOUT_SECONDS": 20, "CACHE_BACKEND": "redis", "MAX_REDIRECTS": 2}`)
+	env := map[string]string{"REQUEST_TIMEOUT_SECONDS": "45", "CACHE_BACKEND": "memory"}
+
+	c, err := loadConfig(path, envOf(env))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if c.requestTimeout != 45*time.Second {
+		t.Errorf("requestTimeout = %s, want the 45s of the environment", c.requestTimeout)
+	}
+	if c.cacheBackend != "memory" {
+		t.Errorf("cacheBackend = %q, want the memory of the environment", c.cacheBackend)
+	}
+	if c.maxRedirects != 2 {
+		t.Errorf("maxRedirects = %d, want the 2 of the file", c.maxRedirects)
+	}
+}
+
+func TestLoadConfigProblems(t *testing.T) {
+	env := map[string]string{
+		"REQUEST_TIMEOUT_SECONDS": "soon",
+		"LOG_FORMAT":              "xml",
+		"LOG_LEVEL":               "loud",
+		"LISTEN_ADDR":             "8080",
+		"LISTEN_SOCKET_MODE":      "rw",
+		"CORS_ALLOWED_ORIGINS":    "app.example.com",
+		"FETCH_ALLOWED_NETWORKS":  "10.0.0.0/33",
+		"TRUSTED_PROXIES":         "10.0.0.1,proxy.internal",
+	}
+	c, err := loadConfig("", envOf(env))
+	if err == nil {
+		t.Fatal("loadConfig succeeded, want the invalid settings reported")
+	}
+	for name := range env {
+		if !strings.Contains(err.Error(), name+": ") {
+			t.Errorf("error %q doesn't report %s", err, name)
+		}
+	}
+	// The invalid settings read as their defaults
+	if c.requestTimeout != 60*time.Second || c.logFormat != "text" {
+		t.Errorf("requestTimeout = %s, logFormat = %q, want the defaults", c.requestTimeout, c.logFormat)
+	}
+}
+
+func TestLoadConfigNetworks(t *testing.T) {
+	for _, name := range []string{"TRUSTED_PROXIES", "FETCH_ALLOWED_NETWORKS"} {
+		t.Run(name, func(t *testing.T) {
+			c, err := loadConfig("", envOf(map[string]string{name: " 10.0.0.1, 192.168.0.0/16,,::1 "}))
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+			networks := map[string][]*net.IPNet{"TRUSTED_PROXIES": c.trustedProxies, "FETCH_ALLOWED_NETWORKS": c.fetchAllowedNetworks}[name]
+			var got []string
+			for _, network := range networks {
+				got = append(got, network.String())
+			}
+			if want := "10.0.0.1/32 192.168.0.0/16 ::1/128"; strings.Join(got, " ") != want {
+				t.Errorf("networks = %v, want %s", got, want)
+			}
+
+			_, err = loadConfig("", envOf(map[string]string{name: "10.0.0.1,10.0.0.0/8/8"}))
+			if err == nil || !strings.Contains(err.Error(), name+`: "10.0.0.0/8/8" isn't an address or CIDR range`) {
+				t.Errorf("loadConfig error = %v, want the invalid entry of %s reported", err, name)
+			}
+		})
+	}
+}
+
+func TestLoadConfigInvalidFile(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", "CACHE:\n  TTL: 30\n")
+	if _, err := loadConfig(path, envOf(nil)); err == nil || !strings.Contains(err.Error(), "CONFIG_FILE: ") {
+		t.Errorf("loadConfig error = %v, want the file reported", err)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// corsAllowedHeaders are the request headers cross-origin requests may carry.
+var corsAllowedHeaders = strings.Join([]string{"Authorization", "Content-Type", "Accept", apiKeyHeader, "Idempotency-Key", requestIDHeader}, ", ")
+
+// corsExposedHeaders are the response headers browsers let cross-origin
+// clients read, next to the ones they always do.
+var corsExposedHeaders = strings.Join([]string{requestIDHeader, "Retry-After", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "Idempotent-Replayed", "Deprecation", "Link", "ETag"}, ", ")
+
+// corsOrigin is an allowed origin: an exact one, or with a wildcard the
+// subdomains of the origin of suffix.
+type corsOrigin struct {
+	exact  string
+	scheme string
+	suffix string
+	any    bool
+}
+
+// parseCORSOrigins parses comma separated origins, exact, as a pattern of
+// subdomains or *, recording the invalid ones as problems of s.
+func parseCORSOrigins(s *configSource, value string) []corsOrigin {
+	var origins []corsOrigin
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			origins = append(origins, corsOrigin{any: true})
+			continue
+		}
+		scheme, host, ok := strings.Cut(entry, "://")
+		if !ok || (scheme != "http" && scheme != "https") || host == "" || strings.ContainsAny(host, "/?#@ ") {
+			s.problem("CORS_ALLOWED_ORIGINS", "%q isn't an origin such as https://app.example.com", entry)
+			continue
+		}
+		if rest, wildcard := strings.CutPrefix(host, "*."); wildcard {
+			if rest == "" || strings.Contains(rest, "*") {
+				s.problem("CORS_ALLOWED_ORIGINS", "%q isn't a pattern such as https://*.example.com", entry)
+				continue
+			}
+			origins = append(origins, corsOrigin{scheme: scheme, suffix: "." + rest})
+			continue
+		}
+		if strings.Contains(host, "*") {
+			s.problem("CORS_ALLOWED_ORIGINS", "%q may only start with a wildcard, as in https://*.example.com", entry)
+			continue
+		}
+		origins = append(origins, corsOrigin{exact: entry})
+	}
+	return origins
+}
+
+// matches reports whether origin, lowercased, is allowed by o.
+func (o corsOrigin) matches(origin string) bool {
+	switch {
+	case o.any:
+		return true
+	case o.exact != "":
+		return origin == o.exact
+	}
+	host, ok := strings.CutPrefix(origin, o.scheme+"://")
+	return ok && len(host) > len(o.suffix) && strings.HasSuffix(host, o.suffix) && !strings.ContainsAny(host, "/?#@")
+}
+
+// corsAllowed reports whether browsers calling from origin may read the
+// responses of the API, allowed to corsOrigins.
+func corsAllowed(corsOrigins []corsOrigin, origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range corsOrigins {
+		if allowed.matches(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowCORS returns the middleware letting the browser clients of the allowed
+// origins call the endpoints of rt. Their responses echo the origin in
+// Access-Control-Allow-Origin, and their preflight OPTIONS requests are
+// answered here, before any API key is asked for, with the methods of the
+// endpoint. Without allowed origins, responses carry no CORS headers.
+func allowCORS(rt *router) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			config := configFrom(r.Context())
+			if len(config.corsOrigins) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Add("Vary", "Origin")
+			origin := r.Header.Get("Origin")
+			if origin == "" || !corsAllowed(config.corsOrigins, origin) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			header := w.Header()
+			header.Set("Access-Control-Allow-Origin", origin)
+			if config.corsAllowCredentials {
+				header.Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			endpoint, known := rt.lookup(r.URL.Path)
+			if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" || !known {
+				header.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+				next.ServeHTTP(w, r)
+				return
+			}
+			header.Add("Vary", "Access-Control-Request-Method")
+			header.Add("Vary", "Access-Control-Request-Headers")
+			header.Set("Access-Control-Allow-Methods", strings.Join(endpoint.allowed(), ", "))
+			header.Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+			header.Set("Access-Control-Max-Age", strconv.Itoa(config.corsMaxAge))
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
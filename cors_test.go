@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCORSOrigins(t *testing.T) {
+	useConfig(t, map[string]string{"CORS_ALLOWED_ORIGINS": "https://app.example.com, https://*.example.org"})
+	origins := currentConfig().corsOrigins
+	for origin, allowed := range map[string]bool{
+		"https://app.example.com":      true,
+		"HTTPS://App.Example.com":      true,
+		"http://app.example.com":       false,
+		"https://app.example.com:8443": false,
+		"https://evil.example.com":     false,
+		"https://a.example.org":        true,
+		"https://a.b.example.org":      true,
+		"https://example.org":          false,
+		"https://evilexample.org":      false,
+		"http://a.example.org":         false,
+		"https://a.example.org.evil":   false,
+		"null":                         false,
+	} {
+		if got := corsAllowed(origins, origin); got != allowed {
+			t.Errorf("corsAllowed(%q) = %v, want %v", origin, got, allowed)
+		}
+	}
+}
+
+func TestCORSCredentialsWithAnyOrigin(t *testing.T) {
+	_, err := loadConfig("", envOf(map[string]string{"CORS_ALLOWED_ORIGINS": "*", "CORS_ALLOW_CREDENTIALS": "1"}))
+	if err == nil || !strings.Contains(err.Error(), "CORS_ALLOW_CREDENTIALS: ") {
+		t.Errorf("loadConfig = %v, want credentials for any origin refused", err)
+	}
+	if _, err := loadConfig("", envOf(map[string]string{"CORS_ALLOWED_ORIGINS": "https://app.example.com", "CORS_ALLOW_CREDENTIALS": "1"})); err != nil {
+		t.Errorf("loadConfig = %v, want credentials allowed to a listed origin", err)
+	}
+}
+
+func TestAllowCORS(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       map[string]string
+		method    string
+		path      string
+		origin    string
+		preflight bool
+		status    int
+		headers   map[string]string
+	}{
+		{
+			name:   "off",
+			env:    map[string]string{},
+			method: http.MethodGet, path: "/v1/ping", origin: "https://app.example.com",
+			status:  http.StatusOK,
+			headers: map[string]string{"Access-Control-Allow-Origin": "", "Access-Control-Expose-Headers": ""},
+		},
+		{
+			name:   "allowed origin",
+			env:    map[string]string{"CORS_ALLOWED_ORIGINS": "https://app.example.com", "CORS_ALLOW_CREDENTIALS": "1"},
+			method: http.MethodGet, path: "/v1/ping", origin: "https://app.example.com",
+			status: http.StatusOK,
+			headers: map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example.com",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Expose-Headers":    corsExposedHeaders,
+				"Vary":                             "Origin",
+			},
+		},
+		{
+			name:   "other origin",
+			env:    map[string]string{"CORS_ALLOWED_ORIGINS": "https://app.example.com"},
+			method: http.MethodGet, path: "/v1/ping", origin: "https://evil.example.com",
+			status:  http.StatusOK,
+			headers: map[string]string{"Access-Control-Allow-Origin": "", "Vary": "Origin"},
+		},
+		{
+			name:   "any origin",
+			env:    map[string]string{"CORS_ALLOWED_ORIGINS": "*"},
+			method: http.MethodGet, path: "/v1/ping", origin: "https://anywhere.example.net",
+			status:  http.StatusOK,
+			headers: map[string]string{"Access-Control-Allow-Origin": "https://anywhere.example.net", "Access-Control-Allow-Credentials": ""},
+		},
+		{
+			name:   "preflight",
+			env:    map[string]string{"CORS_ALLOWED_ORIGINS": "https://*.example.com", "CORS_MAX_AGE_SECONDS": "120"},
+			method: http.MethodOptions, path: "/v1/sitemap", origin: "https://dashboard.example.com", preflight: true,
+			status: http.StatusNoContent,
+			headers: map[string]string{
+				"Access-Control-Allow-Origin":  "https://dashboard.example.com",
+				"Access-Control-Allow-Methods": "GET, POST, OPTIONS",
+				"Access-Control-Allow-Headers": corsAllowedHeaders,
+				"Access-Control-Max-Age":       "120",
+			},
+		},
+		{
+			name:   "preflight of another origin",
+			env:    map[string]string{"CORS_ALLOWED_ORIGINS": "https://*.example.com"},
+			method: http.MethodOptions, path: "/v1/sitemap", origin: "https://example.com", preflight: true,
+			status:  http.StatusNoContent,
+			headers: map[string]string{"Access-Control-Allow-Origin": "", "Access-Control-Allow-Methods": ""},
+		},
+		{
+			name:   "preflight of an unknown path",
+			env:    map[string]string{"CORS_ALLOWED_ORIGINS": "https://app.example.com"},
+			method: http.MethodOptions, path: "/v1/nothing", origin: "https://app.example.com", preflight: true,
+			status:  http.StatusNotFound,
+			headers: map[string]string{"Access-Control-Allow-Methods": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.env["ACCESS_LOG"] = "0"
+			useLocalConfig(t, tt.env)
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			r.Header.Set("Origin", tt.origin)
+			if tt.preflight {
+				r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			}
+			w := serve(r)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			for name, want := range tt.headers {
+				if got := strings.Join(w.Header().Values(name), ", "); !strings.HasPrefix(got, want) || want == "" && got != "" {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
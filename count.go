@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+)
+
+// countResponse is the response of the count endpoint.
+type countResponse struct {
+	Count     int  `json:"count"`
+	Sitemaps  int  `json:"sitemaps"`
+	Truncated bool `json:"truncated"`
+}
+
+// handleCountEndpoint counts the URLs of a sitemap or domain.
+//
+// It expects a GET request with either the 'url' or the 'domain' query
+// parameter, and walks the sitemap with the server defaults and limits. Only
+// the number of URLs and of sitemaps walked is returned. When a limit or the time
+// budget cut the walk short, or a child sitemap failed, the count covers what
+// was read and 'truncated' is set. The walk is cached like the ones of
+// /sitemap and /domain, so polling the count doesn't walk the site again.
+func handleCountEndpoint(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	requestType := "sitemap"
+	switch {
+	case query.Get(queryParamSitemap) != "" && query.Get(queryParamDomain) != "":
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, "Only one of the 'url' and 'domain' query parameters may be set", nil)
+		return
+	case query.Get(queryParamDomain) != "":
+		requestType = "domain"
+	case query.Get(queryParamSitemap) == "":
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, "Missing 'url' or 'domain' query parameter", nil)
+		return
+	}
+
+	requestID(w, r)
+
+	response, err := processRequest(r.Context(), requestType, payloadFromQuery(query, requestType).walkOnly())
+	if err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	// The root sitemap is walked along with every child that was followed
+	writeCacheableJSON(w, r, countResponse{
+		Count:     len(response.URLs),
+		Sitemaps:  1 + len(response.Sitemaps),
+		Truncated: response.Truncated || response.Partial,
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCountSharesTheCache(t *testing.T) {
+	useLocalConfig(t, map[string]string{"ACCESS_LOG": "0"})
+	captureLogs(t)
+	documents := map[string]string{
+		"/index.xml": sitemapIndex("/a.xml", "/b.xml"),
+		"/a.xml":     urlSet("https://example.com/a1", "https://example.com/a2"),
+		"/b.xml":     urlSet("https://example.com/b1"),
+	}
+	var fetches int32
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		fmt.Fprint(w, strings.ReplaceAll(documents[r.URL.Path], "{base}", server.URL))
+	}))
+	defer server.Close()
+
+	count := func() countResponse {
+		t.Helper()
+		w := serve(httptest.NewRequest(http.MethodGet, "/v1/count?url="+server.URL+"/index.xml", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", w.Code, w.Body)
+		}
+		var response countResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	if response := count(); response.Count != 3 || response.Sitemaps != 3 || response.Truncated {
+		t.Errorf("count = %+v, want 3 URLs from 3 sitemaps", response)
+	}
+	walked := atomic.LoadInt32(&fetches)
+	if walked != 3 {
+		t.Errorf("the first count fetched %d documents, want 3", walked)
+	}
+	if response := count(); response.Count != 3 || response.Sitemaps != 3 {
+		t.Errorf("count = %+v from the cache, want the same count", response)
+	}
+	if n := atomic.LoadInt32(&fetches); n != walked {
+		t.Errorf("the second count fetched %d documents, want none", n-walked)
+	}
+}
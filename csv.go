@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// csvColumns is the header row of CSV exports.
+var csvColumns = []string{"loc", "lastmod", "changefreq", "priority", "source_sitemap"}
+
+// csvExporter writes the URLs as CSV rows, flushing after each sitemap. It is
+// safe for concurrent use.
+type csvExporter struct {
+	exportStream
+	writer   *csv.Writer
+	filename string
+}
+
+// newCSVExporter returns an exporter of CSV to w, suggesting the given file name
+// for the download.
+func newCSVExporter(w http.ResponseWriter, filename string) *csvExporter {
+	return &csvExporter{exportStream: exportStream{w: w}, writer: csv.NewWriter(w), filename: filename}
+}
+
+// begin writes the response header and the header row on the first call. The
+// caller holds mu.
+func (c *csvExporter) begin() {
+	c.w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", c.filename))
+	if c.start("text/csv; charset=utf-8") {
+		c.writer.Write(csvColumns)
+	}
+}
+
+// writeURLs writes a row for each URL. Missing metadata is left blank.
+func (c *csvExporter) writeURLs(sitemap string, urls []SitemapURL) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.begin()
+	for _, u := range urls {
+		c.writer.Write([]string{
+			strings.TrimSpace(u.Loc),
+			strings.TrimSpace(u.Lastmod),
+			strings.TrimSpace(u.Changefreq),
+			strings.TrimSpace(u.Priority),
+			sitemap,
+		})
+	}
+	c.writer.Flush()
+	c.flush()
+}
+
+// writeSummary ends the export. CSV has no room for the rest of the response, so
+// only the header row is written when no URL was found.
+func (c *csvExporter) writeSummary(response *sitemapResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.begin()
+	c.writer.Flush()
+	c.flush()
+}
+
+// writeError ends an export that has already started. The rows written so far
+// are kept as they are, since CSV has no way to carry the error.
+func (c *csvExporter) writeError(err *requestError) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writer.Flush()
+	c.flush()
+}
+
+// csvFilename returns the download file name of a CSV export, derived from the
+// host of the requested domain or sitemap.
+func csvFilename(value string) string {
+	host := extractDomain(value)
+	if host == "" {
+		return "sitemap.csv"
+	}
+
+	// Keep the name safe for any file system
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, host)
+	return name + "-sitemap.csv"
+}
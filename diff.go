@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// diffPayload represents the JSON payload accepted by the diff endpoint. It
+// accepts the walk and filter options of the sitemap endpoint, applied to both
+// sides.
+type diffPayload struct {
+	requestPayload
+	A          string `json:"a"`
+	B          string `json:"b"`
+	IgnoreHost bool   `json:"ignoreHost"`
+	Limit      *int   `json:"limit"`
+}
+
+// diffResponse is the response of the diff endpoint.
+type diffResponse struct {
+	Type       string    `json:"type"`
+	A          *diffSide `json:"a"`
+	B          *diffSide `json:"b"`
+	IgnoreHost bool      `json:"ignoreHost"`
+	OnlyInA    diffList  `json:"onlyInA"`
+	OnlyInB    diffList  `json:"onlyInB"`
+	InBoth     diffList  `json:"inBoth"`
+	Partial    bool      `json:"partial"`
+}
+
+// diffSide describes the walk of one of the compared sitemaps.
+type diffSide struct {
+	Sitemap   string         `json:"sitemap"`
+	URLs      int            `json:"urls"`
+	Errors    []sitemapError `json:"errors"`
+	Partial   bool           `json:"partial"`
+	Truncated bool           `json:"truncated"`
+	Error     string         `json:"error,omitempty"`
+	Code      string         `json:"code,omitempty"`
+
+	// keys maps the comparison key of each URL to the URL.
+	keys map[string]string
+}
+
+// diffList is one of the lists of a /diff response.
+type diffList struct {
+	Count     int      `json:"count"`
+	URLs      []string `json:"urls"`
+	Truncated bool     `json:"truncated"`
+}
+
+// diffKey returns the form of a URL compared by the diff: its normalized form,
+// or only its path and query string when hosts are ignored.
+func diffKey(loc string, ignoreHost bool) string {
+	normalized := normalizeURL(loc)
+	if !ignoreHost {
+		return normalized
+	}
+	u, err := url.Parse(normalized)
+	if err != nil {
+		return normalized
+	}
+	return u.RequestURI()
+}
+
+// walkDiffSide walks one of the compared sitemaps. A failure is reported in the
+// side rather than returned, so the other side still gets compared.
+func walkDiffSide(r *http.Request, sitemap string, payload requestPayload, ignoreHost bool) *diffSide {
+	side := &diffSide{Sitemap: sitemap, Errors: []sitemapError{}, keys: make(map[string]string)}
+
+	payload.Sitemap = sitemap
+	response, err := processRequest(r.Context(), "sitemap", payload)
+	if err != nil {
+		reqErr := asRequestError(err)
+		side.Error = reqErr.Message
+		side.Code = reqErr.Code
+		side.Partial = true
+		return side
+	}
+
+	for _, loc := range response.URLs {
+		key := diffKey(loc, ignoreHost)
+		if _, ok := side.keys[key]; !ok {
+			side.keys[key] = loc
+		}
+	}
+	side.URLs = len(side.keys)
+	side.Errors = response.Errors
+	side.Partial = response.Partial
+	side.Truncated = response.Truncated
+	return side
+}
+
+// newDiffList returns the sorted list of the URLs, capped to limit.
+func newDiffList(urls []string, limit int) diffList {
+	sort.Strings(urls)
+	list := diffList{Count: len(urls), URLs: urls}
+	if len(urls) > limit {
+		list.URLs = urls[:limit]
+		list.Truncated = true
+	}
+	return list
+}
+
+// handleDiffEndpoint compares the URLs of two sitemaps.
+//
+// It expects a POST request with a JSON payload containing the 'a' and 'b'
+// sitemap URLs. Both are walked in parallel with the usual limits, and the
+// response lists the URLs only in A, only in B and in both, compared in their
+// normalized forms. A side that fails is reported in its own entry and the
+// diff is marked partial.
+func handleDiffEndpoint(w http.ResponseWriter, r *http.Request) {
+	// Decompress a gzip request body and check it is JSON before decoding it
+	if err := prepareJSONBody(w, r); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	// Decode the JSON payload
+	var payload diffPayload
+	if err := decodeJSONBody(r, &payload); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+	if payload.A == "" || payload.B == "" {
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, "Missing 'a' or 'b' field in JSON payload", nil)
+		return
+	}
+	applyCacheControl(r, &payload.requestPayload)
+
+	requestID(w, r)
+
+	maxDiffListSize := configFrom(r.Context()).maxDiffListSize
+	limit := maxDiffListSize
+	if payload.Limit != nil {
+		if *payload.Limit < 0 || *payload.Limit > maxDiffListSize {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Invalid 'limit': must be between 0 and %d", maxDiffListSize), nil)
+			return
+		}
+		limit = *payload.Limit
+	}
+
+	// Reject bad walk options once rather than on each side
+	if _, err := payload.walkOptions(configFrom(r.Context())); err != nil {
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error(), nil)
+		return
+	}
+
+	// Walk both sides in parallel
+	walk := payload.walkOnly()
+	var a, b *diffSide
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		a = walkDiffSide(r, payload.A, walk, payload.IgnoreHost)
+	}()
+	go func() {
+		defer wg.Done()
+		b = walkDiffSide(r, payload.B, walk, payload.IgnoreHost)
+	}()
+	wg.Wait()
+
+	// Compare the sides by key, listing the URLs as found in A for both
+	onlyInA, onlyInB, inBoth := []string{}, []string{}, []string{}
+	for key, loc := range a.keys {
+		if _, ok := b.keys[key]; ok {
+			inBoth = append(inBoth, loc)
+		} else {
+			onlyInA = append(onlyInA, loc)
+		}
+	}
+	for key, loc := range b.keys {
+		if _, ok := a.keys[key]; !ok {
+			onlyInB = append(onlyInB, loc)
+		}
+	}
+
+	response := diffResponse{
+		Type:       "diff",
+		A:          a,
+		B:          b,
+		IgnoreHost: payload.IgnoreHost,
+		OnlyInA:    newDiffList(onlyInA, limit),
+		OnlyInB:    newDiffList(onlyInB, limit),
+		InBoth:     newDiffList(inBoth, limit),
+		Partial:    a.Partial || b.Partial || a.Truncated || b.Truncated,
+	}
+
+	writeCacheableJSON(w, r, response)
+}
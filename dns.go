@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dnsEntry is the outcome of resolving a host. ready is closed once the lookup
+// is done, so concurrent dials of the host wait for a single lookup.
+type dnsEntry struct {
+	ready   chan struct{}
+	addrs   []string
+	err     error
+	expires time.Time
+}
+
+// dnsCache memoizes the addresses of hosts for the dials of outbound fetches.
+// Hosts that don't exist are remembered too, but not failed lookups. It is safe
+// for concurrent use.
+type dnsCache struct {
+	resolver *net.Resolver
+	dialer   *net.Dialer
+	// ttl is how long the addresses of a host are reused, and negativeTTL how
+	// long a host found not to exist stays so.
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+
+	hits   int64
+	misses int64
+}
+
+// resolver is the DNS cache of outbound fetches, set up by setupServices.
+var resolver *dnsCache
+
+// newDNSCache returns the DNS cache configured by c, whose dials are guarded
+// by guardDial.
+func newDNSCache(c *Config) *dnsCache {
+	return &dnsCache{
+		resolver:    net.DefaultResolver,
+		dialer:      newFetchDialer(c),
+		ttl:         c.dnsCacheTTL,
+		negativeTTL: c.dnsNegativeTTL,
+		entries:     make(map[string]*dnsEntry),
+	}
+}
+
+// lookup returns the addresses of host, from the cache when they are known.
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	if ok {
+		select {
+		case <-entry.ready:
+			if time.Now().After(entry.expires) {
+				ok = false
+			}
+		default:
+			// Another dial is resolving the host
+		}
+	}
+	if ok {
+		c.mu.Unlock()
+		atomic.AddInt64(&c.hits, 1)
+		select {
+		case <-entry.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return entry.addrs, entry.err
+	}
+	entry = &dnsEntry{ready: make(chan struct{})}
+	c.entries[host] = entry
+	c.mu.Unlock()
+	atomic.AddInt64(&c.misses, 1)
+
+	// The lookup outlives the dial that started it, as others may wait for it
+	lookupCtx, cancel := context.WithTimeout(context.Background(), c.dialer.Timeout)
+	addrs, err := c.resolver.LookupHost(lookupCtx, host)
+	cancel()
+	entry.addrs, entry.err = addrs, err
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil:
+		entry.expires = time.Now().Add(c.ttl)
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		entry.expires = time.Now().Add(c.negativeTTL)
+	default:
+		// Don't remember a lookup that failed for another reason
+		c.mu.Lock()
+		if c.entries[host] == entry {
+			delete(c.entries, host)
+		}
+		c.mu.Unlock()
+	}
+	close(entry.ready)
+	return addrs, err
+}
+
+// dialContext dials addr through the cached addresses of its host, trying them
+// in turn. It is the DialContext of the transport of outbound fetches.
+func (c *dnsCache) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return c.dialer.DialContext(ctx, network, addr)
+	}
+
+	// The lookup is timed as the DNS phase of the fetch, hit or not
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.DNSStart != nil {
+		trace.DNSStart(httptrace.DNSStartInfo{Host: host})
+	}
+	addrs, err := c.lookup(ctx, host)
+	if trace != nil && trace.DNSDone != nil {
+		trace.DNSDone(httptrace.DNSDoneInfo{Err: err})
+	}
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	for _, ip := range addrs {
+		var conn net.Conn
+		if conn, err = c.dialer.DialContext(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+			return conn, nil
+		}
+	}
+	if err == nil {
+		err = &net.OpError{Op: "dial", Net: network, Err: &net.DNSError{Err: "no addresses", Name: host}}
+	}
+	return nil, err
+}
+
+// sweep drops the hosts expired at now, returning how many were dropped.
+func (c *dnsCache) sweep(now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	for host, entry := range c.entries {
+		select {
+		case <-entry.ready:
+			if now.After(entry.expires) {
+				delete(c.entries, host)
+				removed++
+			}
+		default:
+		}
+	}
+	return removed
+}
+
+// forget drops the addresses of host, or of every host when host is empty,
+// returning how many were dropped, so hosts found not to exist are looked up
+// again.
+func (c *dnsCache) forget(host string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	for name := range c.entries {
+		if host == "" || name == host {
+			delete(c.entries, name)
+			removed++
+		}
+	}
+	return removed
+}
+
+// usage returns the number of hosts cached, and the hits and misses of lookups
+// so far.
+func (c *dnsCache) usage() (entries int, hits, misses int64) {
+	c.mu.Lock()
+	entries = len(c.entries)
+	c.mu.Unlock()
+	return entries, atomic.LoadInt64(&c.hits), atomic.LoadInt64(&c.misses)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// jsonFlushEvery is the number of URLs written between two flushes of a
+// streamed URL list, so clients get the first ones before the last are encoded.
+const jsonFlushEvery = 1000
+
+// streamedJSON is implemented by the responses whose largest part is encoded
+// as it is written, rather than held in memory whole.
+type streamedJSON interface {
+	encodeJSON(w io.Writer) error
+}
+
+// encodeJSON writes the JSON encoding of response to w, followed by a newline,
+// as a json.Encoder does.
+func encodeJSON(w io.Writer, response interface{}) error {
+	if s, ok := response.(streamedJSON); ok {
+		return s.encodeJSON(w)
+	}
+	return json.NewEncoder(w).Encode(response)
+}
+
+// sitemapResponseHead holds the fields of a sitemapResponse written before its
+// URLs.
+type sitemapResponseHead struct {
+	Type       string            `json:"type"`
+	Format     string            `json:"format,omitempty"`
+	SitemapURL string            `json:"sitemapUrl,omitempty"`
+	Discovery  *sitemapDiscovery `json:"discovery,omitempty"`
+}
+
+// sitemapResponseTail holds the fields of a sitemapResponse written after its
+// URLs.
+type sitemapResponseTail struct {
+	*walkSummary
+	*urlChanges
+	*resultPage
+
+	Debug *fetchTimings `json:"debug,omitempty"`
+}
+
+// encodeJSON writes the response as json.Marshal would, with its URLs encoded
+// one at a time as they are written, and flushed every jsonFlushEvery when w
+// is an http.Flusher. Everything else is encoded before the first byte is
+// written, so only a failing w can cut it short.
+func (r sitemapResponse) encodeJSON(w io.Writer) error {
+	head, err := json.Marshal(sitemapResponseHead{Type: r.Type, Format: r.Format, SitemapURL: r.SitemapURL, Discovery: r.Discovery})
+	if err != nil {
+		return err
+	}
+	tail, err := json.Marshal(sitemapResponseTail{r.walkSummary, r.urlChanges, r.resultPage, r.Debug})
+	if err != nil {
+		return err
+	}
+
+	flusher, _ := w.(http.Flusher)
+	out := bufio.NewWriterSize(w, 32*1024)
+	out.Write(head[:len(head)-1])
+	out.WriteString(`,"urls":`)
+	if r.URLs == nil {
+		out.WriteString("null")
+	} else {
+		out.WriteByte('[')
+		for i, loc := range r.URLs {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			encoded, err := json.Marshal(loc)
+			if err != nil {
+				return err
+			}
+			out.Write(encoded)
+			if (i+1)%jsonFlushEvery == 0 {
+				if err := out.Flush(); err != nil {
+					return err
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+		}
+		out.WriteByte(']')
+	}
+	if len(tail) > 2 {
+		out.WriteByte(',')
+		out.Write(tail[1:])
+	} else {
+		out.WriteByte('}')
+	}
+	out.WriteByte('\n')
+	return out.Flush()
+}
+
+// responseWriter tells whether anything was written to w, past which the
+// status of the reply is sent and can't be changed anymore.
+type responseWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	w.started = true
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush sends what was written so far to the client.
+func (w *responseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// halfEncoded is a response whose encoding fails once its start went out.
+type halfEncoded struct{}
+
+const halfEncodedStart = `{"type":"sitemap","urls":["https://example.com/a",`
+
+func (halfEncoded) encodeJSON(w io.Writer) error {
+	io.WriteString(w, halfEncodedStart)
+	w.(http.Flusher).Flush()
+	return errors.New("encoder failed")
+}
+
+// failingWriter is a ResponseWriter failing every write past its first limit
+// bytes.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+	limit int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		n, _ := w.ResponseRecorder.Write(p[:w.limit])
+		w.limit = 0
+		return n, errors.New("connection reset")
+	}
+	w.limit -= len(p)
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestWriteJSONAbortsWhenTheEncoderFails(t *testing.T) {
+	useLocalConfig(t, map[string]string{"ACCESS_LOG": "0"})
+	captureLogs(t)
+	routes := newRouter()
+	routes.handle("/half", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, halfEncoded{})
+	}, http.MethodGet)
+	routes.use(recoverPanics)
+	server := httptest.NewServer(routes.handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/half")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err == nil {
+		t.Errorf("read the whole reply %q, want the connection aborted", body)
+	}
+	if string(body) != halfEncodedStart {
+		t.Errorf("body = %q, want the start written %q", body, halfEncodedStart)
+	}
+	if json.Valid(body) {
+		t.Errorf("body = %q, want it cut short", body)
+	}
+}
+
+func TestWriteJSONAbortsWhenTheWriterFails(t *testing.T) {
+	captureLogs(t)
+	urls := make([]string, 5*jsonFlushEvery)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("https://example.com/%d", i)
+	}
+	w := &failingWriter{ResponseRecorder: httptest.NewRecorder(), limit: 1024}
+
+	defer func() {
+		if recovered := recover(); recovered != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler", recovered)
+		}
+		if w.Body.Len() != 1024 || json.Valid(w.Body.Bytes()) {
+			t.Errorf("wrote %d bytes, want the 1024 the writer took, cut short", w.Body.Len())
+		}
+	}()
+	writeJSON(w, sitemapResponse{Type: "sitemap", URLs: urls, walkSummary: &walkSummary{}})
+	t.Error("writeJSON returned after the writer failed")
+}
+
+func TestWriteJSONFailsBeforeWriting(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeJSON(w, map[string]interface{}{"unencodable": make(chan int)})
+
+	assertErrorCode(t, w, http.StatusInternalServerError, errCodeInternal)
+	if strings.Contains(w.Body.String(), "unencodable") {
+		t.Errorf("body = %s, want only the error envelope", w.Body)
+	}
+}
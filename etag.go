@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// canonicalResponse is implemented by the responses holding fields that differ
+// between two answers of the same result, such as durations.
+type canonicalResponse interface {
+	// canonical returns the response with those fields cleared.
+	canonical() interface{}
+}
+
+// canonical returns the meta with what describes the request rather than the
+// result cleared: its duration, and how much was fetched or served from the
+// cache to answer it.
+func (m responseMeta) canonical() responseMeta {
+	m.DurationMs = 0
+	m.SitemapsFetched, m.FetchErrors, m.NotModified, m.Retries, m.BytesDownloaded = 0, 0, 0, 0, 0
+	m.CrawlDelaySeconds = 0
+	m.Cached, m.CacheAgeSeconds, m.Refreshed = false, 0, false
+	return m
+}
+
+func (r sitemapResponse) canonical() interface{} {
+	if r.walkSummary != nil {
+		summary := *r.walkSummary
+		summary.Meta = summary.Meta.canonical()
+		r.walkSummary = &summary
+	}
+	r.Debug = nil
+	return r
+}
+
+func (r statsResponse) canonical() interface{} {
+	r.Meta = r.Meta.canonical()
+	return r
+}
+
+func (r batchResponse) canonical() interface{} {
+	r.Meta.DurationMs = 0
+	results := make([]batchResult, len(r.Results))
+	for i, result := range r.Results {
+		result.DurationMs = 0
+		if result.Result != nil {
+			canonical := result.Result.canonical().(sitemapResponse)
+			result.Result = &canonical
+		}
+		results[i] = result
+	}
+	r.Results = results
+	return r
+}
+
+// responseETag returns the strong ETag of a response: the hash of its JSON
+// encoding, once canonical, which is hashed as it is encoded. A response
+// without fields to clear is its own canonical form, so its encoding is
+// returned too, to be written without encoding the response again. The
+// others are encoded anew when written, streamed.
+func responseETag(response interface{}) (etag string, body []byte, err error) {
+	hash := sha256.New()
+	if c, ok := response.(canonicalResponse); ok {
+		err = encodeJSON(hash, c.canonical())
+	} else {
+		var encoded bytes.Buffer
+		err = encodeJSON(io.MultiWriter(hash, &encoded), response)
+		body = encoded.Bytes()
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`, body, nil
+}
+
+// etagMatches reports whether the If-None-Match header lists etag, comparing
+// the tags weakly as the header requires.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeCacheableJSON writes the response like writeJSON, with its ETag and a
+// Cache-Control header. A request whose If-None-Match lists the ETag is
+// answered with a 304 and no body.
+func writeCacheableJSON(w http.ResponseWriter, r *http.Request, response interface{}) {
+	etag, body, err := responseETag(response)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, errCodeInternal, "Failed to create JSON response", nil)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	if responseMaxAge := configFrom(r.Context()).responseMaxAge; responseMaxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", responseMaxAge))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if body == nil {
+		writeJSON(w, response)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// clearCacheHeaders drops the caching headers a reply may have been given
+// before failing, and forbids storing it.
+func clearCacheHeaders(w http.ResponseWriter) {
+	w.Header().Del("ETag")
+	w.Header().Set("Cache-Control", "no-store")
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// countedResponse counts how many times it is encoded.
+type countedResponse struct {
+	encodings *int
+}
+
+func (r countedResponse) MarshalJSON() ([]byte, error) {
+	*r.encodings++
+	return []byte(`{"type":"counted"}`), nil
+}
+
+func TestWriteCacheableJSONEncodesOnce(t *testing.T) {
+	useConfig(t, nil)
+	encodings := 0
+	response := countedResponse{&encodings}
+
+	w := httptest.NewRecorder()
+	writeCacheableJSON(w, httptest.NewRequest(http.MethodGet, "/v1/count", nil), response)
+	if encodings != 1 {
+		t.Errorf("response encoded %d times, want once for its ETag and body", encodings)
+	}
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || w.Body.String() != "{\"type\":\"counted\"}\n" || etag == "" {
+		t.Fatalf("response = %d %q with ETag %q", w.Code, w.Body, etag)
+	}
+	if w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Content-Type = %q", w.Header().Get("Content-Type"))
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/count", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	writeCacheableJSON(w, r, response)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 || w.Header().Get("ETag") != etag {
+		t.Errorf("revalidation = %d %q with ETag %q, want a 304 with the same ETag", w.Code, w.Body, w.Header().Get("ETag"))
+	}
+}
+
+func TestResponseETagIgnoresDurations(t *testing.T) {
+	fast := statsResponse{Meta: responseMeta{DurationMs: 3}}
+	slow := statsResponse{Meta: responseMeta{DurationMs: 300, Cached: true}}
+	fastTag, _, err := responseETag(fast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slowTag, _, err := responseETag(slow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fastTag != slowTag {
+		t.Errorf("ETags %s and %s differ for the same result", fastTag, slowTag)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+)
+
+// urlExporter writes the URLs of a request while they are parsed, in a format
+// other than the JSON envelope.
+type urlExporter interface {
+	// writeURLs writes the URL entries of a parsed sitemap.
+	writeURLs(sitemap string, urls []SitemapURL)
+	// writeSummary ends the output with the rest of the response.
+	writeSummary(response *sitemapResponse)
+	// writeError ends output that has already started with an error.
+	writeError(err *requestError)
+	// hasStarted reports whether anything has been written yet.
+	hasStarted() bool
+}
+
+// exportStream holds the response of an exporter. The response header is only
+// written with the first output, so a request failing before anything was
+// produced can still reply with a regular error.
+type exportStream struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	started bool
+}
+
+// start writes the response header with the given content type, unless it was
+// already written. It reports whether it wrote it. The caller holds mu.
+func (s *exportStream) start(contentType string) bool {
+	if s.started {
+		return false
+	}
+	s.w.Header().Set("Content-Type", contentType)
+	s.w.WriteHeader(http.StatusOK)
+	s.started = true
+	return true
+}
+
+// flush sends what has been written so far to the client.
+func (s *exportStream) flush() {
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// hasStarted reports whether the response header has been written yet.
+func (s *exportStream) hasStarted() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.started
+}
+
+// handleExportRequest processes a domain or sitemap request and hands its URLs
+// to the exporter while they are parsed, so memory stays flat on huge sitemaps.
+func handleExportRequest(w http.ResponseWriter, r *http.Request, requestType string, payload requestPayload, id string, out urlExporter) {
+	payload.onURLs = out.writeURLs
+
+	response, err := processRequest(r.Context(), requestType, payload)
+	if err != nil {
+		reqErr := asRequestError(err)
+		if payload.CallbackURL != "" {
+			sendCallback(r.Context(), payload.CallbackURL, callbackBody{RequestID: id, Status: reqErr.Status, Error: reqErr.Message, Code: reqErr.Code})
+		}
+		// Once output went out the status can't change, so end with the error instead
+		if out.hasStarted() {
+			out.writeError(reqErr)
+			return
+		}
+		writeError(w, payload.Format, reqErr)
+		return
+	}
+
+	// The URLs have already been written by the exporter
+	response.URLs = nil
+	response.Format = payload.Format
+
+	if payload.CallbackURL != "" {
+		sendCallback(r.Context(), payload.CallbackURL, callbackBody{RequestID: id, Status: http.StatusOK, Result: response})
+	}
+
+	out.writeSummary(response)
+}
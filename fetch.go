@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// errCodeTooManyRedirects is reported when a fetch exceeds maxRedirects.
+const errCodeTooManyRedirects = "TOO_MANY_REDIRECTS"
+
+// errCodeUpstreamTooLarge is reported when a fetched body exceeds
+// FETCH_MAX_BODY_BYTES.
+const errCodeUpstreamTooLarge = "UPSTREAM_TOO_LARGE"
+
+// maxDrainBytes is how much of an unread response body is read before closing
+// it, so its connection can be reused.
+const maxDrainBytes = 64 << 10
+
+// httpClient is the client shared by every outbound fetch: robots.txt, candidate
+// sitemap locations and sitemap documents. Fetches are bounded by fetchURL
+// rather than by a client timeout, so the bound can vary per request. It is
+// set up by setupServices.
+var httpClient *http.Client
+
+// newFetchClient returns the client of outbound fetches configured by c,
+// dialing through dns.
+func newFetchClient(c *Config, dns *dnsCache) *http.Client {
+	return &http.Client{
+		Transport:     newFetchTransport(c, dns),
+		CheckRedirect: checkRedirect,
+	}
+}
+
+// newFetchDialer returns the dialer of outbound fetches, which guardDial keeps
+// from dialing internal addresses.
+func newFetchDialer(c *Config) *net.Dialer {
+	return &net.Dialer{Timeout: c.fetchConnectTimeout, KeepAlive: 30 * time.Second, Control: guardDial(c.fetchAllowedNetworks)}
+}
+
+// newFetchTransport returns the transport of outbound fetches, with the pool
+// configured by c, which dials through dns unless the DNS cache is turned
+// off. Either way, guardDial keeps it from dialing internal addresses. Fetches
+// never go through the proxy of HTTP_PROXY or HTTPS_PROXY, whose address is all
+// guardDial would see of them.
+func newFetchTransport(c *Config, dns *dnsCache) *http.Transport {
+	dial := newFetchDialer(c).DialContext
+	if c.dnsCacheTTL > 0 {
+		dial = dns.dialContext
+	}
+	return &http.Transport{
+		DialContext:           dial,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          c.fetchMaxIdleConns,
+		MaxIdleConnsPerHost:   c.fetchMaxIdleConnsPerHost,
+		MaxConnsPerHost:       c.fetchMaxConnsPerHost,
+		IdleConnTimeout:       c.fetchIdleConnTimeout,
+		TLSHandshakeTimeout:   c.fetchTLSHandshakeTimeout,
+		ResponseHeaderTimeout: c.fetchResponseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// fetchTimeouts reports the timeouts of the phases of outbound fetches, in
+// seconds, as they take effect: none outlasts the timeout of the whole fetch,
+// which the timeoutSeconds of a request can lower further.
+type fetchTimeouts struct {
+	ConnectSeconds        float64 `json:"connectSeconds"`
+	TLSHandshakeSeconds   float64 `json:"tlsHandshakeSeconds"`
+	ResponseHeaderSeconds float64 `json:"responseHeaderSeconds"`
+	FetchSeconds          float64 `json:"fetchSeconds"`
+}
+
+// effectiveFetchTimeouts returns the timeouts outbound fetches are made with
+// under c.
+func effectiveFetchTimeouts(c *Config) fetchTimeouts {
+	fetchTimeout := c.fetchTimeout
+	capped := func(timeout time.Duration) float64 {
+		if timeout <= 0 || timeout > fetchTimeout {
+			timeout = fetchTimeout
+		}
+		return timeout.Seconds()
+	}
+	return fetchTimeouts{
+		ConnectSeconds:        capped(c.fetchConnectTimeout),
+		TLSHandshakeSeconds:   capped(c.fetchTLSHandshakeTimeout),
+		ResponseHeaderSeconds: capped(c.fetchResponseHeaderTimeout),
+		FetchSeconds:          fetchTimeout.Seconds(),
+	}
+}
+
+// fetchTimeoutKey is the context key under which the per-fetch timeout of a
+// request is stored.
+type fetchTimeoutKey struct{}
+
+// withFetchTimeout returns a context whose fetches are each bounded by timeout.
+func withFetchTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, fetchTimeoutKey{}, timeout)
+}
+
+// fetchTimeoutOf returns the per-fetch timeout carried by ctx, or the
+// configured one when it carries none.
+func fetchTimeoutOf(ctx context.Context) time.Duration {
+	if timeout, ok := ctx.Value(fetchTimeoutKey{}).(time.Duration); ok {
+		return timeout
+	}
+	return configFrom(ctx).fetchTimeout
+}
+
+// cancelOnClose is a response body releasing the context of its fetch once
+// closed. What is left of a short body is read first, so the connection goes
+// back to the pool.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	io.CopyN(io.Discard, b.ReadCloser, maxDrainBytes)
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// redirectHop represents a single redirect followed during a fetch.
+type redirectHop struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Status    int    `json:"status"`
+	CrossHost bool   `json:"crossHost"`
+}
+
+// redirectTrace records the redirect chain followed while fetching a URL.
+type redirectTrace struct {
+	RequestedURL string        `json:"requestedUrl"`
+	FinalURL     string        `json:"finalUrl"`
+	Chain        []redirectHop `json:"chain"`
+	CrossHost    bool          `json:"crossHost"`
+}
+
+// redirectTraceKey is the context key under which a fetch's redirectTrace is stored.
+type redirectTraceKey struct{}
+
+// redirectLimitError is returned when a fetch is redirected more than maxRedirects times.
+type redirectLimitError struct {
+	URL   string
+	Limit int
+}
+
+func (e *redirectLimitError) Error() string {
+	return fmt.Sprintf("%s: stopped after %d redirects while fetching %s", errCodeTooManyRedirects, e.Limit, e.URL)
+}
+
+// upstreamStatusError is returned when a document is fetched with a status
+// other than 2xx.
+type upstreamStatusError struct {
+	URL    string
+	Status int
+}
+
+func (e *upstreamStatusError) Error() string {
+	return fmt.Sprintf("Unexpected status %d fetching %s", e.Status, e.URL)
+}
+
+// bodyTooLargeError is returned when the body of a fetched document is larger
+// than the fetches of the service read.
+type bodyTooLargeError struct {
+	URL   string
+	Limit int
+}
+
+func (e *bodyTooLargeError) Error() string {
+	return fmt.Sprintf("%s is larger than the %d bytes fetched", e.URL, e.Limit)
+}
+
+// readBody reads the body of the response to a fetch of url, up to limit
+// bytes. A longer body isn't read any further and is a *bodyTooLargeError.
+func readBody(resp *http.Response, url string, limit int) ([]byte, error) {
+	// Read one byte past the limit to tell whether the body is longer
+	body, err := io.ReadAll(io.LimitReader(resp.Body, int64(limit)+1))
+	if err != nil {
+		return body, err
+	}
+	if len(body) > limit {
+		return body[:limit], &bodyTooLargeError{URL: url, Limit: limit}
+	}
+	return body, nil
+}
+
+// isTimeout reports whether err is a fetch that ran out of time.
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// fetchError returns the error reported to the client when the upstream document
+// of a request couldn't be fetched or parsed. Upstream failures are told apart
+// from our own: an unreachable or failing upstream is a 502, a slow one a 504,
+// one asking for a wait we can't make or cut off by its circuit breaker a 503,
+// a missing sitemap a 404, a document that isn't a sitemap, or a host asking
+// for a Crawl-delay longer than honored, a 422, and an internal address a 403.
+// A document larger than fetched is a 502 of its own.
+func fetchError(err error) *requestError {
+	var reqErr *requestError
+	var limitErr *redirectLimitError
+	var statusErr *upstreamStatusError
+	var parseErr *sitemapParseError
+	var rateErr *upstreamRateLimitedError
+	var openErr *circuitOpenError
+	var delayErr *crawlDelayError
+	var targetErr *forbiddenTargetError
+	var panicErr *panicError
+	var sizeErr *bodyTooLargeError
+	switch {
+	case errors.As(err, &reqErr):
+		return reqErr
+	case errors.As(err, &panicErr):
+		return &requestError{http.StatusInternalServerError, errCodeInternal, "Internal error while parsing", nil}
+	case errors.As(err, &rateErr):
+		return &requestError{http.StatusServiceUnavailable, errCodeUpstreamRateLimited, rateErr.Error(), map[string]interface{}{"retryAfterSeconds": rateErr.retryAfterSeconds()}}
+	case errors.As(err, &openErr):
+		return &requestError{http.StatusServiceUnavailable, errCodeUpstreamCircuitOpen, openErr.Error(), map[string]interface{}{"host": openErr.Host, "retryAfterSeconds": openErr.retryAfterSeconds()}}
+	case errors.As(err, &delayErr):
+		return &requestError{http.StatusUnprocessableEntity, errCodeCrawlDelayTooLong, delayErr.Error(), map[string]interface{}{"host": delayErr.Host, "crawlDelaySeconds": delayErr.Delay.Seconds(), "maxCrawlDelaySeconds": int(delayErr.Max / time.Second)}}
+	case errors.As(err, &targetErr):
+		return &requestError{http.StatusForbidden, errCodeTargetForbidden, targetErr.Error(), map[string]interface{}{"address": targetErr.Addr}}
+	case errors.As(err, &limitErr):
+		return &requestError{http.StatusBadGateway, errCodeTooManyRedirects, limitErr.Error(), nil}
+	case errors.As(err, &sizeErr):
+		return &requestError{http.StatusBadGateway, errCodeUpstreamTooLarge, sizeErr.Error(), map[string]interface{}{"limit": sizeErr.Limit}}
+	case errors.As(err, &parseErr):
+		return &requestError{http.StatusUnprocessableEntity, errCodeParseFailed, "Failed to parse sitemap: " + parseErr.Error(), nil}
+	case errors.As(err, &statusErr):
+		if statusErr.Status == http.StatusNotFound || statusErr.Status == http.StatusGone {
+			return &requestError{http.StatusNotFound, errCodeSitemapNotFound, statusErr.Error(), nil}
+		}
+		return &requestError{http.StatusBadGateway, errCodeFetchFailed, statusErr.Error(), nil}
+	case isTimeout(err):
+		return &requestError{http.StatusGatewayTimeout, errCodeUpstreamTimeout, "Timed out fetching sitemap: " + err.Error(), nil}
+	}
+	return &requestError{http.StatusBadGateway, errCodeFetchFailed, "Failed to fetch sitemap: " + err.Error(), nil}
+}
+
+// isFetchRefusal reports whether err is a fetch refused by the upstream, or by
+// the service on behalf of the upstream, which fetchError reports with codes
+// and details of their own.
+func isFetchRefusal(err error) bool {
+	var rateErr *upstreamRateLimitedError
+	var openErr *circuitOpenError
+	var delayErr *crawlDelayError
+	var targetErr *forbiddenTargetError
+	return errors.As(err, &rateErr) || errors.As(err, &openErr) || errors.As(err, &delayErr) || errors.As(err, &targetErr)
+}
+
+// checkRedirect is the CheckRedirect policy shared by all outbound clients.
+//
+// It enforces maxRedirects, refuses redirects to schemes other than http and
+// https, and appends every hop to the redirectTrace carried by the request
+// context, if any.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if maxRedirects := configFrom(req.Context()).maxRedirects; len(via) > maxRedirects {
+		return &redirectLimitError{URL: via[0].URL.String(), Limit: maxRedirects}
+	}
+	if err := checkFetchURL(req.URL.String()); err != nil {
+		return err
+	}
+
+	trace, _ := req.Context().Value(redirectTraceKey{}).(*redirectTrace)
+	if trace == nil {
+		return nil
+	}
+
+	previous := via[len(via)-1]
+	hop := redirectHop{
+		From:      previous.URL.String(),
+		To:        req.URL.String(),
+		CrossHost: !strings.EqualFold(previous.URL.Host, req.URL.Host),
+	}
+	if req.Response != nil {
+		hop.Status = req.Response.StatusCode
+	}
+	trace.Chain = append(trace.Chain, hop)
+	if hop.CrossHost {
+		trace.CrossHost = true
+	}
+	return nil
+}
+
+// fetchURL sends a GET request for rawURL using the shared client.
+//
+// The request is bound to ctx, so cancelling it aborts the fetch, and each
+// attempt of the fetch is also bounded by the timeout of fetchTimeoutOf, until
+// the response body is closed. Transient failures are retried as retryFetch
+// does, and every attempt goes through the circuit breaker of the host, then
+// waits for its turn among the fetches of the host. When trace is not nil, the
+// redirects followed and the final URL are recorded into it.
+func fetchURL(ctx context.Context, rawURL string, trace *redirectTrace) (*http.Response, error) {
+	return fetchURLWithHeader(ctx, rawURL, trace, nil)
+}
+
+// fetchURLWithHeader is fetchURL sending the given header fields along, such
+// as the validators of a conditional request.
+func fetchURLWithHeader(ctx context.Context, rawURL string, trace *redirectTrace, header http.Header) (*http.Response, error) {
+	return retryFetch(ctx, func() (*http.Response, error) {
+		return breakers.fetch(ctx, rawURL, func() (*http.Response, error) {
+			if err := politeness.wait(ctx, rawURL); err != nil {
+				return nil, err
+			}
+			return fetchOnce(ctx, rawURL, trace, header)
+		})
+	})
+}
+
+// fetchOnce makes a single attempt of a fetch of fetchURLWithHeader, once one
+// of the fetchSlots is free, which it holds until the response body is closed.
+// The wait for the slot doesn't count against the timeout of the fetch.
+func fetchOnce(ctx context.Context, rawURL string, trace *redirectTrace, header http.Header) (*http.Response, error) {
+	if err := checkFetchURL(rawURL); err != nil {
+		return nil, err
+	}
+	release, err := fetchSlots.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancelFetch := context.WithTimeout(traceFetch(ctx), fetchTimeoutOf(ctx))
+	cancel := func() {
+		cancelFetch()
+		release()
+	}
+	if trace != nil {
+		trace.RequestedURL = rawURL
+		trace.Chain = []redirectHop{}
+		ctx = context.WithValue(ctx, redirectTraceKey{}, trace)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	if trace != nil {
+		trace.FinalURL = resp.Request.URL.String()
+	}
+	return resp, nil
+}
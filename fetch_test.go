@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFetchBodyLimit(t *testing.T) {
+	document := urlSet("https://example.com/a", "https://example.com/b")
+	tests := []struct {
+		name  string
+		limit string
+		fails bool
+	}{
+		{"within the limit", "4096", false},
+		{"exactly the limit", strconv.Itoa(len(document)), false},
+		{"past the limit", "64", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLocalConfig(t, map[string]string{"FETCH_MAX_BODY_BYTES": tt.limit})
+			server := sitemapServer(t, map[string]string{"/sitemap.xml": document})
+
+			result, err := parseSitemap(context.Background(), server.URL+"/sitemap.xml", nil, defaultWalkOptions(currentConfig()))
+			if !tt.fails {
+				if err != nil || len(result.URLs) != 2 {
+					t.Fatalf("parseSitemap = %v, %v, want both URLs", result, err)
+				}
+				return
+			}
+			reqErr := fetchError(err)
+			if reqErr.Status != http.StatusBadGateway || reqErr.Code != errCodeUpstreamTooLarge || reqErr.Details["limit"] != 64 {
+				t.Errorf("fetchError(%v) = %d %s %v, want a 502 %s with the limit", err, reqErr.Status, reqErr.Code, reqErr.Details, errCodeUpstreamTooLarge)
+			}
+		})
+	}
+}
+
+func TestRobotsBodyLimit(t *testing.T) {
+	useLocalConfig(t, map[string]string{"FETCH_MAX_BODY_BYTES": "32"})
+	captureLogs(t)
+	site, _ := robotsServer(t, "User-agent: *\nDisallow:\nSitemap: https://example.com/sitemap.xml\n")
+
+	w := httptest.NewRecorder()
+	handleRobotsEndpoint(w, httptest.NewRequest(http.MethodGet, "/v1/robots?domain="+hostOf(site), nil))
+	if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), errCodeUpstreamTooLarge) {
+		t.Errorf("response = %d %s, want a 502 %s", w.Code, w.Body, errCodeUpstreamTooLarge)
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	useLocalConfig(t, map[string]string{"FETCH_TIMEOUT_SECONDS": "1"})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Hang well past the timeout, until the test is over
+		select {
+		case <-release:
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	start := time.Now()
+	_, err := parseSitemap(context.Background(), server.URL+"/sitemap.xml", nil, defaultWalkOptions(currentConfig()))
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("parseSitemap returned after %s, want it to give up after the 1s timeout", elapsed)
+	}
+	if !isTimeout(err) {
+		t.Fatalf("parseSitemap error = %v, want a timeout", err)
+	}
+	if reqErr := fetchError(err); reqErr.Status != http.StatusGatewayTimeout || reqErr.Code != errCodeUpstreamTimeout {
+		t.Errorf("fetchError(%v) = %d %s, want a 504", err, reqErr.Status, reqErr.Code)
+	}
+}
+
+func TestFetchesReuseTLSConnections(t *testing.T) {
+	useLocalConfig(t, map[string]string{"SITEMAP_FETCH_CONCURRENCY": "1"})
+	documents := map[string]string{
+		"/index.xml": sitemapIndex("/a.xml", "/b.xml", "/c.xml"),
+		"/a.xml":     urlSet("https://example.com/a"),
+		"/b.xml":     urlSet("https://example.com/b"),
+		"/c.xml":     urlSet("https://example.com/c"),
+	}
+	var handshakes, connections int32
+	var server *httptest.Server
+	server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, strings.ReplaceAll(documents[r.URL.Path], "{base}", server.URL))
+	}))
+	server.TLS = &tls.Config{GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		atomic.AddInt32(&handshakes, 1)
+		return nil, nil
+	}}
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	server.StartTLS()
+	defer server.Close()
+	trustServers(t, server)
+
+	for i := 0; i < 3; i++ {
+		result, err := parseSitemap(context.Background(), server.URL+"/index.xml", nil, defaultWalkOptions(currentConfig()))
+		if err != nil || len(result.URLs) != 3 {
+			t.Fatalf("parseSitemap = %v, %v, want the 3 URLs", result, err)
+		}
+	}
+	if n := atomic.LoadInt32(&handshakes); n != 1 {
+		t.Errorf("12 fetches made %d TLS handshakes, want 1", n)
+	}
+	if n := atomic.LoadInt32(&connections); n != 1 {
+		t.Errorf("12 fetches opened %d connections, want 1", n)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fetchSlotSet is the semaphore of the outbound fetches. It is safe for
+// concurrent use.
+type fetchSlotSet struct {
+	slots chan struct{}
+
+	waits    int64
+	waitedNs int64
+}
+
+var fetchSlots *fetchSlotSet
+
+// newFetchSlotSet returns the semaphore of limit fetches at once, or one not
+// bounding them when limit isn't positive.
+func newFetchSlotSet(limit int) *fetchSlotSet {
+	s := &fetchSlotSet{}
+	if limit > 0 {
+		s.slots = make(chan struct{}, limit)
+	}
+	return s
+}
+
+// acquire waits until a fetch may be opened, or ctx is done, and returns the
+// function releasing its slot, which may be called more than once. The wait is
+// accounted for in the fetchSlotWait carried by ctx, if any.
+func (s *fetchSlotSet) acquire(ctx context.Context) (release func(), err error) {
+	if s.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		started := time.Now()
+		select {
+		case s.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		waited := time.Since(started)
+		atomic.AddInt64(&s.waits, 1)
+		atomic.AddInt64(&s.waitedNs, int64(waited))
+		if wait, ok := ctx.Value(fetchSlotWaitKey{}).(*fetchSlotWait); ok {
+			atomic.AddInt64(&wait.ns, int64(waited))
+		}
+	}
+	var once sync.Once
+	return func() { once.Do(func() { <-s.slots }) }, nil
+}
+
+// fetchSlotMetrics reports the use of the slots of outbound fetches.
+type fetchSlotMetrics struct {
+	Open     int   `json:"open"`
+	Max      int   `json:"max"`
+	Waits    int64 `json:"waits"`
+	WaitedMs int64 `json:"waitedMs"`
+}
+
+// metrics reports the fetches open against the bound, and the fetches that
+// waited for a slot since the start and for how long in total.
+func (s *fetchSlotSet) metrics() fetchSlotMetrics {
+	return fetchSlotMetrics{
+		Open:     len(s.slots),
+		Max:      cap(s.slots),
+		Waits:    atomic.LoadInt64(&s.waits),
+		WaitedMs: atomic.LoadInt64(&s.waitedNs) / int64(time.Millisecond),
+	}
+}
+
+// fetchSlotWait sums how long the fetches of a request waited for a slot.
+type fetchSlotWait struct {
+	ns int64
+}
+
+// fetchSlotWaitKey is the context key of the fetchSlotWait of a request.
+type fetchSlotWaitKey struct{}
+
+// withFetchSlotWait returns ctx with the waits for a slot of the fetches made
+// with it summed into wait.
+func withFetchSlotWait(ctx context.Context, wait *fetchSlotWait) context.Context {
+	return context.WithValue(ctx, fetchSlotWaitKey{}, wait)
+}
+
+// waited returns how long the fetches waited so far.
+func (w *fetchSlotWait) waited() time.Duration {
+	return time.Duration(atomic.LoadInt64(&w.ns))
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The phases of an outbound fetch that are timed: resolving the host, opening
+// the connection, the TLS handshake, and the wait for the first byte of the
+// response once the request was sent.
+const (
+	phaseDNS     = "dns"
+	phaseConnect = "connect"
+	phaseTLS     = "tls"
+	phaseTTFB    = "ttfb"
+)
+
+// fetchPhaseNames lists the phases in the order they happen.
+var fetchPhaseNames = []string{phaseDNS, phaseConnect, phaseTLS, phaseTTFB}
+
+// phaseBuckets are the upper bounds, in seconds, of the buckets of the
+// histograms of the phases.
+var phaseBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram counts durations by bucket, with their sum.
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// phaseHistograms holds the histogram of each phase of the outbound fetches
+// since the start. It is safe for concurrent use.
+type phaseHistograms struct {
+	mu     sync.Mutex
+	phases map[string]*histogram
+}
+
+var fetchPhases = newPhaseHistograms()
+
+func newPhaseHistograms() *phaseHistograms {
+	h := &phaseHistograms{phases: make(map[string]*histogram)}
+	for _, phase := range fetchPhaseNames {
+		h.phases[phase] = &histogram{counts: make([]uint64, len(phaseBuckets))}
+	}
+	return h
+}
+
+// observe counts a phase that took d.
+func (h *phaseHistograms) observe(phase string, d time.Duration) {
+	seconds := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hist := h.phases[phase]
+	for i, bound := range phaseBuckets {
+		if seconds <= bound {
+			hist.counts[i]++
+			break
+		}
+	}
+	hist.count++
+	hist.sum += seconds
+}
+
+// writePrometheus writes the histograms in the Prometheus text format, as the
+// fetch_phase_seconds histogram labeled by phase.
+func (h *phaseHistograms) writePrometheus(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP fetch_phase_seconds Duration of the phases of outbound fetches.")
+	fmt.Fprintln(w, "# TYPE fetch_phase_seconds histogram")
+	for _, phase := range fetchPhaseNames {
+		hist := h.phases[phase]
+		var cumulative uint64
+		for i, bound := range phaseBuckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(w, "fetch_phase_seconds_bucket{phase=%q,le=%q} %d\n", phase, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "fetch_phase_seconds_bucket{phase=%q,le=\"+Inf\"} %d\n", phase, hist.count)
+		fmt.Fprintf(w, "fetch_phase_seconds_sum{phase=%q} %g\n", phase, hist.sum)
+		fmt.Fprintf(w, "fetch_phase_seconds_count{phase=%q} %d\n", phase, hist.count)
+	}
+}
+
+// phaseTiming sums the durations of a phase over the fetches of a request.
+type phaseTiming struct {
+	Count   int     `json:"count"`
+	TotalMs float64 `json:"totalMs"`
+	MaxMs   float64 `json:"maxMs"`
+}
+
+// fetchDebug collects the timings of the fetches of a request, by phase. It is
+// safe for concurrent use.
+type fetchDebug struct {
+	mu      sync.Mutex
+	fetches int
+	phases  map[string]phaseTiming
+}
+
+func newFetchDebug() *fetchDebug {
+	return &fetchDebug{phases: make(map[string]phaseTiming)}
+}
+
+// observe accounts for a phase of a fetch that took d.
+func (d *fetchDebug) observe(phase string, took time.Duration) {
+	ms := float64(took.Microseconds()) / 1000
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	timing := d.phases[phase]
+	timing.Count++
+	timing.TotalMs += ms
+	if ms > timing.MaxMs {
+		timing.MaxMs = ms
+	}
+	d.phases[phase] = timing
+}
+
+// fetchTimings is the debug field of a response, reporting the timings of the
+// fetches of the request by phase. Phases skipped by a fetch, such as the
+// connection of a fetch reusing one, aren't counted.
+type fetchTimings struct {
+	Fetches int                    `json:"fetches"`
+	Phases  map[string]phaseTiming `json:"phases"`
+}
+
+// report returns the timings collected so far.
+func (d *fetchDebug) report() *fetchTimings {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	timings := &fetchTimings{Fetches: d.fetches, Phases: make(map[string]phaseTiming, len(fetchPhaseNames))}
+	for _, phase := range fetchPhaseNames {
+		timings.Phases[phase] = d.phases[phase]
+	}
+	return timings
+}
+
+// fetchDebugKey is the context key of the fetchDebug of a request.
+type fetchDebugKey struct{}
+
+// withFetchDebug returns ctx with the fetches made with it timed into debug.
+func withFetchDebug(ctx context.Context, debug *fetchDebug) context.Context {
+	return context.WithValue(ctx, fetchDebugKey{}, debug)
+}
+
+// fetchTimer times the phases of a fetch. The connection phases may be
+// reported from the goroutine dialing it.
+type fetchTimer struct {
+	debug *fetchDebug
+
+	mu                            sync.Mutex
+	dnsStart, connStart, tlsStart time.Time
+	wroteRequest                  time.Time
+}
+
+// mark records that a phase starts, unless it already started, so a connect
+// phase spans the failed attempts before the one that connects.
+func (t *fetchTimer) mark(at *time.Time) {
+	t.mu.Lock()
+	if at.IsZero() {
+		*at = time.Now()
+	}
+	t.mu.Unlock()
+}
+
+// done accounts for a phase that started at *at, once.
+func (t *fetchTimer) done(phase string, at *time.Time) {
+	t.mu.Lock()
+	started := *at
+	*at = time.Time{}
+	t.mu.Unlock()
+	if started.IsZero() {
+		return
+	}
+	took := time.Since(started)
+	fetchPhases.observe(phase, took)
+	if t.debug != nil {
+		t.debug.observe(phase, took)
+	}
+}
+
+// traceFetch returns ctx with the phases of the fetch made with it timed, into
+// the histograms of the phases and the fetchDebug of the request, if any.
+func traceFetch(ctx context.Context) context.Context {
+	t := &fetchTimer{}
+	if debug, ok := ctx.Value(fetchDebugKey{}).(*fetchDebug); ok {
+		t.debug = debug
+		debug.mu.Lock()
+		debug.fetches++
+		debug.mu.Unlock()
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart:     func(httptrace.DNSStartInfo) { t.mark(&t.dnsStart) },
+		DNSDone:      func(httptrace.DNSDoneInfo) { t.done(phaseDNS, &t.dnsStart) },
+		ConnectStart: func(network, addr string) { t.mark(&t.connStart) },
+		ConnectDone: func(network, addr string, err error) {
+			if err == nil {
+				t.done(phaseConnect, &t.connStart)
+			}
+		},
+		TLSHandshakeStart: func() { t.mark(&t.tlsStart) },
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				t.done(phaseTLS, &t.tlsStart)
+			}
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { t.mark(&t.wroteRequest) },
+		GotFirstResponseByte: func() { t.done(phaseTTFB, &t.wroteRequest) },
+	})
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// maxFilterPatterns is the maximum number of patterns accepted in each of the
+// include and exclude fields.
+const maxFilterPatterns = 20
+
+// maxForeignHosts is the maximum number of distinct foreign hosts reported.
+const maxForeignHosts = 100
+
+// stringList is a payload field accepting either a single string or an array
+// of strings.
+type stringList []string
+
+// UnmarshalJSON decodes a string or an array of strings.
+func (l *stringList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*l = stringList{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// openAPISchema describes the field in the OpenAPI document, which can't tell
+// from the type that a single string is accepted too.
+func (stringList) openAPISchema() map[string]interface{} {
+	return map[string]interface{}{
+		"oneOf": []interface{}{
+			map[string]interface{}{"type": "string"},
+			map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+		},
+	}
+}
+
+// urlFilter decides which of the URLs listed in sitemaps are returned.
+type urlFilter struct {
+	// sameHostOnly drops the URLs on another host than the sitemap of the
+	// request; ignoreWWW treats www and non-www hosts as the same.
+	sameHostOnly bool
+	ignoreWWW    bool
+	// pathPrefixes keeps only the URLs whose path is below one of the prefixes,
+	// when not empty. Prefixes have no trailing slash, except the root one.
+	pathPrefixes []string
+	// includeExtensions keeps only the URLs with one of the extensions, when
+	// not empty, and excludeExtensions drops the URLs with any of them. The
+	// empty extension stands for paths without one.
+	includeExtensions map[string]bool
+	excludeExtensions map[string]bool
+	// minPriority keeps only the URLs with at least that priority, when set.
+	// URLs without one count as the protocol default, unless
+	// dropUnprioritized is set.
+	minPriority       *float64
+	dropUnprioritized bool
+	// include keeps only the URLs matching at least one pattern, when not empty.
+	include []*regexp.Regexp
+	// exclude drops the URLs matching any pattern.
+	exclude []*regexp.Regexp
+}
+
+// compilePatterns compiles the regular expressions of the named payload field.
+//
+// It returns an error naming the first pattern that doesn't compile.
+func compilePatterns(field string, patterns []string) ([]*regexp.Regexp, error) {
+	if len(patterns) > maxFilterPatterns {
+		return nil, fmt.Errorf("Invalid '%s': at most %d patterns are allowed", field, maxFilterPatterns)
+	}
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid '%s' pattern %q: %v", field, pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// normalizePathPrefixes returns the prefixes of the pathPrefix field with a
+// leading slash and without a trailing one.
+func normalizePathPrefixes(prefixes []string) ([]string, error) {
+	if len(prefixes) > maxFilterPatterns {
+		return nil, fmt.Errorf("Invalid 'pathPrefix': at most %d prefixes are allowed", maxFilterPatterns)
+	}
+	normalized := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		if prefix == "" {
+			return nil, fmt.Errorf("Invalid 'pathPrefix': prefixes can't be empty")
+		}
+		if !strings.HasPrefix(prefix, "/") {
+			prefix = "/" + prefix
+		}
+		if len(prefix) > 1 {
+			prefix = strings.TrimRight(prefix, "/")
+		}
+		if prefix == "" {
+			prefix = "/"
+		}
+		normalized = append(normalized, prefix)
+	}
+	return normalized, nil
+}
+
+// filterStats counts the URLs dropped by a filter.
+type filterStats struct {
+	// Filtered counts every URL dropped, whichever the reason.
+	Filtered int
+	// ExcludedByExtension counts the URLs dropped because of their extension.
+	ExcludedByExtension int
+	// ForeignURLs counts the URLs dropped because they are on another host,
+	// and ForeignHosts holds the distinct hosts they are on.
+	ForeignURLs  int
+	ForeignHosts map[string]bool
+}
+
+// add adds the counts of other to s.
+func (s *filterStats) add(other filterStats) {
+	s.Filtered += other.Filtered
+	s.ExcludedByExtension += other.ExcludedByExtension
+	s.ForeignURLs += other.ForeignURLs
+	for host := range other.ForeignHosts {
+		s.addForeignHost(host)
+	}
+}
+
+// addForeignHost records a foreign host, up to maxForeignHosts of them.
+func (s *filterStats) addForeignHost(host string) {
+	if s.ForeignHosts == nil {
+		s.ForeignHosts = make(map[string]bool)
+	}
+	if len(s.ForeignHosts) < maxForeignHosts {
+		s.ForeignHosts[host] = true
+	}
+}
+
+// foreignHosts returns the distinct foreign hosts in alphabetical order.
+func (s filterStats) foreignHosts() []string {
+	hosts := make([]string, 0, len(s.ForeignHosts))
+	for host := range s.ForeignHosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// extensionSet returns the extensions of the named payload field as a set,
+// lowercase and without a leading dot, or nil when there are none.
+func extensionSet(field string, extensions []string) (map[string]bool, error) {
+	if len(extensions) == 0 {
+		return nil, nil
+	}
+	if len(extensions) > maxFilterPatterns {
+		return nil, fmt.Errorf("Invalid '%s': at most %d extensions are allowed", field, maxFilterPatterns)
+	}
+	set := make(map[string]bool, len(extensions))
+	for _, ext := range extensions {
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if strings.ContainsAny(ext, "./") {
+			return nil, fmt.Errorf("Invalid '%s': %q is not a file extension", field, ext)
+		}
+		set[ext] = true
+	}
+	return set, nil
+}
+
+// urlFilter returns the filter described by the payload, or nil when it doesn't
+// filter anything.
+func (p requestPayload) urlFilter() (*urlFilter, error) {
+	prefixes, err := normalizePathPrefixes(p.PathPrefix)
+	if err != nil {
+		return nil, err
+	}
+	includeExtensions, err := extensionSet("includeExtensions", p.IncludeExtensions)
+	if err != nil {
+		return nil, err
+	}
+	excludeExtensions, err := extensionSet("excludeExtensions", p.ExcludeExtensions)
+	if err != nil {
+		return nil, err
+	}
+	include, err := compilePatterns("include", p.Include)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := compilePatterns("exclude", p.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	if p.MinPriority != nil && (*p.MinPriority < 0 || *p.MinPriority > 1) {
+		return nil, fmt.Errorf("Invalid 'minPriority': must be between 0.0 and 1.0")
+	}
+
+	f := &urlFilter{
+		sameHostOnly:      p.SameHostOnly,
+		ignoreWWW:         p.IgnoreWWW,
+		pathPrefixes:      prefixes,
+		includeExtensions: includeExtensions,
+		excludeExtensions: excludeExtensions,
+		minPriority:       p.MinPriority,
+		dropUnprioritized: p.IncludeUnprioritized != nil && !*p.IncludeUnprioritized,
+		include:           include,
+		exclude:           exclude,
+	}
+	if f.empty() {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// empty reports whether the filter keeps every URL.
+func (f *urlFilter) empty() bool {
+	return !f.sameHostOnly && len(f.pathPrefixes) == 0 && f.includeExtensions == nil && f.excludeExtensions == nil &&
+		f.minPriority == nil && !f.dropUnprioritized && len(f.include) == 0 && len(f.exclude) == 0
+}
+
+// Reasons for a filter to drop a URL.
+const (
+	dropNone = iota
+	dropOther
+	dropExtension
+	dropForeignHost
+)
+
+// check returns why the URL doesn't pass the filter, or dropNone when it does.
+// The site is the host of the sitemap of the request, as returned by siteHost.
+// The cheap checks come first.
+func (f *urlFilter) check(u SitemapURL, site string) int {
+	if f.sameHostOnly && f.host(u.Loc) != site {
+		return dropForeignHost
+	}
+	if len(f.pathPrefixes) > 0 || f.includeExtensions != nil || f.excludeExtensions != nil {
+		p := urlPath(u.Loc)
+		if len(f.pathPrefixes) > 0 && !hasPathPrefix(p, f.pathPrefixes) {
+			return dropOther
+		}
+		ext := strings.ToLower(strings.TrimPrefix(path.Ext(p), "."))
+		if f.includeExtensions != nil && !f.includeExtensions[ext] || f.excludeExtensions[ext] {
+			return dropExtension
+		}
+	}
+	if f.minPriority != nil || f.dropUnprioritized {
+		priority, ok := parsePriority(u.Priority)
+		if !ok {
+			if f.dropUnprioritized {
+				return dropOther
+			}
+			priority = defaultPriority
+		}
+		if f.minPriority != nil && priority < *f.minPriority {
+			return dropOther
+		}
+	}
+	if len(f.include) > 0 && !matchesAny(f.include, u.Loc) {
+		return dropOther
+	}
+	if matchesAny(f.exclude, u.Loc) {
+		return dropOther
+	}
+	return dropNone
+}
+
+// apply returns the URLs passing the filter, in their original order, and the
+// counts of the URLs dropped. The site is the host of the sitemap of the request.
+func (f *urlFilter) apply(urls []SitemapURL, site string) ([]SitemapURL, filterStats) {
+	var stats filterStats
+	kept := make([]SitemapURL, 0, len(urls))
+	for _, u := range urls {
+		switch f.check(u, site) {
+		case dropNone:
+			kept = append(kept, u)
+			continue
+		case dropExtension:
+			stats.ExcludedByExtension++
+		case dropForeignHost:
+			stats.ForeignURLs++
+			stats.addForeignHost(urlHostname(u.Loc))
+		}
+		stats.Filtered++
+	}
+	return kept, stats
+}
+
+// siteHost returns the host the URLs of the sitemap at rawURL are compared to.
+func (f *urlFilter) siteHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return f.host(u.Scheme + "://" + u.Host)
+}
+
+// host returns the host of a URL as compared by the filter.
+func (f *urlFilter) host(loc string) string {
+	host := urlHostname(loc)
+	if f.ignoreWWW {
+		host = strings.TrimPrefix(host, "www.")
+	}
+	return host
+}
+
+// urlPath returns the path of an absolute URL, without its query string and
+// fragment. It is "/" when the URL has no path.
+//
+// It only slices the string, as it runs for every URL of a walk and url.Parse
+// is much more expensive.
+func urlPath(loc string) string {
+	loc = strings.TrimSpace(loc)
+	if i := strings.Index(loc, "://"); i >= 0 {
+		loc = loc[i+3:]
+		slash := strings.IndexAny(loc, "/?#")
+		if slash < 0 || loc[slash] != '/' {
+			return "/"
+		}
+		loc = loc[slash:]
+	}
+	if i := strings.IndexAny(loc, "?#"); i >= 0 {
+		loc = loc[:i]
+	}
+	if loc == "" {
+		return "/"
+	}
+	return loc
+}
+
+// urlHostname returns the lowercase host name of an absolute URL, without its
+// port, or an empty string when it has none. Like urlPath, it only slices the
+// string.
+func urlHostname(loc string) string {
+	loc = strings.TrimSpace(loc)
+	i := strings.Index(loc, "://")
+	if i < 0 {
+		return ""
+	}
+	host := loc[i+3:]
+	if end := strings.IndexAny(host, "/?#"); end >= 0 {
+		host = host[:end]
+	}
+	if at := strings.LastIndex(host, "@"); at >= 0 {
+		host = host[at+1:]
+	}
+	if strings.HasPrefix(host, "[") {
+		if end := strings.Index(host, "]"); end >= 0 {
+			return strings.ToLower(host[1:end])
+		}
+	}
+	if colon := strings.LastIndex(host, ":"); colon >= 0 {
+		host = host[:colon]
+	}
+	return strings.ToLower(host)
+}
+
+// hasPathPrefix reports whether the path is one of the prefixes or below one
+// of them. Whole segments are compared, so "/blog" doesn't match "/blogging".
+func hasPathPrefix(path string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if prefix == "/" || path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAny reports whether s matches at least one of the patterns.
+func matchesAny(patterns []*regexp.Regexp, s string) bool {
+	for _, re := range patterns {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Limits of a single sitemap document set by the sitemap protocol.
+const (
+	maxSitemapEntries = 50000
+	maxSitemapBytes   = 50 << 20
+)
+
+// maxDroppedReported is the maximum number of dropped entry indexes listed in
+// the X-Dropped-Entries header.
+const maxDroppedReported = 100
+
+// sitemapNamespace is the XML namespace of sitemap documents.
+const sitemapNamespace = "http://www.sitemaps.org/schemas/sitemap/0.9"
+
+// Response headers reporting the entries dropped by /generate.
+const (
+	droppedCountHeader   = "X-Dropped-Count"
+	droppedEntriesHeader = "X-Dropped-Entries"
+)
+
+// generatePayload represents the JSON payload accepted by the generate endpoint.
+type generatePayload struct {
+	URLs []SitemapURL `json:"urls"`
+	// BaseURL is where the child documents will be served from, needed to list
+	// them in the index when the entries don't fit in one document.
+	BaseURL string `json:"baseUrl"`
+	Gzip    bool   `json:"gzip"`
+}
+
+// generatedURL is a url element of a generated document.
+type generatedURL struct {
+	XMLName    xml.Name `xml:"url"`
+	Loc        string   `xml:"loc"`
+	Lastmod    string   `xml:"lastmod,omitempty"`
+	Changefreq string   `xml:"changefreq,omitempty"`
+	Priority   string   `xml:"priority,omitempty"`
+}
+
+// generatedSitemap is a sitemap element of a generated index.
+type generatedSitemap struct {
+	XMLName xml.Name `xml:"sitemap"`
+	Loc     string   `xml:"loc"`
+}
+
+// changefreqValues are the values allowed in a changefreq element.
+var changefreqValues = map[string]bool{
+	"always": true, "hourly": true, "daily": true, "weekly": true, "monthly": true, "yearly": true, "never": true,
+}
+
+// validateEntry returns the entry as written in a generated document, or an
+// error when it can't be listed in a sitemap.
+func validateEntry(entry SitemapURL) (generatedURL, error) {
+	loc := strings.TrimSpace(entry.Loc)
+	u, err := url.Parse(loc)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return generatedURL{}, fmt.Errorf("loc is not an absolute http(s) URL")
+	}
+	generated := generatedURL{
+		Loc:        loc,
+		Lastmod:    strings.TrimSpace(entry.Lastmod),
+		Changefreq: strings.ToLower(strings.TrimSpace(entry.Changefreq)),
+		Priority:   strings.TrimSpace(entry.Priority),
+	}
+	if generated.Lastmod != "" {
+		if _, ok := parseLastmod(generated.Lastmod); !ok {
+			return generatedURL{}, fmt.Errorf("lastmod is not a W3C datetime")
+		}
+	}
+	if generated.Changefreq != "" && !changefreqValues[generated.Changefreq] {
+		return generatedURL{}, fmt.Errorf("changefreq is not a valid value")
+	}
+	if generated.Priority != "" {
+		if _, ok := parsePriority(generated.Priority); !ok {
+			return generatedURL{}, fmt.Errorf("priority is not between 0.0 and 1.0")
+		}
+	}
+	return generated, nil
+}
+
+// encodeDocument returns a sitemap document with the given root element and
+// already encoded children.
+func encodeDocument(root string, children [][]byte) []byte {
+	var doc bytes.Buffer
+	doc.WriteString(xml.Header)
+	fmt.Fprintf(&doc, "<%s xmlns=\"%s\">\n", root, sitemapNamespace)
+	for _, child := range children {
+		doc.Write(child)
+		doc.WriteByte('\n')
+	}
+	fmt.Fprintf(&doc, "</%s>\n", root)
+	return doc.Bytes()
+}
+
+// splitEntries groups the encoded entries into documents within the protocol
+// limits of entries and bytes.
+func splitEntries(entries [][]byte) [][][]byte {
+	overhead := len(encodeDocument("urlset", nil))
+	var chunks [][][]byte
+	var current [][]byte
+	size := overhead
+	for _, entry := range entries {
+		if len(current) == maxSitemapEntries || (len(current) > 0 && size+len(entry)+1 > maxSitemapBytes) {
+			chunks = append(chunks, current)
+			current, size = nil, overhead
+		}
+		current = append(current, entry)
+		size += len(entry) + 1
+	}
+	return append(chunks, current)
+}
+
+// gzipBytes returns the gzip compression of data.
+func gzipBytes(data []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(data)
+	gz.Close()
+	return buf.Bytes()
+}
+
+// handleGenerateEndpoint generates sitemap XML from a list of URLs.
+//
+// It expects a POST request with a JSON payload containing the 'urls' entries,
+// each with a 'loc' and optionally 'lastmod', 'changefreq' and 'priority'.
+// Entries that can't be listed in a sitemap are dropped and reported in the
+// X-Dropped-Count and X-Dropped-Entries headers. The response is a urlset
+// document, gzipped when 'gzip' is set. When the entries exceed the limits of a
+// single document, it is instead a zip archive holding a sitemap index and the
+// numbered child documents, listed under 'baseUrl'.
+func handleGenerateEndpoint(w http.ResponseWriter, r *http.Request) {
+	// Decompress a gzip request body and check it is JSON before decoding it
+	if err := prepareJSONBody(w, r); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	// Decode the JSON payload
+	var payload generatePayload
+	if err := decodeJSONBody(r, &payload); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+	if len(payload.URLs) == 0 {
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, "Missing 'urls' field in JSON payload", nil)
+		return
+	}
+	if maxURLs := configFrom(r.Context()).maxGenerateURLs; len(payload.URLs) > maxURLs {
+		writeAPIError(w, http.StatusBadRequest, errCodeLimitExceeded, fmt.Sprintf("Too many URLs: %d (maximum is %d)", len(payload.URLs), maxURLs), map[string]interface{}{"limit": maxURLs})
+		return
+	}
+
+	requestID(w, r)
+
+	// Encode the valid entries, remembering which ones were dropped
+	var entries [][]byte
+	var dropped []string
+	droppedCount := 0
+	for i, entry := range payload.URLs {
+		generated, err := validateEntry(entry)
+		if err == nil {
+			var encoded []byte
+			encoded, err = xml.Marshal(generated)
+			if err == nil {
+				entries = append(entries, encoded)
+				continue
+			}
+		}
+		droppedCount++
+		if len(dropped) < maxDroppedReported {
+			dropped = append(dropped, strconv.Itoa(i))
+		}
+	}
+	w.Header().Set(droppedCountHeader, strconv.Itoa(droppedCount))
+	if len(dropped) > 0 {
+		w.Header().Set(droppedEntriesHeader, strings.Join(dropped, ","))
+	}
+	if len(entries) == 0 {
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, "No valid entry in 'urls'", nil)
+		return
+	}
+
+	extension := ".xml"
+	if payload.Gzip {
+		extension = ".xml.gz"
+	}
+
+	chunks := splitEntries(entries)
+	if len(chunks) == 1 {
+		document := encodeDocument("urlset", chunks[0])
+		if payload.Gzip {
+			w.Header().Set("Content-Type", "application/gzip")
+			w.Header().Set("Content-Disposition", `attachment; filename="sitemap.xml.gz"`)
+			w.Write(gzipBytes(document))
+			return
+		}
+		w.Header().Set("Content-Type", xmlContentType)
+		w.Write(document)
+		return
+	}
+
+	// The index must list the children by absolute URL
+	base, err := url.Parse(payload.BaseURL)
+	if payload.BaseURL == "" || err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Invalid 'baseUrl': an absolute http(s) URL is needed to split %d entries into %d sitemaps", len(entries), len(chunks)), nil)
+		return
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	var children [][]byte
+	for i, chunk := range chunks {
+		name := fmt.Sprintf("sitemap-%d%s", i+1, extension)
+		document := encodeDocument("urlset", chunk)
+		if payload.Gzip {
+			document = gzipBytes(document)
+		}
+		f, err := zw.Create(name)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, errCodeInternal, "Failed to create archive", nil)
+			return
+		}
+		f.Write(document)
+
+		encoded, _ := xml.Marshal(generatedSitemap{Loc: base.ResolveReference(&url.URL{Path: name}).String()})
+		children = append(children, encoded)
+	}
+	f, err := zw.Create("sitemap.xml")
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, errCodeInternal, "Failed to create archive", nil)
+		return
+	}
+	f.Write(encodeDocument("sitemapindex", children))
+	if err := zw.Close(); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, errCodeInternal, "Failed to create archive", nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="sitemaps.zip"`)
+	w.Write(archive.Bytes())
+}
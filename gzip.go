@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// gzipMinBytes is the size under which a complete reply is sent uncompressed,
+// since gzip would save little or even grow it.
+const gzipMinBytes = 1024
+
+// gzipMediaTypes are the media types of the replies compressed.
+var gzipMediaTypes = map[string]bool{
+	"application/json":     true,
+	"application/x-ndjson": true,
+	"application/xml":      true,
+	"text/csv":             true,
+	"text/event-stream":    true,
+}
+
+var gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+
+// acceptsGzip reports whether the Accept-Encoding header of a request allows
+// a gzip reply.
+func acceptsGzip(r *http.Request) bool {
+	for _, coding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(coding), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		params = strings.ReplaceAll(params, " ", "")
+		if !strings.HasPrefix(params, "q=") {
+			return true
+		}
+		if value, err := strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64); err == nil && value > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// compressResponses is the middleware gzipping the successful JSON, NDJSON,
+// CSV, XML and event stream replies to the requests accepting it. Replies are
+// held back until gzipMinBytes were written, so tiny ones go uncompressed; a
+// flush sends what was written right away, compressed, so streams keep
+// reaching the client event by event.
+func compressResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		// WebSocket upgrades take the connection over
+		if !acceptsGzip(r) || r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(gw, r)
+		// A handler aborting its reply panics past here, so it isn't completed
+		gw.close()
+	})
+}
+
+// gzipResponseWriter compresses a reply once it knows whether it should.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+
+	status  int
+	decided bool
+	gz      *gzip.Writer
+	held    bytes.Buffer
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.decided {
+		if w.gz != nil {
+			return w.gz.Write(p)
+		}
+		return w.ResponseWriter.Write(p)
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", http.DetectContentType(p))
+	}
+	w.held.Write(p)
+	if w.held.Len() >= gzipMinBytes {
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// compressible reports whether the reply should be gzipped. more tells more of
+// the reply may come than what was written so far.
+func (w *gzipResponseWriter) compressible(more bool) bool {
+	if w.status < 200 || w.status >= 300 || w.status == http.StatusNoContent || w.Header().Get("Content-Encoding") != "" {
+		return false
+	}
+	if !more && w.held.Len() < gzipMinBytes {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	return gzipMediaTypes[mediaType]
+}
+
+// decide sends the header of the reply, compressed when it should be, and
+// what was held back. more tells more of the reply may come.
+func (w *gzipResponseWriter) decide(more bool) error {
+	w.decided = true
+	header := w.Header()
+	if w.compressible(more) {
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", "gzip")
+		// The compressed reply isn't the same bytes as the one its ETag was made for
+		if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+		w.gz = gzipWriters.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	} else if !more && w.status != http.StatusNotModified && w.status != http.StatusNoContent {
+		header.Set("Content-Length", strconv.Itoa(w.held.Len()))
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if w.held.Len() == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(w.held.Bytes())
+	} else {
+		_, err = w.ResponseWriter.Write(w.held.Bytes())
+	}
+	w.held.Reset()
+	return err
+}
+
+// Flush sends what was written so far to the client, compressing the reply
+// from then on when it should be, whatever its size.
+func (w *gzipResponseWriter) Flush() {
+	if !w.decided {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		w.decide(true)
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// close sends what is still held back and ends the compressed stream.
+func (w *gzipResponseWriter) close() {
+	if !w.decided {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		w.decide(false)
+	}
+	if w.gz != nil {
+		w.gz.Close()
+		w.gz.Reset(nil)
+		gzipWriters.Put(w.gz)
+		w.gz = nil
+	}
+}
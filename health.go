@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+// The states of the service, as told by /readyz.
+const (
+	stateStarting int32 = iota
+	stateReady
+	stateStopping
+)
+
+// serviceState is the state of the service: starting until it is set up and
+// serving, then ready until it starts shutting down.
+var serviceState int32
+
+// The paths of the probes, outside of the versioned API as orchestrators
+// expect them there.
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+)
+
+// The statuses of the service and its components in the health responses.
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+	healthDisabled = "disabled"
+	healthStarting = "starting"
+	healthDraining = "draining"
+	healthClosed   = "closed"
+)
+
+// healthResponse is the response of /healthz and /readyz.
+type healthResponse struct {
+	Status     string            `json:"status"`
+	Components map[string]string `json:"components,omitempty"`
+}
+
+// writeHealth writes response with status, never cached.
+func writeHealth(w http.ResponseWriter, status int, response healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleHealthz is the liveness probe: it succeeds for as long as the process
+// serves requests, draining included.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, healthResponse{Status: healthOK})
+}
+
+// handleReadyz is the readiness probe: it succeeds once the worker pool, the
+// cache and the parse store are set up, and fails with a 503 before and once
+// shutting down. A cache backend that can't be reached only degrades the
+// service, as its failures are cache misses.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	components := map[string]string{"workers": healthOK, "cache": healthOK, "store": healthOK}
+	if parseWorkers.isClosed() {
+		components["workers"] = healthClosed
+	}
+	if redis, ok := cache.(*redisCache); ok && redis.ping() != nil {
+		components["cache"] = healthDegraded
+	}
+	if parses == nil {
+		components["store"] = healthDisabled
+	}
+
+	response := healthResponse{Status: healthOK, Components: components}
+	switch atomic.LoadInt32(&serviceState) {
+	case stateStarting:
+		response.Status = healthStarting
+	case stateStopping:
+		response.Status = healthDraining
+	default:
+		if components["workers"] != healthOK {
+			response.Status = healthClosed
+		}
+	}
+	if response.Status != healthOK {
+		writeHealth(w, http.StatusServiceUnavailable, response)
+		return
+	}
+	writeHealth(w, http.StatusOK, response)
+}
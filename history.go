@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// historyEntry is the last successful URL list of a sitemap.
+type historyEntry struct {
+	urls      []string
+	fetchedAt time.Time
+}
+
+// sitemapHistory holds the last successful URL list per normalized sitemap URL,
+// so successive runs can report what changed, for up to maxEntries sitemaps.
+// It is safe for concurrent use.
+type sitemapHistory struct {
+	mu         sync.Mutex
+	entries    map[string]*historyEntry
+	maxEntries int
+}
+
+var history *sitemapHistory
+
+// newSitemapHistory returns a history of the URL lists of up to maxEntries
+// sitemaps, keeping none when maxEntries isn't positive.
+func newSitemapHistory(maxEntries int) *sitemapHistory {
+	return &sitemapHistory{entries: make(map[string]*historyEntry), maxEntries: maxEntries}
+}
+
+// get returns the last recorded URL list of a sitemap, or nil when there is none.
+func (h *sitemapHistory) get(sitemapURL string) *historyEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.entries[normalizeURL(sitemapURL)]
+}
+
+// swap records the URL list of a sitemap and returns the previous one, or nil
+// when there is none. The oldest entry is dropped once the history is full.
+func (h *sitemapHistory) swap(sitemapURL string, urls []string, fetchedAt time.Time) *historyEntry {
+	key := normalizeURL(sitemapURL)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	previous := h.entries[key]
+	if previous == nil && len(h.entries) >= h.maxEntries {
+		var oldest string
+		for k, entry := range h.entries {
+			if oldest == "" || entry.fetchedAt.Before(h.entries[oldest].fetchedAt) {
+				oldest = k
+			}
+		}
+		delete(h.entries, oldest)
+	}
+	if h.maxEntries > 0 {
+		h.entries[key] = &historyEntry{urls: urls, fetchedAt: fetchedAt}
+	}
+	return previous
+}
+
+// wantsDiffAgainstPrevious reports whether the request asks for the changes
+// since the previous run, which needs the full URL list of the default format.
+func (p requestPayload) wantsDiffAgainstPrevious() (bool, error) {
+	if !p.DiffAgainstPrevious {
+		return false, nil
+	}
+	if p.Format != "" && p.Format != formatJSON {
+		return false, fmt.Errorf("Invalid 'diffAgainstPrevious': not supported with the %q format", p.Format)
+	}
+	if p.GroupBySource || p.Sample != nil {
+		return false, fmt.Errorf("Invalid 'diffAgainstPrevious': not supported with 'groupBySource' or 'sample'")
+	}
+	return true, nil
+}
+
+// changesSince returns the URLs added to and removed from a sitemap since the
+// previous run, comparing normalized URLs.
+func changesSince(previous, current []string) ([]string, []string) {
+	before := make(map[string]bool, len(previous))
+	for _, loc := range previous {
+		before[normalizeURL(loc)] = true
+	}
+	now := make(map[string]bool, len(current))
+	added := []string{}
+	for _, loc := range current {
+		key := normalizeURL(loc)
+		if !now[key] && !before[key] {
+			added = append(added, loc)
+		}
+		now[key] = true
+	}
+	removed := []string{}
+	seen := make(map[string]bool, len(previous))
+	for _, loc := range previous {
+		key := normalizeURL(loc)
+		if !now[key] && !seen[key] {
+			removed = append(removed, loc)
+		}
+		seen[key] = true
+	}
+	return added, removed
+}
+
+// urlChanges is the part of a response telling what changed since the
+// previous run on the same sitemap. PreviousFetchedAt is null, and Baseline
+// false, on the first run.
+type urlChanges struct {
+	PreviousFetchedAt *string  `json:"previousFetchedAt"`
+	Baseline          bool     `json:"baseline"`
+	Added             []string `json:"added"`
+	Removed           []string `json:"removed"`
+}
+
+// addChanges records the URL list of a successful run in the history and adds
+// the changes since the previous run to the response. Partial runs are not
+// recorded, so they don't show URLs as removed the next time. With a store, the
+// previous run is its last complete parse of the sitemap, and processRequest
+// records the run.
+func addChanges(response *sitemapResponse, sitemapURL string, result *sitemapResult) {
+	response.urlChanges = &urlChanges{Added: []string{}, Removed: []string{}}
+
+	var previous *historyEntry
+	switch {
+	case parses != nil:
+		previous = parses.previous(sitemapURL)
+	case result.Partial:
+		previous = history.get(sitemapURL)
+	default:
+		previous = history.swap(sitemapURL, result.URLs, time.Now())
+	}
+	if previous == nil {
+		return
+	}
+
+	added, removed := changesSince(previous.urls, result.URLs)
+	fetchedAt := previous.fetchedAt.UTC().Format(time.RFC3339)
+	response.PreviousFetchedAt = &fetchedAt
+	response.Baseline = true
+	response.Added = added
+	response.Removed = removed
+}
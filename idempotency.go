@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errCodeIdempotencyConflict is reported for the requests reusing the
+// Idempotency-Key of a different request.
+const errCodeIdempotencyConflict = "IDEMPOTENCY_KEY_CONFLICT"
+
+// idempotentCall is the execution of the request first sent with an
+// Idempotency-Key. done is closed once it completed, after which the response
+// is set when it is kept for replay.
+type idempotentCall struct {
+	fingerprint string
+	done        chan struct{}
+	response    *recordedResponse
+	expires     time.Time
+}
+
+// recordedResponse is a response kept for replay.
+type recordedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// idempotencyStore holds the calls by Idempotency-Key. It is safe for
+// concurrent use.
+type idempotencyStore struct {
+	mu    sync.Mutex
+	calls map[string]*idempotentCall
+}
+
+var idempotency = &idempotencyStore{calls: make(map[string]*idempotentCall)}
+
+// requestFingerprint identifies what a request asks for: its path and query,
+// the negotiated format, and the hash of its body.
+func requestFingerprint(r *http.Request, body []byte) string {
+	sum := sha256.Sum256(body)
+	return r.URL.Path + "?" + r.URL.RawQuery + " " + r.Header.Get("Accept") + " " + hex.EncodeToString(sum[:])
+}
+
+// claim returns the call of key: the one running or completed for it when
+// there is one, with owner false, or else a new one for the caller to run.
+func (s *idempotencyStore) claim(key, fingerprint string, now time.Time) (call *idempotentCall, owner bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if call, ok := s.calls[key]; ok && (call.expires.IsZero() || now.Before(call.expires)) {
+		return call, false
+	}
+	call = &idempotentCall{fingerprint: fingerprint, done: make(chan struct{})}
+	s.calls[key] = call
+	return call, true
+}
+
+// complete ends the call of key, keeping its response for replay until ttl
+// passed, or forgetting the call when response is nil, so the next request
+// with the key runs again.
+func (s *idempotencyStore) complete(key string, call *idempotentCall, response *recordedResponse, ttl time.Duration) {
+	s.mu.Lock()
+	if response == nil {
+		if s.calls[key] == call {
+			delete(s.calls, key)
+		}
+	} else {
+		call.response = response
+		call.expires = time.Now().Add(ttl)
+	}
+	s.mu.Unlock()
+	close(call.done)
+}
+
+// sweep drops the calls expired at now, returning how many were dropped.
+func (s *idempotencyStore) sweep(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	for key, call := range s.calls {
+		if !call.expires.IsZero() && !now.Before(call.expires) {
+			delete(s.calls, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// idempotent wraps the handler of an expensive POST endpoint, so a request
+// retried with the same Idempotency-Key header doesn't run again. The first
+// request with a key runs, and its response is replayed, with an
+// Idempotent-Replayed header, to the requests repeating it within
+// IDEMPOTENCY_TTL_SECONDS, which wait for it while it runs. A request reusing
+// the key of another request is refused with a 409. Responses telling to try
+// again, server errors and 429s, aren't kept, nor are the ones larger than
+// IDEMPOTENCY_MAX_BYTES.
+func idempotent(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || r.Method != http.MethodPost || configFrom(r.Context()).idempotencyTTL <= 0 {
+			handler(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeRequestError(w, bodyReadError(err, "Failed to read request body"))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := requestFingerprint(r, body)
+		// Clients holding different API keys never share a key
+		key = apiKeyFrom(r.Context()) + " " + key
+
+		for {
+			call, owner := idempotency.claim(key, fingerprint, time.Now())
+			if call.fingerprint != fingerprint {
+				writeAPIError(w, http.StatusConflict, errCodeIdempotencyConflict, "Idempotency-Key already used for a different request", nil)
+				return
+			}
+			if owner {
+				runIdempotent(w, r, handler, key, call)
+				return
+			}
+
+			select {
+			case <-call.done:
+			case <-r.Context().Done():
+				return
+			}
+			if response := call.response; response != nil {
+				replayResponse(w, response)
+				return
+			}
+			// The call wasn't kept: run the request, unless another retry took the key over
+		}
+	}
+}
+
+// runIdempotent runs the handler as the call of key, recording its response.
+func runIdempotent(w http.ResponseWriter, r *http.Request, handler http.HandlerFunc, key string, call *idempotentCall) {
+	config := configFrom(r.Context())
+	recorder := &responseRecorder{ResponseWriter: w, limit: config.idempotencyMaxBytes}
+	completed := false
+	defer func() {
+		// A handler aborting its reply leaves nothing to replay
+		if !completed {
+			idempotency.complete(key, call, nil, 0)
+		}
+	}()
+	handler(recorder, r)
+	completed = true
+
+	var response *recordedResponse
+	if status := recorder.statusCode(); status < 500 && status != http.StatusTooManyRequests && !recorder.overflow {
+		response = &recordedResponse{status: status, header: recorder.header, body: recorder.body.Bytes()}
+	}
+	idempotency.complete(key, call, response, config.idempotencyTTL)
+}
+
+// replayResponse writes a kept response again, under the ID of the request
+// replayed to.
+func replayResponse(w http.ResponseWriter, response *recordedResponse) {
+	for name, values := range response.header {
+		if name == requestIDHeader && w.Header().Get(requestIDHeader) != "" {
+			continue
+		}
+		w.Header()[name] = append([]string(nil), values...)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(response.status)
+	w.Write(response.body)
+}
+
+// responseRecorder writes a response through while keeping a copy of it, up
+// to limit bytes of body.
+type responseRecorder struct {
+	http.ResponseWriter
+	limit int
+
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+		w.header = w.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.overflow {
+		if w.body.Len()+len(p) > w.limit {
+			w.overflow = true
+			w.body.Reset()
+		} else {
+			w.body.Write(p)
+		}
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush sends what was written so far to the client.
+func (w *responseRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// statusCode returns the status of the response, which is a 200 when the
+// handler wrote nothing.
+func (w *responseRecorder) statusCode() int {
+	if w.status == 0 {
+		w.status = http.StatusOK
+		w.header = w.Header().Clone()
+	}
+	return w.status
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingSitemap serves a sitemap, counting its fetches, each held until
+// hold returns.
+func countingSitemap(t *testing.T, hold func()) (*httptest.Server, *int32) {
+	t.Helper()
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		if hold != nil {
+			hold()
+		}
+		fmt.Fprint(w, urlSet("https://example.com/a"))
+	}))
+	t.Cleanup(server.Close)
+	return server, &fetches
+}
+
+// freshIdempotency keeps the calls of the test in a store of their own.
+func freshIdempotency(t *testing.T) {
+	previous := idempotency
+	idempotency = &idempotencyStore{calls: make(map[string]*idempotentCall)}
+	t.Cleanup(func() { idempotency = previous })
+}
+
+// idempotentPost posts the parse of sitemapURL to /v1/sitemap with key, and
+// query when it isn't empty.
+func idempotentPost(sitemapURL, key, query string, header ...string) *httptest.ResponseRecorder {
+	path := "/v1/sitemap"
+	if query != "" {
+		path += "?" + query
+	}
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"sitemap":"`+sitemapURL+`","cache":false}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Idempotency-Key", key)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	return serve(r)
+}
+
+func TestIdempotencyReplays(t *testing.T) {
+	useLocalConfig(t, map[string]string{"ACCESS_LOG": "0"})
+	captureLogs(t)
+	server, fetches := countingSitemap(t, nil)
+	freshIdempotency(t)
+	key := t.Name()
+
+	first := idempotentPost(server.URL, key, "")
+	if first.Code != http.StatusOK || first.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("first = %d replayed %q: %s", first.Code, first.Header().Get("Idempotent-Replayed"), first.Body)
+	}
+	second := idempotentPost(server.URL, key, "")
+	if second.Code != http.StatusOK || second.Header().Get("Idempotent-Replayed") != "true" || second.Body.String() != first.Body.String() {
+		t.Errorf("retry = %d replayed %q: %s, want the first response replayed", second.Code, second.Header().Get("Idempotent-Replayed"), second.Body)
+	}
+	if n := atomic.LoadInt32(fetches); n != 1 {
+		t.Errorf("fetched the sitemap %d times, want once", n)
+	}
+}
+
+func TestIdempotencyAttachesToTheCallInFlight(t *testing.T) {
+	useLocalConfig(t, map[string]string{"ACCESS_LOG": "0"})
+	captureLogs(t)
+	fetching := make(chan struct{}, 2)
+	release := make(chan struct{})
+	server, fetches := countingSitemap(t, func() {
+		fetching <- struct{}{}
+		<-release
+	})
+	freshIdempotency(t)
+	key := t.Name()
+
+	responses := make([]*httptest.ResponseRecorder, 2)
+	var requests sync.WaitGroup
+	requests.Add(2)
+	go func() {
+		defer requests.Done()
+		responses[0] = idempotentPost(server.URL, key, "")
+	}()
+	<-fetching
+	go func() {
+		defer requests.Done()
+		responses[1] = idempotentPost(server.URL, key, "")
+	}()
+	// Give the retry the time to wait for the first request
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	requests.Wait()
+
+	if responses[0].Code != http.StatusOK || responses[1].Code != http.StatusOK {
+		t.Fatalf("responses = %d and %d, want both 200", responses[0].Code, responses[1].Code)
+	}
+	if responses[1].Header().Get("Idempotent-Replayed") != "true" || responses[1].Body.String() != responses[0].Body.String() {
+		t.Errorf("retry = %s, want the response of the request in flight replayed", responses[1].Body)
+	}
+	if n := atomic.LoadInt32(fetches); n != 1 {
+		t.Errorf("fetched the sitemap %d times, want once", n)
+	}
+}
+
+func TestIdempotencyConflicts(t *testing.T) {
+	useLocalConfig(t, map[string]string{"ACCESS_LOG": "0"})
+	captureLogs(t)
+	server, fetches := countingSitemap(t, nil)
+	freshIdempotency(t)
+	key := t.Name()
+
+	if w := idempotentPost(server.URL+"/sitemap.xml", key, ""); w.Code != http.StatusOK {
+		t.Fatalf("first = %d: %s", w.Code, w.Body)
+	}
+	tests := []struct {
+		name       string
+		sitemapURL string
+		query      string
+	}{
+		{"other payload", server.URL + "/other.xml", ""},
+		{"other query", server.URL + "/sitemap.xml", "pageSize=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := idempotentPost(tt.sitemapURL, key, tt.query)
+			assertErrorCode(t, w, http.StatusConflict, errCodeIdempotencyConflict)
+		})
+	}
+	if n := atomic.LoadInt32(fetches); n != 1 {
+		t.Errorf("fetched %d times, want only the first request to run", n)
+	}
+}
+
+func TestIdempotencyScopedToTheAPIKey(t *testing.T) {
+	useLocalConfig(t, map[string]string{"ACCESS_LOG": "0", "API_KEYS": "dashboard=dashboard-secret,pipeline=pipeline-secret"})
+	captureLogs(t)
+	server, fetches := countingSitemap(t, nil)
+	freshIdempotency(t)
+	key := t.Name()
+
+	for _, apiKey := range []string{"dashboard-secret", "pipeline-secret"} {
+		w := idempotentPost(server.URL, key, "", apiKeyHeader, apiKey)
+		if w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" {
+			t.Errorf("%s = %d replayed %q, want its own run", apiKey, w.Code, w.Header().Get("Idempotent-Replayed"))
+		}
+	}
+	if n := atomic.LoadInt32(fetches); n != 2 {
+		t.Errorf("fetched %d times, want once for each API key", n)
+	}
+	if w := idempotentPost(server.URL, key, "", apiKeyHeader, "pipeline-secret"); w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry with the same API key = %d, want the response replayed", w.Code)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// errCodeTooManyInFlight is reported for the requests turned away because
+// their endpoint already handles as many as it may at once.
+const errCodeTooManyInFlight = "TOO_MANY_IN_FLIGHT"
+
+// inFlightRetryAfter is the Retry-After, in seconds, of the requests turned
+// away by a full endpoint.
+const inFlightRetryAfter = 1
+
+// endpointLoad counts the requests of an endpoint being handled.
+type endpointLoad struct {
+	// limit returns the bound of the endpoint, which a reload of the
+	// configuration may change.
+	limit    func() int
+	current  int
+	rejected int64
+}
+
+// inFlightSet bounds the requests handled at once, by endpoint. It is safe for
+// concurrent use.
+type inFlightSet struct {
+	mu        sync.Mutex
+	endpoints map[string]*endpointLoad
+}
+
+var inFlight = &inFlightSet{endpoints: make(map[string]*endpointLoad)}
+
+// limit wraps the handler of path, replying with a 429 to the requests coming
+// while limit() of them are handled already. A limit of zero only counts them.
+func (s *inFlightSet) limit(path string, limit func() int, handler http.HandlerFunc) http.HandlerFunc {
+	s.mu.Lock()
+	load := &endpointLoad{limit: limit}
+	s.endpoints[path] = load
+	s.mu.Unlock()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := load.limit()
+		s.mu.Lock()
+		if limit > 0 && load.current >= limit {
+			load.rejected++
+			s.mu.Unlock()
+			writeAPIError(w, http.StatusTooManyRequests, errCodeTooManyInFlight, fmt.Sprintf("%s handles %d requests at once; try again later", path, limit), map[string]interface{}{"limit": limit, "retryAfterSeconds": inFlightRetryAfter})
+			return
+		}
+		load.current++
+		s.mu.Unlock()
+
+		defer func() {
+			s.mu.Lock()
+			load.current--
+			s.mu.Unlock()
+		}()
+		handler(w, r)
+	}
+}
+
+// inFlightMetrics reports the requests of an endpoint handled at once against
+// its limit, and the requests turned away since the start.
+type inFlightMetrics struct {
+	Path     string `json:"path"`
+	InFlight int    `json:"inFlight"`
+	Limit    int    `json:"limit"`
+	Rejected int64  `json:"rejected"`
+}
+
+// metrics reports the endpoints, by path.
+func (s *inFlightSet) metrics() []inFlightMetrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	metrics := make([]inFlightMetrics, 0, len(s.endpoints))
+	for path, load := range s.endpoints {
+		metrics = append(metrics, inFlightMetrics{Path: path, InFlight: load.current, Limit: load.limit(), Rejected: load.rejected})
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].Path < metrics[j].Path })
+	return metrics
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInFlightLimit(t *testing.T) {
+	useLocalConfig(t, map[string]string{"MAX_INFLIGHT_SITEMAP": "2", "CACHE_TTL_SECONDS": "0", "ACCESS_LOG": "0"})
+	captureLogs(t)
+	release := make(chan struct{})
+	releaseAll := sync.OnceFunc(func() { close(release) })
+	var started int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&started, 1)
+		<-release
+		fmt.Fprint(w, urlSet("https://example.com/"))
+	}))
+	defer upstream.Close()
+	defer releaseAll()
+	handler := newRoutes().handler()
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	// Two requests held by the slow upstream fill the endpoint
+	var held sync.WaitGroup
+	statuses := make([]int, 2)
+	for i := range statuses {
+		held.Add(1)
+		go func(i int) {
+			defer held.Done()
+			statuses[i] = get(fmt.Sprintf("/v1/sitemap?url=%s/sitemap-%d.xml", upstream.URL, i)).Code
+		}(i)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&started) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the held requests never reached the upstream")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Every request past them is turned away at once, in parallel
+	var hammering sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		hammering.Add(1)
+		go func(i int) {
+			defer hammering.Done()
+			w := get(fmt.Sprintf("/v1/sitemap?url=%s/other-%d.xml", upstream.URL, i))
+			assertErrorCode(t, w, http.StatusTooManyRequests, errCodeTooManyInFlight)
+			if retry := w.Header().Get("Retry-After"); retry != "1" {
+				t.Errorf("Retry-After = %q, want 1", retry)
+			}
+		}(i)
+	}
+	hammering.Wait()
+	if n := atomic.LoadInt32(&started); n != 2 {
+		t.Errorf("%d upstream fetches, want none for the rejected requests", n)
+	}
+	// Other endpoints aren't starved
+	if w := get("/v1/ping"); w.Code != http.StatusOK {
+		t.Errorf("/v1/ping = %d while /v1/sitemap is full", w.Code)
+	}
+	for _, m := range inFlight.metrics() {
+		if m.Path == "/v1/sitemap" && (m.InFlight != 2 || m.Limit != 2 || m.Rejected != 20) {
+			t.Errorf("metrics = %+v, want 2 in flight against 2, with 20 rejected", m)
+		}
+	}
+
+	releaseAll()
+	held.Wait()
+	if statuses[0] != http.StatusOK || statuses[1] != http.StatusOK {
+		t.Errorf("held requests = %v, want both served", statuses)
+	}
+	// Once they are done, the endpoint takes requests again
+	if w := get("/v1/sitemap?url=" + upstream.URL + "/sitemap-2.xml"); w.Code != http.StatusOK {
+		t.Errorf("status = %d after the held requests ended: %s", w.Code, w.Body)
+	}
+}
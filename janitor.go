@@ -0,0 +1,136 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// sweeper is implemented by the holders of expiring entries.
+type sweeper interface {
+	// sweep removes the entries expired at now and returns how many it removed.
+	sweep(now time.Time) int
+}
+
+// janitor periodically sweeps a set of sweepers, by name. Each sweeper guards
+// its own entries, so sweeps never race with their readers.
+type janitor struct {
+	interval time.Duration
+	// now is the clock of the sweeps.
+	now      func() time.Time
+	sweepers map[string]sweeper
+
+	stop chan struct{}
+	done chan struct{}
+
+	mu      sync.Mutex
+	sweeps  int
+	last    map[string]int
+	removed map[string]int
+}
+
+// cleanup is the janitor of the service, started by main.
+var cleanup *janitor
+
+func newJanitor(interval time.Duration, now func() time.Time, sweepers map[string]sweeper) *janitor {
+	return &janitor{
+		interval: interval,
+		now:      now,
+		sweepers: sweepers,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		last:     make(map[string]int),
+		removed:  make(map[string]int),
+	}
+}
+
+// serviceSweepers returns the sweepers of the service: the in-memory cache,
+// the paginated results, the DNS cache, the circuit breakers, the host rate
+// limits, the client rate limits, and the store when there is one. Redis
+// expires its entries itself.
+func serviceSweepers() map[string]sweeper {
+	sweepers := map[string]sweeper{"results": results, "dns": resolver, "breakers": breakers, "politeness": politeness, "clients": clientRates, "idempotency": idempotency}
+	if memory, ok := cache.(*resultCache); ok {
+		sweepers["cache"] = memory
+	}
+	if parses != nil {
+		sweepers["store"] = parses
+	}
+	return sweepers
+}
+
+// start sweeps every interval until close is called. A janitor without an
+// interval never sweeps.
+func (j *janitor) start() {
+	if j.interval <= 0 {
+		close(j.done)
+		return
+	}
+	go func() {
+		defer close(j.done)
+		ticker := time.NewTicker(j.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				j.sweep()
+			case <-j.stop:
+				return
+			}
+		}
+	}()
+}
+
+// close stops the janitor, waiting for a sweep in progress to end.
+func (j *janitor) close() {
+	close(j.stop)
+	<-j.done
+}
+
+// sweep runs every sweeper once, logging what they removed, and returns the
+// number of entries removed by name.
+func (j *janitor) sweep() map[string]int {
+	now := j.now()
+	removed := make(map[string]int, len(j.sweepers))
+	var names []string
+	for name, s := range j.sweepers {
+		removed[name] = s.sweep(now)
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	var counts []interface{}
+	for _, name := range names {
+		if removed[name] > 0 {
+			counts = append(counts, name, removed[name])
+		}
+	}
+	if len(counts) > 0 {
+		logger.Info("janitor removed expired entries", counts...)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.sweeps++
+	j.last = removed
+	for name, n := range removed {
+		j.removed[name] += n
+	}
+	return removed
+}
+
+// stats returns the number of sweeps done, the entries removed by the last one
+// and the entries removed in total, by name.
+func (j *janitor) stats() (int, map[string]int, map[string]int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	last := make(map[string]int, len(j.last))
+	for name, n := range j.last {
+		last[name] = n
+	}
+	total := make(map[string]int, len(j.removed))
+	for name, n := range j.removed {
+		total[name] = n
+	}
+	return j.sweeps, last, total
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingSweeper counts its sweeps, removing nothing.
+type countingSweeper struct {
+	sweeps int32
+}
+
+func (s *countingSweeper) sweep(time.Time) int {
+	atomic.AddInt32(&s.sweeps, 1)
+	return 0
+}
+
+func TestJanitorSweepsWhatExpired(t *testing.T) {
+	captureLogs(t)
+	clock := time.Now()
+	memory := newResultCache(100, 1<<20)
+	memory.set("sitemap https://example.com/a.xml {}", &cacheEntry{}, time.Minute)
+	memory.set("sitemap https://example.com/b.xml {}", &cacheEntry{}, 10*time.Minute)
+	stored := newResultStore(5 * time.Minute)
+	id := stored.put(&storedResult{})
+	j := newJanitor(time.Minute, func() time.Time { return clock }, map[string]sweeper{"cache": memory, "results": stored})
+
+	steps := []struct {
+		elapsed time.Duration
+		cache   int
+		results int
+	}{
+		{0, 0, 0},
+		{2 * time.Minute, 1, 0},
+		{6 * time.Minute, 0, 1},
+		{11 * time.Minute, 1, 0},
+		{time.Hour, 0, 0},
+	}
+	start := clock
+	for _, step := range steps {
+		clock = start.Add(step.elapsed)
+		removed := j.sweep()
+		if removed["cache"] != step.cache || removed["results"] != step.results {
+			t.Errorf("after %s: removed %v, want %d cache entries and %d results", step.elapsed, removed, step.cache, step.results)
+		}
+	}
+	if stored.get(id) != nil || len(memory.entries) != 0 {
+		t.Error("entries are left past their expiry")
+	}
+
+	sweeps, last, total := j.stats()
+	if sweeps != len(steps) || last["cache"] != 0 || total["cache"] != 2 || total["results"] != 1 {
+		t.Errorf("stats = %d sweeps, last %v, total %v, want %d sweeps removing 2 cache entries and 1 result", sweeps, last, total, len(steps))
+	}
+}
+
+func TestJanitorStartAndClose(t *testing.T) {
+	counter := &countingSweeper{}
+	j := newJanitor(5*time.Millisecond, time.Now, map[string]sweeper{"counter": counter})
+	j.start()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&counter.sweeps) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the janitor didn't sweep every interval")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	j.close()
+	closed := atomic.LoadInt32(&counter.sweeps)
+	time.Sleep(20 * time.Millisecond)
+	if n := atomic.LoadInt32(&counter.sweeps); n != closed {
+		t.Errorf("%d sweeps after close, want none", n-closed)
+	}
+
+	// Without an interval, the janitor never sweeps
+	idle := &countingSweeper{}
+	j = newJanitor(0, time.Now, map[string]sweeper{"idle": idle})
+	j.start()
+	j.close()
+	if n := atomic.LoadInt32(&idle.sweeps); n != 0 {
+		t.Errorf("%d sweeps without an interval, want none", n)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// unixSocketPrefix starts the listen addresses of Unix domain sockets.
+const unixSocketPrefix = "unix://"
+
+// validateListenAddr reports why addr can't be listened on, or nil.
+func validateListenAddr(addr string) error {
+	if strings.HasPrefix(addr, unixSocketPrefix) {
+		if path := strings.TrimPrefix(addr, unixSocketPrefix); path == "" {
+			return fmt.Errorf("invalid listen address %q: expected the path of the socket, such as unix:///run/sitemap-parser.sock", addr)
+		}
+		return nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid listen address %q: expected host:port, such as :8080 or 127.0.0.1:8080", addr)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid listen address %q: port %q isn't a number from 0 to 65535", addr, port)
+	}
+	if host != "" && net.ParseIP(host) == nil && strings.ContainsAny(host, " /\\?#@") {
+		return fmt.Errorf("invalid listen address %q: host %q isn't an IP address or host name", addr, host)
+	}
+	return nil
+}
+
+// parseSocketMode parses the octal file mode of a Unix domain socket.
+func parseSocketMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid socket mode %q: expected octal permissions, such as 0660", value)
+	}
+	return os.FileMode(mode), nil
+}
+
+// listen opens the listener of the API on addr, once validated, a Unix domain
+// socket being given socketMode. Its Addr is the address actually bound, with
+// the port picked for port 0.
+func listen(addr string, socketMode os.FileMode) (net.Listener, error) {
+	if err := validateListenAddr(addr); err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(addr, unixSocketPrefix) {
+		return listenUnix(strings.TrimPrefix(addr, unixSocketPrefix), socketMode)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// newAPIServer returns a server of handler, configured by c.
+func newAPIServer(c *Config, handler http.Handler) *http.Server {
+	return &http.Server{Handler: handler, ReadHeaderTimeout: c.readHeaderTimeout}
+}
+
+// listenUnix opens a Unix domain socket at path, with mode. A
+// socket file left over by a process that is gone is removed first, but not
+// one a process still listens on, nor a file that isn't a socket. Closing the
+// listener, as shutting down the server does, removes the socket file.
+//
+// The socket is created in a directory only this process can enter, and given
+// mode there before it is moved to path, so no client can connect to it while
+// its permissions are still those of the umask.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("listening on %s: the file exists and isn't a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("listening on %s: another process is listening on the socket", path)
+		}
+		logger.Info("removing stale socket", "path", path)
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	private, err := os.MkdirTemp(filepath.Dir(path), ".listen-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(private)
+	created := filepath.Join(private, "sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: created, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The socket file is removed at path on close, not where it was created
+	listener.SetUnlinkOnClose(false)
+	if err := os.Chmod(created, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if err := os.Rename(created, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: listener, addr: &net.UnixAddr{Name: path, Net: "unix"}}, nil
+}
+
+// unixListener is a listener on the Unix domain socket at addr, removing its
+// file when closed.
+type unixListener struct {
+	*net.UnixListener
+	addr *net.UnixAddr
+}
+
+// Addr returns the address of the socket file.
+func (l *unixListener) Addr() net.Addr {
+	return l.addr
+}
+
+// Close stops listening and removes the socket file. Only the first call does.
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	if err == nil {
+		os.Remove(l.addr.Name)
+	}
+	return err
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// serveListener serves the API on listener until the test is over.
+func serveListener(t *testing.T, listener net.Listener) {
+	t.Helper()
+	server := newAPIServer(currentConfig(), newRoutes().handler())
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+}
+
+func TestListenOnPortZero(t *testing.T) {
+	useLocalConfig(t, map[string]string{"ACCESS_LOG": "0"})
+	listener, err := listen("127.0.0.1:0", 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveListener(t, listener)
+
+	addr, ok := listener.Addr().(*net.TCPAddr)
+	if !ok || addr.Port == 0 || !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("listening on %v, want the port picked on 127.0.0.1", listener.Addr())
+	}
+	resp, err := http.Get("http://" + addr.String() + "/v1/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(body) != "Pong!" {
+		t.Errorf("ping = %d %q, want 200 Pong!", resp.StatusCode, body)
+	}
+}
+
+func TestServerReadHeaderTimeout(t *testing.T) {
+	useLocalConfig(t, map[string]string{"ACCESS_LOG": "0", "READ_HEADER_TIMEOUT_SECONDS": "1"})
+	if timeout := newAPIServer(currentConfig(), nil).ReadHeaderTimeout; timeout != time.Second {
+		t.Fatalf("ReadHeaderTimeout = %s, want the 1s configured", timeout)
+	}
+	listener, err := listen("127.0.0.1:0", 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveListener(t, listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The headers never end
+	if _, err := io.WriteString(conn, "GET /v1/ping HTTP/1.1\r\nHost: localhost\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	started := time.Now()
+	conn.SetReadDeadline(started.Add(5 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("connection still open after %s: %v", time.Since(started), err)
+	}
+	if elapsed := time.Since(started); elapsed > 3*time.Second {
+		t.Errorf("connection closed after %s, want about the 1s configured", elapsed)
+	}
+}
+
+// unixClient returns a client sending every request to the socket at path.
+func unixClient(path string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+}
+
+func TestListenOnUnixSocket(t *testing.T) {
+	useLocalConfig(t, map[string]string{"ACCESS_LOG": "0"})
+	captureLogs(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "api.sock")
+
+	listener, err := listen(unixSocketPrefix+path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveListener(t, listener)
+	if addr := listener.Addr().String(); addr != path {
+		t.Errorf("listening on %s, want %s", addr, path)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Errorf("socket file mode = %s, want a socket with 0600", info.Mode())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("directory holds %d files, want only the socket", len(entries))
+	}
+
+	resp, err := unixClient(path).Get("http://sitemap-parser/v1/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "Pong!" {
+		t.Errorf("ping = %d %q, want 200 Pong!", resp.StatusCode, body)
+	}
+
+	// A second service can't take the socket over
+	if other, err := listen(unixSocketPrefix+path, 0600); err == nil {
+		other.Close()
+		t.Error("listened on a socket another listener serves")
+	}
+	if err := listener.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file left after closing: %v", err)
+	}
+}
+
+func TestListenOnUnixSocketLeftOver(t *testing.T) {
+	captureLogs(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "api.sock")
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A process that is gone leaves its socket file behind
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listen(unixSocketPrefix+path, 0660)
+	if err != nil {
+		t.Fatalf("listen over a stale socket: %v", err)
+	}
+	listener.Close()
+
+	regular := filepath.Join(dir, "file")
+	if err := os.WriteFile(regular, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if listener, err := listen(unixSocketPrefix+regular, 0660); err == nil {
+		listener.Close()
+		t.Error("listened over a file that isn't a socket")
+	}
+}
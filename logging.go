@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// logLevelVar is the level of logger, which a reload of the configuration
+// changes.
+var logLevelVar = &slog.LevelVar{}
+
+// logger is the logger of the events of the service outside of any request,
+// and the one the logger of a request derives from. It is the default logger
+// of slog too. main replaces it with the one of the configured format and
+// level.
+var logger = newLogger(os.Stderr, "text", slog.LevelInfo)
+
+// parseLogLevel returns the level named by value, or info when it names none.
+func parseLogLevel(value string) (slog.Level, bool) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(value))); err != nil {
+		return slog.LevelInfo, false
+	}
+	return level, true
+}
+
+// newLogger returns the logger writing the events at level or above to w, in
+// format, text or json, and makes it the default logger of slog. Its level is
+// logLevelVar.
+func newLogger(w io.Writer, format string, level slog.Level) *slog.Logger {
+	logLevelVar.Set(level)
+	options := &slog.HandlerOptions{Level: logLevelVar}
+	var handler slog.Handler
+	if strings.ToLower(format) == "json" {
+		handler = slog.NewJSONHandler(w, options)
+	} else {
+		handler = slog.NewTextHandler(w, options)
+	}
+	l := slog.New(handler)
+	slog.SetDefault(l)
+	return l
+}
+
+// loggerKey is the context key of the logger of a request.
+type loggerKey struct{}
+
+// withLogger returns ctx with the events of its request logged through l.
+func withLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// loggerFrom returns the logger of the request of ctx, which tells its request
+// ID, or the logger of the service outside of any request.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return logger
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
-	"encoding/xml"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -20,37 +26,384 @@ type Sitemap struct {
 
 // SitemapURL represents a URL in a sitemap.
 type SitemapURL struct {
-	Loc string `xml:"loc"`
+	Loc        string `xml:"loc" json:"loc"`
+	Lastmod    string `xml:"lastmod" json:"lastmod,omitempty"`
+	Changefreq string `xml:"changefreq" json:"changefreq,omitempty"`
+	Priority   string `xml:"priority" json:"priority,omitempty"`
 }
 
 // SitemapSitemap represents a sitemap in a sitemap index.
 type SitemapSitemap struct {
-	Loc string `xml:"loc"`
+	Loc     string `xml:"loc"`
+	Lastmod string `xml:"lastmod"`
 }
 
-// parseSitemapFromRobotsTxt function is used to parse the sitemap from robots.txt.
-// Input: robotsTxt string
-// Output: sitemap string
-func parseSitemapFromRobotsTxt(robotsTxt string) string {
+// lastmodLayouts are the W3C datetime layouts allowed for sitemap lastmod values.
+var lastmodLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+}
+
+// parseLastmod parses a sitemap lastmod value.
+//
+// It returns false when the value is empty or not in a W3C datetime format.
+func parseLastmod(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	for _, layout := range lastmodLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// requestPayload represents the JSON payload accepted by the domain and sitemap endpoints.
+type requestPayload struct {
+	Domain       string `json:"domain"`
+	Sitemap      string `json:"sitemap"`
+	DiscoverOnly bool   `json:"discoverOnly"`
+
+	CandidatePaths []string `json:"candidatePaths"`
+
+	MaxDepth    *int `json:"maxDepth"`
+	MaxSitemaps *int `json:"maxSitemaps"`
+	MaxURLs     *int `json:"maxUrls"`
+
+	TimeoutSeconds *int `json:"timeoutSeconds"`
+
+	AllowCrossHost bool `json:"allowCrossHost"`
+	GroupBySource  bool `json:"groupBySource"`
+
+	Format string `json:"format"`
+
+	CallbackURL string `json:"callbackUrl"`
+
+	ModifiedSince string `json:"modifiedSince"`
+
+	Include    []string   `json:"include"`
+	Exclude    []string   `json:"exclude"`
+	PathPrefix stringList `json:"pathPrefix"`
+
+	IncludeExtensions []string `json:"includeExtensions"`
+	ExcludeExtensions []string `json:"excludeExtensions"`
+
+	Sort string `json:"sort"`
+
+	DiffAgainstPrevious bool `json:"diffAgainstPrevious"`
+
+	Sample *int   `json:"sample"`
+	Seed   *int64 `json:"seed"`
+
+	SameHostOnly bool `json:"sameHostOnly"`
+	IgnoreWWW    bool `json:"ignoreWww"`
+
+	MinPriority          *float64 `json:"minPriority"`
+	IncludeUnprioritized *bool    `json:"includeUnprioritized"`
+
+	PageSize *int   `json:"pageSize"`
+	Cursor   string `json:"cursor"`
+
+	Cache   *bool `json:"cache"`
+	Refresh bool  `json:"refresh"`
+
+	Debug bool `json:"debug"`
+
+	// onURLs, when set, streams the URLs out as they are parsed.
+	onURLs func(sitemap string, urls []SitemapURL)
+
+	// upload, when set, is the body of an uploaded root sitemap.
+	upload []byte
+}
+
+// timeout returns the time budget of the request, which covers discovery and
+// the whole sitemap walk. The payload can only lower the default of c.
+func (p requestPayload) timeout(c *Config) (time.Duration, error) {
+	requestTimeout := c.requestTimeout
+	if p.TimeoutSeconds == nil {
+		return requestTimeout, nil
+	}
+	budget := time.Duration(*p.TimeoutSeconds) * time.Second
+	if budget <= 0 || budget > requestTimeout {
+		return 0, fmt.Errorf("Invalid 'timeoutSeconds': must be between 1 and %d", int(requestTimeout/time.Second))
+	}
+	return budget, nil
+}
+
+// perFetchTimeout returns the timeout of each fetch of the request. Setting
+// timeoutSeconds makes it the bound of every fetch as well as of the request,
+// instead of the fetchTimeout of c.
+func (p requestPayload) perFetchTimeout(c *Config, budget time.Duration) time.Duration {
+	if p.TimeoutSeconds == nil {
+		return c.fetchTimeout
+	}
+	return budget
+}
 
-	// Split the robotsTxt by new line character to get the lines
-	lines := strings.Split(robotsTxt, "\n")
+// Response formats supported by the domain and sitemap endpoints.
+const (
+	formatJSON   = "json"
+	formatTree   = "tree"
+	formatNDJSON = "ndjson"
+	formatCSV    = "csv"
+	formatXML    = "xml"
+)
 
-	// Loop over each line in the lines
-	for _, line := range lines {
+// acceptFormats maps the media types of the Accept header to response formats.
+var acceptFormats = map[string]string{
+	"application/x-ndjson": formatNDJSON,
+	"text/csv":             formatCSV,
+	"application/xml":      formatXML,
+	"text/xml":             formatXML,
+}
 
-		// Check if the line starts with "Sitemap:"
-		if strings.HasPrefix(line, "Sitemap:") {
+// formatFromAccept returns the response format for the first media type of an
+// Accept header that has one, or an empty string when none does.
+func formatFromAccept(accept string) string {
+	for _, mediaType := range strings.Split(accept, ",") {
+		if i := strings.Index(mediaType, ";"); i >= 0 {
+			mediaType = mediaType[:i]
+		}
+		if format, ok := acceptFormats[strings.ToLower(strings.TrimSpace(mediaType))]; ok {
+			return format
+		}
+	}
+	return ""
+}
 
-			// If it does, then trim the prefix "Sitemap: " from the line
-			return strings.TrimPrefix(line, "Sitemap: ")
+// walkOptions returns the walk options for the request, applying any limits
+// overridden in the payload on top of the defaults of c.
+func (p requestPayload) walkOptions(c *Config) (walkOptions, error) {
+	opts := defaultWalkOptions(c)
+	opts.AllowCrossHost = p.AllowCrossHost
+	opts.GroupBySource = p.GroupBySource
+	opts.OnURLs = p.onURLs
+	opts.Upload = p.upload
+	filter, err := p.urlFilter()
+	if err != nil {
+		return opts, err
+	}
+	opts.Filter = filter
+	switch p.Format {
+	case "", formatJSON:
+	case formatTree:
+		opts.Tree = true
+	case formatNDJSON, formatCSV, formatXML:
+		// Each streamed line already names its sitemap
+		if p.GroupBySource {
+			return opts, fmt.Errorf("Invalid 'groupBySource': not supported with the %q format", p.Format)
+		}
+	default:
+		return opts, fmt.Errorf("Invalid 'format': %q is not supported", p.Format)
+	}
+	if p.ModifiedSince != "" {
+		since, err := time.Parse(time.RFC3339, p.ModifiedSince)
+		if err != nil {
+			since, err = time.Parse("2006-01-02", p.ModifiedSince)
+		}
+		if err != nil {
+			return opts, fmt.Errorf("Invalid 'modifiedSince': expected RFC3339 or YYYY-MM-DD")
+		}
+		opts.ModifiedSince = since
+	}
+	settings := c
+	if p.MaxDepth != nil {
+		if *p.MaxDepth < 0 || *p.MaxDepth > settings.maxSitemapDepth {
+			return opts, fmt.Errorf("Invalid 'maxDepth': must be between 0 and %d", settings.maxSitemapDepth)
+		}
+		opts.MaxDepth = *p.MaxDepth
+	}
+	if p.MaxSitemaps != nil {
+		if *p.MaxSitemaps < 0 || *p.MaxSitemaps > settings.maxChildSitemaps {
+			return opts, fmt.Errorf("Invalid 'maxSitemaps': must be between 0 and %d", settings.maxChildSitemaps)
+		}
+		opts.MaxSitemaps = *p.MaxSitemaps
+	}
+	if p.MaxURLs != nil {
+		if *p.MaxURLs < 0 || *p.MaxURLs > settings.maxSitemapURLs {
+			return opts, fmt.Errorf("Invalid 'maxUrls': must be between 0 and %d", settings.maxSitemapURLs)
 		}
+		opts.MaxURLs = *p.MaxURLs
 	}
+	if p.Sample != nil {
+		if *p.Sample < 1 || *p.Sample > settings.maxSitemapURLs {
+			return opts, fmt.Errorf("Invalid 'sample': must be between 1 and %d", settings.maxSitemapURLs)
+		}
+		// The sample replaces the URL list of the default format
+		if opts.Tree || opts.GroupBySource || opts.OnURLs != nil || (p.Format != "" && p.Format != formatJSON) {
+			return opts, fmt.Errorf("Invalid 'sample': only supported with the default format, without 'groupBySource'")
+		}
+		opts.Sample = *p.Sample
+		opts.Seed = time.Now().UnixNano()
+		if p.Seed != nil {
+			opts.Seed = *p.Seed
+		}
+	}
+	return opts, nil
+}
+
+// Query parameters carrying the request target on GET requests.
+const (
+	queryParamDomain  = "domain"
+	queryParamSitemap = "url"
+)
+
+// Query parameters carrying the pagination of GET requests.
+const (
+	queryParamPageSize = "pageSize"
+	queryParamCursor   = "cursor"
+)
+
+// payloadFromQuery builds the payload of a GET request from its query parameters.
+//
+// The target is read from "domain" on the domain endpoint and from "url" on the
+// sitemap endpoint, along with "pageSize" and "cursor"; any other parameter is ignored.
+func payloadFromQuery(query url.Values, requestType string) requestPayload {
+	var payload requestPayload
+	switch requestType {
+	case "domain":
+		payload.Domain = query.Get(queryParamDomain)
+	case "sitemap":
+		payload.Sitemap = query.Get(queryParamSitemap)
+	}
+	if value := query.Get(queryParamPageSize); value != "" {
+		// A value that isn't a number is rejected like an out of range one
+		size, _ := strconv.Atoi(value)
+		payload.PageSize = &size
+	}
+	payload.Cursor = query.Get(queryParamCursor)
+	return payload
+}
 
-	// If no sitemap is found, return an empty string
+// decodePayload reads the payload of a POST request from its body.
+//
+// A JSON body is expected, except that a text/plain body, or a body without a
+// content type that isn't a JSON object, may hold just the target: its trimmed
+// single line is taken as the sitemap URL or the domain, e.g. for
+// `curl -d 'https://example.com/sitemap.xml'`. Sitemap requests may also upload
+// the sitemap as multipart/form-data. Any other content type is refused with a
+// 415, and a JSON body without one gets a Warning header. Failures are returned
+// as a *requestError.
+func decodePayload(w http.ResponseWriter, r *http.Request, requestType string) (requestPayload, error) {
+	var payload requestPayload
+	mediaType, err := requestMediaType(r, mediaTypeJSON, mediaTypeText, mediaTypeForm, mediaTypeMultipart)
+	if err != nil {
+		return payload, err
+	}
+	switch mediaType {
+	case mediaTypeMultipart:
+		if requestType != "sitemap" {
+			return payload, &requestError{http.StatusBadRequest, errCodeInvalidRequest, "File uploads are only supported on /sitemap", nil}
+		}
+		return payloadFromUpload(r)
+	case "", mediaTypeText, mediaTypeForm:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return payload, bodyReadError(err, "Failed to read the request body")
+		}
+		target := strings.TrimSpace(string(body))
+		// JSON sent without its content type keeps working
+		if mediaType != mediaTypeText && strings.HasPrefix(target, "{") {
+			if mediaType == "" {
+				w.Header().Set("Warning", missingContentTypeWarning)
+			}
+			if err := json.Unmarshal(body, &payload); err != nil {
+				return payload, &requestError{http.StatusBadRequest, errCodeInvalidRequest, "Invalid JSON payload", nil}
+			}
+			return payload, nil
+		}
+		if strings.ContainsAny(target, "\r\n") {
+			return payload, &requestError{http.StatusBadRequest, errCodeInvalidRequest, "Invalid plain text payload: expected a single line", nil}
+		}
+		switch requestType {
+		case "domain":
+			payload.Domain = target
+		case "sitemap":
+			payload.Sitemap = target
+		}
+		return payload, nil
+	}
+	if err := decodeJSONBody(r, &payload); err != nil {
+		return payload, err
+	}
+	return payload, nil
+}
+
+// walkOnly returns the payload with only its walk and filter options, for the
+// endpoints building their own response from the walk.
+func (p requestPayload) walkOnly() requestPayload {
+	p.Format = ""
+	p.GroupBySource = false
+	p.DiscoverOnly = false
+	p.Sample = nil
+	p.Sort = ""
+	p.PageSize = nil
+	p.Cursor = ""
+	p.CallbackURL = ""
+	return p
+}
+
+// field returns the value of the payload field named after the request type.
+func (p requestPayload) field(requestType string) string {
+	switch requestType {
+	case "domain":
+		return p.Domain
+	case "sitemap":
+		return p.Sitemap
+	}
 	return ""
 }
 
+// Sources a discovered sitemap URL can come from.
+const (
+	discoverySourceRobots    = "robots.txt"
+	discoverySourceCandidate = "candidate"
+	discoverySourceCaller    = "caller"
+)
+
+// sitemapDiscovery describes where the sitemap of a domain was found.
+type sitemapDiscovery struct {
+	Domain     string `json:"domain"`
+	SitemapURL string `json:"sitemapUrl"`
+	Source     string `json:"source"`
+	Path       string `json:"path,omitempty"`
+	RobotsURL  string `json:"robotsUrl,omitempty"`
+
+	Redirects *redirectTrace `json:"redirects,omitempty"`
+}
+
+// Limits on the candidate paths a caller may supply in a domain request.
+const (
+	maxCandidatePaths      = 10
+	maxCandidatePathLength = 256
+)
+
+// validateCandidatePaths checks the caller-supplied candidate paths.
+//
+// Every path must start with "/", must not contain whitespace or control
+// characters, and both the number of paths and their length are capped.
+func validateCandidatePaths(paths []string) error {
+	if len(paths) > maxCandidatePaths {
+		return fmt.Errorf("Too many candidate paths: %d (maximum is %d)", len(paths), maxCandidatePaths)
+	}
+	for _, path := range paths {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("Candidate path %q must start with '/'", path)
+		}
+		if len(path) > maxCandidatePathLength {
+			return fmt.Errorf("Candidate path exceeds %d characters", maxCandidatePathLength)
+		}
+		for _, c := range path {
+			if c <= ' ' || c == 0x7f {
+				return fmt.Errorf("Candidate path %q contains invalid characters", path)
+			}
+		}
+	}
+	return nil
+}
+
 // Function to check if a given domain string is valid
 // @param domain: string - The domain to be checked
 // @return: bool - True if the domain is valid, False otherwise
@@ -60,10 +413,20 @@ func isValidDomain(domain string) bool {
 		return false // Input string is empty
 	}
 
+	// Whitespace and control characters could smuggle another request in
+	if hasSpaceOrControl(domain) {
+		return false
+	}
+
+	// Only the http and https schemes may be given
+	if scheme, _, found := strings.Cut(domain, "://"); found && !isFetchableScheme(scheme) {
+		return false
+	}
+
 	// Check if the domain starts with "http://" or "https://",
 	// if not, prepend it to the domain for proper URL parsing
 	if !strings.HasPrefix(domain, "http://") && !strings.HasPrefix(domain, "https://") {
-		domain = "http://" + domain
+		domain = "http://" + bracketIPv6(domain)
 	}
 
 	parsedURL, err := url.Parse(domain)
@@ -71,10 +434,92 @@ func isValidDomain(domain string) bool {
 		return false // Error parsing URL
 	}
 
+	// Userinfo would hide the host actually fetched, as in user@host
+	if parsedURL.User != nil {
+		return false
+	}
+
 	// Check if the parsed URL's Host field is not empty
 	return parsedURL.Host != "" // URL's Host field is empty
 }
 
+// Function to wrap a bare IPv6 literal in brackets
+// @param domain: string - The domain, possibly a bare IPv6 address such as "2001:db8::1"
+// @return: string - The domain with IPv6 literals bracketed, e.g. "[2001:db8::1]"
+func bracketIPv6(domain string) string {
+	ip := net.ParseIP(domain)
+	if ip == nil || ip.To4() != nil {
+		return domain // Not an IPv6 literal
+	}
+	return "[" + domain + "]"
+}
+
+// hostURL builds an absolute URL for the given scheme, host and path.
+//
+// The URL is assembled with url.URL rather than string formatting so bracketed
+// IPv6 hosts and ports survive unchanged.
+func hostURL(scheme, host, path string) string {
+	u := &url.URL{Scheme: scheme, Host: host, Path: path}
+	return u.String()
+}
+
+// normalizeURL returns the canonical form of rawURL used to compare sitemap URLs.
+//
+// The scheme and host are lowercased, default ports and fragments are dropped,
+// and an empty path becomes "/". Unparseable input is returned unchanged.
+func normalizeURL(rawURL string) string {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return rawURL
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if (u.Scheme == "http" && u.Port() == "80") || (u.Scheme == "https" && u.Port() == "443") {
+		u.Host = strings.TrimSuffix(u.Host, ":"+u.Port())
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.Fragment = ""
+	return u.String()
+}
+
+// sameSite reports whether two URLs are hosted on the same site.
+//
+// Hostnames are compared case-insensitively, ignoring ports and treating the
+// "www." and bare forms of a host as equal.
+func sameSite(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	hostA := strings.TrimPrefix(strings.ToLower(ua.Hostname()), "www.")
+	hostB := strings.TrimPrefix(strings.ToLower(ub.Hostname()), "www.")
+	return hostA != "" && hostA == hostB
+}
+
+// isPrivateHost reports whether the host of rawURL is localhost or a loopback,
+// private, link-local or unspecified IP literal.
+func isPrivateHost(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return true
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
 // Function to extract a domain from a String
 // @param domain: string - The domain to be extracted
 // @return: string - The extracted domain
@@ -86,7 +531,7 @@ func extractDomain(domain string) string {
 
 	// Prepend "http://" if domain does not start with it
 	if !strings.HasPrefix(domain, "http://") && !strings.HasPrefix(domain, "https://") {
-		domain = "http://" + domain
+		domain = "http://" + bracketIPv6(domain)
 	}
 
 	parsedURL, err := url.Parse(domain)
@@ -100,244 +545,438 @@ func extractDomain(domain string) string {
 
 // getSitemapURLFromDomain retrieves the sitemap URL from the given domain.
 //
-// It takes a domain string as a parameter and returns a string and an error.
-func getSitemapURLFromDomain(domain string) (string, error) {
+// It takes the request context, a domain string and optional caller-supplied candidate
+// paths, which are probed before the built-in locations, and returns the discovery
+// details and an error.
+func getSitemapURLFromDomain(ctx context.Context, domain string, candidatePaths []string) (*sitemapDiscovery, error) {
 	// Check if the domain is valid. If not, return an error.
 	if !isValidDomain(domain) {
-		return "", fmt.Errorf("Failed to validate %s", domain)
+		return nil, &requestError{http.StatusBadRequest, errCodeInvalidDomain, fmt.Sprintf("Failed to validate %s", domain), nil}
 	}
 
 	// Extract the domain from the input.
 	domain = extractDomain(domain)
 
-	// Create an HTTP client with a timeout of 3 seconds.
-	client := http.Client{Timeout: time.Second * 3}
+	logger := loggerFrom(ctx)
 
-	// If no sitemap is found, fetch the robots.txt file.
-	robotsURL := fmt.Sprintf("https://%s/robots.txt", domain)
-	resp, err := client.Get(robotsURL)
-	if err != nil {
-		// If the request fails, return the error.
-		return "", err
+	// Fetch the robots.txt file first. A failure here must not stop discovery,
+	// so any error simply falls through to probing the candidate locations.
+	robots, err := fetchRobotsCached(ctx, domain)
+	if err == nil {
+		// A sitemap of robots.txt that isn't http or https is never fetched
+		sitemapLoc := robots.sitemapURL()
+		for _, sitemap := range robots.Sitemaps {
+			if sitemap == sitemapLoc {
+				break
+			}
+			logger.Warn("ignoring the sitemap of robots.txt, only http and https sitemaps are fetched", "domain", domain, "sitemap", sitemap)
+		}
+		// Take the first sitemap robots.txt declares
+		if sitemapLoc != "" {
+			logger.Debug("sitemap found in robots.txt", "domain", domain, "sitemap", sitemapLoc)
+			return &sitemapDiscovery{Domain: domain, SitemapURL: sitemapLoc, Source: discoverySourceRobots, RobotsURL: robots.URL}, nil
+		}
+		logger.Debug("robots.txt names no sitemap, probing candidate locations", "domain", domain)
+	} else {
+		logger.Warn("fetching robots.txt failed, probing candidate locations", "domain", domain, "err", err)
 	}
-	defer resp.Body.Close()
 
-	// If the response status is OK, parse the sitemap URL from the robots.txt file.
-	if resp.StatusCode == http.StatusOK {
-		robotsTxt, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return "", err
+	sitemapLocations := configFrom(ctx).sitemapLocations
+
+	// Probe the caller-supplied paths before the built-in locations.
+	locations := append(append([]string{}, candidatePaths...), sitemapLocations...)
+
+	// Loop through each sitemap location. A location that can't be fetched
+	// doesn't stop the others from being probed; its error is only returned
+	// when no location could be fetched at all.
+	var lastErr error
+	answered := false
+	for i, location := range locations {
+		source := discoverySourceCandidate
+		if i < len(candidatePaths) {
+			source = discoverySourceCaller
 		}
-		sitemapLoc := parseSitemapFromRobotsTxt(string(robotsTxt))
-		// Check if sitemapLoc could be extracted from robots.txt
-		if sitemapLoc != "" {
-			return sitemapLoc, nil
-		}
-	}
-
-	// Define a list of possible sitemap locations.
-	sitemapLocations := []string{
-		"/test.xml",
-		"/sitemap.xml",
-		"/sitemap1.xml",
-		"/sitemap.txt",
-		"/sitemap_index.xml",
-		"/sitemap/",
-		"/sitemap",
-		"/sitemap-index.xml",
-		"/sitemaps/",
-		"/sitemaps",
-		"/site-map",
-		"/sitemap-indexes/",
-		"/post-sitemap.xml",
-		"/page-sitemap.xml",
-		"/category-sitemap.xml",
-		"/tag-sitemap.xml",
-		"/pages-sitemap.xml",
-		"/blog-pages-sitemap.xml",
-		"/member-profile-sitemap.xml",
-		"/dynamic-pages-sitemap.xml",
-		"/other-pages-sitemap.xml",
-		"/sitemap.xml.gz",
-		"/sitemapindex.xml",
-		"/sitemap_index.xml.gz",
-		"/sitemap/index.xml",
-		"/sitemap.xml",
-		"/sitemap_map.html",
-		"/wp-sitemap.xml",
-		"/other-pages-sitemap.xml",
-		"/category-sitemap.xml",
-		"/tag-sitemap.xml",
-		"/author-sitemap.xml",
-		"/post-sitemap",
-		"/sitemaps-2-sitemap.xml",
-		"/page-sitemap",
-	}
-
-	// Loop through each sitemap location.
-	for _, location := range sitemapLocations {
+
+		// Stop probing as soon as the request is cancelled or out of time.
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		// Construct the URL.
-		url := fmt.Sprintf("https://%s%s", domain, location)
-		// Send a GET request to the URL.
-		resp, err := client.Get(url)
+		sitemapURL := hostURL("https", domain, location)
+		// Send a GET request to the URL, keeping track of any redirects.
+		probeCtx, span := startSpan(ctx, "probe candidate", spanKindClient)
+		span.set("url.full", sitemapURL, "sitemap.discovery.source", source)
+		trace := &redirectTrace{}
+		resp, err := fetchURL(probeCtx, sitemapURL, trace)
 		if err != nil {
-			// If the request fails, return the error.
-			return "", err
+			logger.Debug("probing a candidate location failed", "domain", domain, "sitemap", sitemapURL, "err", err)
+			span.fail(err)
+			span.finish()
+			lastErr = err
+			continue
 		}
-		defer resp.Body.Close()
+		answered = true
+		// Only the status matters, so release the connection right away.
+		resp.Body.Close()
+		span.set("http.response.status_code", resp.StatusCode)
+		span.finish()
 
 		// If the response status is OK, return the URL.
 		if resp.StatusCode == http.StatusOK {
-			return url, nil
+			logger.Debug("sitemap found at a candidate location", "domain", domain, "sitemap", sitemapURL, "source", source)
+			return &sitemapDiscovery{Domain: domain, SitemapURL: sitemapURL, Source: source, Path: location, Redirects: trace}, nil
 		}
 	}
 
-	// If the URL cannot be retrieved, return an error.
-	return "", fmt.Errorf("Couldn't find sitemap for %s", domain)
+	// Stop with the fetch error when no location answered, or else report
+	// that there is no sitemap.
+	if !answered && lastErr != nil {
+		logger.Warn("no candidate location could be fetched", "domain", domain, "probed", len(locations), "err", lastErr)
+		return nil, lastErr
+	}
+	logger.Info("no sitemap found", "domain", domain, "probed", len(locations))
+	return nil, &requestError{http.StatusNotFound, errCodeSitemapNotFound, fmt.Sprintf("Couldn't find sitemap for %s", domain), nil}
 }
 
-// parseSitemap parses a sitemap URL and returns a slice of URLs found in the sitemap.
+// handleRequest handles the HTTP request for both domain and sitemap endpoints.
 //
-// It takes a string parameter named 'url' which specifies the URL of the sitemap.
-// The function returns a slice of strings ([]string) containing the URLs found in the sitemap,
-// and an error if there was an error during the parsing process.
-func parseSitemap(url string) ([]string, error) {
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, err
+// It expects a GET or POST request and validates the method.
+// It reads the payload from the query string (GET) or decodes the JSON or plain text payload (POST) and checks for errors.
+// It retrieves the required field (domain or sitemap) from the payload and checks for its existence.
+// It processes the request based on the specified requestType ('domain' or 'sitemap').
+// It constructs a JSON response with the parsed URLs.
+// It marshals the JSON response and checks for errors.
+// It sets the Content-Type header to "application/json".
+// It writes the JSON response to the HTTP response writer.
+func handleRequest(w http.ResponseWriter, r *http.Request, requestType string) {
+	// Errors are reported in the negotiated format until the payload names one
+	format := formatFromAccept(r.Header.Get("Accept"))
+
+	// Read the payload from the query string for GET requests, and from the
+	// JSON body for POST requests
+	var payload requestPayload
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		payload = payloadFromQuery(r.URL.Query(), requestType)
+	case http.MethodPost:
+		// Decode the JSON payload, or take a plain text body as the target,
+		// once a gzip body is decompressed
+		err = inflateBody(r)
+		if err == nil {
+			payload, err = decodePayload(w, r, requestType)
+		}
+		if err != nil {
+			// If the payload is invalid, report it with its status
+			writeError(w, format, asRequestError(err))
+			return
+		}
+	default:
+		// For any other method, return a method not allowed error
+		if format == formatXML {
+			w.Header().Set("Allow", "GET, POST")
+			writeXMLError(w, &requestError{http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Method not allowed", nil})
+			return
+		}
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPost, http.MethodOptions)
+		return
 	}
-	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	applyCacheControl(r, &payload)
+
+	// Use the format asked for in the payload, or else the one of the Accept header
+	if payload.Format == "" {
+		payload.Format = format
 	}
+	format = payload.Format
 
-	var sitemap Sitemap
-	err = xml.Unmarshal(body, &sitemap)
-	if err != nil {
-		return nil, err
+	id := requestID(w, r)
+
+	// Reject a malformed callback URL before any fetching starts
+	if payload.CallbackURL != "" {
+		if reqErr := validateCallbackURL(configFrom(r.Context()), payload.CallbackURL); reqErr != nil {
+			writeError(w, format, reqErr)
+			return
+		}
 	}
 
-	// If sitemap contains URLs, return them
-	if len(sitemap.URLs) > 0 {
-		urls := make([]string, len(sitemap.URLs))
-		for i, u := range sitemap.URLs {
-			urls[i] = u.Loc
+	// Serve the next page of a paginated result without walking again
+	if payload.Cursor != "" {
+		response, err := nextPage(configFrom(r.Context()), payload)
+		if err != nil {
+			writeError(w, format, asRequestError(err))
+			return
 		}
-		return urls, nil
+		writeCacheableJSON(w, r, response)
+		return
 	}
 
-	// If sitemap contains sitemaps, parse each of them
-	var sitemapIndex Sitemap
-	err = xml.Unmarshal(body, &sitemapIndex)
+	// Reject a bad page size before any fetching starts
+	pageSize, err := payload.pageSize(configFrom(r.Context()))
 	if err != nil {
-		return nil, err
+		writeError(w, format, &requestError{http.StatusBadRequest, errCodeInvalidRequest, err.Error(), nil})
+		return
 	}
 
-	urls := make([]string, len(sitemapIndex.Sitemaps))
-	for i, s := range sitemapIndex.Sitemaps {
-		subUrls, err := parseSitemap(s.Loc)
-		if err != nil {
-			return nil, err
+	// Stream the URLs out when the format allows it
+	switch payload.Format {
+	case formatNDJSON:
+		handleExportRequest(w, r, requestType, payload, id, newNDJSONExporter(w))
+		return
+	case formatCSV:
+		handleExportRequest(w, r, requestType, payload, id, newCSVExporter(w, csvFilename(payload.field(requestType))))
+		return
+	case formatXML:
+		handleExportRequest(w, r, requestType, payload, id, newXMLExporter(w, requestType))
+		return
+	}
+
+	// Process the request and report failures with their HTTP status
+	response, err := processRequest(r.Context(), requestType, payload)
+	if err != nil {
+		reqErr := asRequestError(err)
+		if payload.CallbackURL != "" {
+			sendCallback(r.Context(), payload.CallbackURL, callbackBody{RequestID: id, Status: reqErr.Status, Error: reqErr.Message, Code: reqErr.Code})
 		}
-		urls[i] = fmt.Sprintf("Sitemap index: %s", s.Loc)
-		urls = append(urls, subUrls...)
+		writeRequestError(w, reqErr)
+		return
+	}
+
+	// Hold the URLs server-side and return the first page when paginating
+	if pageSize > 0 {
+		response = paginate(response, pageSize)
 	}
 
-	return urls, nil
+	// Push the result to the callback URL, if any
+	if payload.CallbackURL != "" {
+		sendCallback(r.Context(), payload.CallbackURL, callbackBody{RequestID: id, Status: http.StatusOK, Result: response})
+	}
+
+	writeCacheableJSON(w, r, response)
 }
 
-// handleRequest handles the HTTP request for both domain and sitemap endpoints.
+// processRequest runs a domain or sitemap request for the given payload on the
+// worker pool, waiting up to WORKER_QUEUE_WAIT_MS for a place in its queue.
 //
-// It expects a POST request and validates the method.
-// It decodes the JSON payload and checks for errors.
-// It retrieves the required field (domain or sitemap) from the payload and checks for its existence.
-// It processes the request based on the specified requestType ('domain' or 'sitemap').
-// It constructs a JSON response with the parsed URLs.
-// It marshals the JSON response and checks for errors.
-// It sets the Content-Type header to "application/json".
-// It writes the JSON response to the HTTP response writer.
-func handleRequest(w http.ResponseWriter, r *http.Request, requestType string) {
+// It validates the payload, discovers the sitemap for domain requests, walks it
+// within the request's time budget, and returns the JSON response. Failures are
+// returned as a *requestError carrying the HTTP status to answer with.
+func processRequest(ctx context.Context, requestType string, payload requestPayload) (*sitemapResponse, error) {
+	var response *sitemapResponse
+	var err error
+	if poolErr := parseWorkers.submit(ctx, configFrom(ctx).workerQueueWait, func() {
+		response, err = runRequest(ctx, requestType, payload)
+	}); poolErr != nil {
+		if reqErr := poolError(poolErr); reqErr != nil {
+			return nil, reqErr
+		}
+		return nil, &requestError{http.StatusGatewayTimeout, errCodeUpstreamTimeout, "Request cancelled while waiting for a worker", nil}
+	}
+	return response, err
+}
 
-	// Check if the request method is POST
-	if r.Method != http.MethodPost {
-		// If it's not POST, return a method not allowed error
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// runRequest runs a domain or sitemap request on the calling goroutine.
+func runRequest(ctx context.Context, requestType string, payload requestPayload) (*sitemapResponse, error) {
+	started := time.Now()
+
+	// Get the value of the request type field
+	fieldValue := payload.field(requestType)
+	if fieldValue == "" {
+		// If the request type field is missing, return a bad request error
+		return nil, &requestError{http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Missing '%s' field in JSON payload", requestType), nil}
 	}
 
-	// Decode the JSON payload
-	var data map[string]string
-	err := json.NewDecoder(r.Body).Decode(&data)
+	loggerFrom(ctx).Info("parse requested", "type", requestType, "target", fieldValue)
+	noteAccessTarget(ctx, fieldValue)
+
+	// Resolve the walk limits before any fetching starts
+	config := configFrom(ctx)
+	opts, err := payload.walkOptions(config)
 	if err != nil {
-		// If the JSON payload is invalid, return a bad request error
-		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
-		return
+		return nil, &requestError{http.StatusBadRequest, errCodeInvalidRequest, err.Error(), nil}
+	}
+	order, err := payload.sortOrder()
+	if err != nil {
+		return nil, &requestError{http.StatusBadRequest, errCodeInvalidRequest, err.Error(), nil}
+	}
+	diffPrevious, err := payload.wantsDiffAgainstPrevious()
+	if err != nil {
+		return nil, &requestError{http.StatusBadRequest, errCodeInvalidRequest, err.Error(), nil}
 	}
 
-	// Get the value of the request type field
-	fieldValue, exists := data[requestType]
-	if !exists {
-		// If the request type field is missing, return a bad request error
-		http.Error(w, fmt.Sprintf("Missing '%s' field in JSON payload", requestType), http.StatusBadRequest)
-		return
+	// Bound discovery and the whole walk by the request's time budget
+	budget, err := payload.timeout(config)
+	if err != nil {
+		return nil, &requestError{http.StatusBadRequest, errCodeInvalidRequest, err.Error(), nil}
 	}
+	ctx, cancel := context.WithTimeout(ctx, budget)
+	defer cancel()
+	perFetch := payload.perFetchTimeout(config, budget)
+	ctx = withFetchTimeout(ctx, perFetch)
 
-	fmt.Println(requestType, fieldValue)
+	// Time the phases of every fetch when asked to debug the request
+	var debug *fetchDebug
+	if payload.Debug {
+		debug = newFetchDebug()
+		ctx = withFetchDebug(ctx, debug)
+	}
+	slotWait := &fetchSlotWait{}
+	ctx = withFetchSlotWait(ctx, slotWait)
 
-	// Declare the URLs slice and the parse error
-	var urls []string
+	// Declare the parse result and the parse error
+	var result *sitemapResult
 	var parseErr error
+	var discovery *sitemapDiscovery
+	redirects := &redirectTrace{}
 
 	// If the request type is "domain", get the sitemap URL from the domain
 	if requestType == "domain" {
-		sitemapURL, err := getSitemapURLFromDomain(fieldValue)
+		// Reject malformed candidate paths before any fetching starts
+		if err := validateCandidatePaths(payload.CandidatePaths); err != nil {
+			return nil, &requestError{http.StatusBadRequest, errCodeInvalidRequest, err.Error(), nil}
+		}
+
+		discovery, err = discoverSitemapCached(ctx, fieldValue, payload.CandidatePaths, payload)
 		if err != nil {
-			// If an error occurs, return an internal server error
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			// If the time budget ran out, report it as a gateway timeout
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil, &requestError{http.StatusGatewayTimeout, errCodeUpstreamTimeout, fmt.Sprintf("Request deadline of %s exceeded", budget), nil}
+			}
+			// Otherwise the domain is invalid, has no sitemap, or couldn't be probed
+			return nil, fetchError(err)
+		}
+
+		// In discovery-only mode, report where the sitemap is without fetching it
+		if payload.DiscoverOnly {
+			response := &sitemapResponse{Type: requestType, SitemapURL: discovery.SitemapURL, Discovery: discovery}
+			if debug != nil {
+				response.Debug = debug.report()
+			}
+			return response, nil
 		}
-		urls, parseErr = parseSitemap(sitemapURL)
+		result, parseErr = parseSitemapCached(ctx, discovery.SitemapURL, redirects, opts, payload)
 	} else if requestType == "sitemap" {
-		// check if fieldValue is a valid URL
-		_, err := url.ParseRequestURI(fieldValue)
-		if err != nil {
-		    // If fieldValue is not a valid URL, return a bad request error
-		    http.Error(w, "Invalid URL", http.StatusBadRequest)
-		    return
+		// check if fieldValue is a valid URL, unless it names an uploaded sitemap
+		if reqErr := validateTargetURL(fieldValue); reqErr != nil && payload.upload == nil {
+			// If fieldValue is not a valid URL, return a bad request error
+			return nil, reqErr
 		}
 		// If the request type is "sitemap", parse the sitemap
-		urls, parseErr = parseSitemap(fieldValue)
+		result, parseErr = parseSitemapCached(ctx, fieldValue, redirects, opts, payload)
+	}
+
+	// If the time budget ran out before anything was collected, report a gateway timeout
+	if parseErr != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, &requestError{http.StatusGatewayTimeout, errCodeUpstreamTimeout, fmt.Sprintf("Request deadline of %s exceeded", budget), nil}
 	}
 
-	// If an error occurs while parsing the sitemap, return an internal server error
+	// If the sitemap couldn't be fetched or parsed, report it as an upstream failure
 	if parseErr != nil {
-		http.Error(w, "Failed to parse sitemap", http.StatusInternalServerError)
-		return
+		return nil, fetchError(parseErr)
 	}
 
+	// Sort what was collected, once filtering is done
+	sortURLs(result, order)
+
 	// Create the response
-	response := map[string]interface{}{
-		// "errors": []string{}, // TODO add errors
-		"type":   requestType,
-		"urls":   urls,
+	response := &sitemapResponse{
+		Type: requestType,
+		URLs: result.URLs,
+		walkSummary: &walkSummary{
+			Errors:     result.Errors,
+			Partial:    result.Partial,
+			Sitemaps:   result.Sitemaps,
+			Unexplored: result.Unexplored,
+			Skipped:    result.Skipped,
+			Truncated:  result.Truncated,
+			Warnings:   result.Warnings,
+			Meta:       newResponseMeta(result, started, perFetch, budget),
+			Redirects:  redirects,
+		},
+	}
+	// The tree format describes the walk structure instead of listing URLs
+	if opts.Tree {
+		response.URLs = nil
+		response.Sitemaps = nil
+		response.Format = formatTree
+		response.Tree = result.Tree
 	}
 
-	// Marshal the response to JSON
-	jsonResponse, err := json.Marshal(response)
-	if err != nil {
-		// If an error occurs, return an internal server error
-		http.Error(w, "Failed to create JSON response", http.StatusInternalServerError)
+	// When grouping by source, list the URLs per sitemap instead of as one flat list
+	if opts.GroupBySource {
+		response.URLs = nil
+		response.Sources = result.Sources
+	}
+	// A sample states what it was drawn from, and how to draw it again
+	if opts.Sample > 0 {
+		response.Sample = &sampleInfo{Size: len(result.URLs), Population: result.Population, Seed: opts.Seed}
+	}
+	if discovery != nil {
+		response.SitemapURL = discovery.SitemapURL
+		response.Discovery = discovery
+	}
+
+	// Report what changed since the previous run on the same sitemap, however it was found
+	if diffPrevious {
+		sitemapURL := fieldValue
+		if discovery != nil {
+			sitemapURL = discovery.SitemapURL
+		}
+		addChanges(response, sitemapURL, result)
+	}
+
+	// Persist the parse, unless it was answered from the cache or only holds a sample
+	if parses != nil && !result.Cached && !opts.Tree && opts.Sample == 0 {
+		sitemapURL := fieldValue
+		if discovery != nil {
+			sitemapURL = discovery.SitemapURL
+		}
+		parses.record(sitemapURL, result, started)
+	}
+
+	noteAccessURLs(ctx, len(result.URLs))
+
+	// Tell when the fetches were held back by the bound on fetches across requests
+	if waited := slotWait.waited(); config.fetchSlotWarnAfter > 0 && waited >= config.fetchSlotWarnAfter {
+		warning := fmt.Sprintf("Fetches waited %s in total for the %d outbound fetches open at once across requests", waited.Round(time.Millisecond), config.fetchMaxConcurrent)
+		response.Warnings = append(append([]string{}, response.Warnings...), warning)
+	}
+
+	if debug != nil {
+		response.Debug = debug.report()
+	}
+	return response, nil
+}
+
+// writeError replies with the error, as an XML document when that is the
+// negotiated format and with the JSON error envelope otherwise.
+func writeError(w http.ResponseWriter, format string, err *requestError) {
+	if format == formatXML {
+		writeXMLError(w, err)
 		return
 	}
+	writeRequestError(w, err)
+}
 
+// writeJSON encodes the response and writes it with a status code of OK, as
+// it is encoded. A failure past the first byte written aborts the reply, so the
+// client sees it cut short instead of ending as if complete.
+func writeJSON(w http.ResponseWriter, response interface{}) {
 	// Set the content type to application/json
 	w.Header().Set("Content-Type", "application/json")
 
 	// Write the JSON response with a status code of OK
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write(jsonResponse)
+	out := &responseWriter{ResponseWriter: w}
+	if err := encodeJSON(out, response); err != nil {
+		if !out.started {
+			// If nothing was written yet, return an internal server error
+			writeAPIError(w, http.StatusInternalServerError, errCodeInternal, "Failed to create JSON response", nil)
+			return
+		}
+		logger.Warn("JSON response cut short", "err", err)
+		panic(http.ErrAbortHandler)
+	}
 }
 
 // handleDomain handles the HTTP request for the domain endpoint.
@@ -350,20 +989,168 @@ func handleSitemapEndpoint(w http.ResponseWriter, r *http.Request) {
 	handleRequest(w, r, "sitemap")
 }
 
-func handleRoot(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "To request URLs, POST the link to /sitemap as {\"sitemap\":\"https://stackovercode.com/sitemap.xml\"}")
+// rootHandler returns the handler of the root path, which tells how to request
+// URLs and lists the versioned endpoints of routes.
+func rootHandler(routes *router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "To request URLs, POST the link to /%s/sitemap as {\"sitemap\":\"https://stackovercode.com/sitemap.xml\"}", apiVersion)
+		fmt.Fprintf(w, "\n\nEndpoints:\n%s\n", strings.Join(routes.endpoints("/"+apiVersion), "\n"))
+	}
 }
 
 func handlePing(w http.ResponseWriter, r *http.Request) {
     fmt.Fprintf(w, "Pong!")
 }
 
+// setupServices builds the components of the service configured by c, which
+// only a restart configures again.
+func setupServices(c *Config) {
+	breakers = newBreakerSet(c.breakerThreshold, c.breakerCooldown)
+	cache = newCacheBackend(c)
+	refreshes = newRefreshLimiter(c.cacheRefreshInterval)
+	resolver = newDNSCache(c)
+	httpClient = newFetchClient(c, resolver)
+	callbackClient = newCallbackClient(c, resolver)
+	fetchSlots = newFetchSlotSet(c.fetchMaxConcurrent)
+	history = newSitemapHistory(c.maxHistoryEntries)
+	results = newResultStore(c.resultTTL)
+	politeness = newHostLimiter(c.hostRate, c.hostRateOverrides, c.maxCrawlDelay)
+	parseWorkers = newWorkerPool(c.workerPoolSize, c.workerQueueSize)
+}
+
+// newRoutes returns the router of the API, with its endpoints and the
+// middleware wrapping them.
+func newRoutes() *router {
+	v1 := "/" + apiVersion
+	routes := newRouter()
+	routes.handle(v1+"/sitemap", idempotent(inFlight.limit(v1+"/sitemap", func() int { return currentConfig().sitemapMaxInFlight }, handleSitemapEndpoint)), http.MethodGet, http.MethodPost)
+	routes.handle(v1+"/sitemap/stream", handleSitemapStreamEndpoint, http.MethodGet)
+	routes.handle(v1+"/ws", handleWebSocketEndpoint, http.MethodGet)
+	routes.handle(v1+"/domain", idempotent(inFlight.limit(v1+"/domain", func() int { return currentConfig().domainMaxInFlight }, handleDomainEndpoint)), http.MethodGet, http.MethodPost)
+	routes.handle(v1+"/batch", idempotent(inFlight.limit(v1+"/batch", func() int { return currentConfig().batchMaxInFlight }, handleBatchEndpoint)), http.MethodPost)
+	routes.handle(v1+"/stats", idempotent(handleStatsEndpoint), http.MethodPost)
+	routes.handle(v1+"/diff", idempotent(handleDiffEndpoint), http.MethodPost)
+	routes.handle(v1+"/raw", handleRawEndpoint, http.MethodGet)
+	routes.handle(v1+"/generate", handleGenerateEndpoint, http.MethodPost)
+	routes.handle(v1+"/submit", idempotent(handleSubmitEndpoint), http.MethodPost)
+	routes.handle(v1+"/count", handleCountEndpoint, http.MethodGet)
+	routes.handle(v1+"/robots", handleRobotsEndpoint, http.MethodGet, http.MethodPost)
+	routes.handle(v1+"/ping", handlePing, http.MethodGet)
+	routes.handle(v1+"/metrics", handleMetricsEndpoint, http.MethodGet)
+	routes.handle(v1+"/admin/breakers", requireAdmin(handleAdminBreakersEndpoint), http.MethodGet, http.MethodDelete)
+	routes.handle(v1+"/admin/cache", requireAdmin(handleAdminCacheEndpoint), http.MethodGet, http.MethodDelete)
+	routes.handle(v1+"/admin/keys", requireAdmin(handleAdminKeysEndpoint), http.MethodGet)
+	routes.handle("/", rootHandler(routes), http.MethodGet)
+	routes.handle(v1, rootHandler(routes), http.MethodGet)
+	routes.handle("/openapi.json", openAPIHandler(routes), http.MethodGet)
+	routes.handle(healthzPath, handleHealthz, http.MethodGet)
+	routes.handle(readyzPath, handleReadyz, http.MethodGet)
+	routes.handle(versionPath, handleVersionEndpoint, http.MethodGet)
+
+	// The paths predating the versioned API stay as deprecated aliases
+	routes.aliasUnprefixed(v1)
+
+	routes.use(snapshotConfig)
+	routes.use(advertiseVersion)
+	routes.use(traceRequests)
+	routes.use(logAccess)
+	routes.use(recoverPanics)
+	routes.use(allowCORS(routes))
+	routes.use(rejectWhileDraining)
+	routes.use(limitClientRate)
+	routes.use(requireAPIKey)
+	routes.use(enforceQuotas)
+	routes.use(limitRequestBody)
+	routes.use(compressResponses)
+	return routes
+}
+
 func main() {
-	http.HandleFunc("/sitemap", handleSitemapEndpoint)
-	http.HandleFunc("/domain", handleDomainEndpoint)
-	http.HandleFunc("/ping", handlePing)
-	http.HandleFunc("/", handleRoot)
+	cfg, err := loadConfig(os.Getenv("CONFIG_FILE"), os.LookupEnv)
+	logger = newLogger(os.Stderr, cfg.logFormat, cfg.logLevel)
+	if err != nil {
+		logger.Error("invalid configuration", "err", err)
+		os.Exit(1)
+	}
+	if cfg.source.path != "" {
+		logger.Info("configuration loaded", "file", cfg.source.path)
+	}
+	cfg.warnUnread()
+	liveConfig.Store(cfg)
+	setupServices(cfg)
+	spans = newSpanExporter(cfg.tracing)
+	if parses, err = openParseStore(cfg); err != nil {
+		logger.Error("opening the parse store failed", "err", err)
+		os.Exit(1)
+	}
+	cleanup = newJanitor(cfg.janitorInterval, time.Now, serviceSweepers())
+	cleanup.start()
 
-	fmt.Println("Server started at :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	routes := newRoutes()
+
+	pprofServer := startPprofServer(cfg.pprofAddr)
+
+	// A second signal during the drain stops the service at once
+	stopped, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var certs *certReloader
+	if cfg.tlsEnabled() {
+		if certs, err = loadCertReloader(cfg.tlsCertFile, cfg.tlsKeyFile); err != nil {
+			logger.Error("loading the TLS certificate failed", "err", err)
+			os.Exit(1)
+		}
+		certs.watch(cfg.tlsReloadInterval)
+	}
+	handleReloads(certs)
+	listener, err := listen(cfg.listenAddr, cfg.listenSocketMode)
+	if err != nil {
+		logger.Error("listening failed", "addr", cfg.listenAddr, "err", err)
+		os.Exit(1)
+	}
+	server := newAPIServer(cfg, routes.handler())
+	servers := []*http.Server{server}
+	failed := make(chan error, 2)
+	if certs == nil {
+		go func() {
+			failed <- server.Serve(listener)
+		}()
+		logger.Info("server started", "addr", listener.Addr().String(), "version", version)
+	} else {
+		server.TLSConfig = newTLSConfig(certs)
+		go func() {
+			failed <- server.ServeTLS(listener, "", "")
+		}()
+		logger.Info("server started", "addr", listener.Addr().String(), "version", version, "tls", true)
+	}
+
+	if cfg.httpListenAddr != "" && certs == nil {
+		logger.Warn("ignoring HTTP_LISTEN_ADDR, which only applies with TLS", "addr", cfg.httpListenAddr)
+	} else if cfg.httpListenAddr != "" {
+		httpListener, err := listen(cfg.httpListenAddr, cfg.listenSocketMode)
+		if err != nil {
+			logger.Error("listening failed", "addr", cfg.httpListenAddr, "err", err)
+			os.Exit(1)
+		}
+		httpServer := newAPIServer(cfg, routes.handler())
+		if cfg.tlsRedirectHTTP {
+			httpServer.Handler = redirectToHTTPS(listener.Addr().String())
+		}
+		servers = append(servers, httpServer)
+		go func() {
+			failed <- httpServer.Serve(httpListener)
+		}()
+		logger.Info("plain HTTP server started", "addr", httpListener.Addr().String(), "redirect", cfg.tlsRedirectHTTP)
+	}
+
+	atomic.StoreInt32(&serviceState, stateReady)
+
+	select {
+	case err := <-failed:
+		logger.Error("server failed", "err", err)
+		os.Exit(1)
+	case <-stopped.Done():
+		stop()
+	}
+	shutdown(cfg, pprofServer, servers...)
 }
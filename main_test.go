@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// hostOf returns the host:port of the server, as the domain of a request.
+func hostOf(server *httptest.Server) string {
+	return strings.TrimPrefix(strings.TrimPrefix(server.URL, "https://"), "http://")
+}
+
+func TestDiscoveryRobotsOverHTTPOnly(t *testing.T) {
+	useLocalConfig(t, nil)
+
+	sitemaps := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/sitemap.xml" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9"><url><loc>https://example.com/</loc></url></urlset>`)
+	}))
+	defer sitemaps.Close()
+	// The host only serves plain HTTP, so its robots.txt is only found over http
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/robots.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, "User-agent: *\nSitemap: %s/sitemap.xml\n", sitemaps.URL)
+	}))
+	defer site.Close()
+	trustServers(t, sitemaps)
+
+	discovery, err := getSitemapURLFromDomain(context.Background(), hostOf(site), nil)
+	if err != nil {
+		t.Fatalf("getSitemapURLFromDomain: %v", err)
+	}
+	if want := sitemaps.URL + "/sitemap.xml"; discovery.SitemapURL != want {
+		t.Errorf("SitemapURL = %q, want %q", discovery.SitemapURL, want)
+	}
+	if discovery.Source != discoverySourceRobots || discovery.RobotsURL != site.URL+"/robots.txt" {
+		t.Errorf("Source = %q, RobotsURL = %q, want the robots.txt over http", discovery.Source, discovery.RobotsURL)
+	}
+
+	result, err := parseSitemap(context.Background(), discovery.SitemapURL, nil, defaultWalkOptions(currentConfig()))
+	if err != nil || len(result.URLs) != 1 {
+		t.Fatalf("parseSitemap = %v, %v, want the URL of the https sitemap", result, err)
+	}
+}
+
+func TestDiscoveryProbesPastFailedCandidates(t *testing.T) {
+	useLocalConfig(t, map[string]string{"SITEMAP_LOCATIONS": "/sitemap.xml"})
+
+	site := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/broken.xml":
+			// Drop the connection without a response
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+		case "/sitemap.xml":
+			fmt.Fprint(w, `<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9"></urlset>`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer site.Close()
+	trustServers(t, site)
+
+	discovery, err := getSitemapURLFromDomain(context.Background(), hostOf(site), []string{"/broken.xml", "/missing.xml"})
+	if err != nil {
+		t.Fatalf("getSitemapURLFromDomain: %v, want the candidates after the failed one probed", err)
+	}
+	if discovery.SitemapURL != site.URL+"/sitemap.xml" || discovery.Source != discoverySourceCandidate {
+		t.Errorf("discovery = %s from %s, want the built-in location", discovery.SitemapURL, discovery.Source)
+	}
+}
+
+func TestDiscoveryFailsWhenNoCandidateAnswers(t *testing.T) {
+	useLocalConfig(t, map[string]string{"SITEMAP_LOCATIONS": "/sitemap.xml,/sitemap_index.xml", "BREAKER_FAILURE_THRESHOLD": "100"})
+	captureLogs(t)
+
+	// Nothing listens on the port of a closed listener
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	domain := listener.Addr().String()
+	listener.Close()
+
+	_, err = getSitemapURLFromDomain(context.Background(), domain, []string{"/a.xml"})
+	var reqErr *requestError
+	if err == nil || errors.As(err, &reqErr) && reqErr.Code == errCodeSitemapNotFound {
+		t.Fatalf("getSitemapURLFromDomain error = %v, want the fetch error rather than no sitemap found", err)
+	}
+	if reqErr := fetchError(err); reqErr.Status != http.StatusBadGateway {
+		t.Errorf("fetchError(%v) = %d, want 502", err, reqErr.Status)
+	}
+}
+
+func TestUpstreamFailureStatuses(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		status  int
+		code    string
+	}{
+		{"connection dropped", func(w http.ResponseWriter, r *http.Request) {
+			if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+				conn.Close()
+			}
+		}, http.StatusBadGateway, errCodeFetchFailed},
+		{"server error", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}, http.StatusBadGateway, errCodeFetchFailed},
+		{"bad gateway", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}, http.StatusBadGateway, errCodeFetchFailed},
+		{"too slow", func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}, http.StatusGatewayTimeout, errCodeUpstreamTimeout},
+		{"not found", func(w http.ResponseWriter, r *http.Request) {
+			http.NotFound(w, r)
+		}, http.StatusNotFound, errCodeSitemapNotFound},
+		{"malformed", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `<urlset><url><loc>https://example.com/`)
+		}, http.StatusUnprocessableEntity, errCodeParseFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLocalConfig(t, map[string]string{"FETCH_TIMEOUT_SECONDS": "1"})
+			captureLogs(t)
+			upstream := httptest.NewServer(tt.handler)
+			defer upstream.Close()
+
+			w := httptest.NewRecorder()
+			handleSitemapEndpoint(w, httptest.NewRequest(http.MethodGet, "/v1/sitemap?url="+upstream.URL+"/sitemap.xml", nil))
+			var body errorBody
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("body %q: %v", w.Body, err)
+			}
+			if w.Code != tt.status || body.Error.Code != tt.code {
+				t.Errorf("response = %d %s, want %d %s", w.Code, body.Error.Code, tt.status, tt.code)
+			}
+		})
+	}
+}
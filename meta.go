@@ -0,0 +1,79 @@
+package main
+
+import "time"
+
+// responseMeta is the meta block of the responses listing the URLs of a walk.
+// It describes what the walk cost and how complete its result is, so its field
+// names are part of the API.
+type responseMeta struct {
+	// APIVersion is the version of the API that produced the response.
+	APIVersion string `json:"apiVersion"`
+	// TotalURLs counts the URLs the walk kept, whether listed, streamed or sampled.
+	TotalURLs int `json:"totalUrls"`
+	// SitemapsFetched counts the sitemap fetches, FetchErrors the ones that
+	// failed, NotModified the ones answered with a 304 by reusing the cached
+	// document, Retries the attempts made again after a transient failure, and
+	// BytesDownloaded the size of the bodies read.
+	SitemapsFetched int   `json:"sitemapsFetched"`
+	FetchErrors     int   `json:"fetchErrors"`
+	NotModified     int   `json:"notModified"`
+	Retries         int   `json:"retries"`
+	BytesDownloaded int64 `json:"bytesDownloaded"`
+	// CrawlDelaySeconds is the Crawl-delay of robots.txt that paced the fetches
+	// of the host of the sitemap, zero when none did.
+	CrawlDelaySeconds float64 `json:"crawlDelaySeconds"`
+	// DurationMs is the wall-clock time the request took, discovery included.
+	DurationMs int64 `json:"durationMs"`
+	// Cached is set when the result was served without walking the sitemap,
+	// from a cache entry stored CacheAgeSeconds ago. Refreshed is set when a
+	// forced refresh walked the sitemap again and replaced the cache entry.
+	Cached          bool `json:"cached"`
+	CacheAgeSeconds int  `json:"cacheAgeSeconds"`
+	Refreshed       bool `json:"refreshed"`
+	// Partial and Truncated mirror the flags of the response.
+	Partial   bool `json:"partial"`
+	Truncated bool `json:"truncated"`
+
+	SavedFetches         int            `json:"savedFetches"`
+	UnvisitedSitemaps    int            `json:"unvisitedSitemaps"`
+	FilteredURLs         int            `json:"filteredUrls"`
+	ExcludedByExtension  int            `json:"excludedByExtension"`
+	PriorityDistribution map[string]int `json:"priorityDistribution"`
+	ForeignURLs          int            `json:"foreignUrls"`
+	ForeignHosts         []string       `json:"foreignHosts"`
+
+	// TimeoutSeconds is the timeout of each fetch, and DeadlineSeconds the time
+	// budget of the whole request.
+	TimeoutSeconds  int `json:"timeoutSeconds"`
+	DeadlineSeconds int `json:"deadlineSeconds"`
+}
+
+// newResponseMeta returns the meta block of a walk that started at started,
+// with the given per-fetch timeout and time budget.
+func newResponseMeta(result *sitemapResult, started time.Time, perFetch, budget time.Duration) responseMeta {
+	return responseMeta{
+		APIVersion:           apiVersion,
+		TotalURLs:            result.Collected,
+		SitemapsFetched:      result.Fetched,
+		FetchErrors:          result.FetchErrors,
+		NotModified:          result.NotModified,
+		Retries:              result.Retries,
+		BytesDownloaded:      result.Bytes,
+		CrawlDelaySeconds:    result.CrawlDelay.Seconds(),
+		DurationMs:           time.Since(started).Milliseconds(),
+		Cached:               result.Cached,
+		CacheAgeSeconds:      int(result.CacheAge / time.Second),
+		Refreshed:            result.Refreshed,
+		Partial:              result.Partial,
+		Truncated:            result.Truncated,
+		SavedFetches:         result.SavedFetches,
+		UnvisitedSitemaps:    len(result.Unexplored),
+		FilteredURLs:         result.Filtered.Filtered,
+		ExcludedByExtension:  result.Filtered.ExcludedByExtension,
+		PriorityDistribution: result.Priorities.counts(),
+		ForeignURLs:          result.Filtered.ForeignURLs,
+		ForeignHosts:         result.Filtered.foreignHosts(),
+		TimeoutSeconds:       int(perFetch / time.Second),
+		DeadlineSeconds:      int(budget / time.Second),
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// queryParamFormat is the query parameter selecting the format of the metrics,
+// and metricsFormatPrometheus the one scraped by Prometheus.
+const (
+	queryParamFormat        = "format"
+	metricsFormatPrometheus = "prometheus"
+)
+
+// metricsResponse is the response of the metrics endpoint, reporting the state
+// of the service.
+type metricsResponse struct {
+	Cache      cacheMetrics      `json:"cache"`
+	DNS        dnsMetrics        `json:"dns"`
+	Fetch      fetchMetrics      `json:"fetch"`
+	Breakers   breakerMetrics    `json:"breakers"`
+	Politeness politenessMetrics `json:"politeness"`
+	ClientRate clientRateMetrics `json:"clientRate"`
+	Workers    workerMetrics     `json:"workers"`
+	InFlight   []inFlightMetrics `json:"inFlight"`
+	Panics     panicMetrics      `json:"panics"`
+	Janitor    janitorMetrics    `json:"janitor"`
+	Callbacks  callbackMetrics   `json:"callbacks"`
+}
+
+// fetchMetrics reports on the outbound fetches since the start.
+type fetchMetrics struct {
+	Retries  int64            `json:"retries"`
+	Slots    fetchSlotMetrics `json:"slots"`
+	Timeouts fetchTimeouts    `json:"timeouts"`
+}
+
+// dnsMetrics reports the hosts held by the DNS cache and how its lookups went.
+type dnsMetrics struct {
+	Enabled    bool  `json:"enabled"`
+	TTLSeconds int   `json:"ttlSeconds"`
+	Entries    int   `json:"entries"`
+	Hits       int64 `json:"hits"`
+	Misses     int64 `json:"misses"`
+}
+
+// cacheMetrics reports the usage of the result cache against its bounds, where
+// a bound of 0 means none. Only the memory backend reports its usage.
+type cacheMetrics struct {
+	Backend    string `json:"backend"`
+	Entries    int    `json:"entries"`
+	Bytes      int64  `json:"bytes"`
+	MaxEntries int    `json:"maxEntries"`
+	MaxBytes   int64  `json:"maxBytes"`
+	TTLSeconds int    `json:"ttlSeconds"`
+}
+
+// currentCacheMetrics reports the result cache, configured by c.
+func currentCacheMetrics(c *Config) cacheMetrics {
+	metrics := cacheMetrics{
+		Backend:    "redis",
+		MaxEntries: c.cacheMaxEntries,
+		MaxBytes:   c.cacheMaxBytes,
+		TTLSeconds: int(c.cacheTTL / time.Second),
+	}
+	if memory, ok := cache.(*resultCache); ok {
+		metrics.Backend = "memory"
+		metrics.Entries, metrics.Bytes = memory.usage()
+	}
+	return metrics
+}
+
+// janitorMetrics reports the sweeps of the janitor, with the entries removed
+// by the last one and in total, by what they were removed from.
+type janitorMetrics struct {
+	IntervalSeconds int            `json:"intervalSeconds"`
+	Sweeps          int            `json:"sweeps"`
+	LastRemoved     map[string]int `json:"lastRemoved"`
+	Removed         map[string]int `json:"removed"`
+}
+
+// handleMetricsEndpoint reports the number of entries in the result cache and
+// their approximate size in bytes, the lookups of the DNS cache, the retries of
+// outbound fetches, their use of the slots bounding them and their timeouts,
+// the circuit breakers, the pacing of fetches per host, the use of the worker
+// pool, the requests in flight by endpoint, the panics recovered, what the
+// janitor removed, and the callbacks delivered and failed. With the prometheus format, it reports the histograms of
+// the phases of outbound fetches instead, in the Prometheus text format.
+func handleMetricsEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get(queryParamFormat) == metricsFormatPrometheus {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fetchPhases.writePrometheus(w)
+		return
+	}
+
+	config := configFrom(r.Context())
+	sweeps := janitorMetrics{IntervalSeconds: int(config.janitorInterval / time.Second), LastRemoved: map[string]int{}, Removed: map[string]int{}}
+	if cleanup != nil {
+		sweeps.Sweeps, sweeps.LastRemoved, sweeps.Removed = cleanup.stats()
+	}
+	dns := dnsMetrics{Enabled: config.dnsCacheTTL > 0, TTLSeconds: int(config.dnsCacheTTL / time.Second)}
+	dns.Entries, dns.Hits, dns.Misses = resolver.usage()
+	fetches := fetchMetrics{Retries: atomic.LoadInt64(&fetchRetries), Slots: fetchSlots.metrics(), Timeouts: effectiveFetchTimeouts(config)}
+	writeJSON(w, metricsResponse{Cache: currentCacheMetrics(config), DNS: dns, Fetch: fetches, Breakers: breakers.metrics(time.Now()), Politeness: politeness.metrics(), ClientRate: clientRates.metrics(config.clientRate), Workers: parseWorkers.metrics(), InFlight: inFlight.metrics(), Panics: currentPanicMetrics(), Janitor: sweeps, Callbacks: currentCallbackMetrics()})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ndjsonExporter writes newline-delimited JSON, one value per line, flushing
+// after each sitemap. It is safe for concurrent use.
+type ndjsonExporter struct {
+	exportStream
+	encoder *json.Encoder
+}
+
+// ndjsonURL is the line written for each URL.
+type ndjsonURL struct {
+	SitemapURL
+	Sitemap string `json:"sitemap"`
+}
+
+// newNDJSONExporter returns an exporter of newline-delimited JSON to w.
+func newNDJSONExporter(w http.ResponseWriter) *ndjsonExporter {
+	return &ndjsonExporter{exportStream: exportStream{w: w}, encoder: json.NewEncoder(w)}
+}
+
+// writeURLs writes each URL on its own line with its metadata and sitemap.
+func (n *ndjsonExporter) writeURLs(sitemap string, urls []SitemapURL) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.start("application/x-ndjson")
+	for _, u := range urls {
+		n.encoder.Encode(ndjsonURL{u, sitemap})
+	}
+	n.flush()
+}
+
+// writeSummary writes the rest of the response as a final {"summary":…} line.
+func (n *ndjsonExporter) writeSummary(response *sitemapResponse) {
+	n.writeLine(map[string]interface{}{"summary": response})
+}
+
+// writeError writes the error as a final {"summary":…} line.
+func (n *ndjsonExporter) writeError(err *requestError) {
+	n.writeLine(map[string]interface{}{"summary": map[string]interface{}{"status": err.Status, "code": err.Code, "error": err.Message}})
+}
+
+// writeLine writes the JSON encoding of value as one line.
+func (n *ndjsonExporter) writeLine(value interface{}) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.start("application/x-ndjson")
+	n.encoder.Encode(value)
+	n.flush()
+}
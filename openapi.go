@@ -0,0 +1,327 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// openAPIVersion is the version of the OpenAPI specification the document
+// served at /openapi.json follows.
+const openAPIVersion = "3.0.3"
+
+// endpointDoc describes an endpoint in the OpenAPI document. Its request and
+// response are given as values of the types the handler decodes and marshals,
+// so the document follows the code.
+type endpointDoc struct {
+	Summary string
+	// Query lists the query parameters of GET and DELETE requests.
+	Query []string
+	// Request is the JSON body of POST requests, nil when there is none.
+	Request interface{}
+	// Response is the JSON body of a successful reply. Endpoints replying with
+	// something else give its ContentType instead.
+	Response    interface{}
+	ContentType string
+	// Status is the status of a successful reply, OK when unset.
+	Status int
+}
+
+// endpointDocs describes the endpoints by their path under the API version.
+var endpointDocs = map[string]endpointDoc{
+	"/sitemap": {
+		Summary:  "List the URLs of a sitemap and of its child sitemaps",
+		Query:    []string{queryParamSitemap, queryParamPageSize, queryParamCursor},
+		Request:  requestPayload{},
+		Response: sitemapResponse{},
+	},
+	"/sitemap/stream": {
+		Summary:     "Stream the URLs of a sitemap as server-sent events",
+		Query:       []string{queryParamSitemap},
+		ContentType: "text/event-stream",
+	},
+	"/ws": {
+		Summary: "Stream the URLs of domains over a WebSocket",
+		Status:  http.StatusSwitchingProtocols,
+	},
+	"/domain": {
+		Summary:  "Discover the sitemap of a domain and list its URLs",
+		Query:    []string{queryParamDomain, queryParamPageSize, queryParamCursor},
+		Request:  requestPayload{},
+		Response: sitemapResponse{},
+	},
+	"/batch": {
+		Summary:  "Run the domain flow for several domains",
+		Request:  batchPayload{},
+		Response: batchResponse{},
+	},
+	"/stats": {
+		Summary:  "Summarize the URLs of a sitemap or domain",
+		Request:  statsPayload{},
+		Response: statsResponse{},
+	},
+	"/diff": {
+		Summary:  "Compare the URLs of two sitemaps",
+		Request:  diffPayload{},
+		Response: diffResponse{},
+	},
+	"/raw": {
+		Summary:     "Return the body of a sitemap as fetched",
+		Query:       []string{queryParamSitemap, "force"},
+		ContentType: "application/xml",
+	},
+	"/generate": {
+		Summary:     "Generate sitemap documents from a list of URLs",
+		Request:     generatePayload{},
+		ContentType: "application/xml",
+	},
+	"/submit": {
+		Summary:  "Ping the search engines with a sitemap",
+		Request:  submitPayload{},
+		Response: submitResponse{},
+	},
+	"/count": {
+		Summary:  "Count the URLs of a sitemap or domain",
+		Query:    []string{queryParamSitemap, queryParamDomain},
+		Response: countResponse{},
+	},
+	"/robots": {
+		Summary:  "Report the robots.txt file of a domain",
+		Query:    []string{queryParamDomain},
+		Request:  robotsPayload{},
+		Response: robotsResponse{},
+	},
+	"/ping": {
+		Summary:     "Check that the service is running",
+		ContentType: "text/plain",
+	},
+	"/metrics": {
+		Summary:  "Report the usage of the result cache",
+		Query:    []string{queryParamFormat},
+		Response: metricsResponse{},
+	},
+	"/admin/breakers": {
+		Summary:  "Report or reset the circuit breakers of upstream hosts",
+		Query:    []string{"host"},
+		Response: adminBreakersResponse{},
+	},
+	"/admin/cache": {
+		Summary:  "Report or flush the result cache",
+		Query:    []string{"url"},
+		Response: adminCacheResponse{},
+	},
+	"/admin/keys": {
+		Summary:  "Report the usage of the API keys against their limits",
+		Response: adminKeysResponse{},
+	},
+}
+
+// queryParamTypes holds the schema types of the query parameters that aren't
+// strings.
+var queryParamTypes = map[string]string{
+	queryParamPageSize: "integer",
+	"force":            "boolean",
+}
+
+// openAPISchemer is implemented by the types whose schema can't be derived
+// from their Go type.
+type openAPISchemer interface {
+	openAPISchema() map[string]interface{}
+}
+
+// schemaBuilder derives JSON schemas from Go types the way encoding/json
+// marshals them. Named structs become components, so recursive types work.
+type schemaBuilder struct {
+	schemas map[string]interface{}
+	// required marks the fields without omitempty as required, which holds for
+	// responses but not for payloads, where every field is optional.
+	required bool
+}
+
+// schemaName returns the component name of a named struct type.
+func schemaName(t reflect.Type) string {
+	return strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+}
+
+// schema returns the schema of values of type t.
+func (b *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	if schemer, ok := reflect.Zero(t).Interface().(openAPISchemer); ok {
+		return schemer.openAPISchema()
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		elem := b.schema(t.Elem())
+		if _, ok := elem["$ref"]; ok {
+			return map[string]interface{}{"allOf": []interface{}{elem}, "nullable": true}
+		}
+		elem["nullable"] = true
+		return elem
+	case reflect.Struct:
+		name := schemaName(t)
+		if _, ok := b.schemas[name]; !ok {
+			// Claim the name first, so a type referring to itself refers to it
+			b.schemas[name] = nil
+			b.schemas[name] = b.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem()), "nullable": true}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem()), "nullable": true}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	}
+	// Interfaces hold any value
+	return map[string]interface{}{}
+}
+
+// object returns the schema of a struct type, with the fields of embedded
+// structs promoted as encoding/json does.
+func (b *schemaBuilder) object(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	var required []string
+	b.fields(t, properties, &required, true)
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// fields adds the JSON fields of struct type t to properties, and the names of
+// the required ones to required. The fields of an embedded pointer are left out
+// when it is nil, so none of them is required.
+func (b *schemaBuilder) fields(t reflect.Type, properties map[string]interface{}, required *[]string, mustHave bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				b.fields(embedded.Elem(), properties, required, false)
+			} else {
+				b.fields(embedded, properties, required, mustHave)
+			}
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = b.schema(field.Type)
+		if b.required && mustHave && !strings.Contains(options, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// openAPIDocument returns the OpenAPI document of the endpoints of routes
+// under the API version.
+func openAPIDocument(routes *router) map[string]interface{} {
+	schemas := map[string]interface{}{}
+	payloads := &schemaBuilder{schemas: schemas}
+	responses := &schemaBuilder{schemas: schemas, required: true}
+	errorSchema := responses.schema(reflect.TypeOf(errorBody{}))
+
+	prefix := "/" + apiVersion
+	paths := map[string]interface{}{}
+	for _, path := range routes.paths {
+		doc, ok := endpointDocs[strings.TrimPrefix(path, prefix)]
+		if !ok || !strings.HasPrefix(path, prefix+"/") {
+			continue
+		}
+
+		status := doc.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		success := map[string]interface{}{"description": http.StatusText(status)}
+		if doc.Response != nil {
+			success["content"] = map[string]interface{}{
+				mediaTypeJSON: map[string]interface{}{"schema": responses.schema(reflect.TypeOf(doc.Response))},
+			}
+		} else if doc.ContentType != "" {
+			success["content"] = map[string]interface{}{
+				doc.ContentType: map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+			}
+		}
+
+		operations := map[string]interface{}{}
+		for _, method := range routes.routes[path].methods {
+			operation := map[string]interface{}{
+				"summary": doc.Summary,
+				"responses": map[string]interface{}{
+					strconv.Itoa(status): success,
+					"default": map[string]interface{}{
+						"description": "Error",
+						"content":     map[string]interface{}{mediaTypeJSON: map[string]interface{}{"schema": errorSchema}},
+					},
+				},
+			}
+			switch method {
+			case http.MethodGet, http.MethodDelete:
+				var parameters []interface{}
+				for _, name := range doc.Query {
+					kind := queryParamTypes[name]
+					if kind == "" {
+						kind = "string"
+					}
+					parameters = append(parameters, map[string]interface{}{
+						"name":   name,
+						"in":     "query",
+						"schema": map[string]interface{}{"type": kind},
+					})
+				}
+				if len(parameters) > 0 {
+					operation["parameters"] = parameters
+				}
+			case http.MethodPost:
+				if doc.Request != nil {
+					operation["requestBody"] = map[string]interface{}{
+						"required": true,
+						"content": map[string]interface{}{
+							mediaTypeJSON: map[string]interface{}{"schema": payloads.schema(reflect.TypeOf(doc.Request))},
+						},
+					}
+				}
+			}
+			operations[strings.ToLower(method)] = operation
+		}
+		paths[path] = operations
+	}
+
+	return map[string]interface{}{
+		"openapi": openAPIVersion,
+		"info": map[string]interface{}{
+			"title":   "Sitemap Parser API",
+			"version": apiVersion,
+		},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": schemas},
+	}
+}
+
+// openAPIHandler returns the handler serving the OpenAPI document of routes.
+func openAPIHandler(routes *router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, openAPIDocument(routes))
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// schemaTypes are the types a schema of OpenAPI 3.0 can have.
+var schemaTypes = map[string]bool{"object": true, "array": true, "string": true, "integer": true, "number": true, "boolean": true}
+
+// checkSchemas fails the test for each $ref of value not resolving to a schema
+// of components, and for each schema with an unknown type or a required
+// property it doesn't have.
+func checkSchemas(t *testing.T, where string, value interface{}, schemas map[string]interface{}) {
+	t.Helper()
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if ref, ok := v["$ref"].(string); ok {
+			name, found := strings.CutPrefix(ref, "#/components/schemas/")
+			if schema, ok := schemas[name].(map[string]interface{}); !found || !ok || schema == nil {
+				t.Errorf("%s: $ref %q doesn't resolve", where, ref)
+			}
+		}
+		if kind, ok := v["type"].(string); ok && !schemaTypes[kind] {
+			t.Errorf("%s: unknown schema type %q", where, kind)
+		}
+		if required, ok := v["required"].([]interface{}); ok {
+			properties, _ := v["properties"].(map[string]interface{})
+			for _, name := range required {
+				if _, ok := properties[name.(string)]; !ok {
+					t.Errorf("%s: required property %q isn't a property", where, name)
+				}
+			}
+		}
+		for key, child := range v {
+			checkSchemas(t, where+"/"+key, child, schemas)
+		}
+	case []interface{}:
+		for _, child := range v {
+			checkSchemas(t, where, child, schemas)
+		}
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	useLocalConfig(t, map[string]string{"ACCESS_LOG": "0"})
+	routes := newRoutes()
+	w := httptest.NewRecorder()
+	routes.handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var document struct {
+		OpenAPI    string                                       `json:"openapi"`
+		Info       map[string]string                            `json:"info"`
+		Paths      map[string]map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &document); err != nil {
+		t.Fatalf("the document isn't JSON of an OpenAPI document: %v", err)
+	}
+	if !strings.HasPrefix(document.OpenAPI, "3.0.") || document.Info["title"] == "" || document.Info["version"] != apiVersion {
+		t.Errorf("openapi = %q, info = %v, want a 3.0 document of the API version", document.OpenAPI, document.Info)
+	}
+
+	// Every versioned endpoint is documented with the methods it accepts
+	prefix := "/" + apiVersion + "/"
+	documented := 0
+	for _, path := range routes.paths {
+		if !strings.HasPrefix(path, prefix) {
+			if _, ok := document.Paths[path]; ok {
+				t.Errorf("%s is documented, want only the versioned endpoints", path)
+			}
+			continue
+		}
+		documented++
+		operations, ok := document.Paths[path]
+		if !ok {
+			t.Errorf("%s isn't documented", path)
+			continue
+		}
+		var methods, want []string
+		for method := range operations {
+			methods = append(methods, method)
+		}
+		for _, method := range routes.routes[path].methods {
+			want = append(want, strings.ToLower(method))
+		}
+		sort.Strings(methods)
+		sort.Strings(want)
+		if strings.Join(methods, " ") != strings.Join(want, " ") {
+			t.Errorf("%s documents %v, want %v", path, methods, want)
+		}
+
+		for method, operation := range operations {
+			responses, _ := operation["responses"].(map[string]interface{})
+			if operation["summary"] == "" || len(responses) < 2 || responses["default"] == nil {
+				t.Errorf("%s %s: operation %v, want a summary, its success and the error reply", method, path, operation)
+			}
+			doc := endpointDocs[strings.TrimPrefix(path, "/"+apiVersion)]
+			if method == "post" && doc.Request != nil && operation["requestBody"] == nil {
+				t.Errorf("%s %s: no requestBody for its payload", method, path)
+			}
+		}
+	}
+	if len(document.Paths) != documented {
+		t.Errorf("%d paths documented, want the %d endpoints", len(document.Paths), documented)
+	}
+	for path := range endpointDocs {
+		if _, ok := routes.routes["/"+apiVersion+path]; !ok {
+			t.Errorf("%s is described but not routed", path)
+		}
+	}
+
+	checkSchemas(t, "#/paths", document.Paths, document.Components.Schemas)
+	checkSchemas(t, "#/components", document.Components.Schemas, document.Components.Schemas)
+	for name, schema := range document.Components.Schemas {
+		if schema == nil {
+			t.Errorf("schema %s is empty", name)
+		}
+	}
+}
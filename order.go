@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Sort orders of the returned URLs.
+const (
+	sortAsc  = "asc"
+	sortDesc = "desc"
+)
+
+// sortOrder returns the sort order of the request, or an empty string to keep
+// the document order.
+func (p requestPayload) sortOrder() (string, error) {
+	switch p.Sort {
+	case "":
+		return "", nil
+	case sortAsc, sortDesc:
+	default:
+		return "", fmt.Errorf("Invalid 'sort': must be %q or %q", sortAsc, sortDesc)
+	}
+	// Streamed URLs go out before the walk completes
+	switch p.Format {
+	case formatNDJSON, formatCSV, formatXML:
+		return "", fmt.Errorf("Invalid 'sort': not supported with the %q format", p.Format)
+	}
+	return p.Sort, nil
+}
+
+// sortURLs sorts the URLs of a walk result lexicographically in the given order,
+// including the URLs grouped by source. The sort is stable, so equal URLs keep
+// their document order.
+func sortURLs(result *sitemapResult, order string) {
+	if order == "" {
+		return
+	}
+	sortStrings(result.URLs, order)
+	for _, source := range result.Sources {
+		sortStrings(source.URLs, order)
+	}
+}
+
+// sortStrings sorts s in the given order.
+func sortStrings(s []string, order string) {
+	sort.SliceStable(s, func(i, j int) bool {
+		if order == sortDesc {
+			return s[i] > s[j]
+		}
+		return s[i] < s[j]
+	})
+}
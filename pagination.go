@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errCodeCursorExpired is the code of the error returned for a cursor whose
+// result is no longer held, so clients can tell it apart from other failures.
+const errCodeCursorExpired = "CURSOR_EXPIRED"
+
+// storedResult is a paginated result held server-side between page requests.
+type storedResult struct {
+	response *sitemapResponse
+	urls     []string
+	pageSize int
+	expires  time.Time
+}
+
+// resultStore holds paginated results by result ID for ttl.
+type resultStore struct {
+	mu      sync.Mutex
+	results map[string]*storedResult
+	ttl     time.Duration
+}
+
+var results *resultStore
+
+// newResultStore returns a store holding results for ttl.
+func newResultStore(ttl time.Duration) *resultStore {
+	return &resultStore{results: make(map[string]*storedResult), ttl: ttl}
+}
+
+// put stores a result and returns its ID. Expired results are dropped on the way.
+func (s *resultStore) put(result *storedResult) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, stored := range s.results {
+		if now.After(stored.expires) {
+			delete(s.results, id)
+		}
+	}
+
+	id := newRequestID()
+	result.expires = now.Add(s.ttl)
+	s.results[id] = result
+	return id
+}
+
+// sweep drops the results expired at now, returning how many were dropped.
+func (s *resultStore) sweep(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	for id, stored := range s.results {
+		if now.After(stored.expires) {
+			delete(s.results, id)
+			removed++
+		}
+	}
+	return removed
+}
+
+// get returns the result with the given ID, or nil when it is unknown or expired.
+func (s *resultStore) get(id string) *storedResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result, ok := s.results[id]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(result.expires) {
+		delete(s.results, id)
+		return nil
+	}
+	return result
+}
+
+// encodeCursor returns the opaque cursor pointing at offset in a stored result.
+func encodeCursor(id string, offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id + ":" + strconv.Itoa(offset)))
+}
+
+// decodeCursor returns the result ID and offset a cursor points at.
+func decodeCursor(cursor string) (string, int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", 0, fmt.Errorf("Invalid 'cursor'")
+	}
+	id, offsetText, ok := strings.Cut(string(raw), ":")
+	offset, err := strconv.Atoi(offsetText)
+	if !ok || id == "" || err != nil || offset < 0 {
+		return "", 0, fmt.Errorf("Invalid 'cursor'")
+	}
+	return id, offset, nil
+}
+
+// pageSize returns the page size of the request, or 0 when it isn't paginated,
+// up to the maxPageSize of c.
+func (p requestPayload) pageSize(c *Config) (int, error) {
+	if p.PageSize == nil {
+		return 0, nil
+	}
+	if maxPageSize := c.maxPageSize; *p.PageSize < 1 || *p.PageSize > maxPageSize {
+		return 0, fmt.Errorf("Invalid 'pageSize': must be between 1 and %d", maxPageSize)
+	}
+	if p.Format != "" && p.Format != formatJSON {
+		return 0, fmt.Errorf("Invalid 'pageSize': not supported with the %q format", p.Format)
+	}
+	if p.GroupBySource {
+		return 0, fmt.Errorf("Invalid 'pageSize': not supported with 'groupBySource'")
+	}
+	return *p.PageSize, nil
+}
+
+// paginate stores the URLs of a response and returns its first page.
+func paginate(response *sitemapResponse, pageSize int) *sitemapResponse {
+	result := &storedResult{response: response, urls: response.URLs, pageSize: pageSize}
+	id := results.put(result)
+	return result.page(id, 0, pageSize)
+}
+
+// nextPage returns the page of a stored result the cursor of the request points
+// at, under c. The page size defaults to the one of the first request.
+func nextPage(c *Config, payload requestPayload) (*sitemapResponse, error) {
+	id, offset, err := decodeCursor(payload.Cursor)
+	if err != nil {
+		return nil, &requestError{http.StatusBadRequest, errCodeInvalidRequest, err.Error(), nil}
+	}
+	size, err := payload.pageSize(c)
+	if err != nil {
+		return nil, &requestError{http.StatusBadRequest, errCodeInvalidRequest, err.Error(), nil}
+	}
+
+	result := results.get(id)
+	if result == nil {
+		return nil, &requestError{http.StatusGone, errCodeCursorExpired, "The result of this cursor has expired or is unknown; repeat the request without a cursor", nil}
+	}
+	if size == 0 {
+		size = result.pageSize
+	}
+	return result.page(id, offset, size), nil
+}
+
+// resultPage is the part of a paginated response locating its page. NextCursor
+// is null on the last page.
+type resultPage struct {
+	NextCursor *string    `json:"nextCursor"`
+	Page       pageBounds `json:"page"`
+}
+
+// pageBounds describes the URLs of a page within the whole result.
+type pageBounds struct {
+	Offset    int `json:"offset"`
+	PageSize  int `json:"pageSize"`
+	TotalURLs int `json:"totalUrls"`
+}
+
+// page returns a copy of the stored response holding the URLs from offset, up
+// to size of them, and the cursor of the next page when there is one.
+func (r *storedResult) page(id string, offset, size int) *sitemapResponse {
+	if offset > len(r.urls) {
+		offset = len(r.urls)
+	}
+	end := offset + size
+	if end > len(r.urls) {
+		end = len(r.urls)
+	}
+
+	page := *r.response
+	page.URLs = r.urls[offset:end]
+	page.resultPage = &resultPage{Page: pageBounds{Offset: offset, PageSize: size, TotalURLs: len(r.urls)}}
+	if end < len(r.urls) {
+		next := encodeCursor(id, end)
+		page.NextCursor = &next
+	}
+	return &page
+}
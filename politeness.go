@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// crawlDelayTTL is how long the Crawl-delay of a robots.txt paces the fetches
+// of its host after the file was fetched.
+const crawlDelayTTL = time.Hour
+
+// errCodeCrawlDelayTooLong is reported for the fetches of a host whose
+// robots.txt asks for a Crawl-delay longer than maxCrawlDelay.
+const errCodeCrawlDelayTooLong = "CRAWL_DELAY_TOO_LONG"
+
+// crawlDelayError is returned for the fetches of a host whose Crawl-delay is
+// longer than maxCrawlDelay, without any request being sent.
+type crawlDelayError struct {
+	Host  string
+	Delay time.Duration
+	Max   time.Duration
+}
+
+func (e *crawlDelayError) Error() string {
+	return fmt.Sprintf("robots.txt of %s asks for %s between requests, more than the %s honored; fetch its sitemaps at that pace yourself", e.Host, e.Delay, e.Max)
+}
+
+// crawlDelay is the Crawl-delay of a host, learned from its robots.txt.
+type crawlDelay struct {
+	delay   time.Duration
+	expires time.Time
+}
+
+// hostRate is the rate of the fetches of a host.
+type hostRate struct {
+	perSecond float64
+	burst     int
+}
+
+// parseHostRates parses the value of HOST_RATE_LIMITS, skipping malformed
+// pairs. A pair without a burst gets burst.
+func parseHostRates(value string, burst int) map[string]hostRate {
+	rates := make(map[string]hostRate)
+	for _, pair := range strings.Split(value, ",") {
+		host, spec, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || host == "" {
+			continue
+		}
+		perSecond, pairBurst, hasBurst := strings.Cut(spec, ":")
+		rate := hostRate{burst: burst}
+		var err error
+		if rate.perSecond, err = strconv.ParseFloat(perSecond, 64); err != nil || rate.perSecond < 0 {
+			continue
+		}
+		if hasBurst {
+			if rate.burst, err = strconv.Atoi(pairBurst); err != nil || rate.burst < 1 {
+				continue
+			}
+		}
+		rates[strings.ToLower(host)] = rate
+	}
+	return rates
+}
+
+// tokenBucket paces the fetches of a host: each takes a token, and tokens are
+// added at the rate of the host up to its burst. Tokens may go negative, for
+// the fetches waiting their turn.
+type tokenBucket struct {
+	rate   hostRate
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the last refill.
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(float64(b.rate.burst), b.tokens+elapsed.Seconds()*b.rate.perSecond)
+		b.last = now
+	}
+}
+
+// pace switches the bucket to rate at now, as when a Crawl-delay starts or
+// stops applying.
+func (b *tokenBucket) pace(rate hostRate, now time.Time) {
+	if rate == b.rate {
+		return
+	}
+	b.refill(now)
+	b.rate = rate
+	b.tokens = math.Min(b.tokens, float64(rate.burst))
+}
+
+// reserve takes a token at now and returns how long to wait for it.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.refill(now)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate.perSecond * float64(time.Second))
+}
+
+// hostLimiter paces the outbound fetches per host, so a walk of many child
+// sitemaps on one host, or many requests for it at once, don't flood it. It is
+// safe for concurrent use.
+type hostLimiter struct {
+	fallback  hostRate
+	overrides map[string]hostRate
+	maxDelay  time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	delays  map[string]crawlDelay
+
+	waits  int64
+	waited time.Duration
+}
+
+var politeness *hostLimiter
+
+func newHostLimiter(fallback hostRate, overrides map[string]hostRate, maxDelay time.Duration) *hostLimiter {
+	return &hostLimiter{
+		fallback:  fallback,
+		overrides: overrides,
+		maxDelay:  maxDelay,
+		buckets:   make(map[string]*tokenBucket),
+		delays:    make(map[string]crawlDelay),
+	}
+}
+
+// limitedHost returns the host whose fetches a fetch of rawURL counts among,
+// empty when it can't be told.
+func limitedHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// rateOf returns the rate of host at now: its own or the default one, or one
+// fetch per Crawl-delay, up to the longest honored, when that is slower. The
+// caller holds l.mu.
+func (l *hostLimiter) rateOf(host string, now time.Time) hostRate {
+	rate, ok := l.overrides[host]
+	if !ok {
+		rate = l.fallback
+	}
+	if delay, ok := l.delays[host]; ok && now.Before(delay.expires) {
+		spacing := delay.delay
+		if spacing > l.maxDelay {
+			spacing = l.maxDelay
+		}
+		if spaced := 1 / spacing.Seconds(); spacing > 0 && (rate.perSecond <= 0 || spaced < rate.perSecond) {
+			rate = hostRate{perSecond: spaced, burst: 1}
+		}
+	}
+	return rate
+}
+
+// setCrawlDelay records the Crawl-delay declared by the robots.txt at
+// robotsURL, or that it declares none when delay is nil.
+func (l *hostLimiter) setCrawlDelay(robotsURL string, delay *float64) {
+	host := limitedHost(robotsURL)
+	if host == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if delay == nil || *delay <= 0 {
+		delete(l.delays, host)
+		return
+	}
+	l.delays[host] = crawlDelay{delay: time.Duration(*delay * float64(time.Second)), expires: time.Now().Add(crawlDelayTTL)}
+}
+
+// forgetCrawlDelays drops the Crawl-delay learned for host, or for every host
+// when host is empty, returning how many were dropped.
+func (l *hostLimiter) forgetCrawlDelays(host string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	removed := 0
+	for name := range l.delays {
+		if host == "" || name == host {
+			delete(l.delays, name)
+			removed++
+		}
+	}
+	return removed
+}
+
+// crawlDelay returns the Crawl-delay pacing the fetches of the host of rawURL,
+// zero when there is none or it isn't honored.
+func (l *hostLimiter) crawlDelay(rawURL string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delay, ok := l.delays[limitedHost(rawURL)]
+	if !ok || !time.Now().Before(delay.expires) || delay.delay > l.maxDelay {
+		return 0
+	}
+	return delay.delay
+}
+
+// wait returns once a fetch of rawURL may be sent, or with the error of ctx
+// when it is done first, in which case the turn of the fetch is given back. A
+// host whose Crawl-delay is longer than the longest honored fails the fetch
+// with a crawlDelayError right away, unless it is of its robots.txt, so the
+// host can lift the delay.
+func (l *hostLimiter) wait(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil
+	}
+	host := strings.ToLower(u.Hostname())
+
+	now := time.Now()
+	l.mu.Lock()
+	if delay, ok := l.delays[host]; ok && now.Before(delay.expires) && delay.delay > l.maxDelay && u.Path != "/robots.txt" {
+		l.mu.Unlock()
+		return &crawlDelayError{Host: host, Delay: delay.delay, Max: l.maxDelay}
+	}
+	rate := l.rateOf(host, now)
+	if rate.perSecond <= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	bucket, ok := l.buckets[host]
+	if !ok {
+		bucket = &tokenBucket{rate: rate, tokens: float64(rate.burst), last: now}
+		l.buckets[host] = bucket
+	}
+	bucket.pace(rate, now)
+	delay := bucket.reserve(now)
+	if delay > 0 {
+		l.waits++
+		l.waited += delay
+	}
+	l.mu.Unlock()
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		bucket.tokens++
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// sweep drops the buckets of the hosts not fetched for long enough to be full
+// again at now, and the expired Crawl-delays, returning how many were dropped.
+func (l *hostLimiter) sweep(now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	removed := 0
+	for host, delay := range l.delays {
+		if !now.Before(delay.expires) {
+			delete(l.delays, host)
+			removed++
+		}
+	}
+	for host, bucket := range l.buckets {
+		bucket.refill(now)
+		if bucket.tokens >= float64(bucket.rate.burst) {
+			delete(l.buckets, host)
+			removed++
+		}
+	}
+	return removed
+}
+
+// politenessMetrics reports the default rate of the fetches of a host, the
+// hosts fetched recently, those paced by their Crawl-delay, and the fetches
+// that waited for their turn since the start.
+type politenessMetrics struct {
+	Enabled           bool    `json:"enabled"`
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	Burst             int     `json:"burst"`
+	Overrides         int     `json:"overrides"`
+	Hosts             int     `json:"hosts"`
+	CrawlDelays       int     `json:"crawlDelays"`
+	MaxCrawlDelay     int     `json:"maxCrawlDelaySeconds"`
+	Waits             int64   `json:"waits"`
+	WaitedMs          int64   `json:"waitedMs"`
+}
+
+// metrics reports the limiter.
+func (l *hostLimiter) metrics() politenessMetrics {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return politenessMetrics{
+		Enabled:           l.fallback.perSecond > 0,
+		RequestsPerSecond: l.fallback.perSecond,
+		Burst:             l.fallback.burst,
+		Overrides:         len(l.overrides),
+		Hosts:             len(l.buckets),
+		CrawlDelays:       len(l.delays),
+		MaxCrawlDelay:     int(l.maxDelay / time.Second),
+		Waits:             l.waits,
+		WaitedMs:          l.waited.Milliseconds(),
+	}
+}
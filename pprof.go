@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// pprofHandler serves the index of the profiles, the goroutine, heap and other
+// runtime profiles, and the CPU profile and execution trace.
+//
+// Importing net/http/pprof registers the same handlers on http.DefaultServeMux,
+// so nothing may ever serve http.DefaultServeMux: every server of the service
+// gets a handler of its own, lest the profiles leak onto the API.
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// startPprofServer starts serving the profiles at addr in the background, and
+// returns its server, or nil when addr is empty. The API keeps running when the
+// listener fails.
+func startPprofServer(addr string) *http.Server {
+	if addr == "" {
+		return nil
+	}
+	server := &http.Server{Addr: addr, Handler: pprofHandler()}
+	go func() {
+		logger.Info("serving profiles", "addr", addr, "path", "/debug/pprof/")
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error("profiling listener failed", "addr", addr, "err", err)
+		}
+	}()
+	return server
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPprofNotServedByTheAPI(t *testing.T) {
+	useLocalConfig(t, map[string]string{"ACCESS_LOG": "0"})
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline", "/debug/pprof/heap"} {
+		w := serve(httptest.NewRequest(http.MethodGet, path, nil))
+		assertErrorCode(t, w, http.StatusNotFound, errCodeNotFound)
+	}
+}
+
+func TestPprofHandler(t *testing.T) {
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline", "/debug/pprof/goroutine"} {
+		w := httptest.NewRecorder()
+		pprofHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s = %d, want 200", path, w.Code)
+		}
+	}
+}
+
+func TestPprofServerOff(t *testing.T) {
+	if server := startPprofServer(""); server != nil {
+		server.Close()
+		t.Error("started a profiling server without an address")
+	}
+}
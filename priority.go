@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// defaultPriority is the priority the sitemap protocol assigns to URLs without one.
+const defaultPriority = 0.5
+
+// parsePriority returns the value of a <priority> element.
+//
+// It returns false when the value is empty or not a number between 0.0 and 1.0.
+func parsePriority(value string) (float64, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	priority, err := strconv.ParseFloat(value, 64)
+	if err != nil || priority < 0 || priority > 1 {
+		return 0, false
+	}
+	return priority, true
+}
+
+// priorityDistribution counts the URLs of a walk per priority bucket of 0.1,
+// from 0.0 to 1.0, and the URLs without a valid priority.
+type priorityDistribution struct {
+	buckets       [11]int
+	unprioritized int
+}
+
+// count adds the priorities of the URLs to the distribution.
+func (d *priorityDistribution) count(urls []SitemapURL) {
+	for _, u := range urls {
+		priority, ok := parsePriority(u.Priority)
+		if !ok {
+			d.unprioritized++
+			continue
+		}
+		// The small epsilon keeps values like 0.3 out of the bucket below
+		d.buckets[int(priority*10+1e-9)]++
+	}
+}
+
+// add adds the counts of other to d.
+func (d *priorityDistribution) add(other priorityDistribution) {
+	for i, n := range other.buckets {
+		d.buckets[i] += n
+	}
+	d.unprioritized += other.unprioritized
+}
+
+// GobEncode encodes the counts of the distribution, so results holding it can
+// be stored in the redis cache backend.
+func (d priorityDistribution) GobEncode() ([]byte, error) {
+	var encoded bytes.Buffer
+	err := gob.NewEncoder(&encoded).Encode(append(d.buckets[:], d.unprioritized))
+	return encoded.Bytes(), err
+}
+
+// GobDecode decodes counts encoded by GobEncode.
+func (d *priorityDistribution) GobDecode(encoded []byte) error {
+	var counts []int
+	if err := gob.NewDecoder(bytes.NewReader(encoded)).Decode(&counts); err != nil {
+		return err
+	}
+	if len(counts) != len(d.buckets)+1 {
+		return fmt.Errorf("priority distribution of %d counts, want %d", len(counts), len(d.buckets)+1)
+	}
+	copy(d.buckets[:], counts)
+	d.unprioritized = counts[len(d.buckets)]
+	return nil
+}
+
+// counts returns the distribution keyed by the lower bound of each bucket, with
+// the URLs without a priority under "none".
+func (d priorityDistribution) counts() map[string]int {
+	counts := make(map[string]int, len(d.buckets)+1)
+	for i, n := range d.buckets {
+		counts[fmt.Sprintf("%.1f", float64(i)/10)] = n
+	}
+	counts["none"] = d.unprioritized
+	return counts
+}
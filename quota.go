@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errCodeQuotaExceeded is reported for the requests of an API key past one of
+// its limits.
+const errCodeQuotaExceeded = "QUOTA_EXCEEDED"
+
+// quotaRetryAfter is the Retry-After, in seconds, of the requests turned away
+// because their key already has as many requests in flight as it may.
+const quotaRetryAfter = 1
+
+// quotaLimits are the limits of an API key: the requests it may make per
+// minute and per UTC day, and the requests it may have in flight at once.
+// Zero means no limit.
+type quotaLimits struct {
+	perMinute  int
+	perDay     int
+	concurrent int
+}
+
+// parseQuotaLimits parses limits given as space separated count/unit terms,
+// such as 60/minute 10000/day 4/concurrent, where the unit is minute, day or
+// concurrent. The limits left out aren't limited.
+func parseQuotaLimits(spec string) (quotaLimits, error) {
+	var limits quotaLimits
+	seen := map[string]bool{}
+	for _, term := range strings.Fields(spec) {
+		count, unit, ok := strings.Cut(term, "/")
+		n, err := strconv.Atoi(count)
+		if !ok || err != nil || n < 0 {
+			return limits, fmt.Errorf("%q isn't a count/unit limit, such as 60/minute", term)
+		}
+		if seen[unit] {
+			return limits, fmt.Errorf("the %s limit is given twice", unit)
+		}
+		seen[unit] = true
+		switch unit {
+		case "minute":
+			limits.perMinute = n
+		case "day":
+			limits.perDay = n
+		case "concurrent":
+			limits.concurrent = n
+		default:
+			return limits, fmt.Errorf("%q isn't one of minute, day, concurrent", unit)
+		}
+	}
+	return limits, nil
+}
+
+// parseKeyLimits parses the API_KEY_LIMITS setting of s, comma separated
+// name=limits pairs giving the limits of the keys among keys by name, and the
+// API_KEY_DEFAULT_LIMITS of the keys without any.
+func parseKeyLimits(s *configSource, keys []apiKey) (map[string]quotaLimits, quotaLimits) {
+	fallback, err := parseQuotaLimits(s.string("API_KEY_DEFAULT_LIMITS", ""))
+	if err != nil {
+		s.problem("API_KEY_DEFAULT_LIMITS", "%v", err)
+	}
+	known := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		known[key.name] = true
+	}
+	limits := map[string]quotaLimits{}
+	for _, entry := range strings.Split(s.string("API_KEY_LIMITS", ""), ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		name, spec, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			s.problem("API_KEY_LIMITS", "%q isn't a name=limits pair", strings.TrimSpace(entry))
+			continue
+		}
+		if !known[name] {
+			s.problem("API_KEY_LIMITS", "no key of API_KEYS is named %q", name)
+			continue
+		}
+		keyLimits, err := parseQuotaLimits(spec)
+		if err != nil {
+			s.problem("API_KEY_LIMITS", "%s: %v", name, err)
+			continue
+		}
+		limits[name] = keyLimits
+	}
+	return limits, fallback
+}
+
+// limitsOf returns the limits of the API key named name.
+func (s *runtimeSettings) limitsOf(name string) quotaLimits {
+	if limits, ok := s.keyLimits[name]; ok {
+		return limits
+	}
+	return s.defaultKeyLimits
+}
+
+// keyUsage is the usage of an API key: the bucket of its requests per minute,
+// its requests of the UTC day starting at day, its requests in flight, and its
+// requests and the ones turned away since the start.
+type keyUsage struct {
+	minute   tokenBucket
+	day      time.Time
+	today    int
+	inFlight int
+	requests int64
+	rejected int64
+}
+
+// advance brings the usage to now under limits: the bucket refilled at the
+// rate of the limit per minute, and the count of the day reset once it is
+// over.
+func (u *keyUsage) advance(limits quotaLimits, now time.Time) {
+	rate := hostRate{perSecond: float64(limits.perMinute) / 60, burst: limits.perMinute}
+	if u.minute.rate.burst == 0 {
+		// A limit just set starts with a full bucket
+		u.minute = tokenBucket{rate: rate, tokens: float64(rate.burst), last: now}
+	}
+	u.minute.pace(rate, now)
+	u.minute.refill(now)
+	if day := now.UTC().Truncate(24 * time.Hour); !day.Equal(u.day) {
+		u.day, u.today = day, 0
+	}
+}
+
+// quotaDecision is the outcome of a request under the limits of its key:
+// whether it goes ahead, and else the limit it is past and when to retry. The
+// limit told in the X-RateLimit headers, the one with the fewest requests
+// left, comes with what is left of it and when it is whole again.
+type quotaDecision struct {
+	allowed    bool
+	exceeded   string
+	retryAfter time.Duration
+
+	limit     int
+	remaining int
+	reset     time.Duration
+}
+
+// quotaSet enforces the limits of the API keys and counts their usage, by
+// name. It is safe for concurrent use.
+type quotaSet struct {
+	mu   sync.Mutex
+	keys map[string]*keyUsage
+}
+
+var quotas = &quotaSet{keys: make(map[string]*keyUsage)}
+
+// usage returns the usage of the key named name, brought to now under limits.
+// s.mu must be held.
+func (s *quotaSet) usage(name string, limits quotaLimits, now time.Time) *keyUsage {
+	usage := s.keys[name]
+	if usage == nil {
+		usage = &keyUsage{}
+		s.keys[name] = usage
+	}
+	usage.advance(limits, now)
+	return usage
+}
+
+// acquire counts a request at now of the key named name, unless it is past one
+// of limits. An allowed request must be released once handled.
+func (s *quotaSet) acquire(name string, limits quotaLimits, now time.Time) quotaDecision {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usage := s.usage(name, limits, now)
+	usage.requests++
+	nextDay := usage.day.Add(24 * time.Hour)
+	var d quotaDecision
+	switch {
+	case limits.concurrent > 0 && usage.inFlight >= limits.concurrent:
+		d.exceeded, d.retryAfter = "concurrent", quotaRetryAfter*time.Second
+	case limits.perDay > 0 && usage.today >= limits.perDay:
+		d.exceeded, d.retryAfter = "day", nextDay.Sub(now)
+	case limits.perMinute > 0 && usage.minute.tokens < 1:
+		d.exceeded = "minute"
+		d.retryAfter = time.Duration((1 - usage.minute.tokens) / usage.minute.rate.perSecond * float64(time.Second))
+	default:
+		d.allowed = true
+		usage.inFlight++
+		usage.today++
+		if limits.perMinute > 0 {
+			usage.minute.tokens--
+		}
+	}
+	if !d.allowed {
+		usage.rejected++
+	}
+
+	if limits.perMinute > 0 {
+		d.limit, d.remaining = limits.perMinute, int(usage.minute.tokens)
+		d.reset = time.Duration((float64(limits.perMinute) - usage.minute.tokens) / usage.minute.rate.perSecond * float64(time.Second))
+	}
+	if left := limits.perDay - usage.today; limits.perDay > 0 && (limits.perMinute == 0 || left < d.remaining || d.exceeded == "day") {
+		d.limit, d.remaining, d.reset = limits.perDay, left, nextDay.Sub(now)
+	}
+	return d
+}
+
+// release ends a request of the key named name.
+func (s *quotaSet) release(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if usage := s.keys[name]; usage != nil {
+		usage.inFlight--
+	}
+}
+
+// keyUsageMetrics reports the usage of an API key against its limits, zero
+// for none: its requests and the ones turned away since the start, its
+// requests of the UTC day, and its requests in flight.
+type keyUsageMetrics struct {
+	Name                string `json:"name"`
+	PerMinute           int    `json:"perMinute"`
+	PerDay              int    `json:"perDay"`
+	Concurrent          int    `json:"concurrent"`
+	Requests            int64  `json:"requests"`
+	Rejected            int64  `json:"rejected"`
+	Today               int    `json:"today"`
+	InFlight            int    `json:"inFlight"`
+	RemainingThisMinute int    `json:"remainingThisMinute"`
+	RemainingToday      int    `json:"remainingToday"`
+}
+
+// metrics reports the usage of the keys of c, in their order.
+func (s *quotaSet) metrics(c *Config, now time.Time) []keyUsageMetrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	metrics := make([]keyUsageMetrics, 0, len(c.apiKeys))
+	for _, key := range c.apiKeys {
+		limits := c.limitsOf(key.name)
+		usage := s.usage(key.name, limits, now)
+		m := keyUsageMetrics{
+			Name:       key.name,
+			PerMinute:  limits.perMinute,
+			PerDay:     limits.perDay,
+			Concurrent: limits.concurrent,
+			Requests:   usage.requests,
+			Rejected:   usage.rejected,
+			Today:      usage.today,
+			InFlight:   usage.inFlight,
+		}
+		if limits.perMinute > 0 {
+			m.RemainingThisMinute = int(usage.minute.tokens)
+		}
+		if limits.perDay > 0 {
+			m.RemainingToday = limits.perDay - usage.today
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+// ceilSeconds returns d in whole seconds, rounded up.
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// enforceQuotas is the middleware enforcing the limits of the API key of
+// each request, after requireAPIKey: requests past one of them get a 429 with
+// a Retry-After header. The responses of limited keys tell the limit closest
+// to being reached in X-RateLimit-Limit, the requests left of it in
+// X-RateLimit-Remaining, and the seconds until it is whole again in
+// X-RateLimit-Reset.
+func enforceQuotas(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := apiKeyFrom(r.Context())
+		if name == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		limits := configFrom(r.Context()).limitsOf(name)
+		d := quotas.acquire(name, limits, time.Now())
+		if d.limit > 0 {
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(d.limit))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(d.remaining))
+			w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(d.reset)))
+		}
+		if !d.allowed {
+			var message string
+			var limit int
+			switch d.exceeded {
+			case "concurrent":
+				message, limit = fmt.Sprintf("The API key %s has %d requests in flight already; try again later", name, limits.concurrent), limits.concurrent
+			case "day":
+				message, limit = fmt.Sprintf("The API key %s made its %d requests of the day; try again tomorrow", name, limits.perDay), limits.perDay
+			default:
+				message, limit = fmt.Sprintf("The API key %s made its %d requests of the minute; try again later", name, limits.perMinute), limits.perMinute
+			}
+			writeAPIError(w, http.StatusTooManyRequests, errCodeQuotaExceeded, message, map[string]interface{}{"quota": d.exceeded, "limit": limit, "retryAfterSeconds": ceilSeconds(d.retryAfter)})
+			return
+		}
+		defer quotas.release(name)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminKeysResponse is the response of the keys admin endpoint.
+type adminKeysResponse struct {
+	Keys []keyUsageMetrics `json:"keys"`
+}
+
+// handleAdminKeysEndpoint reports the usage of every API key against its
+// limits, for accounting.
+func handleAdminKeysEndpoint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, adminKeysResponse{Keys: quotas.metrics(configFrom(r.Context()), time.Now())})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Response headers describing the upstream fetch of /raw.
+const (
+	finalURLHeader       = "X-Final-Url"
+	upstreamStatusHeader = "X-Upstream-Status"
+	rawTruncatedHeader   = "X-Raw-Truncated"
+)
+
+// isSitemapContentType reports whether a content type may hold a sitemap: XML,
+// plain text, gzip or an unspecified binary body. A missing type is accepted.
+func isSitemapContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "application/xml", "text/xml", "text/plain", "application/gzip", "application/x-gzip", "application/octet-stream":
+		return true
+	}
+	return strings.HasSuffix(mediaType, "+xml")
+}
+
+// handleRawEndpoint returns the body of a sitemap exactly as the service fetches it.
+//
+// It expects a GET request with the sitemap URL in the "url" query parameter.
+// The sitemap is fetched with the same client as a walk, and its body is passed
+// through, decompressed, with the upstream Content-Type. The final URL after
+// redirects and the upstream status are exposed in headers. Bodies over
+// RAW_MAX_BYTES are cut, and content types that can't be sitemaps are refused
+// unless "force=true" is set.
+func handleRawEndpoint(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	sitemapURL := query.Get(queryParamSitemap)
+	if sitemapURL == "" {
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, "Missing 'url' query parameter", nil)
+		return
+	}
+	if reqErr := validateTargetURL(sitemapURL); reqErr != nil {
+		writeRequestError(w, reqErr)
+		return
+	}
+	force, _ := strconv.ParseBool(query.Get("force"))
+
+	requestID(w, r)
+
+	config := configFrom(r.Context())
+	ctx, cancel := context.WithTimeout(r.Context(), config.requestTimeout)
+	defer cancel()
+
+	trace := &redirectTrace{}
+	resp, err := fetchURL(ctx, sitemapURL, trace)
+	if err != nil {
+		var limitErr *redirectLimitError
+		if errors.As(err, &limitErr) {
+			writeAPIError(w, http.StatusBadGateway, errCodeTooManyRedirects, limitErr.Error(), map[string]interface{}{"limit": limitErr.Limit})
+			return
+		}
+		if isFetchRefusal(err) {
+			writeRequestError(w, fetchError(err))
+			return
+		}
+		if isTimeout(err) {
+			writeAPIError(w, http.StatusGatewayTimeout, errCodeUpstreamTimeout, fmt.Sprintf("Timed out fetching %s: %v", sitemapURL, err), nil)
+			return
+		}
+		writeAPIError(w, http.StatusBadGateway, errCodeFetchFailed, fmt.Sprintf("Failed to fetch %s: %v", sitemapURL, err), nil)
+		return
+	}
+	defer resp.Body.Close()
+
+	contentType := resp.Header.Get("Content-Type")
+	if !force && !isSitemapContentType(contentType) {
+		writeAPIError(w, http.StatusUnsupportedMediaType, errCodeUnsupportedMediaType, fmt.Sprintf("Upstream content type %q is not a sitemap type; set force=true to pass it through", contentType), map[string]interface{}{"contentType": contentType})
+		return
+	}
+
+	// Read one byte past the cap to tell whether the body was cut
+	body, err := io.ReadAll(io.LimitReader(resp.Body, int64(config.maxRawBytes)+1))
+	if err != nil {
+		writeAPIError(w, http.StatusBadGateway, errCodeFetchFailed, fmt.Sprintf("Failed to read %s: %v", sitemapURL, err), nil)
+		return
+	}
+	if len(body) > config.maxRawBytes {
+		body = body[:config.maxRawBytes]
+		w.Header().Set(rawTruncatedHeader, "true")
+	}
+
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	// The body comes from a third party, so keep browsers from running it
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set(finalURLHeader, trace.FinalURL)
+	w.Header().Set(upstreamStatusHeader, strconv.Itoa(resp.StatusCode))
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
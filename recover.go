@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+)
+
+// panicError is the error of work that panicked, reported as an internal
+// error without the panic, which is logged instead.
+type panicError struct {
+	value interface{}
+}
+
+func (e *panicError) Error() string {
+	return "Internal error"
+}
+
+// Counts of the panics recovered since the start: in handlers, and in the
+// work done for requests on other goroutines, such as parses on the worker
+// pool and the walks of child sitemaps.
+var handlerPanics, workerPanics int64
+
+// panicMetrics reports the panics recovered since the start.
+type panicMetrics struct {
+	Handlers int64 `json:"handlers"`
+	Workers  int64 `json:"workers"`
+}
+
+// currentPanicMetrics reports the panics recovered.
+func currentPanicMetrics() panicMetrics {
+	return panicMetrics{Handlers: atomic.LoadInt64(&handlerPanics), Workers: atomic.LoadInt64(&workerPanics)}
+}
+
+// logPanic logs a recovered panic with the stack of the goroutine that
+// panicked, under the request ID of ctx, and counts it into counter.
+func logPanic(ctx context.Context, where string, value interface{}, counter *int64) {
+	atomic.AddInt64(counter, 1)
+	loggerFrom(ctx).Error("panic recovered", "in", where, "panic", value, "stack", string(debug.Stack()))
+}
+
+// recoverTo recovers a panic of the goroutine deferring it, logging it and
+// setting *err to a panicError, so the work fails instead of the process. It
+// must be deferred directly.
+func recoverTo(ctx context.Context, where string, err *error) {
+	value := recover()
+	if value == nil {
+		return
+	}
+	logPanic(ctx, where, value, &workerPanics)
+	*err = &panicError{value: value}
+}
+
+// recoverPanics is the middleware recovering the panics of handlers: the
+// panic is logged with its stack and the request ID, and the request gets the
+// JSON 500 envelope, or has its connection cut when part of the reply went out
+// already. Handlers aborting their reply with http.ErrAbortHandler keep doing
+// so.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		aw := &accessWriter{ResponseWriter: w}
+		defer func() {
+			value := recover()
+			if value == nil {
+				return
+			}
+			if value == http.ErrAbortHandler {
+				panic(value)
+			}
+			logPanic(r.Context(), r.Method+" "+r.URL.Path, value, &handlerPanics)
+			if aw.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			// Drop what the handler set up for the reply it didn't send
+			header := w.Header()
+			for name := range header {
+				if name != requestIDHeader && name != "Vary" && name != "Server" && !strings.HasPrefix(name, "Access-Control-") {
+					delete(header, name)
+				}
+			}
+			writeAPIError(w, http.StatusInternalServerError, errCodeInternal, "Internal server error", nil)
+		}()
+		next.ServeHTTP(aw, r)
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// panickingRoutes returns a router panicking on /boom once its headers are set,
+// and on /partial once part of its reply went out, with the middleware of the
+// API around them.
+func panickingRoutes() *router {
+	routes := newRouter()
+	routes.handle("/boom", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		w.Header().Set("ETag", `"abc"`)
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		var m map[string]int
+		m["secret"]++
+	}, http.MethodGet)
+	routes.handle("/partial", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `{"urls":["https://example.com/`)
+		w.(http.Flusher).Flush()
+		panic("half way")
+	}, http.MethodGet)
+	routes.use(snapshotConfig)
+	routes.use(traceRequests)
+	routes.use(logAccess)
+	routes.use(recoverPanics)
+	routes.use(allowCORS(routes))
+	return routes
+}
+
+func TestRecoverPanicsResponse(t *testing.T) {
+	useLocalConfig(t, map[string]string{"ACCESS_LOG": "0", "CORS_ALLOWED_ORIGINS": "https://app.example.com"})
+	logs := captureLogs(t)
+	before := atomic.LoadInt64(&handlerPanics)
+
+	r := httptest.NewRequest(http.MethodGet, "/boom", nil)
+	r.Header.Set(requestIDHeader, "panicking-request")
+	r.Header.Set("Origin", "https://app.example.com")
+	w := httptest.NewRecorder()
+	panickingRoutes().handler().ServeHTTP(w, r)
+
+	assertErrorCode(t, w, http.StatusInternalServerError, errCodeInternal)
+	if body := w.Body.String(); !strings.Contains(body, `"message":"Internal server error"`) || strings.Contains(body, "nil map") {
+		t.Errorf("body = %s, want the generic message without the panic", body)
+	}
+	header := w.Header()
+	if header.Get("Content-Type") != mediaTypeJSON || header.Get("ETag") != "" || header.Get("Cache-Control") == "public, max-age=60" {
+		t.Errorf("headers = %v, want the JSON envelope without those of the reply not sent", header)
+	}
+	if header.Get(requestIDHeader) != "panicking-request" || header.Get("Access-Control-Allow-Origin") == "" {
+		t.Errorf("headers = %v, want the request ID and CORS headers kept", header)
+	}
+	if n := atomic.LoadInt64(&handlerPanics) - before; n != 1 {
+		t.Errorf("%d handler panics counted, want 1", n)
+	}
+	output := logs.String()
+	if !strings.Contains(output, "panic recovered") || !strings.Contains(output, "panicking-request") || !strings.Contains(output, "recover_test.go") {
+		t.Errorf("the panic wasn't logged with the request ID and its stack:\n%s", output)
+	}
+}
+
+func TestRecoverPanicsAfterReplyStarted(t *testing.T) {
+	useLocalConfig(t, map[string]string{"ACCESS_LOG": "0"})
+	captureLogs(t)
+	server := httptest.NewServer(panickingRoutes().handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/partial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	// The connection is cut, so the client can't take the reply as complete
+	body, err := io.ReadAll(resp.Body)
+	if err == nil {
+		t.Errorf("read %q in full, want the reply cut short", body)
+	}
+	if strings.Contains(string(body), errCodeInternal) {
+		t.Errorf("body = %q, want no envelope after the partial reply", body)
+	}
+}
+
+func TestRecoverToFailsTheWork(t *testing.T) {
+	captureLogs(t)
+	before := atomic.LoadInt64(&workerPanics)
+	work := func() (err error) {
+		defer recoverTo(context.Background(), "test work", &err)
+		panic("worker panic")
+	}
+
+	err := work()
+	var panicked *panicError
+	if !errors.As(err, &panicked) || panicked.value != "worker panic" || err.Error() != "Internal error" {
+		t.Errorf("err = %v, want the panic as a panicError", err)
+	}
+	if n := atomic.LoadInt64(&workerPanics) - before; n != 1 {
+		t.Errorf("%d worker panics counted, want 1", n)
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// redisRetryInterval is how long Redis is left alone after failing, during
+	// which every lookup is a miss.
+	redisRetryInterval = 5 * time.Second
+	// redisMaxIdleConns is the number of connections kept open between commands.
+	redisMaxIdleConns = 8
+)
+
+// errRedisUnavailable is returned for the commands not sent because Redis
+// failed less than redisRetryInterval ago.
+var errRedisUnavailable = errors.New("redis unavailable")
+
+// redisEntry is a cache entry as stored in Redis, encoded with gob.
+type redisEntry struct {
+	Result    *sitemapResult
+	Redirects redirectTrace
+	Discovery *sitemapDiscovery
+	Robots    *robotsFile
+
+	Sitemap      *Sitemap
+	ETag         string
+	LastModified string
+
+	Stored time.Time
+}
+
+// redisConn is a connection to Redis with its buffered reader.
+type redisConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// redisCache is the cache backend holding entries in Redis, where their TTL is
+// enforced. Redis failing degrades to cache misses: the failure is logged and
+// Redis is left alone for redisRetryInterval.
+type redisCache struct {
+	addr   string
+	prefix string
+	// password authenticates the connections when set, and db is the database
+	// they select, when not the default 0.
+	password string
+	db       int
+	// timeout bounds each command.
+	timeout time.Duration
+
+	mu        sync.Mutex
+	idle      []*redisConn
+	downUntil time.Time
+}
+
+// newRedisCache returns the redis cache backend configured by c.
+func newRedisCache(c *Config) *redisCache {
+	return &redisCache{addr: c.redisAddr, prefix: c.redisKeyPrefix, password: c.redisPassword, db: c.redisDB, timeout: c.redisTimeout}
+}
+
+func (c *redisCache) get(key string) *cacheEntry {
+	reply, err := c.do("GET", c.prefix+key)
+	if err != nil || reply == nil {
+		return nil
+	}
+	encoded, ok := reply.([]byte)
+	if !ok {
+		return nil
+	}
+
+	var stored redisEntry
+	if err := gob.NewDecoder(bytes.NewReader(encoded)).Decode(&stored); err != nil {
+		logger.Warn("redis cache entry can't be decoded", "key", key, "err", err)
+		return nil
+	}
+	entry := &cacheEntry{result: stored.Result, redirects: stored.Redirects, discovery: stored.Discovery, robots: stored.Robots, stored: stored.Stored}
+	if stored.Sitemap != nil {
+		entry.document = &cachedDocument{sitemap: stored.Sitemap, etag: stored.ETag, lastModified: stored.LastModified}
+	}
+	return entry
+}
+
+func (c *redisCache) set(key string, entry *cacheEntry, ttl time.Duration) {
+	entry.stored = time.Now()
+	entry.expires = entry.stored.Add(ttl)
+	stored := redisEntry{Result: entry.result, Redirects: entry.redirects, Discovery: entry.discovery, Robots: entry.robots, Stored: entry.stored}
+	if entry.document != nil {
+		stored.Sitemap, stored.ETag, stored.LastModified = entry.document.sitemap, entry.document.etag, entry.document.lastModified
+	}
+
+	var encoded bytes.Buffer
+	if err := gob.NewEncoder(&encoded).Encode(stored); err != nil {
+		logger.Warn("redis cache entry can't be encoded", "key", key, "err", err)
+		return
+	}
+	c.do("SET", c.prefix+key, encoded.String(), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+}
+
+func (c *redisCache) delete(key string) {
+	c.do("DEL", c.prefix+key)
+}
+
+// purge drops the entries whose key match accepts, scanning the keys under the
+// prefix of the cache, and returns how many were dropped. A failure of Redis
+// stops the scan, with only the entries seen so far dropped.
+func (c *redisCache) purge(match func(key string) bool) int {
+	removed := 0
+	cursor := "0"
+	for {
+		reply, err := c.do("SCAN", cursor, "MATCH", c.prefix+"*", "COUNT", "500")
+		page, ok := reply.([]interface{})
+		if err != nil || !ok || len(page) != 2 {
+			return removed
+		}
+		next, _ := page[0].([]byte)
+		keys, _ := page[1].([]interface{})
+		args := []string{"DEL"}
+		for _, key := range keys {
+			if name, ok := key.([]byte); ok && match(strings.TrimPrefix(string(name), c.prefix)) {
+				args = append(args, string(name))
+			}
+		}
+		if len(args) > 1 {
+			if deleted, err := c.do(args...); err == nil {
+				count, _ := deleted.(int64)
+				removed += int(count)
+			}
+		}
+		if cursor = string(next); cursor == "0" || cursor == "" {
+			return removed
+		}
+	}
+}
+
+// do sends a command to Redis and returns its reply: nil, a string for status
+// replies, an int64, a []byte for bulk strings, or a []interface{} for arrays.
+// Error replies are returned as errors.
+func (c *redisCache) do(args ...string) (interface{}, error) {
+	conn, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	reply, err := conn.command(args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		// The connection is in an unknown state
+		conn.Close()
+		c.fail(err)
+		return nil, err
+	}
+	c.release(conn)
+	return reply, err
+}
+
+// ping reports why Redis can't be reached, or nil.
+func (c *redisCache) ping() error {
+	_, err := c.do("PING")
+	return err
+}
+
+// conn returns an idle connection to Redis, or a new one.
+func (c *redisCache) conn() (*redisConn, error) {
+	c.mu.Lock()
+	if time.Now().Before(c.downUntil) {
+		c.mu.Unlock()
+		return nil, errRedisUnavailable
+	}
+	if n := len(c.idle); n > 0 {
+		conn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return conn, nil
+	}
+	c.mu.Unlock()
+
+	netConn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		c.fail(err)
+		return nil, err
+	}
+	conn := &redisConn{Conn: netConn, reader: bufio.NewReader(netConn)}
+	if err := c.setUp(conn); err != nil {
+		conn.Close()
+		c.fail(err)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// setUp authenticates a new connection with the password of the cache, and
+// selects its database, when they are set. An error reply fails it like a
+// connection error, as no command can be sent over it.
+func (c *redisCache) setUp(conn *redisConn) error {
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	if c.password != "" {
+		if _, err := conn.command("AUTH", c.password); err != nil {
+			return fmt.Errorf("redis AUTH: %w", err)
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.command("SELECT", strconv.Itoa(c.db)); err != nil {
+			return fmt.Errorf("redis SELECT %d: %w", c.db, err)
+		}
+	}
+	return nil
+}
+
+// release keeps a connection for the next commands, or closes it when enough
+// are kept.
+func (c *redisCache) release(conn *redisConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle) >= redisMaxIdleConns {
+		conn.Close()
+		return
+	}
+	c.idle = append(c.idle, conn)
+}
+
+// fail leaves Redis alone for redisRetryInterval after err, dropping the idle
+// connections. Only the first failure of an outage is logged.
+func (c *redisCache) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Now().Before(c.downUntil) {
+		return
+	}
+	logger.Warn("redis cache failed, caching is off for a while", "addr", c.addr, "retryIn", redisRetryInterval, "err", err)
+	c.downUntil = time.Now().Add(redisRetryInterval)
+	for _, conn := range c.idle {
+		conn.Close()
+	}
+	c.idle = nil
+}
+
+// redisError is an error reply of Redis.
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// command writes a command in the RESP protocol and reads its reply.
+func (conn *redisConn) command(args ...string) (interface{}, error) {
+	var request bytes.Buffer
+	fmt.Fprintf(&request, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&request, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := conn.Write(request.Bytes()); err != nil {
+		return nil, err
+	}
+	return conn.reply()
+}
+
+// reply reads a reply in the RESP protocol.
+func (conn *redisConn) reply() (interface{}, error) {
+	line, err := conn.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed redis reply %q", line)
+	}
+	kind, value := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return value, nil
+	case '-':
+		return nil, redisError(value)
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		body := make([]byte, size+2)
+		if _, err := io.ReadFull(conn.reader, body); err != nil {
+			return nil, err
+		}
+		return body[:size], nil
+	case '*':
+		count, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			if items[i], err = conn.reply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("malformed redis reply %q", line)
+}
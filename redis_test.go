@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a Redis server speaking enough of RESP for the cache: AUTH,
+// SELECT, PING, GET, SET with PX, DEL and SCAN. Its keys are per database,
+// and replying with errors for a command is set in failing.
+type fakeRedis struct {
+	addr     string
+	password string
+
+	mu       sync.Mutex
+	values   map[string]string
+	expires  map[string]time.Time
+	failing  map[string]string
+	commands []string
+}
+
+// newFakeRedis serves a fakeRedis requiring password, when set, on the
+// loopback for the rest of the test.
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	server := &fakeRedis{addr: listener.Addr().String(), password: password, values: map[string]string{}, expires: map[string]time.Time{}, failing: map[string]string{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+// serve answers the commands of a connection until it is closed.
+func (s *fakeRedis) serve(netConn net.Conn) {
+	defer netConn.Close()
+	// The requests are RESP arrays of bulk strings, read like replies
+	conn := &redisConn{Conn: netConn, reader: bufio.NewReader(netConn)}
+	authenticated, db := s.password == "", "0"
+	for {
+		request, err := conn.reply()
+		items, ok := request.([]interface{})
+		if err != nil || !ok || len(items) == 0 {
+			return
+		}
+		args := make([]string, len(items))
+		for i, item := range items {
+			value, _ := item.([]byte)
+			args[i] = string(value)
+		}
+		name := strings.ToUpper(args[0])
+
+		s.mu.Lock()
+		s.commands = append(s.commands, name)
+		var reply string
+		switch failure, failing := s.failing[name]; {
+		case failing:
+			reply = "-" + failure + "\r\n"
+		case name == "AUTH":
+			if len(args) == 2 && args[1] == s.password {
+				authenticated = true
+				reply = "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid username-password pair\r\n"
+			}
+		case !authenticated:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case name == "SELECT":
+			db = args[1]
+			reply = "+OK\r\n"
+		default:
+			reply = s.run(db, args)
+		}
+		s.mu.Unlock()
+		if _, err := fmt.Fprint(netConn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// run runs a data command in db and returns its reply. The caller holds s.mu.
+func (s *fakeRedis) run(db string, args []string) string {
+	bulk := func(value string) string { return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value) }
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "GET":
+		key := db + " " + args[1]
+		if expires, ok := s.expires[key]; ok && time.Now().After(expires) {
+			delete(s.values, key)
+			delete(s.expires, key)
+		}
+		value, ok := s.values[key]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulk(value)
+	case "SET":
+		key := db + " " + args[1]
+		s.values[key] = args[2]
+		if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+			ms, _ := strconv.Atoi(args[4])
+			s.expires[key] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "+OK\r\n"
+	case "DEL":
+		deleted := 0
+		for _, name := range args[1:] {
+			if _, ok := s.values[db+" "+name]; ok {
+				delete(s.values, db+" "+name)
+				deleted++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", deleted)
+	case "SCAN":
+		// Every key in a single page matching the prefix of the pattern
+		prefix := strings.TrimSuffix(args[3], "*")
+		var keys []string
+		for key := range s.values {
+			if name := strings.TrimPrefix(key, db+" "); name != key && strings.HasPrefix(name, prefix) {
+				keys = append(keys, bulk(name))
+			}
+		}
+		return "*2\r\n" + bulk("0") + fmt.Sprintf("*%d\r\n", len(keys)) + strings.Join(keys, "")
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+// fakeRedisCache returns a redis cache backend using server, with env over
+// its REDIS_ADDR.
+func fakeRedisCache(t *testing.T, server *fakeRedis, env map[string]string) *redisCache {
+	t.Helper()
+	settings := map[string]string{"CACHE_BACKEND": "redis", "REDIS_ADDR": server.addr}
+	for name, value := range env {
+		settings[name] = value
+	}
+	c, err := loadConfig("", envOf(settings))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	return newCacheBackend(c).(*redisCache)
+}
+
+func TestRedisCacheGetSetExpiry(t *testing.T) {
+	server := newFakeRedis(t, "")
+	cache := fakeRedisCache(t, server, nil)
+
+	if entry := cache.get("sitemap https://example.com/"); entry != nil {
+		t.Fatalf("get = %+v before any set, want a miss", entry)
+	}
+	cache.set("sitemap https://example.com/", &cacheEntry{result: &sitemapResult{URLs: []string{"https://example.com/a"}}}, time.Minute)
+	cache.set("robots example.com", &cacheEntry{robots: &robotsFile{URL: "https://example.com/robots.txt", Exists: true, Sitemaps: []string{"https://example.com/sitemap.xml"}}}, 50*time.Millisecond)
+
+	entry := cache.get("sitemap https://example.com/")
+	if entry == nil || entry.result == nil || len(entry.result.URLs) != 1 || entry.stored.IsZero() {
+		t.Fatalf("get = %+v, want the result stored", entry)
+	}
+	if entry := cache.get("robots example.com"); entry == nil || entry.robots == nil || entry.robots.Sitemaps[0] != "https://example.com/sitemap.xml" {
+		t.Fatalf("get = %+v, want the robots.txt stored", entry)
+	}
+	server.mu.Lock()
+	_, prefixed := server.values["0 sitemap-parser:robots example.com"]
+	server.mu.Unlock()
+	if !prefixed {
+		t.Error("the key isn't stored under REDIS_KEY_PREFIX")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if entry := cache.get("robots example.com"); entry != nil {
+		t.Errorf("get = %+v past its TTL, want a miss", entry)
+	}
+	if removed := cache.purge(func(key string) bool { return strings.HasPrefix(key, "sitemap ") }); removed != 1 {
+		t.Errorf("purge removed %d entries, want 1", removed)
+	}
+	if entry := cache.get("sitemap https://example.com/"); entry != nil {
+		t.Errorf("get = %+v after the purge, want a miss", entry)
+	}
+}
+
+func TestRedisCacheAuthAndSelect(t *testing.T) {
+	server := newFakeRedis(t, "s3cret")
+	cache := fakeRedisCache(t, server, map[string]string{"REDIS_PASSWORD": "s3cret", "REDIS_DB": "2"})
+
+	cache.set("document https://example.com/", &cacheEntry{}, time.Minute)
+	if err := cache.ping(); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	server.mu.Lock()
+	commands := strings.Join(server.commands, " ")
+	_, selected := server.values["2 sitemap-parser:document https://example.com/"]
+	server.mu.Unlock()
+	if commands != "AUTH SELECT SET PING" {
+		t.Errorf("commands = %s, want the connection set up once before its commands", commands)
+	}
+	if !selected {
+		t.Error("the entry wasn't stored in the database of REDIS_DB")
+	}
+}
+
+func TestRedisCacheWrongPassword(t *testing.T) {
+	logs := captureLogs(t)
+	server := newFakeRedis(t, "s3cret")
+	cache := fakeRedisCache(t, server, map[string]string{"REDIS_PASSWORD": "wrong"})
+
+	cache.set("document https://example.com/", &cacheEntry{}, time.Minute)
+	if entry := cache.get("document https://example.com/"); entry != nil {
+		t.Errorf("get = %+v, want a miss", entry)
+	}
+	// The refused password leaves Redis alone like a failure
+	if err := cache.ping(); err != errRedisUnavailable {
+		t.Errorf("ping = %v, want %v", err, errRedisUnavailable)
+	}
+	if output := logs.String(); !strings.Contains(output, "WRONGPASS") || strings.Contains(output, "wrong") {
+		t.Errorf("the refusal wasn't logged, or the password was:\n%s", output)
+	}
+}
+
+func TestRedisCacheErrorReplies(t *testing.T) {
+	server := newFakeRedis(t, "")
+	cache := fakeRedisCache(t, server, nil)
+	cache.set("document https://example.com/", &cacheEntry{}, time.Minute)
+
+	server.mu.Lock()
+	server.failing["GET"] = "ERR out of memory"
+	server.mu.Unlock()
+	if entry := cache.get("document https://example.com/"); entry != nil {
+		t.Errorf("get = %+v on an error reply, want a miss", entry)
+	}
+
+	// An error reply leaves the connection, and Redis, usable
+	server.mu.Lock()
+	delete(server.failing, "GET")
+	server.mu.Unlock()
+	if entry := cache.get("document https://example.com/"); entry == nil {
+		t.Error("get missed after an error reply, want Redis used again")
+	}
+	if _, err := cache.do("FLUSHALL"); err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Errorf("do = %v, want the error reply returned", err)
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// defaultSitemapLocations are the paths probed, after the candidatePaths of
+// the request, for the sitemap of a domain whose robots.txt names none.
+var defaultSitemapLocations = []string{
+	"/test.xml",
+	"/sitemap.xml",
+	"/sitemap1.xml",
+	"/sitemap.txt",
+	"/sitemap_index.xml",
+	"/sitemap/",
+	"/sitemap",
+	"/sitemap-index.xml",
+	"/sitemaps/",
+	"/sitemaps",
+	"/site-map",
+	"/sitemap-indexes/",
+	"/post-sitemap.xml",
+	"/page-sitemap.xml",
+	"/category-sitemap.xml",
+	"/tag-sitemap.xml",
+	"/pages-sitemap.xml",
+	"/blog-pages-sitemap.xml",
+	"/member-profile-sitemap.xml",
+	"/dynamic-pages-sitemap.xml",
+	"/other-pages-sitemap.xml",
+	"/sitemap.xml.gz",
+	"/sitemapindex.xml",
+	"/sitemap_index.xml.gz",
+	"/sitemap/index.xml",
+	"/sitemap.xml",
+	"/sitemap_map.html",
+	"/wp-sitemap.xml",
+	"/other-pages-sitemap.xml",
+	"/category-sitemap.xml",
+	"/tag-sitemap.xml",
+	"/author-sitemap.xml",
+	"/post-sitemap",
+	"/sitemaps-2-sitemap.xml",
+	"/page-sitemap",
+}
+
+// runtimeSettings are the settings that can change while the service runs,
+// read again from the configuration on SIGHUP. A snapshot is never modified:
+// a reload replaces it, so a request reading it sees the settings of before or
+// after the reload, not a mix.
+type runtimeSettings struct {
+	// requestTimeout is the time budget of a parse request, covering discovery
+	// and the whole sitemap walk. It can be configured through the
+	// REQUEST_TIMEOUT_SECONDS environment variable, and lowered per request
+	// with the timeoutSeconds payload field.
+	requestTimeout time.Duration
+
+	// fetchTimeout bounds each outbound fetch, including reading the response
+	// body, and so the phases of the fetch bounded by the timeouts of the
+	// transport. It can be configured through the FETCH_TIMEOUT_SECONDS
+	// environment variable, and overridden per request with the
+	// timeoutSeconds payload field.
+	fetchTimeout time.Duration
+
+	// maxBatchDomains is the maximum number of domains accepted by a batch
+	// request. It can be configured through the BATCH_MAX_DOMAINS environment
+	// variable.
+	maxBatchDomains int
+
+	// maxSitemapDepth is the deepest level of nested sitemap indexes followed.
+	// It can be configured through the SITEMAP_MAX_DEPTH environment variable,
+	// and lowered per request with the maxDepth payload field.
+	maxSitemapDepth int
+
+	// maxChildSitemaps is the maximum number of child sitemaps followed per
+	// request. It can be configured through the SITEMAP_MAX_CHILDREN
+	// environment variable, and lowered per request with the maxSitemaps
+	// payload field.
+	maxChildSitemaps int
+
+	// maxSitemapURLs is the maximum number of URLs collected per request. It
+	// can be configured through the SITEMAP_MAX_URLS environment variable, and
+	// lowered per request with the maxUrls payload field.
+	maxSitemapURLs int
+
+	// maxPageSize is the largest page size a request can ask for. It can be
+	// configured through the MAX_PAGE_SIZE environment variable.
+	maxPageSize int
+
+	// domainMaxInFlight, sitemapMaxInFlight and batchMaxInFlight bound the
+	// requests of /domain, /sitemap and /batch handled at once, so a client
+	// flooding an expensive endpoint doesn't starve the cheap ones. Zero means
+	// no bound. They can be configured through the MAX_INFLIGHT_DOMAIN,
+	// MAX_INFLIGHT_SITEMAP and MAX_INFLIGHT_BATCH environment variables.
+	domainMaxInFlight  int
+	sitemapMaxInFlight int
+	batchMaxInFlight   int
+
+	// sitemapLocations are the paths probed for the sitemap of a domain whose
+	// robots.txt names none. They can be configured through the
+	// SITEMAP_LOCATIONS environment variable, as comma separated paths.
+	sitemapLocations []string
+
+	// logLevel is the least severe level of the events logged. It can be
+	// configured through the LOG_LEVEL environment variable.
+	logLevel slog.Level
+
+	// apiKeys are the keys the API requires, none when it is open to every
+	// client. They can be configured through the API_KEYS environment
+	// variable.
+	apiKeys []apiKey
+
+	// keyLimits are the limits of the API keys by name, and defaultKeyLimits
+	// the ones of the keys without any. They can be configured through the
+	// API_KEY_LIMITS and API_KEY_DEFAULT_LIMITS environment variables.
+	keyLimits        map[string]quotaLimits
+	defaultKeyLimits quotaLimits
+
+	// clientRate is the rate of the requests of each client address, none
+	// when its perSecond is zero. It can be configured through the
+	// CLIENT_RATE_LIMIT_PER_MINUTE and CLIENT_RATE_LIMIT_BURST environment
+	// variables.
+	clientRate hostRate
+}
+
+// reloadableSettings are the names of the settings applied by a reload. The
+// others only apply after a restart.
+var reloadableSettings = map[string]bool{
+	"REQUEST_TIMEOUT_SECONDS":      true,
+	"FETCH_TIMEOUT_SECONDS":        true,
+	"BATCH_MAX_DOMAINS":            true,
+	"SITEMAP_MAX_DEPTH":            true,
+	"SITEMAP_MAX_CHILDREN":         true,
+	"SITEMAP_MAX_URLS":             true,
+	"MAX_PAGE_SIZE":                true,
+	"MAX_INFLIGHT_DOMAIN":          true,
+	"MAX_INFLIGHT_SITEMAP":         true,
+	"MAX_INFLIGHT_BATCH":           true,
+	"SITEMAP_LOCATIONS":            true,
+	"LOG_LEVEL":                    true,
+	"API_KEYS":                     true,
+	"API_KEY_LIMITS":               true,
+	"API_KEY_DEFAULT_LIMITS":       true,
+	"CLIENT_RATE_LIMIT_PER_MINUTE": true,
+	"CLIENT_RATE_LIMIT_BURST":      true,
+}
+
+// readRuntimeSettings reads the runtime settings of s.
+func readRuntimeSettings(s *configSource) *runtimeSettings {
+	r := &runtimeSettings{
+		requestTimeout:     s.seconds("REQUEST_TIMEOUT_SECONDS", 60),
+		fetchTimeout:       s.seconds("FETCH_TIMEOUT_SECONDS", 10),
+		maxBatchDomains:    s.int("BATCH_MAX_DOMAINS", 50),
+		maxSitemapDepth:    s.int("SITEMAP_MAX_DEPTH", 3),
+		maxChildSitemaps:   s.int("SITEMAP_MAX_CHILDREN", 100),
+		maxSitemapURLs:     s.int("SITEMAP_MAX_URLS", 100000),
+		maxPageSize:        s.int("MAX_PAGE_SIZE", 10000),
+		domainMaxInFlight:  s.int("MAX_INFLIGHT_DOMAIN", 16),
+		sitemapMaxInFlight: s.int("MAX_INFLIGHT_SITEMAP", 64),
+		batchMaxInFlight:   s.int("MAX_INFLIGHT_BATCH", 4),
+	}
+	for _, location := range strings.Split(s.string("SITEMAP_LOCATIONS", strings.Join(defaultSitemapLocations, ",")), ",") {
+		location = strings.TrimSpace(location)
+		if location == "" {
+			continue
+		}
+		if !strings.HasPrefix(location, "/") {
+			s.problem("SITEMAP_LOCATIONS", "%q isn't a path starting with /", location)
+			continue
+		}
+		r.sitemapLocations = append(r.sitemapLocations, location)
+	}
+	level, valid := parseLogLevel(s.string("LOG_LEVEL", "info"))
+	if !valid {
+		value, _ := s.lookup("LOG_LEVEL")
+		s.problem("LOG_LEVEL", "%q isn't one of debug, info, warn, error", value)
+	}
+	r.logLevel = level
+	r.apiKeys = parseAPIKeys(s)
+	r.keyLimits, r.defaultKeyLimits = parseKeyLimits(s, r.apiKeys)
+	r.clientRate = readClientRate(s)
+	return r
+}
+
+// liveConfig holds the configuration in use, the one of the defaults until
+// main loads the configuration of the service.
+var liveConfig = newConfigValue(defaultConfig())
+
+// defaultConfig returns the configuration without any setting.
+func defaultConfig() *Config {
+	c, _ := loadConfig("", func(string) (string, bool) { return "", false })
+	return c
+}
+
+// newConfigValue returns a value holding c.
+func newConfigValue(c *Config) *atomic.Value {
+	v := &atomic.Value{}
+	v.Store(c)
+	return v
+}
+
+// currentConfig returns the configuration in use. Requests get theirs through
+// configFrom, for them to keep what they read.
+func currentConfig() *Config {
+	return liveConfig.Load().(*Config)
+}
+
+// configKey is the context key of the configuration of a request.
+type configKey struct{}
+
+// withConfig returns ctx with its request served under c.
+func withConfig(ctx context.Context, c *Config) context.Context {
+	return context.WithValue(ctx, configKey{}, c)
+}
+
+// configFrom returns the configuration the request of ctx is served under, or
+// the one in use outside of any request.
+func configFrom(ctx context.Context) *Config {
+	if c, ok := ctx.Value(configKey{}).(*Config); ok {
+		return c
+	}
+	return currentConfig()
+}
+
+// snapshotConfig is the middleware serving each request under the
+// configuration in use when it arrived, so a reload while it is handled
+// doesn't mix the settings of before and after it.
+func snapshotConfig(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(withConfig(r.Context(), currentConfig())))
+	})
+}
+
+// reloadMu serializes reloads, which replace the configuration in use.
+var reloadMu sync.Mutex
+
+// reloadConfig reads the configuration again, from the environment and the
+// file, checking every setting like at startup, and applies the runtime
+// settings. The settings that changed are logged, with the ones only a
+// restart applies. An invalid configuration is logged and returned, and the
+// one in use kept.
+func reloadConfig() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	current := currentConfig()
+	next, err := loadConfig(current.source.path, current.source.lookupEnv)
+	if err != nil {
+		logger.Error("reloading the configuration failed, keeping the current one", "err", err)
+		return err
+	}
+	var applied, restart []string
+	for _, name := range current.source.names(next.source) {
+		before, _ := current.source.lookup(name)
+		after, _ := next.source.lookup(name)
+		if before == after {
+			continue
+		}
+		if reloadableSettings[name] {
+			applied = append(applied, name)
+		} else {
+			restart = append(restart, name)
+		}
+	}
+	next.warnUnread()
+
+	// The settings of components built at startup stay as they were
+	reloaded := *current
+	reloaded.source = next.source
+	reloaded.runtimeSettings = next.runtimeSettings
+	liveConfig.Store(&reloaded)
+	logLevelVar.Set(reloaded.logLevel)
+	logger.Info("configuration reloaded", "file", next.source.path, "changed", strings.Join(applied, ", "))
+	if len(restart) > 0 {
+		logger.Warn("settings changed that only apply after a restart", "settings", strings.Join(restart, ", "))
+	}
+	return nil
+}
+
+// names returns the names of the settings s read or holds in its file,
+// together with the ones of other, sorted.
+func (s *configSource) names(other *configSource) []string {
+	seen := map[string]bool{}
+	for _, source := range []*configSource{s, other} {
+		source.mu.Lock()
+		for name := range source.read {
+			seen[name] = true
+		}
+		source.mu.Unlock()
+		for name := range source.file {
+			seen[name] = true
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// handleReloads reloads the configuration on SIGHUP, in the background, and
+// the TLS certificate when certs isn't nil.
+func handleReloads(certs *certReloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			logger.Info("reloading on SIGHUP")
+			reloadConfig()
+			if certs != nil {
+				if err := certs.reload(); err != nil {
+					logger.Warn("reloading the TLS certificate failed, keeping the current one", "err", err)
+				}
+			}
+		}
+	}()
+}
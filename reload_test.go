@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// captureLogs sends the events logged for the rest of the test to the buffer
+// returned.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	previous := logger
+	logger = slog.New(slog.NewTextHandler(&buf, nil))
+	t.Cleanup(func() { logger = previous })
+	return &buf
+}
+
+func TestReloadConfig(t *testing.T) {
+	path := writeConfigFile(t, "config.json", `{"REQUEST_TIMEOUT_SECONDS": 20, "API_KEYS": "ci=one", "CACHE_TTL_SECONDS": 30, "LISTEN_ADDR": ":9090"}`)
+	env := map[string]string{"FETCH_TIMEOUT_SECONDS": "4"}
+	c, err := loadConfig(path, envOf(env))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	previous := currentConfig()
+	liveConfig.Store(c)
+	t.Cleanup(func() { liveConfig.Store(previous) })
+	logs := captureLogs(t)
+
+	// A request holds on to the configuration it arrived under
+	ctx := withConfig(context.Background(), currentConfig())
+
+	if err := os.WriteFile(path, []byte(`{"REQUEST_TIMEOUT_SECONDS": 40, "API_KEYS": "ci=two", "CACHE_TTL_SECONDS": 90, "LISTEN_ADDR": ":9090"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadConfig(); err != nil {
+		t.Fatalf("reloadConfig: %v", err)
+	}
+
+	reloaded := currentConfig()
+	if reloaded.requestTimeout != 40*time.Second || reloaded.fetchTimeout != 4*time.Second {
+		t.Errorf("timeouts = %s, %s, want the 40s of the file and the 4s of the environment", reloaded.requestTimeout, reloaded.fetchTimeout)
+	}
+	if reloaded.cacheTTL != 30*time.Second {
+		t.Errorf("cacheTTL = %s, want the 30s of the start, which only a restart changes", reloaded.cacheTTL)
+	}
+	if same := configFrom(ctx); same.requestTimeout != 20*time.Second || same.apiKeys[0].digest == reloaded.apiKeys[0].digest {
+		t.Errorf("the configuration of a request in flight changed: requestTimeout = %s", same.requestTimeout)
+	}
+	output := logs.String()
+	if strings.Contains(output, "unknown settings") {
+		t.Errorf("the settings of the file were logged as unknown:\n%s", output)
+	}
+	if !strings.Contains(output, "changed=\"API_KEYS, REQUEST_TIMEOUT_SECONDS\"") || !strings.Contains(output, "settings=CACHE_TTL_SECONDS") {
+		t.Errorf("the changed settings weren't logged as applied and needing a restart:\n%s", output)
+	}
+}
+
+func TestReloadConfigInvalid(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", "REQUEST_TIMEOUT_SECONDS: 20\n")
+	c, err := loadConfig(path, envOf(nil))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	previous := currentConfig()
+	liveConfig.Store(c)
+	t.Cleanup(func() { liveConfig.Store(previous) })
+	captureLogs(t)
+
+	// A restart-only setting is checked like at startup too
+	if err := os.WriteFile(path, []byte("REQUEST_TIMEOUT_SECONDS: 40\nLISTEN_ADDR: nowhere\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadConfig(); err == nil || !strings.Contains(err.Error(), "LISTEN_ADDR: ") {
+		t.Errorf("reloadConfig error = %v, want LISTEN_ADDR reported", err)
+	}
+	if currentConfig() != c {
+		t.Error("an invalid configuration replaced the one in use")
+	}
+}
+
+func TestReloadConfigWhileServing(t *testing.T) {
+	path := writeConfigFile(t, "config.json", `{"MAX_PAGE_SIZE": 10}`)
+	c, err := loadConfig(path, envOf(nil))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	previous := currentConfig()
+	liveConfig.Store(c)
+	t.Cleanup(func() { liveConfig.Store(previous) })
+	captureLogs(t)
+
+	// Run under -race, readers and reloads must not race
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if size := configFrom(context.Background()).maxPageSize; size != 10 && size != 20 {
+					t.Errorf("maxPageSize = %d", size)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		size := []string{"10", "20"}[i%2]
+		if err := os.WriteFile(path, []byte(`{"MAX_PAGE_SIZE": `+size+`}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := reloadConfig(); err != nil {
+			t.Fatalf("reloadConfig: %v", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
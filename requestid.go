@@ -0,0 +1,35 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// requestIDHeader is the header carrying the ID of a request.
+const requestIDHeader = "X-Request-Id"
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestID returns the ID of the request, taken from the X-Request-Id header
+// when the client sent a reasonable one, and generated otherwise. The ID is
+// echoed in the X-Request-Id response header, and kept for the request once
+// it is.
+func requestID(w http.ResponseWriter, r *http.Request) string {
+	if id := w.Header().Get(requestIDHeader); id != "" {
+		return id
+	}
+	id := r.Header.Get(requestIDHeader)
+	if id == "" || len(id) > 128 {
+		id = newRequestID()
+	}
+	w.Header().Set(requestIDHeader, id)
+	return id
+}
@@ -0,0 +1,46 @@
+package main
+
+// sitemapResponse is the response of the domain and sitemap endpoints, which
+// is also the result of /batch entries and callbacks.
+type sitemapResponse struct {
+	Type       string            `json:"type"`
+	Format     string            `json:"format,omitempty"`
+	SitemapURL string            `json:"sitemapUrl,omitempty"`
+	Discovery  *sitemapDiscovery `json:"discovery,omitempty"`
+	// URLs lists the URLs kept by the walk. It is empty when they are streamed
+	// out, grouped by source or described by the tree.
+	URLs []string `json:"urls"`
+
+	// The walk is left out in discovery-only mode, the changes unless asked for
+	// and the page unless the URLs are paginated.
+	*walkSummary
+	*urlChanges
+	*resultPage
+
+	// Debug reports the timings of the fetches, when asked for.
+	Debug *fetchTimings `json:"debug,omitempty"`
+}
+
+// walkSummary is the part of a response describing the walk of a sitemap.
+type walkSummary struct {
+	Errors     []sitemapError   `json:"errors"`
+	Partial    bool             `json:"partial"`
+	Sitemaps   []string         `json:"sitemaps"`
+	Unexplored []string         `json:"unexplored"`
+	Skipped    []skippedSitemap `json:"skipped"`
+	Truncated  bool             `json:"truncated"`
+	Warnings   []string         `json:"warnings"`
+	Meta       responseMeta     `json:"meta"`
+	Redirects  *redirectTrace   `json:"redirects"`
+
+	Tree    *sitemapNode    `json:"tree,omitempty"`
+	Sources []sitemapSource `json:"sources,omitempty"`
+	Sample  *sampleInfo     `json:"sample,omitempty"`
+}
+
+// sampleInfo states what a sample was drawn from, and how to draw it again.
+type sampleInfo struct {
+	Size       int   `json:"size"`
+	Population int   `json:"population"`
+	Seed       int64 `json:"seed"`
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// fetchRetries counts the retries of every outbound fetch since the start.
+var fetchRetries int64
+
+// retryCounterKey is the context key under which the retry count of a walk is
+// stored.
+type retryCounterKey struct{}
+
+// withRetryCounter returns a context whose fetch retries are counted into n.
+func withRetryCounter(ctx context.Context, n *int64) context.Context {
+	return context.WithValue(ctx, retryCounterKey{}, n)
+}
+
+// countRetry accounts for a retry of a fetch bound to ctx.
+func countRetry(ctx context.Context) {
+	atomic.AddInt64(&fetchRetries, 1)
+	if n, ok := ctx.Value(retryCounterKey{}).(*int64); ok {
+		atomic.AddInt64(n, 1)
+	}
+}
+
+// retryableStatus reports whether a response status is worth another attempt.
+func retryableStatus(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// upstreamRateLimitedError is returned when an upstream answers 429 or 503 with
+// a Retry-After header asking for a wait that can't be made, as it outlasts the
+// request deadline or no attempt is left.
+type upstreamRateLimitedError struct {
+	URL        string
+	Status     int
+	RetryAfter time.Duration
+}
+
+func (e *upstreamRateLimitedError) Error() string {
+	return fmt.Sprintf("Rate limited fetching %s: status %d, retry after %s", e.URL, e.Status, e.RetryAfter)
+}
+
+// retryAfterSeconds returns the wait asked for, in whole seconds rounded up.
+func (e *upstreamRateLimitedError) retryAfterSeconds() int {
+	return int((e.RetryAfter + time.Second - 1) / time.Second)
+}
+
+// retryAfter returns the wait asked for by the Retry-After header of a 429 or
+// 503 response, given in seconds or as an HTTP date. ok is false for other
+// responses, and when the header is missing or malformed.
+func retryAfter(resp *http.Response) (wait time.Duration, ok bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	value := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if wait = time.Until(date); wait < 0 {
+		wait = 0
+	}
+	return wait, true
+}
+
+// isTransient reports whether a failed fetch may succeed if attempted again:
+// timeouts, and connections that couldn't be made or broke. Hosts that don't
+// exist, redirect loops, invalid certificates and internal addresses fail the
+// same way again.
+func isTransient(err error) bool {
+	var dnsErr *net.DNSError
+	var limitErr *redirectLimitError
+	var certErr *x509.CertificateInvalidError
+	var authorityErr x509.UnknownAuthorityError
+	var hostErr x509.HostnameError
+	var targetErr *forbiddenTargetError
+	switch {
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound,
+		errors.As(err, &limitErr), errors.As(err, &targetErr),
+		errors.As(err, &certErr), errors.As(err, &authorityErr), errors.As(err, &hostErr):
+		return false
+	case isTimeout(err), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
+
+// retryBackoff returns the wait before the given retry, counting from 1:
+// backoff doubled per retry, with half of it random.
+func retryBackoff(backoff time.Duration, retry int) time.Duration {
+	wait := backoff << (retry - 1)
+	if wait <= 0 {
+		return 0
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// retryFetch calls fetch up to the fetchMaxAttempts of the configuration of
+// ctx times, while it fails with a transient error or a 502, 503 or 504
+// status, waiting retryBackoff between attempts. A 429 or 503 response with a Retry-After header is retried after
+// the wait it asks for instead, and when that wait would outlast the deadline
+// of ctx, or no attempt is left, an upstreamRateLimitedError is returned right
+// away. Other statuses, 4xx included, are returned as they are. Any other wait
+// that would outlast the deadline isn't made, the last outcome being returned
+// instead.
+func retryFetch(ctx context.Context, fetch func() (*http.Response, error)) (*http.Response, error) {
+	config := configFrom(ctx)
+	for attempt := 1; ; attempt++ {
+		resp, err := fetch()
+		var wait time.Duration
+		var asked bool
+		if err == nil {
+			wait, asked = retryAfter(resp)
+		}
+		if asked {
+			if deadline, ok := ctx.Deadline(); attempt >= config.fetchMaxAttempts || ok && time.Until(deadline) < wait {
+				resp.Body.Close()
+				return nil, &upstreamRateLimitedError{URL: resp.Request.URL.String(), Status: resp.StatusCode, RetryAfter: wait}
+			}
+		} else {
+			retryable := err == nil && retryableStatus(resp.StatusCode) || err != nil && ctx.Err() == nil && isTransient(err)
+			if !retryable || attempt >= config.fetchMaxAttempts {
+				return resp, err
+			}
+			wait = retryBackoff(config.fetchRetryBackoff, attempt)
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+				return resp, err
+			}
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		if err != nil {
+			loggerFrom(ctx).Debug("retrying fetch", "attempt", attempt+1, "wait", wait, "err", err)
+		} else {
+			loggerFrom(ctx).Debug("retrying fetch", "attempt", attempt+1, "wait", wait, "url", resp.Request.URL.String(), "status", resp.StatusCode)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+		countRetry(ctx)
+	}
+}
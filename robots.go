@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// robotsFile describes the robots.txt file of a domain.
+type robotsFile struct {
+	// URL is the URL that answered, over https or http.
+	URL        string
+	Exists     bool
+	Status     int
+	Size       int
+	Sitemaps   []string
+	CrawlDelay *float64
+
+	// body holds the file contents, empty when the file doesn't exist. It isn't
+	// kept by the cache.
+	body string
+}
+
+// sitemapURL returns the sitemap discovery picks from the file: the first
+// declared one that is an http or https URL, or "" when there is none.
+func (r *robotsFile) sitemapURL() string {
+	for _, sitemap := range r.Sitemaps {
+		if checkFetchURL(sitemap) == nil {
+			return sitemap
+		}
+	}
+	return ""
+}
+
+// robotsPayload represents the JSON payload accepted by the robots endpoint.
+type robotsPayload struct {
+	Domain string `json:"domain"`
+}
+
+// robotsResponse is the response of the robots endpoint. SitemapURL is the
+// sitemap discovery would pick from the file.
+type robotsResponse struct {
+	Type       string   `json:"type"`
+	Domain     string   `json:"domain"`
+	RobotsURL  string   `json:"robotsUrl"`
+	Exists     bool     `json:"exists"`
+	Status     int      `json:"status"`
+	Size       int      `json:"size"`
+	Sitemaps   []string `json:"sitemaps"`
+	CrawlDelay *float64 `json:"crawlDelay"`
+	SitemapURL string   `json:"sitemapUrl"`
+}
+
+// fetchRobots fetches and parses the robots.txt file of the given domain.
+//
+// It tries https first and retries over http when the https request fails at the
+// transport level, e.g. because TLS isn't set up on the host. Any status but OK
+// is reported as a missing file. The Crawl-delay of the file, or its absence,
+// then paces the fetches of the host.
+func fetchRobots(ctx context.Context, domain string) (*robotsFile, error) {
+	ctx, span := startSpan(ctx, "robots.txt", spanKindClient)
+	defer span.finish()
+	robotsURL := hostURL("https", domain, "/robots.txt")
+	resp, err := fetchURL(ctx, robotsURL, nil)
+	var limitErr *redirectLimitError
+	var rateErr *upstreamRateLimitedError
+	var delayErr *crawlDelayError
+	var targetErr *forbiddenTargetError
+	if err != nil && !errors.As(err, &limitErr) && !errors.As(err, &rateErr) && !errors.As(err, &delayErr) && !errors.As(err, &targetErr) && ctx.Err() == nil {
+		// No response was received over https, so retry over plain http.
+		loggerFrom(ctx).Debug("fetching robots.txt over https failed, trying http", "domain", domain, "err", err)
+		robotsURL = hostURL("http", domain, "/robots.txt")
+		resp, err = fetchURL(ctx, robotsURL, nil)
+	}
+	span.set("url.full", robotsURL)
+	if err != nil {
+		span.fail(err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	span.set("http.response.status_code", resp.StatusCode)
+
+	robots := &robotsFile{URL: robotsURL, Status: resp.StatusCode, Sitemaps: []string{}}
+	if resp.StatusCode != http.StatusOK {
+		politeness.setCrawlDelay(robotsURL, nil)
+		return robots, nil
+	}
+
+	body, err := readBody(resp, robotsURL, configFrom(ctx).fetchMaxBodyBytes)
+	span.set("http.response.body.size", len(body))
+	if err != nil {
+		span.fail(err)
+		return nil, err
+	}
+	robots.Exists = true
+	robots.Size = len(body)
+	robots.body = string(body)
+	robots.parse()
+	politeness.setCrawlDelay(robotsURL, robots.CrawlDelay)
+	return robots, nil
+}
+
+// robotsCacheKey returns the cache key of the robots.txt file of domain.
+func robotsCacheKey(domain string) string {
+	return "robots " + strings.ToLower(domain)
+}
+
+// fetchRobotsCached fetches the robots.txt file of domain like fetchRobots,
+// answering from the cache for CACHE_TTL_SECONDS, so discovery and /robots
+// don't fetch the file of a domain again for every request.
+func fetchRobotsCached(ctx context.Context, domain string) (*robotsFile, error) {
+	config := configFrom(ctx)
+	if config.cacheTTL <= 0 {
+		return fetchRobots(ctx, domain)
+	}
+	key := robotsCacheKey(domain)
+	if entry := cache.get(key); entry != nil && entry.robots != nil {
+		return entry.robots, nil
+	}
+	robots, err := fetchRobots(ctx, domain)
+	if err == nil {
+		cache.set(key, &cacheEntry{robots: robots}, config.cacheTTL)
+	}
+	return robots, err
+}
+
+// parse collects the Sitemap directives of the file, and the Crawl-delay of
+// the group of rules applying to every user agent, "User-agent: *". Directive
+// names are matched case-insensitively, and only the first Crawl-delay of that
+// group counts.
+func (r *robotsFile) parse() {
+	// A group starts with User-agent lines, and ends at the next User-agent line
+	// following its rules
+	everyAgent, inRules := false, true
+	for _, line := range strings.Split(r.body, "\n") {
+		// Drop comments and surrounding whitespace
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		name, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "user-agent":
+			if inRules {
+				everyAgent, inRules = false, false
+			}
+			if value == "*" {
+				everyAgent = true
+			}
+		case "sitemap":
+			if value != "" {
+				r.Sitemaps = append(r.Sitemaps, value)
+			}
+		case "crawl-delay":
+			inRules = true
+			if delay, err := strconv.ParseFloat(value, 64); err == nil && delay >= 0 && everyAgent && r.CrawlDelay == nil {
+				r.CrawlDelay = &delay
+			}
+		default:
+			inRules = true
+		}
+	}
+}
+
+// handleRobotsEndpoint reports the robots.txt file of a domain.
+//
+// It expects a GET request with the 'domain' query parameter, or a POST request
+// with a JSON payload containing the 'domain' field. The file is fetched the
+// same way as during discovery, and the response tells whether it exists, its
+// HTTP status and size, the sitemaps and Crawl-delay it declares, and the
+// sitemap URL discovery would pick from it.
+func handleRobotsEndpoint(w http.ResponseWriter, r *http.Request) {
+	var domain string
+	switch r.Method {
+	case http.MethodGet:
+		domain = r.URL.Query().Get(queryParamDomain)
+	case http.MethodPost:
+		// Decompress a gzip request body and check it is JSON before decoding it
+		if err := prepareJSONBody(w, r); err != nil {
+			writeRequestError(w, err)
+			return
+		}
+		var payload robotsPayload
+		if err := decodeJSONBody(r, &payload); err != nil {
+			writeRequestError(w, err)
+			return
+		}
+		domain = payload.Domain
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPost, http.MethodOptions)
+		return
+	}
+
+	if domain == "" {
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, "Missing 'domain' field", nil)
+		return
+	}
+	if !isValidDomain(domain) {
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidDomain, fmt.Sprintf("Invalid 'domain': %q", domain), nil)
+		return
+	}
+	domain = extractDomain(domain)
+
+	requestID(w, r)
+
+	ctx, cancel := context.WithTimeout(r.Context(), configFrom(r.Context()).requestTimeout)
+	defer cancel()
+
+	robots, err := fetchRobotsCached(ctx, domain)
+	if err != nil {
+		var limitErr *redirectLimitError
+		if errors.As(err, &limitErr) {
+			writeAPIError(w, http.StatusBadGateway, errCodeTooManyRedirects, limitErr.Error(), map[string]interface{}{"limit": limitErr.Limit})
+			return
+		}
+		var sizeErr *bodyTooLargeError
+		if isFetchRefusal(err) || errors.As(err, &sizeErr) {
+			writeRequestError(w, fetchError(err))
+			return
+		}
+		if isTimeout(err) {
+			writeAPIError(w, http.StatusGatewayTimeout, errCodeUpstreamTimeout, fmt.Sprintf("Timed out fetching robots.txt of %s: %v", domain, err), nil)
+			return
+		}
+		writeAPIError(w, http.StatusBadGateway, errCodeFetchFailed, fmt.Sprintf("Failed to fetch robots.txt of %s: %v", domain, err), nil)
+		return
+	}
+
+	writeCacheableJSON(w, r, robotsResponse{
+		Type:       "robots",
+		Domain:     domain,
+		RobotsURL:  robots.URL,
+		Exists:     robots.Exists,
+		Status:     robots.Status,
+		Size:       robots.Size,
+		Sitemaps:   robots.Sitemaps,
+		CrawlDelay: robots.CrawlDelay,
+		SitemapURL: robots.sitemapURL(),
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// robotsServer serves body as its robots.txt over plain http, counting the
+// fetches of the file.
+func robotsServer(t *testing.T, body string) (*httptest.Server, *int32) {
+	t.Helper()
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/robots.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		atomic.AddInt32(&fetches, 1)
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(server.Close)
+	return server, &fetches
+}
+
+func TestRobotsSharedWithDiscovery(t *testing.T) {
+	useLocalConfig(t, nil)
+	captureLogs(t)
+	site, fetches := robotsServer(t, "User-agent: *\nCrawl-delay: 0\nsitemap: ftp://example.com/sitemap.xml\nSITEMAP: https://example.com/sitemap.xml\nSitemap: https://example.com/news.xml\n")
+
+	w := httptest.NewRecorder()
+	handleRobotsEndpoint(w, httptest.NewRequest(http.MethodGet, "/v1/robots?domain="+hostOf(site), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var response robotsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if !response.Exists || len(response.Sitemaps) != 3 || response.CrawlDelay == nil {
+		t.Errorf("response = %+v, want the file with its three sitemaps and Crawl-delay", response)
+	}
+	if response.SitemapURL != "https://example.com/sitemap.xml" {
+		t.Errorf("sitemapUrl = %q, want the first https sitemap", response.SitemapURL)
+	}
+
+	discovery, err := getSitemapURLFromDomain(context.Background(), hostOf(site), nil)
+	if err != nil {
+		t.Fatalf("getSitemapURLFromDomain: %v", err)
+	}
+	if discovery.SitemapURL != response.SitemapURL || discovery.RobotsURL != site.URL+"/robots.txt" {
+		t.Errorf("discovery = %s from %s, want the sitemap /robots reported", discovery.SitemapURL, discovery.RobotsURL)
+	}
+	if n := atomic.LoadInt32(fetches); n != 1 {
+		t.Errorf("robots.txt fetched %d times, want once for /robots and discovery", n)
+	}
+
+	// Flushing the cache fetches the file again
+	cache.purge(func(string) bool { return true })
+	if _, err := getSitemapURLFromDomain(context.Background(), hostOf(site), nil); err != nil {
+		t.Fatalf("getSitemapURLFromDomain: %v", err)
+	}
+	if n := atomic.LoadInt32(fetches); n != 2 {
+		t.Errorf("robots.txt fetched %d times, want it fetched again after the flush", n)
+	}
+}
+
+func TestRobotsNotCachedWithoutTTL(t *testing.T) {
+	useLocalConfig(t, map[string]string{"CACHE_TTL_SECONDS": "0"})
+	site, fetches := robotsServer(t, "Sitemap: https://example.com/sitemap.xml\n")
+
+	for i := 0; i < 2; i++ {
+		if _, err := fetchRobotsCached(context.Background(), hostOf(site)); err != nil {
+			t.Fatalf("fetchRobotsCached: %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(fetches); n != 2 {
+		t.Errorf("robots.txt fetched %d times, want every time with the cache off", n)
+	}
+}
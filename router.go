@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// apiVersion is the version of the API, which prefixes the endpoint paths and
+// is reported in the response meta. Breaking changes go to a new version, so
+// the paths of this one keep their behavior.
+const apiVersion = "v1"
+
+// route is an endpoint of the router: its handler and the methods it accepts.
+type route struct {
+	handler http.HandlerFunc
+	methods []string
+	// successor is the path replacing a deprecated alias.
+	successor string
+}
+
+// allows reports whether the route accepts method.
+func (rt route) allows(method string) bool {
+	for _, m := range rt.methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed returns the methods to list in the Allow header of the route, which
+// always include OPTIONS.
+func (rt route) allowed() []string {
+	return append(append([]string(nil), rt.methods...), http.MethodOptions)
+}
+
+// middleware wraps a handler with behavior shared by every endpoint.
+type middleware func(http.Handler) http.Handler
+
+// router dispatches requests by path, with or without a trailing slash,
+// replying with a JSON 404 for unknown paths, a 204 listing the allowed methods
+// for OPTIONS, and a 405 for methods the endpoint doesn't declare.
+type router struct {
+	routes     map[string]route
+	paths      []string
+	middleware []middleware
+}
+
+func newRouter() *router {
+	return &router{routes: make(map[string]route)}
+}
+
+// handle registers handler for path, accepting only the given methods.
+func (rt *router) handle(path string, handler http.HandlerFunc, methods ...string) {
+	rt.routes[path] = route{handler: handler, methods: methods}
+	rt.paths = append(rt.paths, path)
+}
+
+// aliasUnprefixed registers every path under prefix without the prefix too, as
+// a deprecated alias of the prefixed path. Replies on an alias carry a
+// Deprecation header and a Link to their successor.
+func (rt *router) aliasUnprefixed(prefix string) {
+	for _, path := range rt.paths {
+		alias := strings.TrimPrefix(path, prefix)
+		if alias == path || !strings.HasPrefix(alias, "/") {
+			continue
+		}
+		if _, taken := rt.routes[alias]; taken {
+			continue
+		}
+		endpoint := rt.routes[path]
+		endpoint.successor = path
+		rt.routes[alias] = endpoint
+	}
+}
+
+// endpoints lists the paths under prefix registered through handle, in order,
+// each with the methods it accepts.
+func (rt *router) endpoints(prefix string) []string {
+	var lines []string
+	for _, path := range rt.paths {
+		if strings.HasPrefix(path, prefix+"/") {
+			lines = append(lines, strings.Join(rt.routes[path].allowed(), ", ")+" "+path)
+		}
+	}
+	return lines
+}
+
+// lookup returns the route of path, ignoring a trailing slash.
+func (rt *router) lookup(path string) (route, bool) {
+	if endpoint, ok := rt.routes[path]; ok {
+		return endpoint, true
+	}
+	if len(path) > 1 && strings.HasSuffix(path, "/") {
+		endpoint, ok := rt.routes[strings.TrimSuffix(path, "/")]
+		return endpoint, ok
+	}
+	return route{}, false
+}
+
+// use adds middleware around every route. Middleware added first runs first.
+func (rt *router) use(mw middleware) {
+	rt.middleware = append(rt.middleware, mw)
+}
+
+// handler returns the router wrapped in its middleware.
+func (rt *router) handler() http.Handler {
+	var h http.Handler = http.HandlerFunc(rt.dispatch)
+	for i := len(rt.middleware) - 1; i >= 0; i-- {
+		h = rt.middleware[i](h)
+	}
+	return h
+}
+
+func (rt *router) dispatch(w http.ResponseWriter, r *http.Request) {
+	endpoint, ok := rt.lookup(r.URL.Path)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, errCodeNotFound, "No endpoint at "+r.URL.Path, nil)
+		return
+	}
+	if endpoint.successor != "" {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+endpoint.successor+`>; rel="successor-version"`)
+	}
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Allow", strings.Join(endpoint.allowed(), ", "))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if !endpoint.allows(r.Method) {
+		writeMethodNotAllowed(w, endpoint.allowed()...)
+		return
+	}
+	endpoint.handler(w, r)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// unusedMethod returns a method endpoint doesn't accept.
+func unusedMethod(endpoint route) string {
+	for _, method := range []string{http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodPost, http.MethodGet} {
+		if !endpoint.allows(method) {
+			return method
+		}
+	}
+	return ""
+}
+
+func TestRouterMethods(t *testing.T) {
+	useLocalConfig(t, map[string]string{"ACCESS_LOG": "0"})
+	routes := newRoutes()
+	if len(routes.paths) == 0 {
+		t.Fatal("no routes registered")
+	}
+	// The deprecated aliases are routes too, answering the same
+	paths := make([]string, 0, len(routes.routes))
+	for path := range routes.routes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		endpoint := routes.routes[path]
+		allow := strings.Join(endpoint.allowed(), ", ")
+		if !strings.HasSuffix(allow, http.MethodOptions) {
+			t.Errorf("%s allows %q, without OPTIONS", path, allow)
+		}
+		t.Run(path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			routes.handler().ServeHTTP(w, httptest.NewRequest(http.MethodOptions, path, nil))
+			if w.Code != http.StatusNoContent || w.Header().Get("Allow") != allow || w.Body.Len() != 0 {
+				t.Errorf("OPTIONS = %d with Allow %q: %q, want 204 with Allow %q", w.Code, w.Header().Get("Allow"), w.Body, allow)
+			}
+
+			method := unusedMethod(endpoint)
+			w = httptest.NewRecorder()
+			routes.handler().ServeHTTP(w, httptest.NewRequest(method, path, nil))
+			assertErrorCode(t, w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed)
+			if got := w.Header().Get("Allow"); got != allow {
+				t.Errorf("%s = Allow %q, want %q", method, got, allow)
+			}
+			if got := w.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("%s = Content-Type %q, want the JSON envelope", method, got)
+			}
+			var body struct {
+				Error struct {
+					Details struct {
+						Allowed []string `json:"allowed"`
+					} `json:"details"`
+				} `json:"error"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || strings.Join(body.Error.Details.Allowed, ", ") != allow {
+				t.Errorf("%s = %s, want the allowed methods in the details", method, w.Body)
+			}
+		})
+	}
+}
+
+func TestRouterPaths(t *testing.T) {
+	useLocalConfig(t, map[string]string{"ACCESS_LOG": "0"})
+	tests := []struct {
+		path       string
+		status     int
+		deprecated bool
+	}{
+		{"/v1/ping", http.StatusOK, false},
+		{"/v1/ping/", http.StatusOK, false},
+		{"/ping", http.StatusOK, true},
+		{"/v1/nothing", http.StatusNotFound, false},
+		{"/v1/ping//", http.StatusNotFound, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := serve(httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status == http.StatusNotFound {
+				assertErrorCode(t, w, http.StatusNotFound, errCodeNotFound)
+			}
+			if deprecated := w.Header().Get("Deprecation") == "true"; deprecated != tt.deprecated {
+				t.Errorf("deprecated = %t, want %t", deprecated, tt.deprecated)
+			}
+			if tt.deprecated && w.Header().Get("Link") != `</v1/ping>; rel="successor-version"` {
+				t.Errorf("Link = %q, want the successor", w.Header().Get("Link"))
+			}
+		})
+	}
+}
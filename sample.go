@@ -0,0 +1,92 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+)
+
+// urlSampler draws a uniform random sample of fixed size from the URLs of a walk
+// without holding all of them.
+//
+// Each URL gets a pseudo-random key hashed from the seed and the URL, and the
+// sample is made of the URLs with the smallest keys. Unlike classic reservoir
+// sampling, this doesn't depend on the order in which the URLs are offered, so
+// a given seed gives the same sample however the concurrent fetches interleave.
+type urlSampler struct {
+	size       int
+	seed       []byte
+	population int
+	kept       sampleHeap
+}
+
+// sampledURL is a URL of the sample with its key.
+type sampledURL struct {
+	key uint64
+	loc string
+}
+
+// sampleHeap is a max-heap of sampled URLs by key, so the URL to evict when a
+// smaller key comes along is always at the top.
+type sampleHeap []sampledURL
+
+func (h sampleHeap) Len() int            { return len(h) }
+func (h sampleHeap) Less(i, j int) bool  { return h[i].key > h[j].key }
+func (h sampleHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *sampleHeap) Push(x interface{}) { *h = append(*h, x.(sampledURL)) }
+func (h *sampleHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// newURLSampler returns a sampler keeping size URLs, drawn with the given seed.
+func newURLSampler(size int, seed int64) *urlSampler {
+	s := &urlSampler{size: size, seed: make([]byte, 8)}
+	binary.BigEndian.PutUint64(s.seed, uint64(seed))
+	return s
+}
+
+// offer adds the URLs to the population the sample is drawn from.
+func (s *urlSampler) offer(urls []SitemapURL) {
+	for _, u := range urls {
+		s.population++
+
+		hash := fnv.New64a()
+		hash.Write(s.seed)
+		hash.Write([]byte(u.Loc))
+		candidate := sampledURL{key: mix64(hash.Sum64()), loc: u.Loc}
+
+		if len(s.kept) < s.size {
+			heap.Push(&s.kept, candidate)
+		} else if candidate.key < s.kept[0].key {
+			s.kept[0] = candidate
+			heap.Fix(&s.kept, 0)
+		}
+	}
+}
+
+// mix64 spreads the bits of an FNV hash over the whole key, as URLs sharing a
+// long prefix would otherwise get keys close to each other. It is the finalizer
+// of MurmurHash3.
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// urls returns the sample, in the order of the keys.
+func (s *urlSampler) urls() []string {
+	kept := append(sampleHeap{}, s.kept...)
+	sort.Slice(kept, func(i, j int) bool { return kept[i].key < kept[j].key })
+	urls := make([]string, len(kept))
+	for i, u := range kept {
+		urls[i] = u.loc
+	}
+	return urls
+}
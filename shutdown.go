@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shutdownRetryAfter is the Retry-After, in seconds, of the requests turned
+// away while the service drains, long enough for a replacement to come up.
+const shutdownRetryAfter = 5
+
+// draining is set once the service stops taking requests.
+var draining int32
+
+// rejectWhileDraining is the middleware turning away the requests that arrive
+// while the service drains, on connections kept alive from before, with a 503
+// and the connection closed, so clients go elsewhere. The liveness probe keeps
+// succeeding, so the service isn't killed before it drained.
+func rejectWhileDraining(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&draining) != 0 && r.URL.Path != healthzPath {
+			w.Header().Set("Connection", "close")
+			writeAPIError(w, http.StatusServiceUnavailable, errCodeServerBusy, "The server is shutting down", map[string]interface{}{"retryAfterSeconds": shutdownRetryAfter})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// shutdown stops the service: /readyz fails for the shutdownDelay of c, then,
+// within its shutdownGrace, servers stop taking requests and let the in-flight ones finish, then the worker pool drains,
+// the janitor stops and the parses and spans still pending are written out.
+// Whatever is left when the grace period ends is cut off. pprofServer may be
+// nil.
+func shutdown(c *Config, pprofServer *http.Server, servers ...*http.Server) {
+	logger.Info("shutting down", "grace", c.shutdownGrace, "delay", c.shutdownDelay)
+	atomic.StoreInt32(&serviceState, stateStopping)
+	time.Sleep(c.shutdownDelay)
+	atomic.StoreInt32(&draining, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), c.shutdownGrace)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				logger.Warn("in-flight requests cut off", "err", err)
+				server.Close()
+			}
+		}(server)
+	}
+	wg.Wait()
+	if err := parseWorkers.close(ctx); err != nil {
+		logger.Warn("queued parses abandoned", "err", err)
+	}
+	if cleanup != nil {
+		cleanup.close()
+	}
+	if parses != nil {
+		if err := parses.close(ctx); err != nil {
+			logger.Warn("pending parses not persisted", "store", parses.path, "err", err)
+		}
+	}
+	if err := spans.shutdown(ctx); err != nil {
+		logger.Warn("pending spans not exported", "err", err)
+	}
+	if pprofServer != nil {
+		pprofServer.Close()
+	}
+	logger.Info("shutdown complete")
+}
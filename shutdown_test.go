@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// drainingService marks the service ready, and restores it and its janitor
+// once the test is done.
+func drainingService(t *testing.T) {
+	t.Helper()
+	previous := cleanup
+	cleanup = nil
+	atomic.StoreInt32(&serviceState, stateReady)
+	t.Cleanup(func() {
+		cleanup = previous
+		atomic.StoreInt32(&draining, 0)
+		atomic.StoreInt32(&serviceState, stateStarting)
+	})
+}
+
+// slowServer serves /slow, answering once release is closed, through the
+// middleware turning requests away while draining. started is closed once a
+// request reached the handler.
+func slowServer(t *testing.T, release chan struct{}) (*http.Server, string, chan struct{}) {
+	t.Helper()
+	started := make(chan struct{})
+	routes := newRouter()
+	routes.handle("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-release:
+			io.WriteString(w, "done")
+		case <-r.Context().Done():
+		}
+	}, http.MethodGet)
+	routes.handle(readyzPath, handleReadyz, http.MethodGet)
+	routes.use(rejectWhileDraining)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: routes.handler()}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return server, "http://" + listener.Addr().String(), started
+}
+
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	useLocalConfig(t, map[string]string{"SHUTDOWN_DELAY_SECONDS": "1", "SHUTDOWN_GRACE_SECONDS": "5"})
+	captureLogs(t)
+	drainingService(t)
+	release := make(chan struct{})
+	server, base, started := slowServer(t, release)
+
+	type reply struct {
+		body string
+		err  error
+	}
+	replies := make(chan reply, 1)
+	go func() {
+		resp, err := http.Get(base + "/slow")
+		if err != nil {
+			replies <- reply{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		replies <- reply{string(body), err}
+	}()
+	<-started
+
+	stopped := make(chan struct{})
+	go func() {
+		shutdown(currentConfig(), nil, server)
+		close(stopped)
+	}()
+
+	// Through the delay, /readyz fails while requests are still taken
+	time.Sleep(100 * time.Millisecond)
+	if resp, err := http.Get(base + readyzPath); err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("/readyz = %v, %v during the delay, want 503", resp, err)
+	} else {
+		resp.Body.Close()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&draining) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the service never started draining")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// The in-flight request keeps the shutdown waiting
+	select {
+	case <-stopped:
+		t.Fatal("shutdown returned with a request in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := http.Get(base + "/slow"); err == nil {
+		t.Error("a new connection was served while draining")
+	}
+
+	close(release)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown didn't return once the request finished")
+	}
+	if r := <-replies; r.err != nil || r.body != "done" {
+		t.Errorf("in-flight request = %q, %v, want it served in full", r.body, r.err)
+	}
+	if !parseWorkers.isClosed() {
+		t.Error("the worker pool wasn't drained")
+	}
+}
+
+func TestShutdownCutsOffPastTheGrace(t *testing.T) {
+	useLocalConfig(t, map[string]string{"SHUTDOWN_GRACE_SECONDS": "1"})
+	logs := captureLogs(t)
+	drainingService(t)
+	server, base, started := slowServer(t, make(chan struct{}))
+
+	failed := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(base + "/slow")
+		if err == nil {
+			_, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		failed <- err
+	}()
+	<-started
+
+	begin := time.Now()
+	shutdown(currentConfig(), nil, server)
+	if elapsed := time.Since(begin); elapsed < time.Second || elapsed > 3*time.Second {
+		t.Errorf("shutdown took %s, want the grace of 1s", elapsed)
+	}
+	if err := <-failed; err == nil {
+		t.Error("the request outlasting the grace was served, want it cut off")
+	}
+	if !strings.Contains(logs.String(), "in-flight requests cut off") {
+		t.Errorf("the cut-off wasn't logged:\n%s", logs)
+	}
+}
+
+func TestRejectWhileDraining(t *testing.T) {
+	useLocalConfig(t, nil)
+	drainingService(t)
+	handler := rejectWhileDraining(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	atomic.StoreInt32(&draining, 1)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/sitemap", nil))
+	assertErrorCode(t, w, http.StatusServiceUnavailable, errCodeServerBusy)
+	if w.Header().Get("Retry-After") != "5" || w.Header().Get("Connection") != "close" {
+		t.Errorf("headers = %v, want a Retry-After of 5 and the connection closed", w.Header())
+	}
+
+	// The liveness probe keeps succeeding while draining
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, healthzPath, nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("%s = %d while draining, want 200", healthzPath, w.Code)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsOtherBucket is the bucket holding the collapsed small buckets.
+const statsOtherBucket = "other"
+
+// statsPayload represents the JSON payload accepted by the stats endpoint. It
+// accepts the walk and filter options of the domain and sitemap endpoints.
+type statsPayload struct {
+	requestPayload
+	OtherThreshold *int `json:"otherThreshold"`
+}
+
+// statsResponse is the response of the stats endpoint.
+type statsResponse struct {
+	Type          string         `json:"type"`
+	SitemapURL    string         `json:"sitemapUrl,omitempty"`
+	Stats         statsSummary   `json:"stats"`
+	ChildSitemaps int            `json:"childSitemaps"`
+	Errors        []sitemapError `json:"errors"`
+	Partial       bool           `json:"partial"`
+	Truncated     bool           `json:"truncated"`
+	Unexplored    []string       `json:"unexplored"`
+	Warnings      []string       `json:"warnings"`
+	Meta          responseMeta   `json:"meta"`
+}
+
+// statsSummary holds the aggregates of the URLs of a walk, bucketed per host,
+// per first path segment, per path depth and per extension.
+type statsSummary struct {
+	URLs           int            `json:"urls"`
+	ByHost         map[string]int `json:"byHost"`
+	ByFirstSegment map[string]int `json:"byFirstSegment"`
+	ByDepth        map[string]int `json:"byDepth"`
+	ByExtension    map[string]int `json:"byExtension"`
+	Lastmod        lastmodRange   `json:"lastmod"`
+}
+
+// lastmodRange is the range of the lastmod values of the URLs that have one.
+// Min and Max are null when none has.
+type lastmodRange struct {
+	Count int     `json:"count"`
+	Min   *string `json:"min"`
+	Max   *string `json:"max"`
+}
+
+// urlStats aggregates the URLs of a walk without holding them. It is safe for
+// concurrent use.
+type urlStats struct {
+	mu          sync.Mutex
+	total       int
+	byHost      map[string]int
+	bySegment   map[string]int
+	byDepth     map[string]int
+	byExtension map[string]int
+	lastmodMin  time.Time
+	lastmodMax  time.Time
+	withLastmod int
+}
+
+// newURLStats returns empty aggregates.
+func newURLStats() *urlStats {
+	return &urlStats{
+		byHost:      make(map[string]int),
+		bySegment:   make(map[string]int),
+		byDepth:     make(map[string]int),
+		byExtension: make(map[string]int),
+	}
+}
+
+// add adds the URLs of a parsed sitemap to the aggregates.
+func (s *urlStats) add(sitemap string, urls []SitemapURL) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range urls {
+		s.total++
+		s.byHost[urlHostname(u.Loc)]++
+
+		p := urlPath(u.Loc)
+		segments := strings.Split(strings.Trim(p, "/"), "/")
+		if segments[0] == "" {
+			segments = nil
+		}
+		first := "/"
+		if len(segments) > 0 {
+			first = "/" + segments[0]
+		}
+		s.bySegment[first]++
+		s.byDepth[strconv.Itoa(len(segments))]++
+
+		ext := strings.ToLower(strings.TrimPrefix(path.Ext(p), "."))
+		if ext == "" {
+			ext = "(none)"
+		}
+		s.byExtension[ext]++
+
+		if lastmod, ok := parseLastmod(u.Lastmod); ok {
+			if s.withLastmod == 0 || lastmod.Before(s.lastmodMin) {
+				s.lastmodMin = lastmod
+			}
+			if s.withLastmod == 0 || lastmod.After(s.lastmodMax) {
+				s.lastmodMax = lastmod
+			}
+			s.withLastmod++
+		}
+	}
+}
+
+// collapseBuckets returns the buckets with the ones holding fewer than threshold
+// URLs merged into "other".
+func collapseBuckets(buckets map[string]int, threshold int) map[string]int {
+	collapsed := make(map[string]int, len(buckets))
+	for key, n := range buckets {
+		if n < threshold {
+			collapsed[statsOtherBucket] += n
+			continue
+		}
+		collapsed[key] += n
+	}
+	return collapsed
+}
+
+// summary returns the aggregates as they appear in the response.
+func (s *urlStats) summary(threshold int) statsSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lastmod := lastmodRange{Count: s.withLastmod}
+	if s.withLastmod > 0 {
+		oldest := s.lastmodMin.Format(time.RFC3339)
+		newest := s.lastmodMax.Format(time.RFC3339)
+		lastmod.Min, lastmod.Max = &oldest, &newest
+	}
+
+	return statsSummary{
+		URLs:           s.total,
+		ByHost:         collapseBuckets(s.byHost, threshold),
+		ByFirstSegment: collapseBuckets(s.bySegment, threshold),
+		ByDepth:        collapseBuckets(s.byDepth, threshold),
+		ByExtension:    collapseBuckets(s.byExtension, threshold),
+		Lastmod:        lastmod,
+	}
+}
+
+// handleStatsEndpoint summarizes the URLs of a sitemap or domain.
+//
+// It expects a POST request with a JSON payload containing the 'sitemap' or the
+// 'domain' field. The walk is the same as for those endpoints, but only counts
+// are kept: per host, per first path segment, per path depth and per extension,
+// along with the lastmod range and the number of child sitemaps.
+func handleStatsEndpoint(w http.ResponseWriter, r *http.Request) {
+	// Decompress a gzip request body and check it is JSON before decoding it
+	if err := prepareJSONBody(w, r); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	// Decode the JSON payload
+	var payload statsPayload
+	if err := decodeJSONBody(r, &payload); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	requestID(w, r)
+
+	threshold := configFrom(r.Context()).statsOtherThreshold
+	if payload.OtherThreshold != nil {
+		if *payload.OtherThreshold < 0 {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid 'otherThreshold': must not be negative", nil)
+			return
+		}
+		threshold = *payload.OtherThreshold
+	}
+
+	requestType := "sitemap"
+	if payload.Domain != "" {
+		requestType = "domain"
+	}
+
+	// Only the aggregates are kept, whatever the payload asks for
+	stats := newURLStats()
+	walk := payload.walkOnly()
+	walk.onURLs = stats.add
+
+	response, err := processRequest(r.Context(), requestType, walk)
+	if err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	result := statsResponse{
+		Type:          "stats",
+		SitemapURL:    response.SitemapURL,
+		Stats:         stats.summary(threshold),
+		ChildSitemaps: len(response.Sitemaps),
+		Errors:        response.Errors,
+		Partial:       response.Partial,
+		Truncated:     response.Truncated,
+		Unexplored:    response.Unexplored,
+		Warnings:      response.Warnings,
+		Meta:          response.Meta,
+	}
+
+	writeCacheableJSON(w, r, result)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// parses persists the completed parses, nil when the store backend is "none".
+var parses *parseStore
+
+// parsesBucket is the bbolt bucket of the parses, keyed by parseKey.
+var parsesBucket = []byte("parses")
+
+// parseRecord is a completed parse as persisted, the JSON value of its key in
+// the store. The URL list is kept as a gzip-compressed JSON array.
+type parseRecord struct {
+	SitemapURL string         `json:"sitemapUrl"`
+	FetchedAt  time.Time      `json:"fetchedAt"`
+	URLCount   int            `json:"urlCount"`
+	URLs       []byte         `json:"urls"`
+	Errors     []sitemapError `json:"errors"`
+	Partial    bool           `json:"partial"`
+}
+
+// parseKey returns the key of the parse of the normalized sitemapURL fetched
+// at fetchedAt: the URL, a zero byte, then the time in big-endian Unix
+// nanoseconds, so the parses of a sitemap are next to each other, oldest first.
+func parseKey(sitemapURL string, fetchedAt time.Time) []byte {
+	key := make([]byte, len(sitemapURL)+1+8)
+	copy(key, sitemapURL)
+	binary.BigEndian.PutUint64(key[len(sitemapURL)+1:], uint64(fetchedAt.UnixNano()))
+	return key
+}
+
+// parseKeyTime returns when the parse of key was fetched.
+func parseKeyTime(key []byte) time.Time {
+	if len(key) < 9 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key[len(key)-8:])))
+}
+
+// parseStore persists completed parses to a single bbolt database file.
+// Records are queued and written by a goroutine of their own. It is safe for
+// concurrent use.
+type parseStore struct {
+	path      string
+	retention time.Duration
+	queue     chan *parseRecord
+	done      chan struct{}
+	db        *bolt.DB
+
+	// queueMu guards closed, so no record is queued once the queue is closed.
+	queueMu sync.RWMutex
+	closed  bool
+}
+
+// openParseStore opens the store selected by the storeBackend of c, nil for
+// "none".
+func openParseStore(c *Config) (*parseStore, error) {
+	switch backend := c.storeBackend; backend {
+	case "none":
+		return nil, nil
+	case "bolt":
+	default:
+		return nil, fmt.Errorf("unknown store backend %q", backend)
+	}
+
+	// Another process holding the database fails the open rather than
+	// blocking the startup
+	db, err := bolt.Open(c.storePath, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening the store %s: %w", c.storePath, err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(parsesBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	s := &parseStore{path: c.storePath, retention: c.storeRetention, queue: make(chan *parseRecord, c.storeQueueSize), done: make(chan struct{}), db: db}
+	if _, err := s.prune(time.Now()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	go s.run()
+	return s, nil
+}
+
+// run writes the queued records.
+func (s *parseStore) run() {
+	defer close(s.done)
+	for record := range s.queue {
+		if err := s.put(record); err != nil {
+			logger.Warn("writing a parse to the store failed", "store", s.path, "sitemap", record.SitemapURL, "err", err)
+		}
+	}
+}
+
+// record queues a completed parse of sitemapURL for writing, dropping it when
+// the queue is full.
+func (s *parseStore) record(sitemapURL string, result *sitemapResult, fetchedAt time.Time) {
+	urls, err := compressURLs(result.URLs)
+	if err != nil {
+		logger.Warn("compressing a parse for the store failed", "store", s.path, "sitemap", sitemapURL, "err", err)
+		return
+	}
+	record := &parseRecord{
+		SitemapURL: normalizeURL(sitemapURL),
+		FetchedAt:  fetchedAt.UTC(),
+		URLCount:   len(result.URLs),
+		URLs:       urls,
+		Errors:     result.Errors,
+		Partial:    result.Partial,
+	}
+	s.queueMu.RLock()
+	defer s.queueMu.RUnlock()
+	if s.closed {
+		logger.Warn("store closed, parse not persisted", "store", s.path, "sitemap", sitemapURL)
+		return
+	}
+	select {
+	case s.queue <- record:
+	default:
+		logger.Warn("store queue full, parse not persisted", "store", s.path, "sitemap", sitemapURL)
+	}
+}
+
+// close stops taking records, writes the ones queued and closes the database.
+// Records still queued when ctx is done are lost, and close returns the error
+// of ctx.
+func (s *parseStore) close(ctx context.Context) error {
+	s.queueMu.Lock()
+	if s.closed {
+		s.queueMu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.queue)
+	s.queueMu.Unlock()
+
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return s.db.Close()
+}
+
+// put writes a record in its own transaction.
+func (s *parseStore) put(record *parseRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(parsesBucket).Put(parseKey(record.SitemapURL, record.FetchedAt), value)
+	})
+}
+
+// previous returns the last complete parse of a sitemap, or nil when there is
+// none or it can't be read.
+func (s *parseStore) previous(sitemapURL string) *historyEntry {
+	normalized := normalizeURL(sitemapURL)
+	prefix := append([]byte(normalized), 0)
+	var record *parseRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		// The parses of the sitemap end right before the first key past the
+		// prefix, which is walked back to the last complete one
+		c := tx.Bucket(parsesBucket).Cursor()
+		key, value := c.Seek(append([]byte(normalized), 1))
+		if key == nil {
+			key, value = c.Last()
+		} else {
+			key, value = c.Prev()
+		}
+		for ; key != nil && bytes.HasPrefix(key, prefix) && len(key) == len(prefix)+8; key, value = c.Prev() {
+			var candidate parseRecord
+			if err := json.Unmarshal(value, &candidate); err != nil {
+				return err
+			}
+			if !candidate.Partial {
+				record = &candidate
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Warn("reading a parse from the store failed", "store", s.path, "sitemap", sitemapURL, "err", err)
+		return nil
+	}
+	if record == nil {
+		return nil
+	}
+	urls, err := decompressURLs(record.URLs)
+	if err != nil {
+		logger.Warn("decompressing a parse from the store failed", "store", s.path, "sitemap", sitemapURL, "err", err)
+		return nil
+	}
+	return &historyEntry{urls: urls, fetchedAt: record.FetchedAt}
+}
+
+// sweep prunes the store as of now, returning the number of parses removed.
+func (s *parseStore) sweep(now time.Time) int {
+	removed, err := s.prune(now)
+	if err != nil {
+		logger.Warn("pruning the store failed", "store", s.path, "err", err)
+	}
+	return removed
+}
+
+// prune deletes the parses older than the retention at now, returning how
+// many were.
+func (s *parseStore) prune(now time.Time) (int, error) {
+	var removed int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		// Deleting under a cursor skips the key after each one deleted, so
+		// the expired keys are collected first
+		bucket := tx.Bucket(parsesBucket)
+		var expired [][]byte
+		c := bucket.Cursor()
+		for key, _ := c.First(); key != nil; key, _ = c.Next() {
+			if now.Sub(parseKeyTime(key)) > s.retention {
+				expired = append(expired, append([]byte(nil), key...))
+			}
+		}
+		for _, key := range expired {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		removed = len(expired)
+		return nil
+	})
+	return removed, err
+}
+
+// compressURLs encodes a URL list as a gzip-compressed JSON array.
+func compressURLs(urls []string) ([]byte, error) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if err := json.NewEncoder(writer).Encode(urls); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+// decompressURLs decodes a URL list encoded by compressURLs.
+func decompressURLs(compressed []byte) ([]string, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	var urls []string
+	err = json.NewDecoder(reader).Decode(&urls)
+	return urls, err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// openTestStore opens a bolt store at path keeping parses for retention.
+func openTestStore(t *testing.T, path string, retention time.Duration) *parseStore {
+	t.Helper()
+	c, err := loadConfig("", envOf(map[string]string{"STORE_BACKEND": "bolt", "STORE_PATH": path}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.storeRetention = retention
+	s, err := openParseStore(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// closeTestStore closes s once the parses queued are written.
+func closeTestStore(t *testing.T, s *parseStore) {
+	t.Helper()
+	if err := s.close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStorePersistsAcrossReopen(t *testing.T) {
+	captureLogs(t)
+	path := filepath.Join(t.TempDir(), "parses.db")
+	fetched := time.Now().Add(-time.Hour).UTC()
+
+	s := openTestStore(t, path, 24*time.Hour)
+	s.record("https://example.com/sitemap.xml", &sitemapResult{URLs: []string{"https://example.com/old"}}, fetched.Add(-time.Minute))
+	s.record("https://example.com/sitemap.xml", &sitemapResult{URLs: []string{"https://example.com/a", "https://example.com/b"}}, fetched)
+	s.record("https://example.com/sitemap.xml", &sitemapResult{URLs: []string{"https://example.com/a"}, Partial: true}, fetched.Add(time.Minute))
+	s.record("https://example.com/sitemap.xml.gz", &sitemapResult{URLs: []string{"https://example.com/gz"}}, fetched.Add(2*time.Minute))
+	closeTestStore(t, s)
+
+	s = openTestStore(t, path, 24*time.Hour)
+	defer closeTestStore(t, s)
+	previous := s.previous("https://example.com/sitemap.xml")
+	if previous == nil {
+		t.Fatal("no previous parse after reopening the store")
+	}
+	if want := []string{"https://example.com/a", "https://example.com/b"}; !reflect.DeepEqual(previous.urls, want) {
+		t.Errorf("previous = %v, want the last complete parse %v", previous.urls, want)
+	}
+	if !previous.fetchedAt.Equal(fetched) {
+		t.Errorf("fetchedAt = %s, want %s", previous.fetchedAt, fetched)
+	}
+	if other := s.previous("https://example.com/sitemap.xml.gz"); other == nil || len(other.urls) != 1 || other.urls[0] != "https://example.com/gz" {
+		t.Errorf("previous of another sitemap = %+v", other)
+	}
+	if none := s.previous("https://example.com/missing.xml"); none != nil {
+		t.Errorf("previous of an unknown sitemap = %+v, want none", none)
+	}
+}
+
+func TestStorePrunesPastRetention(t *testing.T) {
+	captureLogs(t)
+	path := filepath.Join(t.TempDir(), "parses.db")
+	now := time.Now()
+
+	s := openTestStore(t, path, 24*time.Hour)
+	s.record("https://example.com/old.xml", &sitemapResult{URLs: []string{"https://example.com/old"}}, now.Add(-48*time.Hour))
+	s.record("https://example.com/sitemap.xml", &sitemapResult{URLs: []string{"https://example.com/old"}}, now.Add(-30*time.Hour))
+	s.record("https://example.com/sitemap.xml", &sitemapResult{URLs: []string{"https://example.com/new"}}, now.Add(-12*time.Hour))
+	closeTestStore(t, s)
+
+	s = openTestStore(t, path, 24*time.Hour)
+	if removed := s.sweep(now); removed != 0 {
+		t.Errorf("sweep removed %d parses, want none left past the retention by the open", removed)
+	}
+	if old := s.previous("https://example.com/old.xml"); old != nil {
+		t.Errorf("previous = %+v past the retention, want it pruned on open", old)
+	}
+	if kept := s.previous("https://example.com/sitemap.xml"); kept == nil || kept.urls[0] != "https://example.com/new" {
+		t.Errorf("previous = %+v, want the parse within the retention", kept)
+	}
+	if removed := s.sweep(now.Add(13 * time.Hour)); removed != 1 {
+		t.Errorf("sweep removed %d parses, want 1", removed)
+	}
+	if kept := s.previous("https://example.com/sitemap.xml"); kept != nil {
+		t.Errorf("previous = %+v, want it swept", kept)
+	}
+	closeTestStore(t, s)
+}
+
+func TestStoreHeldByAnotherProcess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "parses.db")
+	s := openTestStore(t, path, time.Hour)
+	defer closeTestStore(t, s)
+
+	c, err := loadConfig("", envOf(map[string]string{"STORE_BACKEND": "bolt", "STORE_PATH": path}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other, err := openParseStore(c); err == nil {
+		other.close(context.Background())
+		t.Error("opened a store another one holds")
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// streamBatchSize is the maximum number of URLs carried by a single "urls" event.
+	streamBatchSize = 100
+
+	// streamProgressInterval is the interval between two "progress" events.
+	streamProgressInterval = 2 * time.Second
+)
+
+// eventStream writes Server-Sent Events to a response, flushing after each event
+// so buffering proxies pass them on right away. It is safe for concurrent use.
+type eventStream struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+// send writes an event with the JSON encoding of data.
+func (s *eventStream) send(event string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, payload)
+	s.flusher.Flush()
+}
+
+// handleSitemapStreamEndpoint streams the URLs of a sitemap as Server-Sent Events.
+//
+// It expects a GET request with the sitemap URL in the "url" query parameter.
+// URLs are emitted in "urls" events as each sitemap is parsed, "progress" events
+// report the counts periodically, and a final "done" event carries the errors and
+// warnings of the walk. A client disconnecting cancels the walk.
+func handleSitemapStreamEndpoint(w http.ResponseWriter, r *http.Request) {
+	sitemapURL := r.URL.Query().Get(queryParamSitemap)
+	if sitemapURL == "" {
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, "Missing 'url' query parameter", nil)
+		return
+	}
+	if reqErr := validateTargetURL(sitemapURL); reqErr != nil {
+		writeRequestError(w, reqErr)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, http.StatusInternalServerError, errCodeInternal, "Streaming not supported", nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	stream := &eventStream{w: w, flusher: flusher}
+	started := time.Now()
+
+	// Count what has been streamed so far for the progress events
+	var (
+		countMu  sync.Mutex
+		urls     int
+		sitemaps int
+	)
+	progress := func() map[string]int {
+		countMu.Lock()
+		defer countMu.Unlock()
+		return map[string]int{"urls": urls, "sitemaps": sitemaps}
+	}
+
+	settings := configFrom(r.Context())
+	opts := defaultWalkOptions(settings)
+	opts.OnURLs = func(sitemap string, entries []SitemapURL) {
+		countMu.Lock()
+		urls += len(entries)
+		sitemaps++
+		countMu.Unlock()
+
+		locs := make([]string, len(entries))
+		for i, entry := range entries {
+			locs[i] = entry.Loc
+		}
+
+		for start := 0; start < len(locs); start += streamBatchSize {
+			end := start + streamBatchSize
+			if end > len(locs) {
+				end = len(locs)
+			}
+			stream.send("urls", map[string]interface{}{"sitemap": sitemap, "urls": locs[start:end]})
+		}
+	}
+
+	// The walk is bound to the client connection and the request's time budget
+	ctx, cancel := context.WithTimeout(r.Context(), settings.requestTimeout)
+	defer cancel()
+	noteAccessTarget(ctx, sitemapURL)
+
+	// Report progress periodically until the walk completes
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(streamProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				stream.send("progress", progress())
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// Streams wait in the worker queue for as long as the request allows
+	var result *sitemapResult
+	var err error
+	if poolErr := parseWorkers.submit(ctx, -1, func() {
+		result, err = parseSitemap(ctx, sitemapURL, nil, opts)
+	}); poolErr != nil {
+		err = poolErr
+	}
+	close(done)
+	if err == nil {
+		noteAccessURLs(ctx, len(result.URLs))
+	}
+
+	// Nobody is listening anymore once the client went away
+	if r.Context().Err() != nil {
+		return
+	}
+
+	summary := map[string]interface{}{"counts": progress()}
+	if err != nil {
+		summary["error"] = err.Error()
+	} else {
+		summary["errors"] = result.Errors
+		summary["warnings"] = result.Warnings
+		summary["partial"] = result.Partial
+		summary["truncated"] = result.Truncated
+		summary["unexplored"] = result.Unexplored
+		summary["meta"] = newResponseMeta(result, started, settings.fetchTimeout, settings.requestTimeout)
+	}
+	stream.send("done", summary)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultSubmitEngines is the default value of SUBMIT_ENGINES.
+const defaultSubmitEngines = "google=https://www.google.com/ping?sitemap={sitemap},bing=https://www.bing.com/ping?sitemap={sitemap}"
+
+// maxSubmitSnippet is the number of bytes of each engine response returned.
+const maxSubmitSnippet = 200
+
+// submitEngine is a search engine ping endpoint.
+type submitEngine struct {
+	Name string
+	URL  string
+}
+
+// submitPayload represents the JSON payload accepted by the submit endpoint.
+type submitPayload struct {
+	Sitemap string `json:"sitemap"`
+}
+
+// submitResponse is the response of the submit endpoint.
+type submitResponse struct {
+	Type    string         `json:"type"`
+	Sitemap string         `json:"sitemap"`
+	Engines []submitResult `json:"engines"`
+}
+
+// submitResult is the outcome of pinging one engine.
+type submitResult struct {
+	Engine  string `json:"engine"`
+	Status  int    `json:"status,omitempty"`
+	Snippet string `json:"snippet,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// parseSubmitEngines parses a comma separated list of name=URL pairs. Malformed
+// pairs are ignored.
+func parseSubmitEngines(value string) []submitEngine {
+	var engines []submitEngine
+	for _, pair := range strings.Split(value, ",") {
+		name, endpoint, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || name == "" || endpoint == "" {
+			continue
+		}
+		engines = append(engines, submitEngine{Name: name, URL: endpoint})
+	}
+	return engines
+}
+
+// submitLimiter remembers when each sitemap was last submitted. It is safe for
+// concurrent use.
+type submitLimiter struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+var submissions = &submitLimiter{last: make(map[string]time.Time)}
+
+// allow records a submission of the sitemap and returns 0, or returns how long
+// to wait when it was submitted less than interval ago.
+func (l *submitLimiter) allow(sitemapURL string, interval time.Duration, now time.Time) time.Duration {
+	key := normalizeURL(sitemapURL)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if last, ok := l.last[key]; ok && now.Sub(last) < interval {
+		return interval - now.Sub(last)
+	}
+	for k, last := range l.last {
+		if now.Sub(last) >= interval {
+			delete(l.last, k)
+		}
+	}
+	l.last[key] = now
+	return 0
+}
+
+// pingEngine calls the ping endpoint of an engine for the sitemap.
+func pingEngine(ctx context.Context, engine submitEngine, sitemapURL string) submitResult {
+	result := submitResult{Engine: engine.Name}
+	endpoint := strings.ReplaceAll(engine.URL, "{sitemap}", url.QueryEscape(sitemapURL))
+
+	resp, err := fetchURL(ctx, endpoint, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+
+	snippet, _ := io.ReadAll(io.LimitReader(resp.Body, maxSubmitSnippet))
+	result.Status = resp.StatusCode
+	result.Snippet = string(snippet)
+	return result
+}
+
+// handleSubmitEndpoint notifies search engines about a sitemap.
+//
+// It expects a POST request with a JSON payload containing the 'sitemap' field.
+// The sitemap is parsed first, and only submitted when that succeeds. Every
+// configured engine is then pinged in parallel, one failing engine not stopping
+// the others, and the response holds each engine's status and the start of its
+// response. The same sitemap can only be submitted once per
+// SUBMIT_INTERVAL_SECONDS, which is checked before the sitemap is fetched, and
+// a sitemap that can't be fetched is reported like on the other endpoints.
+func handleSubmitEndpoint(w http.ResponseWriter, r *http.Request) {
+	// Decompress a gzip request body and check it is JSON before decoding it
+	if err := prepareJSONBody(w, r); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	// Decode the JSON payload
+	var payload submitPayload
+	if err := decodeJSONBody(r, &payload); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+	if payload.Sitemap == "" {
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, "Missing 'sitemap' field in JSON payload", nil)
+		return
+	}
+	if reqErr := validateTargetURL(payload.Sitemap); reqErr != nil {
+		writeRequestError(w, reqErr)
+		return
+	}
+
+	requestID(w, r)
+
+	config := configFrom(r.Context())
+	ctx, cancel := context.WithTimeout(r.Context(), config.requestTimeout)
+	defer cancel()
+
+	// A sitemap submitted recently isn't even fetched again
+	if wait := submissions.allow(payload.Sitemap, config.submitInterval, time.Now()); wait > 0 {
+		seconds := int(wait.Seconds()) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		writeAPIError(w, http.StatusTooManyRequests, errCodeRateLimited, "This sitemap was submitted recently; try again later", map[string]interface{}{"retryAfterSeconds": seconds})
+		return
+	}
+
+	// Only submit what actually parses as a sitemap; the top document is enough
+	opts := defaultWalkOptions(config)
+	opts.MaxDepth = 0
+	var result *sitemapResult
+	var err error
+	if poolErr := parseWorkers.submit(ctx, config.workerQueueWait, func() {
+		result, err = parseSitemap(ctx, payload.Sitemap, nil, opts)
+	}); poolErr != nil {
+		if reqErr := poolError(poolErr); reqErr != nil {
+			writeRequestError(w, reqErr)
+			return
+		}
+		err = poolErr
+	}
+	if err != nil {
+		writeRequestError(w, fetchError(err))
+		return
+	}
+	if len(result.URLs) == 0 && len(result.Unexplored) == 0 && len(result.Sitemaps) == 0 {
+		writeAPIError(w, http.StatusUnprocessableEntity, errCodeParseFailed, "Not a valid sitemap: it lists no URL and no child sitemap", nil)
+		return
+	}
+
+	// Ping the engines in parallel
+	results := make([]submitResult, len(config.submitEngines))
+	var wg sync.WaitGroup
+	for i, engine := range config.submitEngines {
+		wg.Add(1)
+		go func(i int, engine submitEngine) {
+			defer wg.Done()
+			results[i] = pingEngine(ctx, engine, payload.Sitemap)
+		}(i, engine)
+	}
+	wg.Wait()
+
+	writeJSON(w, submitResponse{Type: "submit", Sitemap: payload.Sitemap, Engines: results})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// submitRequest returns a /submit request for sitemapURL.
+func submitRequest(sitemapURL string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/v1/submit", strings.NewReader(`{"sitemap":"`+sitemapURL+`"}`))
+	r.Header.Set("Content-Type", mediaTypeJSON)
+	return r
+}
+
+func TestSubmitRateLimitedBeforeFetching(t *testing.T) {
+	var pings int32
+	engine := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&pings, 1)
+		fmt.Fprint(w, "Sitemap notification received")
+	}))
+	defer engine.Close()
+	useLocalConfig(t, map[string]string{"SUBMIT_ENGINES": "test=" + engine.URL + "/ping?sitemap={sitemap}", "ACCESS_LOG": "0"})
+	captureLogs(t)
+	var fetches int32
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		fmt.Fprint(w, urlSet("https://example.com/"))
+	}))
+	defer site.Close()
+
+	w := serve(submitRequest(site.URL + "/sitemap.xml"))
+	var response submitResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if len(response.Engines) != 1 || response.Engines[0].Status != http.StatusOK || atomic.LoadInt32(&pings) != 1 {
+		t.Errorf("engines = %+v, want the engine pinged", response.Engines)
+	}
+
+	// Submitted again within the interval, the sitemap isn't fetched
+	for i := 0; i < 3; i++ {
+		w = serve(submitRequest(site.URL + "/sitemap.xml"))
+		assertErrorCode(t, w, http.StatusTooManyRequests, errCodeRateLimited)
+		if w.Header().Get("Retry-After") == "" {
+			t.Error("no Retry-After on the rate limited submission")
+		}
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("the sitemap was fetched %d times, want once", n)
+	}
+	if n := atomic.LoadInt32(&pings); n != 1 {
+		t.Errorf("the engine was pinged %d times, want once", n)
+	}
+}
+
+func TestSubmitFetchFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		status  int
+		code    string
+	}{
+		{"not found", http.NotFound, http.StatusNotFound, errCodeSitemapNotFound},
+		{"server error", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}, http.StatusBadGateway, errCodeFetchFailed},
+		{"too slow", func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}, http.StatusGatewayTimeout, errCodeUpstreamTimeout},
+		{"malformed", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `<urlset><url>`)
+		}, http.StatusUnprocessableEntity, errCodeParseFailed},
+		{"empty", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, urlSet())
+		}, http.StatusUnprocessableEntity, errCodeParseFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLocalConfig(t, map[string]string{"FETCH_TIMEOUT_SECONDS": "1", "SUBMIT_ENGINES": "", "ACCESS_LOG": "0"})
+			captureLogs(t)
+			site := httptest.NewServer(tt.handler)
+			defer site.Close()
+
+			assertErrorCode(t, serve(submitRequest(site.URL+"/sitemap.xml")), tt.status, tt.code)
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"unicode"
+)
+
+// errCodeTargetForbidden is reported for the fetches of addresses of the
+// internal network, which the service doesn't fetch on behalf of clients.
+const errCodeTargetForbidden = "TARGET_FORBIDDEN"
+
+// forbiddenTargetError is returned for the dials of an internal address, so
+// nothing is sent to it.
+type forbiddenTargetError struct {
+	Addr string
+}
+
+func (e *forbiddenTargetError) Error() string {
+	return fmt.Sprintf("%s is an address of an internal network, which isn't fetched", e.Addr)
+}
+
+// isInternalIP reports whether ip is of a network clients mustn't reach
+// through the service: loopback, link-local, including the cloud metadata
+// address 169.254.169.254, private, unique local, or unspecified.
+func isInternalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsPrivate() || ip.IsUnspecified()
+}
+
+// guardDial returns the Control of the dialers of outbound fetches, refusing
+// to connect to internal addresses other than the ones of allowed. It checks
+// the address actually dialed, once resolved, so a host resolving to an
+// internal address, or changing its answer between lookups, is stopped too.
+func guardDial(allowed []*net.IPNet) func(network, address string, _ syscall.RawConn) error {
+	return func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || !isInternalIP(ip) {
+			return nil
+		}
+		for _, network := range allowed {
+			if network.Contains(ip) {
+				return nil
+			}
+		}
+		return &forbiddenTargetError{Addr: host}
+	}
+}
+
+// hasSpaceOrControl reports whether s holds whitespace or control characters,
+// which have no place in a URL or domain given by a client.
+func hasSpaceOrControl(s string) bool {
+	return strings.IndexFunc(s, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0
+}
+
+// isFetchableScheme reports whether scheme is one the service fetches: http
+// or https.
+func isFetchableScheme(scheme string) bool {
+	scheme = strings.ToLower(scheme)
+	return scheme == "http" || scheme == "https"
+}
+
+// validateTargetURL checks a sitemap URL given by a client: an absolute http
+// or https URL with a host, without userinfo, whitespace or control
+// characters, which could make the service fetch something else than it
+// seems to. It returns the 400 to reply with, or nil.
+func validateTargetURL(rawURL string) *requestError {
+	invalid := func(reason string) *requestError {
+		return &requestError{http.StatusBadRequest, errCodeInvalidURL, "Invalid URL: " + reason, nil}
+	}
+	if hasSpaceOrControl(rawURL) {
+		return invalid("it holds whitespace or control characters")
+	}
+	u, err := url.ParseRequestURI(rawURL)
+	switch {
+	case err != nil:
+		return invalid("it can't be parsed")
+	case !isFetchableScheme(u.Scheme):
+		return invalid("only http and https URLs are fetched")
+	case u.Host == "":
+		return invalid("it has no host")
+	case u.User != nil:
+		return invalid("userinfo isn't allowed")
+	}
+	return nil
+}
+
+// checkFetchURL checks that rawURL, about to be fetched, uses the http or
+// https scheme, wherever it came from: a client, a robots.txt, the loc of an
+// index or a redirect.
+func checkFetchURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if !isFetchableScheme(u.Scheme) {
+		return fmt.Errorf("won't fetch %s: only http and https URLs are fetched", rawURL)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tlsEnabled tells whether c serves the API over HTTPS.
+func (c *Config) tlsEnabled() bool {
+	return c.tlsCertFile != "" || c.tlsKeyFile != ""
+}
+
+// newTLSConfig returns the TLS configuration of the API: TLS 1.2 or later,
+// with forward secret AEAD cipher suites only, serving the certificate of
+// certs.
+func newTLSConfig(certs *certReloader) *tls.Config {
+	return &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+		// TLS 1.3 suites aren't configurable and are all sound
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+		GetCertificate: certs.certificate,
+	}
+}
+
+// certReloader holds the certificate the API is served with, loaded from its
+// files again when they change or on SIGHUP. It is safe for concurrent use.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+}
+
+// loadCertReloader loads the certificate of certFile and keyFile, failing
+// when either is missing, or they don't make a valid pair.
+func loadCertReloader(certFile, keyFile string) (*certReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload loads the certificate files, keeping the certificate served so far
+// when they don't make a valid pair.
+func (c *certReloader) reload() error {
+	modTimes := c.fileModTimes()
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading the TLS certificate %s and key %s: %w", c.certFile, c.keyFile, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("parsing the TLS certificate %s: %w", c.certFile, err)
+	}
+	cert.Leaf = leaf
+	if time.Now().After(leaf.NotAfter) {
+		logger.Warn("TLS certificate expired", "cert", c.certFile, "notAfter", leaf.NotAfter)
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.modTimes = modTimes
+	c.mu.Unlock()
+	logger.Info("TLS certificate loaded", "cert", c.certFile, "subject", leaf.Subject.String(), "notAfter", leaf.NotAfter)
+	return nil
+}
+
+// fileModTimes returns the modification times of the certificate and key
+// files, zero for the ones that can't be read.
+func (c *certReloader) fileModTimes() [2]time.Time {
+	var modTimes [2]time.Time
+	for i, path := range []string{c.certFile, c.keyFile} {
+		if info, err := os.Stat(path); err == nil {
+			modTimes[i] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// changed reports whether the certificate files changed since they were last
+// loaded.
+func (c *certReloader) changed() bool {
+	modTimes := c.fileModTimes()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return modTimes != c.modTimes
+}
+
+// watch reloads the certificate every interval when its files changed, in
+// the background. A failed reload is logged and the certificate served so far
+// kept. SIGHUP reloads it through handleReloads.
+func (c *certReloader) watch(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for range time.NewTicker(interval).C {
+			if !c.changed() {
+				continue
+			}
+			if err := c.reload(); err != nil {
+				logger.Warn("reloading the TLS certificate failed, keeping the current one", "err", err)
+			}
+		}
+	}()
+}
+
+// certificate returns the certificate to serve, for tls.Config.GetCertificate.
+func (c *certReloader) certificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// redirectToHTTPS is the handler of the plain HTTP listener when it redirects:
+// every request is sent to the same URL over HTTPS, on the port of httpsAddr,
+// the address of the HTTPS listener.
+func redirectToHTTPS(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.TrimSuffix(strings.TrimPrefix(r.Host, "["), "]")
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		w.Header().Set("Connection", "close")
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
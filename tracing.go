@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The kinds of spans the service starts.
+const (
+	spanKindInternal = trace.SpanKindInternal
+	spanKindServer   = trace.SpanKindServer
+	spanKindClient   = trace.SpanKindClient
+)
+
+// The OTLP protocols spans can be exported with.
+const (
+	otlpProtocolProtobuf = "http/protobuf"
+	otlpProtocolGRPC     = "grpc"
+)
+
+// tracerName is the name of the instrumentation scope of the spans.
+const tracerName = "sitemap-parser"
+
+// tracePropagator reads the trace of callers from their W3C Trace Context
+// headers, traceparent and tracestate.
+var tracePropagator = propagation.TraceContext{}
+
+// span is an operation of a trace. The methods of a nil span do nothing, so
+// code doesn't tell whether tracing is on. A span is safe for concurrent use.
+type span struct {
+	span trace.Span
+}
+
+// spanFrom returns the current span of ctx, or nil when it has none being
+// recorded.
+func spanFrom(ctx context.Context) *span {
+	s := trace.SpanFromContext(ctx)
+	if !s.IsRecording() {
+		return nil
+	}
+	return &span{span: s}
+}
+
+// startSpan starts a span named name as a child of the current span of ctx,
+// and returns it with the context it is the current span of. Without a
+// current span, as when tracing is off or the caller didn't sample the trace,
+// it returns ctx and a nil span.
+func startSpan(ctx context.Context, name string, kind trace.SpanKind) (context.Context, *span) {
+	if spanFrom(ctx) == nil {
+		return ctx, nil
+	}
+	ctx, s := spans.tracer.Start(ctx, name, trace.WithSpanKind(kind))
+	return ctx, &span{span: s}
+}
+
+// set adds attributes to the span, as key and value pairs.
+func (s *span) set(keyValues ...interface{}) {
+	if s == nil {
+		return
+	}
+	attributes := make([]attribute.KeyValue, 0, len(keyValues)/2)
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		key := keyValues[i].(string)
+		switch v := keyValues[i+1].(type) {
+		case bool:
+			attributes = append(attributes, attribute.Bool(key, v))
+		case int:
+			attributes = append(attributes, attribute.Int(key, v))
+		case int64:
+			attributes = append(attributes, attribute.Int64(key, v))
+		case string:
+			attributes = append(attributes, attribute.String(key, v))
+		default:
+			attributes = append(attributes, attribute.String(key, fmt.Sprint(v)))
+		}
+	}
+	s.span.SetAttributes(attributes...)
+}
+
+// fail marks the span as failed with err, when err isn't nil.
+func (s *span) fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+// finish ends the span, which queues it for export. Only the first call
+// counts.
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.span.End()
+}
+
+// traceIDString returns the hex ID of the trace of the span, or an empty
+// string for a nil span.
+func (s *span) traceIDString() string {
+	if s == nil {
+		return ""
+	}
+	return s.span.SpanContext().TraceID().String()
+}
+
+// traceRequests is the middleware starting a server span for every request,
+// continuing the trace of the traceparent header of the caller when it sends
+// one. A caller that didn't sample its trace gets no spans. It does nothing
+// while no exporter is configured.
+func traceRequests(next http.Handler) http.Handler {
+	if !spans.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, server := spans.tracer.Start(ctx, r.Method+" "+r.URL.Path, trace.WithSpanKind(spanKindServer))
+		s := &span{span: server}
+		if !server.IsRecording() {
+			server.End()
+			next.ServeHTTP(w, r)
+			return
+		}
+		s.set("http.request.method", r.Method, "url.path", r.URL.Path, "client.address", clientIP(r))
+		if agent := r.UserAgent(); agent != "" {
+			s.set("user_agent.original", agent)
+		}
+		aw := &accessWriter{ResponseWriter: w}
+		defer func() {
+			status := aw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			s.set("http.response.status_code", status, "http.response.body.size", aw.bytes)
+			if status >= 500 {
+				s.fail(fmt.Errorf("status %d", status))
+			}
+			s.finish()
+		}()
+		next.ServeHTTP(aw, r.WithContext(ctx))
+	})
+}
+
+// tracingConfig is the configuration of the export of spans, read from the
+// standard OTEL_* environment variables.
+type tracingConfig struct {
+	// endpoint is the URL the spans are exported to, empty when they aren't.
+	endpoint    string
+	headers     map[string]string
+	protocol    string
+	serviceName string
+	timeout     time.Duration
+}
+
+// readTracingConfig reads the configuration of the export of spans of s.
+func readTracingConfig(s *configSource) tracingConfig {
+	protocol := s.choice("OTEL_EXPORTER_OTLP_PROTOCOL", otlpProtocolProtobuf, otlpProtocolProtobuf, otlpProtocolGRPC)
+	protocol = s.choice("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL", protocol, otlpProtocolProtobuf, otlpProtocolGRPC)
+	return tracingConfig{
+		endpoint:    otlpEndpoint(s, protocol),
+		headers:     otlpHeaders(s),
+		protocol:    protocol,
+		serviceName: s.string("OTEL_SERVICE_NAME", "sitemap-parser"),
+		timeout:     s.milliseconds("OTEL_EXPORTER_OTLP_TIMEOUT", 10000),
+	}
+}
+
+// otlpEndpoint returns the URL the spans are exported to with protocol, from
+// the standard OTEL_EXPORTER_OTLP_TRACES_ENDPOINT setting of s, or else from
+// OTEL_EXPORTER_OTLP_ENDPOINT, the traces going under its /v1/traces over
+// HTTP. It is empty when no exporter is configured, or tracing is turned off
+// through OTEL_SDK_DISABLED or OTEL_TRACES_EXPORTER.
+func otlpEndpoint(s *configSource, protocol string) string {
+	if strings.EqualFold(s.string("OTEL_SDK_DISABLED", ""), "true") {
+		return ""
+	}
+	if exporter := s.string("OTEL_TRACES_EXPORTER", "otlp"); exporter != "otlp" {
+		return ""
+	}
+	if endpoint := s.string("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", ""); endpoint != "" {
+		return endpoint
+	}
+	endpoint := s.string("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	if endpoint == "" || protocol == otlpProtocolGRPC {
+		return endpoint
+	}
+	return strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+}
+
+// otlpHeaders returns the header fields sent along the exports, from the
+// standard OTEL_EXPORTER_OTLP_HEADERS and OTEL_EXPORTER_OTLP_TRACES_HEADERS
+// settings of s, as comma separated key=value pairs with URL encoded values.
+func otlpHeaders(s *configSource) map[string]string {
+	headers := map[string]string{}
+	for _, name := range []string{"OTEL_EXPORTER_OTLP_HEADERS", "OTEL_EXPORTER_OTLP_TRACES_HEADERS"} {
+		for _, pair := range strings.Split(s.string(name, ""), ",") {
+			key, value, ok := strings.Cut(pair, "=")
+			if !ok || strings.TrimSpace(key) == "" {
+				continue
+			}
+			if decoded, err := url.QueryUnescape(strings.TrimSpace(value)); err == nil {
+				value = decoded
+			}
+			headers[strings.TrimSpace(key)] = value
+		}
+	}
+	return headers
+}
+
+// spanExporter holds the tracer provider of the service, which batches the
+// ended spans and sends them to an OTLP collector.
+type spanExporter struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+// spans exports the spans of the service, doing nothing until main starts the
+// exporter configured.
+var spans = newTracing(nil)
+
+// newTracing returns the tracing of provider, which does nothing when
+// provider is nil.
+func newTracing(provider *sdktrace.TracerProvider) *spanExporter {
+	if provider == nil {
+		return &spanExporter{tracer: trace.NewNoopTracerProvider().Tracer(tracerName)}
+	}
+	return &spanExporter{provider: provider, tracer: provider.Tracer(tracerName)}
+}
+
+// newSpanExporter returns the tracing configured by c, exporting spans with
+// the OTLP protocol of c, or doing nothing when c has no endpoint. Traces the
+// caller sampled are sampled, and so are the traces started here.
+func newSpanExporter(c tracingConfig) *spanExporter {
+	if c.endpoint == "" {
+		return newTracing(nil)
+	}
+	var exporter sdktrace.SpanExporter
+	var err error
+	if c.protocol == otlpProtocolGRPC {
+		exporter, err = otlptracegrpc.New(context.Background(), otlptracegrpc.WithEndpointURL(c.endpoint), otlptracegrpc.WithHeaders(c.headers), otlptracegrpc.WithTimeout(c.timeout))
+	} else {
+		exporter, err = otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(c.endpoint), otlptracehttp.WithHeaders(c.headers), otlptracehttp.WithTimeout(c.timeout))
+	}
+	if err != nil {
+		logger.Warn("exporting traces failed, tracing is off", "endpoint", c.endpoint, "err", err)
+		return newTracing(nil)
+	}
+	service, _ := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", c.serviceName)))
+	logger.Info("exporting traces", "endpoint", c.endpoint, "protocol", c.protocol)
+	return newTracing(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(service),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.AlwaysSample())),
+	))
+}
+
+// enabled reports whether spans are exported.
+func (e *spanExporter) enabled() bool {
+	return e.provider != nil
+}
+
+// shutdown exports the spans still queued, waiting until ctx is done at most.
+func (e *spanExporter) shutdown(ctx context.Context) error {
+	if e.provider == nil {
+		return nil
+	}
+	return e.provider.Shutdown(ctx)
+}
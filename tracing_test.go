@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// recordSpans traces with a provider recording the ended spans in memory for
+// the rest of the test.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(recorder),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.AlwaysSample())),
+	)
+	previous := spans
+	spans = newTracing(provider)
+	t.Cleanup(func() {
+		spans = previous
+		provider.Shutdown(context.Background())
+	})
+	return recorder
+}
+
+// countSitemaps serves a count of the URLs of the index of server, with the
+// traceparent header when it isn't empty.
+func countSitemaps(t *testing.T, server *httptest.Server, traceparent string) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/v1/count?url="+server.URL+"/index.xml", nil)
+	if traceparent != "" {
+		r.Header.Set("traceparent", traceparent)
+	}
+	if w := serve(r); w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+}
+
+func tracedSite(t *testing.T) *httptest.Server {
+	return sitemapServer(t, map[string]string{
+		"/index.xml": sitemapIndex("/a.xml", "/b.xml"),
+		"/a.xml":     urlSet("https://example.com/a"),
+		"/b.xml":     urlSet("https://example.com/b"),
+	})
+}
+
+func TestTraceContinuesTheCallerTrace(t *testing.T) {
+	useLocalConfig(t, map[string]string{"ACCESS_LOG": "0"})
+	recorder := recordSpans(t)
+	server := tracedSite(t)
+
+	countSitemaps(t, server, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ended := recorder.Ended()
+	if len(ended) == 0 {
+		t.Fatal("no spans recorded")
+	}
+	for _, s := range ended {
+		if id := s.SpanContext().TraceID().String(); id != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("span %q is of trace %s, want the trace of the caller", s.Name(), id)
+		}
+	}
+	root := ended[len(ended)-1]
+	if root.Name() != "GET /v1/count" || root.Parent().SpanID().String() != "00f067aa0ba902b7" || !root.Parent().IsRemote() {
+		t.Errorf("server span %q has parent %s, want the span of the caller", root.Name(), root.Parent().SpanID())
+	}
+}
+
+func TestTraceSkipsUnsampledCallers(t *testing.T) {
+	useLocalConfig(t, map[string]string{"ACCESS_LOG": "0"})
+	recorder := recordSpans(t)
+	server := tracedSite(t)
+
+	countSitemaps(t, server, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	if ended := recorder.Ended(); len(ended) != 0 {
+		t.Errorf("recorded %d spans of a trace the caller didn't sample", len(ended))
+	}
+}
+
+func TestTraceSpanParentage(t *testing.T) {
+	useLocalConfig(t, map[string]string{"ACCESS_LOG": "0"})
+	recorder := recordSpans(t)
+	server := tracedSite(t)
+
+	countSitemaps(t, server, "")
+	byID := map[string]sdktrace.ReadOnlySpan{}
+	var root sdktrace.ReadOnlySpan
+	for _, s := range recorder.Ended() {
+		byID[s.SpanContext().SpanID().String()] = s
+		if !s.Parent().IsValid() {
+			if root != nil {
+				t.Fatalf("spans %q and %q are both roots", root.Name(), s.Name())
+			}
+			root = s
+		}
+	}
+	if root == nil || root.Name() != "GET /v1/count" {
+		t.Fatalf("root = %v, want the server span", root)
+	}
+
+	// Every fetch is under the parse of the request, itself under the server
+	// span
+	fetches := 0
+	for _, s := range byID {
+		if s.Name() != "fetch sitemap" {
+			continue
+		}
+		fetches++
+		var names []string
+		for p := byID[s.Parent().SpanID().String()]; p != nil; p = byID[p.Parent().SpanID().String()] {
+			names = append(names, p.Name())
+		}
+		if len(names) == 0 || names[len(names)-1] != root.Name() || !contains(names, "parse sitemap") {
+			t.Errorf("fetch sitemap has ancestors %v, want parse sitemap under the server span", names)
+		}
+	}
+	if fetches != 3 {
+		t.Errorf("recorded %d fetches, want 3", fetches)
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTraceExportsOTLPProtobuf(t *testing.T) {
+	var mu sync.Mutex
+	var exports []*coltracepb.ExportTraceServiceRequest
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/x-protobuf" || r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("export to %s as %q with Authorization %q", r.URL.Path, r.Header.Get("Content-Type"), r.Header.Get("Authorization"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		var export coltracepb.ExportTraceServiceRequest
+		if err := proto.Unmarshal(body, &export); err != nil {
+			t.Errorf("export isn't OTLP protobuf: %v", err)
+		}
+		mu.Lock()
+		exports = append(exports, &export)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer collector.Close()
+	useLocalConfig(t, map[string]string{
+		"ACCESS_LOG":                  "0",
+		"OTEL_EXPORTER_OTLP_ENDPOINT": collector.URL,
+		"OTEL_EXPORTER_OTLP_HEADERS":  "Authorization=Bearer%20token",
+		"OTEL_SERVICE_NAME":           "sitemaps-test",
+	})
+	captureLogs(t)
+	previous := spans
+	spans = newSpanExporter(currentConfig().tracing)
+	defer func() { spans = previous }()
+	if !spans.enabled() {
+		t.Fatal("tracing is off with an endpoint configured")
+	}
+	server := tracedSite(t)
+
+	countSitemaps(t, server, "")
+	if err := spans.shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	names := map[string]bool{}
+	for _, export := range exports {
+		for _, resourceSpans := range export.ResourceSpans {
+			service := ""
+			for _, attribute := range resourceSpans.Resource.Attributes {
+				if attribute.Key == "service.name" {
+					service = attribute.Value.GetStringValue()
+				}
+			}
+			if service != "sitemaps-test" {
+				t.Errorf("service.name = %q, want sitemaps-test", service)
+			}
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				for _, s := range scopeSpans.Spans {
+					names[s.Name] = true
+				}
+			}
+		}
+	}
+	for _, name := range []string{"GET /v1/count", "parse sitemap", "fetch sitemap"} {
+		if !names[name] {
+			t.Errorf("no %q span exported, got %v", name, names)
+		}
+	}
+}
+
+func TestTracingConfig(t *testing.T) {
+	cases := []struct {
+		name     string
+		env      map[string]string
+		endpoint string
+		protocol string
+	}{
+		{"off", map[string]string{}, "", otlpProtocolProtobuf},
+		{"protobuf by default", map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318/"}, "http://collector:4318/v1/traces", otlpProtocolProtobuf},
+		{"grpc", map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4317", "OTEL_EXPORTER_OTLP_PROTOCOL": "grpc"}, "http://collector:4317", otlpProtocolGRPC},
+		{"traces protocol first", map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318", "OTEL_EXPORTER_OTLP_PROTOCOL": "grpc", "OTEL_EXPORTER_OTLP_TRACES_PROTOCOL": "http/protobuf"}, "http://collector:4318/v1/traces", otlpProtocolProtobuf},
+		{"traces endpoint as is", map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": "http://traces:4318/custom"}, "http://traces:4318/custom", otlpProtocolProtobuf},
+		{"disabled", map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318", "OTEL_SDK_DISABLED": "true"}, "", otlpProtocolProtobuf},
+		{"other exporter", map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318", "OTEL_TRACES_EXPORTER": "none"}, "", otlpProtocolProtobuf},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := loadConfig("", envOf(tc.env))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.tracing.endpoint != tc.endpoint || c.tracing.protocol != tc.protocol {
+				t.Errorf("tracing = %s over %s, want %s over %s", c.tracing.endpoint, c.tracing.protocol, tc.endpoint, tc.protocol)
+			}
+		})
+	}
+
+	if _, err := loadConfig("", envOf(map[string]string{"OTEL_EXPORTER_OTLP_PROTOCOL": "http/json"})); err == nil {
+		t.Error("loaded the unsupported http/json protocol")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Parts of a multipart sitemap upload.
+const (
+	uploadFilePart         = "file"
+	uploadSkipChildrenPart = "skipChildren"
+)
+
+// uploadScheme prefixes the name of an uploaded sitemap where its URL would be.
+const uploadScheme = "upload:"
+
+// payloadFromUpload builds the payload of a multipart/form-data request carrying
+// a sitemap in its 'file' part, optionally gzipped.
+//
+// The uploaded document stands in for the root sitemap, named after the file.
+// Its children are fetched as usual, unless the 'skipChildren' part is true.
+// Failures are returned as a *requestError.
+func payloadFromUpload(r *http.Request) (requestPayload, error) {
+	var payload requestPayload
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return payload, &requestError{http.StatusBadRequest, errCodeInvalidRequest, "Invalid multipart payload", nil}
+	}
+
+	var body []byte
+	filename := ""
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return payload, bodyReadError(err, "Invalid multipart payload")
+		}
+
+		switch part.FormName() {
+		case uploadFilePart:
+			body, err = readUpload(part, configFrom(r.Context()).maxUploadBytes)
+			if err != nil {
+				return payload, err
+			}
+			filename = part.FileName()
+		case uploadSkipChildrenPart:
+			value, _ := io.ReadAll(io.LimitReader(part, 16))
+			skip, err := strconv.ParseBool(strings.TrimSpace(string(value)))
+			if err != nil {
+				return payload, &requestError{http.StatusBadRequest, errCodeInvalidRequest, "Invalid 'skipChildren': expected true or false", nil}
+			}
+			if skip {
+				depth := 0
+				payload.MaxDepth = &depth
+			}
+		}
+		part.Close()
+	}
+
+	if body == nil {
+		return payload, &requestError{http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Missing '%s' part in multipart payload", uploadFilePart), nil}
+	}
+	if filename == "" {
+		filename = "sitemap.xml"
+	}
+	payload.Sitemap = uploadScheme + url.PathEscape(filename)
+	payload.upload = body
+	return payload, nil
+}
+
+// readUpload reads an uploaded sitemap, decompressing it when it is gzipped.
+// Documents over maxUploadBytes, as sent or decompressed, are refused.
+func readUpload(part io.Reader, maxUploadBytes int) ([]byte, error) {
+	tooLarge := &requestError{http.StatusRequestEntityTooLarge, errCodePayloadTooLarge, fmt.Sprintf("Uploaded sitemap exceeds %d bytes", maxUploadBytes), nil}
+
+	// Read one byte past the cap to tell whether the file was cut
+	body, err := io.ReadAll(io.LimitReader(part, int64(maxUploadBytes)+1))
+	if err != nil {
+		return nil, bodyReadError(err, "Failed to read the uploaded sitemap")
+	}
+	if len(body) > maxUploadBytes {
+		return nil, tooLarge
+	}
+
+	// Gzipped files are recognized by their magic number, whatever their name
+	if !bytes.HasPrefix(body, []byte{0x1f, 0x8b}) {
+		return body, nil
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, &requestError{http.StatusBadRequest, errCodeInvalidRequest, "Invalid gzip data in the uploaded sitemap", nil}
+	}
+	defer gz.Close()
+	body, err = io.ReadAll(io.LimitReader(gz, int64(maxUploadBytes)+1))
+	if err != nil {
+		return nil, &requestError{http.StatusBadRequest, errCodeInvalidRequest, "Invalid gzip data in the uploaded sitemap", nil}
+	}
+	if len(body) > maxUploadBytes {
+		return nil, tooLarge
+	}
+	return body, nil
+}
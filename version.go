@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// The build of the service, set at build time with
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Without them, the commit and build date are taken from the version control
+// information Go stamps into the binary, when there is any.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// versionPath is the path of the build information, outside of the versioned
+// API as it is about the deployment.
+const versionPath = "/version"
+
+// serverName is the Server header of every response.
+const serverName = "sitemap-parser"
+
+// versionResponse is the response of /version.
+type versionResponse struct {
+	Version    string `json:"version"`
+	Commit     string `json:"commit"`
+	BuildDate  string `json:"buildDate"`
+	GoVersion  string `json:"goVersion"`
+	APIVersion string `json:"apiVersion"`
+}
+
+// buildInfo is the build of the running service, with unknown for what
+// couldn't be found out.
+var buildInfo = readBuildInfo()
+
+// readBuildInfo returns the build of the service, from the values set at
+// build time or the version control information of the binary.
+func readBuildInfo() versionResponse {
+	info := versionResponse{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version(), APIVersion: apiVersion}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range build.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+// advertiseVersion is the middleware telling the version of the service in
+// the Server header of every response.
+func advertiseVersion(next http.Handler) http.Handler {
+	server := serverName + "/" + version
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", server)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func handleVersionEndpoint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, buildInfo)
+}
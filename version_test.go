@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestBuildInfoDefaults(t *testing.T) {
+	// Test binaries are built without ldflags or version control information
+	want := versionResponse{Version: "dev", Commit: "unknown", BuildDate: "unknown", GoVersion: runtime.Version(), APIVersion: apiVersion}
+	if info := readBuildInfo(); info != want {
+		t.Errorf("readBuildInfo() = %+v, want %+v", info, want)
+	}
+
+	useLocalConfig(t, map[string]string{"ACCESS_LOG": "0"})
+	w := serve(httptest.NewRequest(http.MethodGet, versionPath, nil))
+	var served versionResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil || served != want {
+		t.Errorf("%s = %d %s, want %+v", versionPath, w.Code, w.Body, want)
+	}
+	if server := w.Header().Get("Server"); server != "sitemap-parser/dev" {
+		t.Errorf("Server = %q, want sitemap-parser/dev", server)
+	}
+}
+
+func TestBuildInfoFromLdflags(t *testing.T) {
+	defer func(v, c, d string) { version, commit, buildDate = v, c, d }(version, commit, buildDate)
+	version, commit, buildDate = "1.4.0", "0123abcd", "2024-05-01T12:00:00Z"
+
+	info := readBuildInfo()
+	if info.Version != "1.4.0" || info.Commit != "0123abcd" || info.BuildDate != "2024-05-01T12:00:00Z" {
+		t.Errorf("readBuildInfo() = %+v, want the values set at build time", info)
+	}
+}
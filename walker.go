@@ -0,0 +1,712 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// walkOptions holds the per-request limits applied to a sitemap walk.
+type walkOptions struct {
+	// MaxDepth is the number of index levels followed below the requested sitemap.
+	// Zero means the children of an index are not followed at all.
+	MaxDepth int
+	// MaxSitemaps is the number of child sitemaps followed across the whole walk.
+	MaxSitemaps int
+	// MaxURLs is the number of URLs collected across the whole walk.
+	MaxURLs int
+	// AllowCrossHost allows following children hosted elsewhere than their index.
+	AllowCrossHost bool
+	// GroupBySource records which sitemap contributed each URL.
+	GroupBySource bool
+	// Tree only counts the URLs of each sitemap instead of collecting them.
+	Tree bool
+	// ModifiedSince skips children of an index whose lastmod is older, when set.
+	ModifiedSince time.Time
+	// OnURLs, when set, receives the URL entries of each sitemap as soon as it is
+	// parsed, instead of them being collected into the result. It may be called
+	// from several goroutines at once.
+	OnURLs func(sitemap string, urls []SitemapURL)
+	// Filter, when set, drops the URLs it doesn't keep before they count
+	// towards MaxURLs.
+	Filter *urlFilter
+	// Sample, when positive, returns a random sample of that many URLs drawn
+	// with Seed from every URL of the walk, instead of all of them.
+	Sample int
+	Seed   int64
+	// Upload, when set, is the body of the root sitemap, which is then parsed
+	// instead of fetched.
+	Upload []byte
+	// Revalidate keeps the documents served with validators in the cache, and
+	// fetches the documents kept conditionally, using them again on a 304.
+	Revalidate bool
+}
+
+// defaultWalkOptions returns the walk options configured by c.
+func defaultWalkOptions(c *Config) walkOptions {
+	return walkOptions{MaxDepth: c.maxSitemapDepth, MaxSitemaps: c.maxChildSitemaps, MaxURLs: c.maxSitemapURLs}
+}
+
+// sitemapResult holds the URLs and child sitemaps found while parsing a sitemap.
+type sitemapResult struct {
+	// URLs contains the page URLs found in the sitemap and all of its children.
+	URLs []string `json:"urls"`
+	// Sitemaps contains the child sitemaps referenced by sitemap indexes, in document order.
+	Sitemaps []string `json:"sitemaps"`
+	// Unexplored contains the child sitemaps that were not followed because a limit was hit.
+	Unexplored []string `json:"unexplored"`
+	// Skipped contains the child sitemaps not fetched because they are unchanged.
+	Skipped []skippedSitemap `json:"skipped"`
+	// Truncated is set when the walk stopped early because a limit was hit.
+	Truncated bool `json:"truncated"`
+	// Warnings contains non-fatal problems encountered during the walk.
+	Warnings []string `json:"warnings"`
+	// SavedFetches counts the references to sitemaps already fetched in this walk.
+	SavedFetches int `json:"savedFetches"`
+	// Filtered counts the URLs dropped by the filter of the walk.
+	Filtered filterStats `json:"-"`
+	// Priorities is the distribution of the priorities of every URL listed,
+	// before filtering.
+	Priorities priorityDistribution `json:"-"`
+	// Population counts the URLs the sample was drawn from, when sampling.
+	Population int `json:"-"`
+	// Collected counts the URLs kept by the walk, whether they were collected,
+	// streamed out or only counted.
+	Collected int `json:"-"`
+	// Fetched counts the sitemap fetches of the walk, FetchErrors the ones that
+	// failed, NotModified the ones answered with a 304, Retries the attempts
+	// made again after a transient failure, and Bytes the size of the bodies
+	// read.
+	Fetched     int   `json:"-"`
+	FetchErrors int   `json:"-"`
+	NotModified int   `json:"-"`
+	Retries     int   `json:"-"`
+	Bytes       int64 `json:"-"`
+	// CrawlDelay is the Crawl-delay that paced the fetches of the host of the
+	// sitemap.
+	CrawlDelay time.Duration `json:"-"`
+	// Cached is set when the result was served from the cache, stored CacheAge
+	// ago, and Refreshed when a forced refresh replaced the cached result.
+	Cached    bool          `json:"-"`
+	CacheAge  time.Duration `json:"-"`
+	Refreshed bool          `json:"-"`
+	// Errors contains the child sitemaps that could not be fetched or parsed.
+	Errors []sitemapError `json:"errors"`
+	// Partial is set when some child sitemaps failed and their URLs are missing.
+	Partial bool `json:"partial"`
+	// Sources groups the URLs by the sitemap they were listed in, in walk order.
+	// It is only filled when the walk groups URLs by source.
+	Sources []sitemapSource `json:"sources,omitempty"`
+	// Tree describes the structure of the walk, one node per sitemap.
+	Tree *sitemapNode `json:"tree,omitempty"`
+
+	// unfetched is set when the sitemap was left unexplored once the walk hit a limit.
+	unfetched bool
+}
+
+// Types of sitemap documents.
+const (
+	sitemapTypeIndex  = "index"
+	sitemapTypeURLSet = "urlset"
+)
+
+// Fetch statuses of the nodes of a sitemap tree.
+const (
+	nodeStatusOK         = "ok"
+	nodeStatusError      = "error"
+	nodeStatusSkipped    = "skipped"
+	nodeStatusUnexplored = "unexplored"
+)
+
+// sitemapNode describes a sitemap in the tree representation of a walk.
+type sitemapNode struct {
+	URL        string         `json:"url"`
+	Type       string         `json:"type,omitempty"`
+	URLCount   int            `json:"urlCount"`
+	ChildCount int            `json:"childCount"`
+	Status     string         `json:"status"`
+	Error      string         `json:"error,omitempty"`
+	Children   []*sitemapNode `json:"children"`
+}
+
+// addChild appends a child that wasn't fetched, with the given status and reason.
+func (n *sitemapNode) addChild(url, status, reason string) {
+	n.Children = append(n.Children, &sitemapNode{URL: url, Status: status, Error: reason, Children: []*sitemapNode{}})
+}
+
+// sitemapSource holds the URLs contributed by a single sitemap document.
+type sitemapSource struct {
+	Sitemap string   `json:"sitemap"`
+	URLs    []string `json:"urls"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// skippedSitemap describes a child sitemap left out for not being modified recently.
+type skippedSitemap struct {
+	Sitemap string `json:"sitemap"`
+	Lastmod string `json:"lastmod"`
+}
+
+// sitemapError describes a child sitemap that failed during the walk.
+type sitemapError struct {
+	Sitemap string `json:"sitemap"`
+	Message string `json:"message"`
+}
+
+// sitemapWalker walks a sitemap and, for sitemap indexes, all of its children.
+//
+// A walker is created per request. Children of an index are fetched by a pool of
+// workers, and fetchSlots bounds the number of documents being fetched at once
+// across every level of the walk.
+type sitemapWalker struct {
+	opts        walkOptions
+	concurrency int
+	fetchSlots  chan struct{}
+	// site is the host of the top sitemap, which the filter compares URLs to.
+	site string
+	// sampler draws the sample of the walk, when sampling.
+	sampler *urlSampler
+
+	// visited holds the normalized URLs of the sitemaps fetched so far,
+	// admitted counts the child sitemaps scheduled for fetching,
+	// collected counts the URLs kept so far, filtered counts the URLs
+	// dropped by the filter, priorities counts the URLs listed per priority,
+	// and fetched, fetchErrors, notModified and bytes account for the fetches.
+	mu          sync.Mutex
+	visited     map[string]bool
+	admitted    int
+	collected   int
+	filtered    filterStats
+	priorities  priorityDistribution
+	fetched     int
+	fetchErrors int
+	notModified int
+	bytes       int64
+}
+
+// recordFetch accounts for a sitemap fetch that read n bytes and ended with err.
+func (w *sitemapWalker) recordFetch(n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.fetched++
+	w.bytes += int64(n)
+	if err != nil {
+		w.fetchErrors++
+	}
+}
+
+// recordNotModified accounts for a sitemap fetch answered with a 304.
+func (w *sitemapWalker) recordNotModified() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.fetched++
+	w.notModified++
+}
+
+// reserveURLs reserves room for n more URLs within MaxURLs.
+//
+// It returns how many of them may be collected, which is less than n once the
+// limit is reached.
+func (w *sitemapWalker) reserveURLs(n int) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if room := w.opts.MaxURLs - w.collected; n > room {
+		n = room
+	}
+	if n < 0 {
+		n = 0
+	}
+	w.collected += n
+	return n
+}
+
+// filterURLs returns the URLs kept by the filter of the walk, counting the others,
+// and adds the priorities of all of them to the distribution of the walk.
+func (w *sitemapWalker) filterURLs(urls []SitemapURL) []SitemapURL {
+	var priorities priorityDistribution
+	priorities.count(urls)
+
+	kept := urls
+	var stats filterStats
+	if w.opts.Filter != nil {
+		kept, stats = w.opts.Filter.apply(urls, w.site)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.filtered.add(stats)
+	w.priorities.add(priorities)
+	return kept
+}
+
+// sampleURLs adds the URLs to the population of the sample.
+func (w *sitemapWalker) sampleURLs(urls []SitemapURL) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.sampler.offer(urls)
+}
+
+// urlLimitReached reports whether MaxURLs URLs have already been collected.
+func (w *sitemapWalker) urlLimitReached() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.collected >= w.opts.MaxURLs
+}
+
+// Outcomes of admitting a child sitemap into the walk.
+const (
+	childAdmitted = iota
+	childVisited
+	childOverLimit
+)
+
+// newSitemapWalker creates a walker fetching up to concurrency documents at once.
+func newSitemapWalker(opts walkOptions, concurrency int) *sitemapWalker {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &sitemapWalker{
+		opts:        opts,
+		concurrency: concurrency,
+		fetchSlots:  make(chan struct{}, concurrency),
+		visited:     make(map[string]bool),
+	}
+}
+
+// visit marks the sitemap at url as fetched in this walk.
+//
+// It returns false when the sitemap was already visited, which happens when
+// indexes reference each other.
+func (w *sitemapWalker) visit(url string) bool {
+	key := normalizeURL(url)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.visited[key] {
+		return false
+	}
+	w.visited[key] = true
+	return true
+}
+
+// admit decides whether the child sitemap at url is fetched.
+//
+// Children already visited in this walk are skipped, and once MaxSitemaps
+// children have been admitted no further child is, so workers never start
+// fetches past the limit.
+func (w *sitemapWalker) admit(url string) int {
+	key := normalizeURL(url)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.visited[key] {
+		return childVisited
+	}
+	if w.admitted >= w.opts.MaxSitemaps || w.collected >= w.opts.MaxURLs {
+		return childOverLimit
+	}
+	w.visited[key] = true
+	w.admitted++
+	return childAdmitted
+}
+
+// parseSitemap parses a sitemap URL and returns the URLs found in the sitemap.
+//
+// It takes the request context, which bounds every fetch of the walk, a string
+// parameter named 'url' which specifies the URL of the sitemap, an optional
+// redirectTrace recording the redirects followed to fetch it, and the walk options.
+// The function returns a sitemapResult containing the page URLs found in the sitemap
+// and, for sitemap indexes, the child sitemaps that were followed,
+// and an error if there was an error during the parsing process.
+func parseSitemap(ctx context.Context, url string, trace *redirectTrace, opts walkOptions) (*sitemapResult, error) {
+	walker := newSitemapWalker(opts, configFrom(ctx).childFetchConcurrency)
+	if opts.Filter != nil {
+		walker.site = opts.Filter.siteHost(url)
+	}
+	if opts.Sample > 0 {
+		walker.sampler = newURLSampler(opts.Sample, opts.Seed)
+	}
+	walker.visit(url)
+	var retries int64
+	result, err := walker.walk(withRetryCounter(ctx, &retries), url, trace, nil)
+	if err != nil {
+		return nil, err
+	}
+	result.Filtered = walker.filtered
+	result.Priorities = walker.priorities
+	result.Collected = walker.collected
+	result.Fetched = walker.fetched
+	result.FetchErrors = walker.fetchErrors
+	result.NotModified = walker.notModified
+	result.Retries = int(atomic.LoadInt64(&retries))
+	result.CrawlDelay = politeness.crawlDelay(url)
+	result.Bytes = walker.bytes
+	if walker.sampler != nil {
+		result.URLs = walker.sampler.urls()
+		result.Population = walker.sampler.population
+		result.Collected = len(result.URLs)
+	}
+
+	// Report a deadline that cut the walk short as a single error entry
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		result.Errors = append(result.Errors, sitemapError{Sitemap: url, Message: "Request deadline exceeded before the walk completed"})
+		result.Partial = true
+	}
+	return result, nil
+}
+
+// fetchSitemap fetches and decodes a single sitemap document.
+//
+// It waits for a free fetch slot first, so the number of concurrent fetches of a
+// walk never exceeds its concurrency. When the walk revalidates, a document kept
+// in the cache is fetched conditionally, and used again without downloading or
+// decoding anything when it wasn't modified.
+func (w *sitemapWalker) fetchSitemap(ctx context.Context, url string, trace *redirectTrace) (sitemap *Sitemap, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ctx, span := startSpan(ctx, "fetch sitemap", spanKindClient)
+	span.set("url.full", url)
+	defer func() {
+		span.fail(err)
+		if sitemap != nil {
+			span.set("sitemap.urls", len(sitemap.URLs), "sitemap.children", len(sitemap.Sitemaps))
+		}
+		span.finish()
+	}()
+	select {
+	case w.fetchSlots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-w.fetchSlots }()
+
+	var stored *cachedDocument
+	var header http.Header
+	if w.opts.Revalidate {
+		if stored = cachedSitemapDocument(url); stored != nil {
+			header = stored.conditionalHeader()
+		}
+	}
+
+	resp, err := fetchURLWithHeader(ctx, url, trace, header)
+	if err != nil {
+		w.recordFetch(0, err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	span.set("http.response.status_code", resp.StatusCode, "cache.hit", stored != nil && resp.StatusCode == http.StatusNotModified)
+
+	if stored != nil && resp.StatusCode == http.StatusNotModified {
+		w.recordNotModified()
+		stored.revalidated(url, resp.Header, configFrom(ctx).cacheValidatorTTL)
+		return stored.sitemap, nil
+	}
+
+	// Don't try to parse error pages as sitemaps
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := &upstreamStatusError{URL: url, Status: resp.StatusCode}
+		w.recordFetch(0, err)
+		return nil, err
+	}
+
+	body, err := readBody(resp, url, configFrom(ctx).fetchMaxBodyBytes)
+	span.set("http.response.body.size", len(body))
+	if err != nil {
+		w.recordFetch(len(body), err)
+		return nil, err
+	}
+	sitemap, err = decodeSitemap(body)
+	w.recordFetch(len(body), err)
+	if err == nil && w.opts.Revalidate {
+		storeSitemapDocument(url, sitemap, resp.Header, configFrom(ctx).cacheValidatorTTL)
+	}
+	return sitemap, err
+}
+
+// sitemapParseError is returned when a document isn't a valid sitemap.
+type sitemapParseError struct {
+	Err error
+}
+
+func (e *sitemapParseError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *sitemapParseError) Unwrap() error {
+	return e.Err
+}
+
+// decodeSitemap decodes the body of a sitemap document.
+func decodeSitemap(body []byte) (*Sitemap, error) {
+	var sitemap Sitemap
+	if err := xml.Unmarshal(body, &sitemap); err != nil {
+		return nil, &sitemapParseError{err}
+	}
+	return &sitemap, nil
+}
+
+// walk parses the sitemap at url and, when it is a sitemap index, all of its children.
+//
+// The parents are the normalized URLs of the indexes above the sitemap; children
+// are only followed while their number is below the configured maximum depth.
+func (w *sitemapWalker) walk(ctx context.Context, url string, trace *redirectTrace, parents []string) (*sitemapResult, error) {
+	result := &sitemapResult{URLs: []string{}, Sitemaps: []string{}, Unexplored: []string{}, Skipped: []skippedSitemap{}, Warnings: []string{}, Errors: []sitemapError{}}
+	result.Tree = &sitemapNode{URL: url, Status: nodeStatusOK, Children: []*sitemapNode{}}
+
+	// Don't fetch children that were scheduled before the URL limit was reached
+	if len(parents) > 0 && w.urlLimitReached() {
+		result.Unexplored = append(result.Unexplored, url)
+		result.Truncated = true
+		result.Tree.Status = nodeStatusUnexplored
+		result.unfetched = true
+		return result, nil
+	}
+
+	// An uploaded root sitemap is parsed as is, and has no host of its own
+	uploaded := len(parents) == 0 && w.opts.Upload != nil
+	var sitemap *Sitemap
+	var err error
+	if uploaded {
+		sitemap, err = decodeSitemap(w.opts.Upload)
+	} else {
+		sitemap, err = w.fetchSitemap(ctx, url, trace)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Don't descend into the children once the walk is cancelled
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	result.Tree.Type = sitemapTypeURLSet
+	if len(sitemap.Sitemaps) > 0 {
+		result.Tree.Type = sitemapTypeIndex
+	}
+	result.Tree.ChildCount = len(sitemap.Sitemaps)
+
+	// Collect the URLs listed in the sitemap that pass the filter, up to the URL
+	// limit. The tree representation only needs their number, streamed URLs
+	// are handed off right away, and sampled URLs are drawn once the walk is
+	// done. As the sample has a fixed size, sampled URLs don't count towards
+	// the limit.
+	entries := w.filterURLs(sitemap.URLs)
+	allowed := len(entries)
+	if w.sampler == nil {
+		allowed = w.reserveURLs(len(entries))
+	}
+	result.Tree.URLCount = allowed
+	switch {
+	case w.sampler != nil:
+		w.sampleURLs(entries)
+	case w.opts.OnURLs != nil:
+		w.opts.OnURLs(url, entries[:allowed])
+	case !w.opts.Tree:
+		for _, u := range entries[:allowed] {
+			result.URLs = append(result.URLs, u.Loc)
+		}
+	}
+	if allowed < len(entries) {
+		result.Truncated = true
+	}
+	if w.opts.GroupBySource {
+		result.Sources = []sitemapSource{{Sitemap: url, URLs: append([]string{}, result.URLs...)}}
+	}
+
+	// Stop descending once the depth limit is reached
+	if len(sitemap.Sitemaps) > 0 && len(parents) >= w.opts.MaxDepth {
+		for _, s := range sitemap.Sitemaps {
+			result.Unexplored = append(result.Unexplored, s.Loc)
+			result.Tree.addChild(s.Loc, nodeStatusUnexplored, "")
+		}
+		result.Truncated = true
+		return result, nil
+	}
+
+	// If sitemap contains sitemaps, parse each of them. The tree keeps a slot
+	// per child so nodes stay in document order.
+	parents = append(parents[:len(parents):len(parents)], normalizeURL(url))
+	locs := make([]string, 0, len(sitemap.Sitemaps))
+	slots := make([]int, 0, len(sitemap.Sitemaps))
+	for _, s := range sitemap.Sitemaps {
+		// Never follow children to schemes other than http and https, such as
+		// file:// or gopher://
+		if checkFetchURL(s.Loc) != nil {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("Skipped sitemap %s: only http and https sitemaps are fetched", s.Loc))
+			result.Tree.addChild(s.Loc, nodeStatusSkipped, "unsupported scheme")
+			continue
+		}
+
+		// Only follow children hosted on the same site as their index, unless
+		// the caller opted in or the index was uploaded, and never follow them
+		// to private addresses
+		if !sameSite(url, s.Loc) {
+			if !w.opts.AllowCrossHost && !uploaded {
+				result.Warnings = append(result.Warnings, fmt.Sprintf("Skipped sitemap %s: host differs from its index %s", s.Loc, url))
+				result.Tree.addChild(s.Loc, nodeStatusSkipped, "host differs from its index")
+				continue
+			}
+			if isPrivateHost(s.Loc) {
+				result.Warnings = append(result.Warnings, fmt.Sprintf("Skipped sitemap %s: private address", s.Loc))
+				result.Tree.addChild(s.Loc, nodeStatusSkipped, "private address")
+				continue
+			}
+		}
+
+		// Skip children that haven't changed since the requested time. Children
+		// without a lastmod are always fetched.
+		if !w.opts.ModifiedSince.IsZero() {
+			if lastmod, ok := parseLastmod(s.Lastmod); ok && lastmod.Before(w.opts.ModifiedSince) {
+				result.Skipped = append(result.Skipped, skippedSitemap{Sitemap: s.Loc, Lastmod: s.Lastmod})
+				result.Tree.addChild(s.Loc, nodeStatusSkipped, "not modified since "+w.opts.ModifiedSince.Format(time.RFC3339))
+				continue
+			}
+		}
+
+		switch w.admit(s.Loc) {
+		case childVisited:
+			// Skip sitemaps fetched earlier in this walk, so cycles terminate and
+			// repeated children are only fetched once
+			result.SavedFetches++
+			if containsString(parents, normalizeURL(s.Loc)) {
+				result.Warnings = append(result.Warnings, fmt.Sprintf("Skipped sitemap %s: cycle detected, already fetched in this request", s.Loc))
+				result.Tree.addChild(s.Loc, nodeStatusSkipped, "cycle detected")
+			} else {
+				result.Warnings = append(result.Warnings, fmt.Sprintf("Skipped sitemap %s: duplicate, already fetched in this request", s.Loc))
+				result.Tree.addChild(s.Loc, nodeStatusSkipped, "duplicate")
+			}
+		case childOverLimit:
+			// Leave the remaining children unexplored once the cap is reached
+			result.Unexplored = append(result.Unexplored, s.Loc)
+			result.Truncated = true
+			result.Tree.addChild(s.Loc, nodeStatusUnexplored, "")
+		default:
+			locs = append(locs, s.Loc)
+			slots = append(slots, len(result.Tree.Children))
+			result.Tree.Children = append(result.Tree.Children, nil)
+		}
+	}
+
+	children, errs := w.walkChildren(ctx, locs, parents)
+
+	// Aggregate the children in index order
+	for i, child := range children {
+		// Children cut off by the request deadline or cancellation stay
+		// unexplored, unlike those that failed on their own before
+		if errs[i] != nil && ctx.Err() != nil && cutOff(errs[i]) {
+			result.Unexplored = append(result.Unexplored, locs[i])
+			result.Partial = true
+			result.Tree.Children[slots[i]] = &sitemapNode{URL: locs[i], Status: nodeStatusUnexplored, Children: []*sitemapNode{}}
+			continue
+		}
+		if errs[i] == nil && child.unfetched {
+			result.Unexplored = append(result.Unexplored, child.Unexplored...)
+			result.Truncated = true
+			result.Tree.Children[slots[i]] = child.Tree
+			continue
+		}
+		result.Sitemaps = append(result.Sitemaps, locs[i])
+
+		// Keep going when a child fails, reporting it instead of its URLs
+		if errs[i] != nil {
+			loggerFrom(ctx).Warn("child sitemap failed", "sitemap", locs[i], "index", url, "err", errs[i])
+			result.Errors = append(result.Errors, sitemapError{Sitemap: locs[i], Message: errs[i].Error()})
+			result.Partial = true
+			if w.opts.GroupBySource {
+				result.Sources = append(result.Sources, sitemapSource{Sitemap: locs[i], URLs: []string{}, Error: errs[i].Error()})
+			}
+			result.Tree.Children[slots[i]] = &sitemapNode{URL: locs[i], Status: nodeStatusError, Error: errs[i].Error(), Children: []*sitemapNode{}}
+			continue
+		}
+
+		result.Sitemaps = append(result.Sitemaps, child.Sitemaps...)
+		result.URLs = append(result.URLs, child.URLs...)
+		result.Unexplored = append(result.Unexplored, child.Unexplored...)
+		result.Skipped = append(result.Skipped, child.Skipped...)
+		result.Warnings = append(result.Warnings, child.Warnings...)
+		result.Truncated = result.Truncated || child.Truncated
+		result.SavedFetches += child.SavedFetches
+		result.Errors = append(result.Errors, child.Errors...)
+		result.Partial = result.Partial || child.Partial
+		result.Sources = append(result.Sources, child.Sources...)
+		result.Tree.Children[slots[i]] = child.Tree
+	}
+
+	return result, nil
+}
+
+// walkChildren walks the given child sitemaps with a bounded pool of workers.
+//
+// The results and per-child errors are returned in the order of locs. A failing
+// child doesn't stop its siblings; once ctx is done no further child is started,
+// and the children that were not walked report the context's error.
+func (w *sitemapWalker) walkChildren(ctx context.Context, locs []string, parents []string) ([]*sitemapResult, []error) {
+	var (
+		results = make([]*sitemapResult, len(locs))
+		errs    = make([]error, len(locs))
+		wg      sync.WaitGroup
+		jobs    = make(chan int)
+	)
+
+	workers := w.concurrency
+	if workers > len(locs) {
+		workers = len(locs)
+	}
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				// Don't start new fetches once the walk is cancelled
+				if err := ctx.Err(); err != nil {
+					errs[i] = err
+					continue
+				}
+				// A child panicking fails on its own, like one failing to fetch
+				func() {
+					defer recoverTo(ctx, "child sitemap", &errs[i])
+					results[i], errs[i] = w.walk(ctx, locs[i], nil, parents)
+				}()
+			}
+		}()
+	}
+
+	// Hand out the children until they are exhausted or the walk is cancelled
+	for i := range locs {
+		if err := ctx.Err(); err != nil {
+			errs[i] = err
+			continue
+		}
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results, errs
+}
+
+// cutOff reports whether err is that of a walk cancelled or out of time.
+func cutOff(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// containsString reports whether values contains value.
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
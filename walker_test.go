@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sitemapServer serves documents by path, with {base} standing for the URL of
+// the server.
+func sitemapServer(t *testing.T, documents map[string]string) *httptest.Server {
+	t.Helper()
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		document, ok := documents[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprint(w, strings.ReplaceAll(document, "{base}", server.URL))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// sitemapIndex returns an index of the children at paths.
+func sitemapIndex(paths ...string) string {
+	var b strings.Builder
+	b.WriteString(`<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">`)
+	for _, path := range paths {
+		fmt.Fprintf(&b, "<sitemap><loc>{base}%s</loc></sitemap>", path)
+	}
+	b.WriteString("</sitemapindex>")
+	return b.String()
+}
+
+// urlSet returns a urlset of the page URLs given.
+func urlSet(locs ...string) string {
+	var b strings.Builder
+	b.WriteString(`<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">`)
+	for _, loc := range locs {
+		fmt.Fprintf(&b, "<url><loc>%s</loc></url>", loc)
+	}
+	b.WriteString("</urlset>")
+	return b.String()
+}
+
+func TestParseSitemapIndexSeparatesURLsAndSitemaps(t *testing.T) {
+	tests := []struct {
+		name      string
+		documents map[string]string
+		urls      []string
+		sitemaps  []string
+	}{
+		{
+			name: "three children",
+			documents: map[string]string{
+				"/index.xml": sitemapIndex("/a.xml", "/b.xml", "/c.xml"),
+				"/a.xml":     urlSet("https://example.com/a1", "https://example.com/a2"),
+				"/b.xml":     urlSet("https://example.com/b1"),
+				"/c.xml":     urlSet("https://example.com/c1", "https://example.com/c2", "https://example.com/c3"),
+			},
+			urls:     []string{"https://example.com/a1", "https://example.com/a2", "https://example.com/b1", "https://example.com/c1", "https://example.com/c2", "https://example.com/c3"},
+			sitemaps: []string{"/a.xml", "/b.xml", "/c.xml"},
+		},
+		{
+			name: "child listed twice",
+			documents: map[string]string{
+				"/index.xml": sitemapIndex("/a.xml", "/b.xml", "/a.xml", "/c.xml"),
+				"/a.xml":     urlSet("https://example.com/a1"),
+				"/b.xml":     urlSet("https://example.com/b1"),
+				"/c.xml":     urlSet("https://example.com/c1"),
+			},
+			urls:     []string{"https://example.com/a1", "https://example.com/b1", "https://example.com/c1"},
+			sitemaps: []string{"/a.xml", "/b.xml", "/c.xml"},
+		},
+		{
+			name: "nested index",
+			documents: map[string]string{
+				"/index.xml":  sitemapIndex("/a.xml", "/b.xml", "/nested.xml"),
+				"/a.xml":      urlSet("https://example.com/a1"),
+				"/b.xml":      urlSet("https://example.com/b1"),
+				"/nested.xml": sitemapIndex("/c.xml"),
+				"/c.xml":      urlSet("https://example.com/c1"),
+			},
+			urls:     []string{"https://example.com/a1", "https://example.com/b1", "https://example.com/c1"},
+			sitemaps: []string{"/a.xml", "/b.xml", "/nested.xml", "/c.xml"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLocalConfig(t, nil)
+			server := sitemapServer(t, tt.documents)
+
+			result, err := parseSitemap(context.Background(), server.URL+"/index.xml", nil, defaultWalkOptions(currentConfig()))
+			if err != nil {
+				t.Fatalf("parseSitemap: %v", err)
+			}
+
+			wantSitemaps := make([]string, len(tt.sitemaps))
+			for i, path := range tt.sitemaps {
+				wantSitemaps[i] = server.URL + path
+			}
+			assertSameSet(t, "urls", result.URLs, tt.urls)
+			assertSameSet(t, "sitemaps", result.Sitemaps, wantSitemaps)
+			for _, loc := range result.URLs {
+				if strings.HasPrefix(loc, server.URL) {
+					t.Errorf("urls holds the sitemap %q", loc)
+				}
+			}
+		})
+	}
+}
+
+// assertSameSet fails the test unless got holds every value of want exactly
+// once, and nothing else.
+func assertSameSet(t *testing.T, name string, got, want []string) {
+	t.Helper()
+	counts := map[string]int{}
+	for _, value := range got {
+		counts[value]++
+	}
+	for value, n := range counts {
+		if n > 1 {
+			t.Errorf("%s holds %q %d times", name, value, n)
+		}
+	}
+	sorted := append([]string(nil), got...)
+	sort.Strings(sorted)
+	wanted := append([]string(nil), want...)
+	sort.Strings(wanted)
+	if strings.Join(sorted, " ") != strings.Join(wanted, " ") {
+		t.Errorf("%s = %v, want %v", name, sorted, wanted)
+	}
+}
+
+func TestParseSitemapTerminatesOnCycles(t *testing.T) {
+	useLocalConfig(t, nil)
+	// Each index lists the other, the one the walk started from included
+	server := sitemapServer(t, map[string]string{
+		"/a.xml":       sitemapIndex("/b.xml", "/a-pages.xml"),
+		"/b.xml":       sitemapIndex("/a.xml", "/b-pages.xml"),
+		"/a-pages.xml": urlSet("https://example.com/a1", "https://example.com/a2"),
+		"/b-pages.xml": urlSet("https://example.com/b1"),
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := parseSitemap(ctx, server.URL+"/a.xml", nil, defaultWalkOptions(currentConfig()))
+	if err != nil {
+		t.Fatalf("parseSitemap: %v", err)
+	}
+
+	assertSameSet(t, "urls", result.URLs, []string{"https://example.com/a1", "https://example.com/a2", "https://example.com/b1"})
+	if result.Fetched != 4 || result.SavedFetches != 1 {
+		t.Errorf("fetched %d sitemaps, saving %d fetches, want each of the 4 fetched once", result.Fetched, result.SavedFetches)
+	}
+	if want := "Skipped sitemap " + server.URL + "/a.xml: cycle detected, already fetched in this request"; len(result.Warnings) != 1 || result.Warnings[0] != want {
+		t.Errorf("warnings = %q, want the cycle back to a.xml", result.Warnings)
+	}
+	if result.Partial || result.Truncated {
+		t.Errorf("partial = %v, truncated = %v, want a complete walk", result.Partial, result.Truncated)
+	}
+}
+
+func TestParseSitemapPartialResults(t *testing.T) {
+	useLocalConfig(t, map[string]string{"FETCH_TIMEOUT_SECONDS": "1"})
+	captureLogs(t)
+	documents := map[string]string{
+		"/index.xml": sitemapIndex("/a.xml", "/missing.xml", "/slow.xml", "/b.xml"),
+		"/a.xml":     urlSet("https://example.com/a1"),
+		"/b.xml":     urlSet("https://example.com/b1", "https://example.com/b2"),
+	}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow.xml" {
+			// Answer only once the fetch gave up
+			<-r.Context().Done()
+			return
+		}
+		document, ok := documents[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, strings.ReplaceAll(document, "{base}", server.URL))
+	}))
+	defer server.Close()
+
+	w := httptest.NewRecorder()
+	handleSitemapEndpoint(w, httptest.NewRequest(http.MethodGet, "/v1/sitemap?url="+server.URL+"/index.xml", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s, want the URLs of the children that succeeded", w.Code, w.Body)
+	}
+	var response struct {
+		URLs    []string       `json:"urls"`
+		Errors  []sitemapError `json:"errors"`
+		Partial bool           `json:"partial"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	assertSameSet(t, "urls", response.URLs, []string{"https://example.com/a1", "https://example.com/b1", "https://example.com/b2"})
+	if !response.Partial {
+		t.Error("partial = false, want true")
+	}
+	failed := make([]string, len(response.Errors))
+	for i, e := range response.Errors {
+		failed[i] = e.Sitemap
+	}
+	assertSameSet(t, "errors", failed, []string{server.URL + "/missing.xml", server.URL + "/slow.xml"})
+}
+
+func TestParseSitemapCutOffByTheDeadline(t *testing.T) {
+	useLocalConfig(t, map[string]string{"SITEMAP_FETCH_CONCURRENCY": "2"})
+	captureLogs(t)
+	documents := map[string]string{
+		"/index.xml": sitemapIndex("/missing.xml", "/slow.xml"),
+	}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow.xml" {
+			// Answer only once the walk ran out of time
+			<-r.Context().Done()
+			return
+		}
+		document, ok := documents[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, strings.ReplaceAll(document, "{base}", server.URL))
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	result, err := parseSitemap(ctx, server.URL+"/index.xml", nil, defaultWalkOptions(currentConfig()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameSet(t, "unexplored", result.Unexplored, []string{server.URL + "/slow.xml"})
+	var failed []string
+	for _, e := range result.Errors {
+		failed = append(failed, e.Sitemap)
+	}
+	// The missing child failed before the deadline, which is reported for the
+	// index
+	assertSameSet(t, "errors", failed, []string{server.URL + "/missing.xml", server.URL + "/index.xml"})
+}
+
+func TestParseSitemapTopLevelFailure(t *testing.T) {
+	useLocalConfig(t, nil)
+	captureLogs(t)
+	server := sitemapServer(t, map[string]string{"/broken.xml": "<urlset><url>"})
+
+	for path, status := range map[string]int{"/missing.xml": http.StatusNotFound, "/broken.xml": http.StatusUnprocessableEntity} {
+		w := httptest.NewRecorder()
+		handleSitemapEndpoint(w, httptest.NewRequest(http.MethodGet, "/v1/sitemap?url="+server.URL+path, nil))
+		if w.Code != status {
+			t.Errorf("%s: status = %d, want %d with no partial result", path, w.Code, status)
+		}
+	}
+}
+
+func TestParseSitemapStopsWhenCancelled(t *testing.T) {
+	useLocalConfig(t, map[string]string{"SITEMAP_FETCH_CONCURRENCY": "1"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	var requested []string
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.URL.Path)
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/index.xml":
+			fmt.Fprint(w, strings.ReplaceAll(sitemapIndex("/1.xml", "/2.xml", "/3.xml", "/4.xml"), "{base}", server.URL))
+		case "/1.xml":
+			// The client goes away while the first child is served
+			cancel()
+			fmt.Fprint(w, urlSet("https://example.com/1"))
+		default:
+			fmt.Fprint(w, urlSet("https://example.com"+r.URL.Path))
+		}
+	}))
+	defer server.Close()
+
+	parseSitemap(ctx, server.URL+"/index.xml", nil, defaultWalkOptions(currentConfig()))
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(requested, " ") != "/index.xml /1.xml" {
+		t.Errorf("requested %v, want no fetch after the cancellation", requested)
+	}
+}
+
+// slowChildren serves an index of n children, each answering after latency,
+// and records the most children served at once in peak.
+func slowChildren(t *testing.T, n int, latency time.Duration, peak *int32) *httptest.Server {
+	t.Helper()
+	paths := make([]string, n)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("/%d.xml", i)
+	}
+	var serving int32
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/index.xml" {
+			fmt.Fprint(w, strings.ReplaceAll(sitemapIndex(paths...), "{base}", server.URL))
+			return
+		}
+		now := atomic.AddInt32(&serving, 1)
+		defer atomic.AddInt32(&serving, -1)
+		for {
+			seen := atomic.LoadInt32(peak)
+			if now <= seen || atomic.CompareAndSwapInt32(peak, seen, now) {
+				break
+			}
+		}
+		time.Sleep(latency)
+		fmt.Fprint(w, urlSet("https://example.com"+r.URL.Path))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestParseSitemapFetchesChildrenConcurrently(t *testing.T) {
+	const children, latency = 8, 200 * time.Millisecond
+	useLocalConfig(t, map[string]string{"SITEMAP_FETCH_CONCURRENCY": "8"})
+	var peak int32
+	server := slowChildren(t, children, latency, &peak)
+
+	started := time.Now()
+	result, err := parseSitemap(context.Background(), server.URL+"/index.xml", nil, defaultWalkOptions(currentConfig()))
+	elapsed := time.Since(started)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.URLs) != children {
+		t.Errorf("found %d URLs, want %d", len(result.URLs), children)
+	}
+	if serial := children * latency; elapsed > serial/2 {
+		t.Errorf("walk took %s, want well under the %s of fetching the children one at a time", elapsed, serial)
+	}
+}
+
+func TestParseSitemapBoundsChildFetches(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		bounds int32
+	}{
+		{"per walk", map[string]string{"SITEMAP_FETCH_CONCURRENCY": "3"}, 3},
+		{"service wide", map[string]string{"SITEMAP_FETCH_CONCURRENCY": "8", "FETCH_MAX_CONCURRENT": "2"}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLocalConfig(t, tt.env)
+			var peak int32
+			server := slowChildren(t, 12, 50*time.Millisecond, &peak)
+
+			result, err := parseSitemap(context.Background(), server.URL+"/index.xml", nil, defaultWalkOptions(currentConfig()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.URLs) != 12 {
+				t.Errorf("found %d URLs, want 12", len(result.URLs))
+			}
+			if got := atomic.LoadInt32(&peak); got != tt.bounds {
+				t.Errorf("fetched %d children at once, want %d", got, tt.bounds)
+			}
+		})
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errCodeServerBusy is reported for the requests turned away because the
+// worker pool and its queue are full.
+const errCodeServerBusy = "SERVER_BUSY"
+
+// busyRetryAfter is the Retry-After of the requests turned away by a full queue.
+const busyRetryAfter = time.Second
+
+// errPoolClosed is returned for the parses submitted after the pool was closed,
+// and for those still queued when it couldn't drain in time.
+var errPoolClosed = errors.New("worker pool closed")
+
+// The states of a job, which the submitter and a worker race to change.
+const (
+	jobQueued int32 = iota
+	jobRunning
+	jobAbandoned
+)
+
+// poolJob is a parse waiting for, or run by, a worker.
+type poolJob struct {
+	ctx   context.Context
+	run   func()
+	state int32
+	err   error
+	done  chan struct{}
+}
+
+// workerPool runs the parses of every request on a fixed number of workers,
+// with a bounded queue in front, so a burst of requests can't start more
+// outbound fetches than the workers make. It is safe for concurrent use.
+type workerPool struct {
+	size  int
+	queue chan *poolJob
+
+	// mu guards closed, so no submit starts once the pool is closed, and
+	// submitting counts the submits under way, which close waits for before
+	// failing the jobs left in the queue.
+	mu         sync.Mutex
+	closed     bool
+	submitting sync.WaitGroup
+	stopped    chan struct{}
+	workers    sync.WaitGroup
+
+	busy      int64
+	completed int64
+	rejected  int64
+}
+
+// parseWorkers runs the parses of the service.
+var parseWorkers *workerPool
+
+// newWorkerPool starts a pool of size workers and a queue of queueSize parses.
+func newWorkerPool(size, queueSize int) *workerPool {
+	if size < 1 {
+		size = 1
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	p := &workerPool{size: size, queue: make(chan *poolJob, queueSize), stopped: make(chan struct{})}
+	p.workers.Add(size)
+	for i := 0; i < size; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// work runs queued jobs until the pool is closed and its queue drained. A job
+// taken once the pool stopped, as the queue couldn't drain in time, fails
+// rather than runs.
+func (p *workerPool) work() {
+	defer p.workers.Done()
+	for {
+		select {
+		case job := <-p.queue:
+			select {
+			case <-p.stopped:
+				abandon(job)
+			default:
+				p.execute(job)
+			}
+		case <-p.stopped:
+			return
+		}
+	}
+}
+
+// abandon fails a job no worker will run with errPoolClosed, unless its
+// submitter gave up on it already.
+func abandon(job *poolJob) {
+	if atomic.CompareAndSwapInt32(&job.state, jobQueued, jobAbandoned) {
+		job.err = errPoolClosed
+	}
+	close(job.done)
+}
+
+// execute runs a job, unless its submitter gave up on it or its context is
+// done. A job panicking fails with a panicError, leaving its worker running.
+func (p *workerPool) execute(job *poolJob) {
+	defer close(job.done)
+	defer recoverTo(job.ctx, "worker", &job.err)
+	if !atomic.CompareAndSwapInt32(&job.state, jobQueued, jobRunning) {
+		return
+	}
+	if job.err = job.ctx.Err(); job.err != nil {
+		return
+	}
+	atomic.AddInt64(&p.busy, 1)
+	defer atomic.AddInt64(&p.busy, -1)
+	defer atomic.AddInt64(&p.completed, 1)
+	job.run()
+}
+
+// serverBusyError is returned for the parses turned away by a full queue.
+type serverBusyError struct {
+	RetryAfter time.Duration
+}
+
+func (e *serverBusyError) Error() string {
+	return "Too many parses are running; try again later"
+}
+
+// submit runs fn on a worker and returns once it ran. When the queue is full,
+// it waits up to wait for room, or as long as ctx allows when wait is negative,
+// before returning a serverBusyError. When ctx is done before fn starts, fn
+// doesn't run and the error of ctx is returned.
+func (p *workerPool) submit(ctx context.Context, wait time.Duration, fn func()) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return errPoolClosed
+	}
+	p.submitting.Add(1)
+	p.mu.Unlock()
+
+	job := &poolJob{ctx: ctx, run: fn, done: make(chan struct{})}
+	err := p.enqueue(ctx, wait, job)
+	p.submitting.Done()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-job.done:
+		return job.err
+	case <-ctx.Done():
+		// Give the job up unless a worker already runs it, which then stops with ctx
+		if atomic.CompareAndSwapInt32(&job.state, jobQueued, jobAbandoned) {
+			return ctx.Err()
+		}
+		<-job.done
+		return job.err
+	}
+}
+
+// enqueue queues job, waiting for room like submit. It gives up with
+// errPoolClosed once the workers stopped, as nothing would take job anymore.
+func (p *workerPool) enqueue(ctx context.Context, wait time.Duration, job *poolJob) error {
+	select {
+	case p.queue <- job:
+		return nil
+	default:
+	}
+	var full <-chan time.Time
+	if wait >= 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		full = timer.C
+	}
+	select {
+	case p.queue <- job:
+		return nil
+	case <-full:
+		atomic.AddInt64(&p.rejected, 1)
+		return &serverBusyError{RetryAfter: busyRetryAfter}
+	case <-p.stopped:
+		return errPoolClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isClosed reports whether the pool stopped taking parses.
+func (p *workerPool) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// close stops taking parses and lets the workers drain the queue. Parses still
+// queued when ctx is done fail with errPoolClosed instead, and close returns
+// the error of ctx once the running ones returned.
+func (p *workerPool) close(ctx context.Context) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		for len(p.queue) > 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	close(p.stopped)
+	p.workers.Wait()
+	p.submitting.Wait()
+
+	// Fail what is left: jobs queued after the drain, or not drained in time.
+	// Every submit under way at the close has queued its job or given up by
+	// now, so none is queued after this
+	for {
+		select {
+		case job := <-p.queue:
+			abandon(job)
+		default:
+			return err
+		}
+	}
+}
+
+// workerMetrics reports the use of the worker pool and its queue.
+type workerMetrics struct {
+	Size        int     `json:"size"`
+	Busy        int64   `json:"busy"`
+	Utilization float64 `json:"utilization"`
+	Queued      int     `json:"queued"`
+	QueueSize   int     `json:"queueSize"`
+	Completed   int64   `json:"completed"`
+	Rejected    int64   `json:"rejected"`
+}
+
+// metrics reports the pool.
+func (p *workerPool) metrics() workerMetrics {
+	busy := atomic.LoadInt64(&p.busy)
+	return workerMetrics{
+		Size:        p.size,
+		Busy:        busy,
+		Utilization: float64(busy) / float64(p.size),
+		Queued:      len(p.queue),
+		QueueSize:   cap(p.queue),
+		Completed:   atomic.LoadInt64(&p.completed),
+		Rejected:    atomic.LoadInt64(&p.rejected),
+	}
+}
+
+// poolError returns the error reported to the client when a parse couldn't be
+// handed to a worker or panicked there, or nil when err is another error.
+func poolError(err error) *requestError {
+	var busyErr *serverBusyError
+	var panicErr *panicError
+	switch {
+	case errors.As(err, &panicErr):
+		return &requestError{http.StatusInternalServerError, errCodeInternal, "Internal error while parsing", nil}
+	case errors.As(err, &busyErr):
+		return &requestError{http.StatusTooManyRequests, errCodeServerBusy, busyErr.Error(), map[string]interface{}{"retryAfterSeconds": int(busyErr.RetryAfter / time.Second)}}
+	case errors.Is(err, errPoolClosed):
+		return &requestError{http.StatusServiceUnavailable, errCodeServerBusy, "The server is shutting down", nil}
+	}
+	return nil
+}
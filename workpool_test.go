@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockWorkers submits a job to each of the size workers of p, which runs until
+// the returned function is called.
+func blockWorkers(t *testing.T, p *workerPool, size int) func() {
+	t.Helper()
+	release := make(chan struct{})
+	var started sync.WaitGroup
+	started.Add(size)
+	for i := 0; i < size; i++ {
+		go p.submit(context.Background(), -1, func() {
+			started.Done()
+			<-release
+		})
+	}
+	started.Wait()
+	var once sync.Once
+	return func() { once.Do(func() { close(release) }) }
+}
+
+func TestWorkerPoolBusy(t *testing.T) {
+	useLocalConfig(t, map[string]string{"ACCESS_LOG": "0", "WORKER_POOL_SIZE": "1", "WORKER_QUEUE_SIZE": "0", "WORKER_QUEUE_WAIT_MS": "20"})
+	captureLogs(t)
+	release := blockWorkers(t, parseWorkers, 1)
+	defer release()
+	server := sitemapServer(t, map[string]string{"/sitemap.xml": urlSet("https://example.com/a")})
+
+	w := serve(httptest.NewRequest(http.MethodGet, "/v1/sitemap?url="+server.URL+"/sitemap.xml", nil))
+	assertErrorCode(t, w, http.StatusTooManyRequests, errCodeServerBusy)
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter != "1" {
+		t.Errorf("Retry-After = %q, want 1", retryAfter)
+	}
+	if rejected := parseWorkers.metrics().Rejected; rejected != 1 {
+		t.Errorf("rejected = %d, want 1", rejected)
+	}
+
+	release()
+	if w := serve(httptest.NewRequest(http.MethodGet, "/v1/sitemap?url="+server.URL+"/sitemap.xml", nil)); w.Code != http.StatusOK {
+		t.Errorf("status = %d once the worker is free, want 200: %s", w.Code, w.Body)
+	}
+}
+
+func TestWorkerPoolDrainsOnClose(t *testing.T) {
+	p := newWorkerPool(2, 8)
+	release := blockWorkers(t, p, 2)
+
+	var ran int32
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		go func() {
+			errs <- p.submit(context.Background(), 0, func() { atomic.AddInt32(&ran, 1) })
+		}()
+	}
+	for p.metrics().Queued != 8 {
+		time.Sleep(time.Millisecond)
+	}
+
+	closed := make(chan error)
+	go func() { closed <- p.close(context.Background()) }()
+	for !p.isClosed() {
+		time.Sleep(time.Millisecond)
+	}
+	if err := p.submit(context.Background(), 0, func() {}); !errors.Is(err, errPoolClosed) {
+		t.Errorf("submit after close = %v, want errPoolClosed", err)
+	}
+	release()
+	if err := <-closed; err != nil {
+		t.Errorf("close = %v, want the queue drained", err)
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("queued parse = %v, want it run", err)
+		}
+	}
+	if n := atomic.LoadInt32(&ran); n != 8 {
+		t.Errorf("ran %d queued parses, want 8", n)
+	}
+}
+
+func TestWorkerPoolCloseTimesOut(t *testing.T) {
+	p := newWorkerPool(1, 4)
+	release := blockWorkers(t, p, 1)
+
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			errs <- p.submit(context.Background(), 0, func() { t.Error("a parse left in the queue ran") })
+		}()
+	}
+	for p.metrics().Queued != 4 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	closed := make(chan error)
+	go func() { closed <- p.close(ctx) }()
+	// The running parse returns once the pool stopped, so a worker could take
+	// the jobs still queued
+	<-p.stopped
+	release()
+	if err := <-closed; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("close = %v, want the deadline exceeded", err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := <-errs; !errors.Is(err, errPoolClosed) {
+			t.Errorf("queued parse = %v, want errPoolClosed", err)
+		}
+	}
+}
+
+func TestWorkerPoolCloseWithSubmitsWaitingForRoom(t *testing.T) {
+	p := newWorkerPool(1, 1)
+	release := blockWorkers(t, p, 1)
+	defer release()
+	queued := make(chan error, 1)
+	go func() { queued <- p.submit(context.Background(), -1, func() {}) }()
+	for p.metrics().Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// These wait for room in the queue for as long as it takes
+	waiting := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		go func() { waiting <- p.submit(context.Background(), -1, func() {}) }()
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	go p.close(ctx)
+	<-p.stopped
+	release()
+	for i := 0; i < 5; i++ {
+		var err error
+		select {
+		case err = <-queued:
+		case err = <-waiting:
+		case <-time.After(5 * time.Second):
+			t.Fatal("a submit waiting for room never returned once the pool closed")
+		}
+		if !errors.Is(err, errPoolClosed) {
+			t.Errorf("submit = %v, want errPoolClosed", err)
+		}
+	}
+}
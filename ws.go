@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Actions a client can send over a WebSocket session.
+const (
+	wsActionParse  = "parse"
+	wsActionCancel = "cancel"
+)
+
+// Types of the messages the server sends over a WebSocket session.
+const (
+	wsTypeURL      = "url"
+	wsTypeProgress = "progress"
+	wsTypeSummary  = "summary"
+	wsTypeError    = "error"
+)
+
+var wsUpgrader = websocket.Upgrader{}
+
+// wsRequest is a message sent by the client.
+type wsRequest struct {
+	Action string `json:"action"`
+	Domain string `json:"domain"`
+}
+
+// wsSession is a WebSocket connection running at most one parse at a time.
+type wsSession struct {
+	conn *websocket.Conn
+	ctx  context.Context
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	cancel  context.CancelFunc
+	running bool
+	// parses tracks the parse goroutine, which the handler waits for.
+	parses sync.WaitGroup
+}
+
+// send writes a JSON message to the client. Write errors are ignored, as a
+// broken connection also ends the read loop, which cancels the running parse.
+func (s *wsSession) send(message map[string]interface{}) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.conn.WriteJSON(message)
+}
+
+// sendError reports a problem with a client message.
+func (s *wsSession) sendError(message string) {
+	s.send(map[string]interface{}{"type": wsTypeError, "message": message})
+}
+
+// start begins parsing a domain in the background. It is rejected when a parse
+// is already running on the session.
+func (s *wsSession) start(domain string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running {
+		s.sendError("A parse is already running; cancel it before starting another one")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, configFrom(s.ctx).requestTimeout)
+	s.cancel = cancel
+	s.running = true
+
+	s.parses.Add(1)
+	go func() {
+		defer s.parses.Done()
+		defer func() {
+			cancel()
+			s.mu.Lock()
+			s.running = false
+			s.mu.Unlock()
+		}()
+		var err error
+		defer func() {
+			if err != nil {
+				s.sendError(err.Error())
+			}
+		}()
+		defer recoverTo(ctx, "websocket session", &err)
+		s.parse(ctx, domain)
+	}()
+}
+
+// stop cancels the running parse, if any.
+func (s *wsSession) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.running {
+		s.sendError("No parse is running")
+		return
+	}
+	s.cancel()
+}
+
+// parse discovers and walks the sitemap of a domain, streaming its URLs to the
+// client, and finishes with a summary message.
+func (s *wsSession) parse(ctx context.Context, domain string) {
+	started := time.Now()
+	discovery, err := getSitemapURLFromDomain(ctx, domain, nil)
+	if err != nil {
+		s.send(map[string]interface{}{"type": wsTypeSummary, "domain": domain, "cancelled": ctx.Err() != nil, "error": err.Error()})
+		return
+	}
+
+	var (
+		countMu  sync.Mutex
+		urls     int
+		sitemaps int
+	)
+
+	settings := configFrom(ctx)
+	opts := defaultWalkOptions(settings)
+	opts.OnURLs = func(sitemap string, entries []SitemapURL) {
+		for _, entry := range entries {
+			s.send(map[string]interface{}{"type": wsTypeURL, "loc": entry.Loc, "sitemap": sitemap})
+		}
+
+		countMu.Lock()
+		urls += len(entries)
+		sitemaps++
+		progress := map[string]interface{}{"type": wsTypeProgress, "urls": urls, "sitemaps": sitemaps}
+		countMu.Unlock()
+		s.send(progress)
+	}
+
+	// Sessions wait in the worker queue for as long as the parse allows
+	var result *sitemapResult
+	if poolErr := parseWorkers.submit(ctx, -1, func() {
+		result, err = parseSitemap(ctx, discovery.SitemapURL, nil, opts)
+	}); poolErr != nil {
+		err = poolErr
+	}
+
+	summary := map[string]interface{}{
+		"type":       wsTypeSummary,
+		"domain":     domain,
+		"sitemapUrl": discovery.SitemapURL,
+		"cancelled":  ctx.Err() == context.Canceled,
+		"urls":       urls,
+		"sitemaps":   sitemaps,
+	}
+	if err != nil {
+		summary["error"] = err.Error()
+	} else {
+		summary["errors"] = result.Errors
+		summary["warnings"] = result.Warnings
+		summary["partial"] = result.Partial
+		summary["truncated"] = result.Truncated
+		summary["unexplored"] = result.Unexplored
+		summary["meta"] = newResponseMeta(result, started, settings.fetchTimeout, settings.requestTimeout)
+	}
+	s.send(summary)
+}
+
+// handleWebSocketEndpoint runs an interactive parsing session over a WebSocket.
+//
+// The client sends {"action":"parse","domain":"..."} to start a parse and
+// {"action":"cancel"} to stop it. The server streams "url" and "progress"
+// messages and ends each parse with a "summary" message. Only one parse runs per
+// connection at a time, and closing the connection cancels it, the handler
+// returning once the parse ended. Client messages
+// are held to the maxRequestBodyBytes of the configuration, like request bodies.
+func handleWebSocketEndpoint(w http.ResponseWriter, r *http.Request) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already replied with an error
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(int64(configFrom(r.Context()).maxRequestBodyBytes))
+
+	// The session outlives the handler's request context once the connection is
+	// hijacked, so it keeps what the middleware attached to it, such as the
+	// request ID and configuration, but is only cancelled when the connection
+	// drops
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	session := &wsSession{conn: conn, ctx: ctx}
+	defer session.parses.Wait()
+	defer cancel()
+
+	for {
+		// A read error means the connection is gone
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var message wsRequest
+		if err := json.Unmarshal(data, &message); err != nil {
+			session.sendError("Invalid JSON message")
+			continue
+		}
+
+		switch message.Action {
+		case wsActionParse:
+			if message.Domain == "" {
+				session.sendError("Missing 'domain' field in message")
+				continue
+			}
+			session.start(message.Domain)
+		case wsActionCancel:
+			session.stop()
+		default:
+			session.sendError("Unknown action '" + message.Action + "'")
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsSite serves a robots.txt naming an ftp sitemap, which discovery warns
+// about, then /index.xml, an index of /a.xml and
+// /slow.xml, which answers once release is closed or its fetch is given up.
+// cancelled receives the path of each request given up by the client.
+func wsSite(t *testing.T, release chan struct{}) (*httptest.Server, chan string) {
+	t.Helper()
+	cancelled := make(chan string, 8)
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/robots.txt":
+			fmt.Fprintf(w, "Sitemap: ftp://example.com/sitemap.xml\nSitemap: %s/index.xml\n", server.URL)
+		case "/index.xml":
+			fmt.Fprint(w, strings.ReplaceAll(sitemapIndex("/a.xml", "/slow.xml"), "{base}", server.URL))
+		case "/a.xml":
+			fmt.Fprint(w, urlSet("https://example.com/a1", "https://example.com/a2"))
+		case "/slow.xml":
+			select {
+			case <-release:
+				fmt.Fprint(w, urlSet("https://example.com/slow"))
+			case <-r.Context().Done():
+				cancelled <- r.URL.Path
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, cancelled
+}
+
+// readProgress reads the messages of the session until the progress message
+// counting urls URLs.
+func readProgress(t *testing.T, conn *websocket.Conn, urls int) {
+	t.Helper()
+	for {
+		if progress, _ := readUntil(t, conn, wsTypeProgress); progress["urls"] == float64(urls) {
+			return
+		}
+	}
+}
+
+// dialWS opens a WebSocket session on the API, with header.
+func dialWS(t *testing.T, header http.Header) *websocket.Conn {
+	t.Helper()
+	// The server doesn't wait for hijacked connections, so the test does
+	var sessions sync.WaitGroup
+	routes := newRoutes().handler()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessions.Add(1)
+		defer sessions.Done()
+		routes.ServeHTTP(w, r)
+	}))
+	t.Cleanup(api.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(api.URL, "http")+"/v1/ws", header)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		sessions.Wait()
+	})
+	return conn
+}
+
+// readUntil reads the messages of the session until one of type kind,
+// returning it with the ones before it.
+func readUntil(t *testing.T, conn *websocket.Conn, kind string) (map[string]interface{}, []map[string]interface{}) {
+	t.Helper()
+	var before []map[string]interface{}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var message map[string]interface{}
+		if err := conn.ReadJSON(&message); err != nil {
+			t.Fatalf("reading until a %s message: %v", kind, err)
+		}
+		if message["type"] == kind {
+			return message, before
+		}
+		before = append(before, message)
+	}
+}
+
+func TestWebSocketParse(t *testing.T) {
+	useLocalConfig(t, map[string]string{"ACCESS_LOG": "0"})
+	logs := captureLogs(t)
+	release := make(chan struct{})
+	close(release)
+	site, _ := wsSite(t, release)
+	conn := dialWS(t, http.Header{requestIDHeader: {"ws-session"}})
+
+	conn.WriteJSON(map[string]string{"action": "parse", "domain": hostOf(site)})
+	summary, messages := readUntil(t, conn, wsTypeSummary)
+	var locs []string
+	progress := 0
+	for _, message := range messages {
+		switch message["type"] {
+		case wsTypeURL:
+			locs = append(locs, message["loc"].(string))
+		case wsTypeProgress:
+			progress++
+		}
+	}
+	assertSameSet(t, "urls", locs, []string{"https://example.com/a1", "https://example.com/a2", "https://example.com/slow"})
+	if progress != 3 || summary["urls"] != 3.0 || summary["sitemaps"] != 3.0 || summary["cancelled"] != false {
+		t.Errorf("%d progress messages, summary %v, want one per sitemap and 3 URLs", progress, summary)
+	}
+	if summary["sitemapUrl"] != site.URL+"/index.xml" {
+		t.Errorf("sitemapUrl = %v, want the sitemap of robots.txt", summary["sitemapUrl"])
+	}
+	// The parse logs under the ID of the request that opened the session
+	if output := logs.String(); !strings.Contains(output, "ignoring the sitemap of robots.txt") || !strings.Contains(output, "requestId=ws-session") {
+		t.Errorf("the parse didn't log under the request ID:\n%s", output)
+	}
+
+	// Invalid messages are answered without ending the session
+	for _, message := range []string{`{"action":`, `{"action":"parse"}`, `{"action":"dance"}`, `{"action":"cancel"}`} {
+		conn.WriteMessage(websocket.TextMessage, []byte(message))
+		if reply, _ := readUntil(t, conn, wsTypeError); reply["message"] == "" {
+			t.Errorf("%s: error %v, want a message", message, reply)
+		}
+	}
+}
+
+func TestWebSocketOneParseAtATime(t *testing.T) {
+	useLocalConfig(t, map[string]string{"ACCESS_LOG": "0"})
+	captureLogs(t)
+	site, cancelled := wsSite(t, make(chan struct{}))
+	conn := dialWS(t, nil)
+
+	conn.WriteJSON(map[string]string{"action": "parse", "domain": hostOf(site)})
+	// Once the URLs of /a.xml are in, the parse waits for /slow.xml
+	readProgress(t, conn, 2)
+	conn.WriteJSON(map[string]string{"action": "parse", "domain": hostOf(site)})
+	if reply, _ := readUntil(t, conn, wsTypeError); !strings.Contains(reply["message"].(string), "already running") {
+		t.Errorf("error = %v, want the second parse rejected", reply)
+	}
+
+	conn.WriteJSON(map[string]string{"action": "cancel"})
+	if summary, _ := readUntil(t, conn, wsTypeSummary); summary["cancelled"] != true || summary["urls"] != 2.0 {
+		t.Errorf("summary = %v, want the parse cancelled with the URLs of /a.xml", summary)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Error("the fetch of /slow.xml wasn't given up")
+	}
+}
+
+func TestWebSocketDisconnectCancels(t *testing.T) {
+	useLocalConfig(t, map[string]string{"ACCESS_LOG": "0"})
+	captureLogs(t)
+	site, cancelled := wsSite(t, make(chan struct{}))
+	conn := dialWS(t, nil)
+
+	conn.WriteJSON(map[string]string{"action": "parse", "domain": hostOf(site)})
+	readProgress(t, conn, 2)
+	conn.Close()
+	select {
+	case path := <-cancelled:
+		if path != "/slow.xml" {
+			t.Errorf("%s given up, want /slow.xml", path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("closing the connection didn't cancel the parse")
+	}
+}
+
+func TestWebSocketReadLimit(t *testing.T) {
+	useLocalConfig(t, map[string]string{"REQUEST_MAX_BYTES": "256", "ACCESS_LOG": "0"})
+	captureLogs(t)
+	conn := dialWS(t, nil)
+
+	conn.WriteJSON(map[string]string{"action": "parse", "domain": strings.Repeat("a", 1024) + ".example.com"})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+			t.Errorf("read = %v, want the session closed for the message size", err)
+		}
+		return
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strconv"
+)
+
+// xmlContentType is the content type of XML responses.
+const xmlContentType = "application/xml; charset=utf-8"
+
+// xmlURL is a URL element of an XML response.
+type xmlURL struct {
+	XMLName    xml.Name `xml:"url"`
+	Loc        string   `xml:"loc"`
+	Lastmod    string   `xml:"lastmod,omitempty"`
+	Changefreq string   `xml:"changefreq,omitempty"`
+	Priority   string   `xml:"priority,omitempty"`
+	Sitemap    string   `xml:"sitemap,attr"`
+}
+
+// xmlSummary is the element closing an XML response, carrying everything but
+// the URLs.
+type xmlSummary struct {
+	XMLName    xml.Name          `xml:"summary"`
+	Partial    bool              `xml:"partial,attr"`
+	Truncated  bool              `xml:"truncated,attr"`
+	SitemapURL string            `xml:"sitemapUrl,omitempty"`
+	Counts     xmlCounts         `xml:"counts"`
+	Errors     []xmlSitemapError `xml:"errors>error"`
+	Warnings   []string          `xml:"warnings>warning"`
+	Unexplored []string          `xml:"unexplored>sitemap"`
+}
+
+// xmlCounts holds the counts of an XML response.
+type xmlCounts struct {
+	URLs       int `xml:"urls,attr"`
+	Sitemaps   int `xml:"sitemaps,attr"`
+	Unexplored int `xml:"unexplored,attr"`
+}
+
+// xmlSitemapError is a sitemap that failed to be fetched or parsed.
+type xmlSitemapError struct {
+	Sitemap string `xml:"sitemap,attr"`
+	Message string `xml:",chardata"`
+}
+
+// xmlError is the document of an XML error reply, and the element ending an XML
+// response that failed after it started.
+type xmlError struct {
+	XMLName xml.Name `xml:"error"`
+	Status  int      `xml:"status,attr"`
+	Code    string   `xml:"code,attr"`
+	Message string   `xml:",chardata"`
+}
+
+// xmlExporter writes the response as an XML document: a <response> element
+// holding a urlset-like list of the URLs, written as they are parsed, followed
+// by a <summary>. It is safe for concurrent use.
+type xmlExporter struct {
+	exportStream
+	encoder     *xml.Encoder
+	requestType string
+	urls        int
+}
+
+// newXMLExporter returns an exporter of an XML document to w.
+func newXMLExporter(w http.ResponseWriter, requestType string) *xmlExporter {
+	return &xmlExporter{exportStream: exportStream{w: w}, encoder: xml.NewEncoder(w), requestType: requestType}
+}
+
+// begin writes the response header and opens the document on the first call.
+// The caller holds mu.
+func (x *xmlExporter) begin() {
+	if !x.start(xmlContentType) {
+		return
+	}
+	x.w.Write([]byte(xml.Header))
+	x.encoder.EncodeToken(xml.StartElement{
+		Name: xml.Name{Local: "response"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "type"}, Value: x.requestType}},
+	})
+	x.encoder.EncodeToken(xml.StartElement{Name: xml.Name{Local: "urlset"}})
+}
+
+// end closes the urlset, writes the closing element and the end of the document.
+// The caller holds mu.
+func (x *xmlExporter) end(closing interface{}) {
+	x.begin()
+	x.encoder.EncodeToken(xml.EndElement{Name: xml.Name{Local: "urlset"}})
+	x.encoder.Encode(closing)
+	x.encoder.EncodeToken(xml.EndElement{Name: xml.Name{Local: "response"}})
+	x.encoder.Flush()
+	x.flush()
+}
+
+// writeURLs writes a <url> element for each URL.
+func (x *xmlExporter) writeURLs(sitemap string, urls []SitemapURL) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.begin()
+	for _, u := range urls {
+		x.encoder.Encode(xmlURL{Loc: u.Loc, Lastmod: u.Lastmod, Changefreq: u.Changefreq, Priority: u.Priority, Sitemap: sitemap})
+	}
+	x.urls += len(urls)
+	x.encoder.Flush()
+	x.flush()
+}
+
+// writeSummary ends the document with a <summary> of the response.
+func (x *xmlExporter) writeSummary(response *sitemapResponse) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	summary := xmlSummary{Counts: xmlCounts{URLs: x.urls}, SitemapURL: response.SitemapURL}
+	// A discovery-only response has no walk to summarize
+	if walk := response.walkSummary; walk != nil {
+		summary.Partial = walk.Partial
+		summary.Truncated = walk.Truncated
+		summary.Warnings = walk.Warnings
+		summary.Unexplored = walk.Unexplored
+		summary.Counts.Sitemaps = len(walk.Sitemaps)
+		summary.Counts.Unexplored = len(walk.Unexplored)
+		for _, e := range walk.Errors {
+			summary.Errors = append(summary.Errors, xmlSitemapError{Sitemap: e.Sitemap, Message: e.Message})
+		}
+	}
+
+	x.end(summary)
+}
+
+// writeError ends a document that has already started with an <error>.
+func (x *xmlExporter) writeError(err *requestError) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.end(xmlError{Status: err.Status, Code: err.Code, Message: err.Message})
+}
+
+// writeXMLError replies with an XML error document and the HTTP status.
+func writeXMLError(w http.ResponseWriter, reqErr *requestError) {
+	body, err := xml.Marshal(xmlError{Status: reqErr.Status, Code: reqErr.Code, Message: reqErr.Message})
+	if err != nil {
+		writeRequestError(w, reqErr)
+		return
+	}
+	clearCacheHeaders(w)
+	if seconds, ok := reqErr.Details["retryAfterSeconds"].(int); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+	w.Header().Set("Content-Type", xmlContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(reqErr.Status)
+	w.Write([]byte(xml.Header))
+	w.Write(body)
+}